@@ -9,3 +9,10 @@ go test github.com/davidsonff/gopacket/reassembly
 go test github.com/davidsonff/gopacket/pcapgo
 go test github.com/davidsonff/gopacket/pcap
 sudo $(which go) test github.com/davidsonff/gopacket/routing
+
+# the pure Go packages must build on 32-bit targets
+for arch in 386 arm; do
+  GOARCH=$arch CGO_ENABLED=0 go build github.com/davidsonff/gopacket github.com/davidsonff/gopacket/layers github.com/davidsonff/gopacket/pcapgo \
+    github.com/davidsonff/gopacket/memlink github.com/davidsonff/gopacket/reassembly/... github.com/davidsonff/gopacket/tcpassembly/... \
+    github.com/davidsonff/gopacket/replay github.com/davidsonff/gopacket/rewrite github.com/davidsonff/gopacket/anonymize
+done
@@ -131,6 +131,10 @@ type TPacket struct {
 	socketStats SocketStats
 	// same as socketStats, but with an extra field freeze_q_cnt
 	socketStatsV3 SocketStatsV3
+
+	txMu sync.Mutex // guards tx below
+	// tx is the transmit ring, if enabled with OptTXRing.
+	tx txRing
 }
 
 var _ gopacket.ZeroCopyPacketDataSource = &TPacket{}
@@ -168,7 +172,7 @@ func (h *TPacket) setRequestedTPacketVersion() error {
 		h.tpVersion = TPacketVersion3
 	case (h.opts.version == TPacketVersionHighestAvailable || h.opts.version == TPacketVersion2) && h.setTPacketVersion(TPacketVersion2) == nil:
 		h.tpVersion = TPacketVersion2
-	case (h.opts.version == TPacketVersionHighestAvailable || h.opts.version == TPacketVersion1) && h.setTPacketVersion(TPacketVersion1) == nil:
+	case (h.opts.version == TPacketVersionHighestAvailable || h.opts.version == TPacketVersion1) && !h.opts.txRing && h.setTPacketVersion(TPacketVersion1) == nil:
 		h.tpVersion = TPacketVersion1
 	default:
 		return errors.New("no known tpacket versions work on this machine")
@@ -178,7 +182,8 @@ func (h *TPacket) setRequestedTPacketVersion() error {
 
 // setUpRing sets up the shared-memory ring buffer between the user process and the kernel.
 func (h *TPacket) setUpRing() (err error) {
-	totalSize := int(h.opts.framesPerBlock * h.opts.numBlocks * h.opts.frameSize)
+	ringSize := int(h.opts.framesPerBlock * h.opts.numBlocks * h.opts.frameSize)
+	totalSize := ringSize
 	switch h.tpVersion {
 	case TPacketVersion1, TPacketVersion2:
 		var tp C.struct_tpacket_req
@@ -189,6 +194,12 @@ func (h *TPacket) setUpRing() (err error) {
 		if err := setsockopt(h.fd, unix.SOL_PACKET, unix.PACKET_RX_RING, unsafe.Pointer(&tp), unsafe.Sizeof(tp)); err != nil {
 			return fmt.Errorf("setsockopt packet_rx_ring: %v", err)
 		}
+		if h.opts.txRing {
+			if err := setsockopt(h.fd, unix.SOL_PACKET, unix.PACKET_TX_RING, unsafe.Pointer(&tp), unsafe.Sizeof(tp)); err != nil {
+				return fmt.Errorf("setsockopt packet_tx_ring: %v", err)
+			}
+			totalSize += ringSize
+		}
 	case TPacketVersion3:
 		var tp C.struct_tpacket_req3
 		tp.tp_block_size = C.uint(h.opts.blockSize)
@@ -199,6 +210,14 @@ func (h *TPacket) setUpRing() (err error) {
 		if err := setsockopt(h.fd, unix.SOL_PACKET, unix.PACKET_RX_RING, unsafe.Pointer(&tp), unsafe.Sizeof(tp)); err != nil {
 			return fmt.Errorf("setsockopt packet_rx_ring v3: %v", err)
 		}
+		if h.opts.txRing {
+			// The kernel rejects a block timeout for the TX ring.
+			tp.tp_retire_blk_tov = 0
+			if err := setsockopt(h.fd, unix.SOL_PACKET, unix.PACKET_TX_RING, unsafe.Pointer(&tp), unsafe.Sizeof(tp)); err != nil {
+				return fmt.Errorf("setsockopt packet_tx_ring v3: %v", err)
+			}
+			totalSize += ringSize
+		}
 	default:
 		return errors.New("invalid tpVersion")
 	}
@@ -210,6 +229,10 @@ func (h *TPacket) setUpRing() (err error) {
 		return errors.New("no ring")
 	}
 	h.rawring = unsafe.Pointer(&h.ring[0])
+	if h.opts.txRing {
+		// The kernel maps the TX ring right after the RX ring.
+		h.tx = newTXRing(h.ring[ringSize:], h.opts.frameSize, h.tpVersion)
+	}
 	return nil
 }
 
@@ -222,6 +245,7 @@ func (h *TPacket) Close() {
 		unix.Munmap(h.ring)
 	}
 	h.ring = nil
+	h.tx.ring = nil
 	unix.Close(h.fd)
 	h.fd = -1
 	runtime.SetFinalizer(h, nil)
@@ -248,6 +272,15 @@ func NewTPacket(opts ...interface{}) (h *TPacket, err error) {
 	if err = h.setRequestedTPacketVersion(); err != nil {
 		goto errlbl
 	}
+	if err = h.setTimestamping(); err != nil {
+		goto errlbl
+	}
+	if h.opts.qdiscBypass {
+		if err = unix.SetsockoptInt(h.fd, unix.SOL_PACKET, unix.PACKET_QDISC_BYPASS, 1); err != nil {
+			err = fmt.Errorf("setsockopt packet_qdisc_bypass: %v", err)
+			goto errlbl
+		}
+	}
 	if err = h.setUpRing(); err != nil {
 		goto errlbl
 	}
@@ -324,6 +357,9 @@ retry:
 	if vlan >= 0 {
 		ci.AncillaryData = append(ci.AncillaryData, AncillaryVLAN{vlan})
 	}
+	if h.opts.tsSource != TimestampSourceDefault {
+		ci.AncillaryData = append(ci.AncillaryData, AncillaryTimestampSource{h.current.getTimestampSource()})
+	}
 	atomic.AddInt64(&h.stats.Packets, 1)
 	h.headerNextNeeded = true
 	h.mu.Unlock()
@@ -469,7 +505,8 @@ func (h *TPacket) pollForFirstPacket(hdr header) error {
 		}
 
 		atomic.AddInt64(&h.stats.Polls, 1)
-		if pollset[0].Revents&unix.POLLERR > 0 {
+		if pollset[0].Revents&unix.POLLERR > 0 && !h.opts.txTimestamps {
+			// With TX timestamps, POLLERR signals pending timestamps.
 			return ErrPoll
 		}
 		if err == syscall.EINTR {
@@ -516,8 +553,61 @@ func (h *TPacket) SetFanout(t FanoutType, id uint16) error {
 	return setsockopt(h.fd, unix.SOL_PACKET, unix.PACKET_FANOUT, unsafe.Pointer(&arg), unsafe.Sizeof(arg))
 }
 
-// WritePacketData transmits a raw packet.
+// WritePacketData transmits a raw packet.  If the TX ring is enabled, the
+// packet is queued into the ring and the ring is flushed, so use WriteTXFrame
+// and FlushTX to transmit packets in batches.
 func (h *TPacket) WritePacketData(pkt []byte) error {
+	if h.opts.txRing {
+		if err := h.WriteTXFrame(pkt); err != nil {
+			return err
+		}
+		_, failed, err := h.FlushTX()
+		if err == nil && failed > 0 {
+			err = ErrTXWrongFormat
+		}
+		return err
+	}
 	_, err := unix.Write(h.fd, pkt)
 	return err
 }
+
+// WritePacketDataBatch transmits raw packets, and returns the number of
+// packets transmitted.  If the TX ring is enabled, the packets are queued into
+// the ring and the ring is flushed when it's full and at the end, so a batch
+// needs only a few syscalls.
+func (h *TPacket) WritePacketDataBatch(pkts [][]byte) (int, error) {
+	if !h.opts.txRing {
+		for i, pkt := range pkts {
+			if _, err := unix.Write(h.fd, pkt); err != nil {
+				return i, err
+			}
+		}
+		return len(pkts), nil
+	}
+	var n, failed int
+	flush := func() error {
+		_, f, err := h.FlushTX()
+		failed += f
+		return err
+	}
+	for _, pkt := range pkts {
+		err := h.WriteTXFrame(pkt)
+		if err == ErrTXRingFull {
+			if err = flush(); err == nil {
+				err = h.WriteTXFrame(pkt)
+			}
+		}
+		if err != nil {
+			flush()
+			return n - failed, err
+		}
+		n++
+	}
+	if err := flush(); err != nil {
+		return n - failed, err
+	}
+	if failed > 0 {
+		return n - failed, ErrTXWrongFormat
+	}
+	return n, nil
+}
@@ -10,7 +10,16 @@ package afpacket
 
 import (
 	"reflect"
+	"runtime"
+	"sync"
 	"testing"
+	"time"
+
+	"github.com/vishvananda/netns"
+	"golang.org/x/net/bpf"
+
+	"github.com/davidsonff/gopacket"
+	"github.com/davidsonff/gopacket/internal/testveth"
 )
 
 func TestParseOptions(t *testing.T) {
@@ -27,6 +36,9 @@ func TestParseOptions(t *testing.T) {
 		{opts: []interface{}{OptTPacketVersion(-3)}, err: true},
 		{opts: []interface{}{OptTPacketVersion(5)}, err: true},
 		{opts: []interface{}{OptFrameSize(1 << 10)}, want: wanted1},
+		{opts: []interface{}{OptTXRing(true), TPacketVersion1}, err: true},
+		{opts: []interface{}{OptTXRing(true), SocketDgram}, err: true},
+		{opts: []interface{}{OptTimestampSource(3)}, err: true},
 	} {
 		got, err := parseOptions(test.opts...)
 		t.Logf("got: %#v\nerr: %v", got, err)
@@ -38,3 +50,329 @@ func TestParseOptions(t *testing.T) {
 		}
 	}
 }
+
+func TestTXRing(t *testing.T) {
+	for _, version := range []OptTPacketVersion{TPacketVersion2, TPacketVersion3} {
+		t.Run(version.String(), func(t *testing.T) {
+			testTXRing(t, version)
+		})
+	}
+}
+
+func testTXRing(t *testing.T, version OptTPacketVersion) {
+	txIface, rxIface, cleanup := testveth.Pair(t, "tx")
+	defer cleanup()
+
+	rx, err := NewTPacket(OptInterface(rxIface), OptFrameSize(4096), OptBlockSize(4096*8), OptNumBlocks(8),
+		OptBlockTimeout(time.Millisecond), OptPollTimeout(100*time.Millisecond))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer rx.Close()
+	tx, err := NewTPacket(OptInterface(txIface), OptFrameSize(4096), OptBlockSize(4096*2), OptNumBlocks(4),
+		OptTXRing(true), OptQdiscBypass(true), version)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer tx.Close()
+
+	packet := func(i byte, length int) []byte {
+		pkt := make([]byte, length)
+		copy(pkt, []byte{0xff, 0xff, 0xff, 0xff, 0xff, 0xff, 0x02, 0, 0, 0, 0, 1, 0x88, 0xb5, i})
+		return pkt
+	}
+	for i := 0; i < 3; i++ {
+		if err := tx.WriteTXFrame(packet(byte(i), 60)); err != nil {
+			t.Fatal(err)
+		}
+	}
+	// exceeds the MTU, so the kernel rejects it
+	if err := tx.WriteTXFrame(packet(3, 2000)); err != nil {
+		t.Fatal(err)
+	}
+	if err := tx.WriteTXFrame(packet(4, 60)); err != nil {
+		t.Fatal(err)
+	}
+	if n := tx.TXPending(); n != 5 {
+		t.Errorf("pending frames: got %d, want 5", n)
+	}
+	if s := tx.TXFrameStatus(0); s != TXFrameSendRequest {
+		t.Errorf("frame status before flush: got %v, want %v", s, TXFrameSendRequest)
+	}
+	sent, failed, err := tx.FlushTX()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if sent != 4 || failed != 1 {
+		t.Errorf("flush: got %d sent, %d failed, want 4 sent, 1 failed", sent, failed)
+	}
+	if s := tx.TXFrameStatus(0); s != TXFrameAvailable {
+		t.Errorf("frame status after flush: got %v, want %v", s, TXFrameAvailable)
+	}
+	if err := tx.WritePacketData(packet(5, 60)); err != nil {
+		t.Fatal(err)
+	}
+	// fill the ring: 8 frames
+	for i := 0; i < 8; i++ {
+		if err := tx.WriteTXFrame(packet(byte(6+i), 60)); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := tx.WriteTXFrame(packet(14, 60)); err != ErrTXRingFull {
+		t.Errorf("write to full ring: got %v, want %v", err, ErrTXRingFull)
+	}
+	if _, _, err := tx.FlushTX(); err != nil {
+		t.Fatal(err)
+	}
+	want := TXStats{Queued: 14, Sent: 13, Failed: 1}
+	got := tx.TXStats()
+	got.Flushes = 0
+	if got != want {
+		t.Errorf("tx stats: got %+v, want %+v", got, want)
+	}
+
+	var seen []byte
+	for len(seen) < 13 {
+		data, _, err := rx.ReadPacketData()
+		if err == ErrTimeout {
+			break
+		}
+		if err != nil {
+			t.Fatal(err)
+		}
+		if len(data) == 60 && data[12] == 0x88 && data[13] == 0xb5 {
+			seen = append(seen, data[14])
+		}
+	}
+	if want := []byte{0, 1, 2, 4, 5, 6, 7, 8, 9, 10, 11, 12, 13}; !reflect.DeepEqual(seen, want) {
+		t.Errorf("received packets: got %v, want %v", seen, want)
+	}
+
+	// a batch larger than the ring, with a rejected packet
+	var batch [][]byte
+	for i := 0; i < 12; i++ {
+		batch = append(batch, packet(byte(20+i), 60))
+	}
+	batch[5] = packet(25, 2000)
+	if n, err := tx.WritePacketDataBatch(batch); n != 11 || err != ErrTXWrongFormat {
+		t.Errorf("batch: got %d, %v, want 11, %v", n, err, ErrTXWrongFormat)
+	}
+	seen = nil
+	for len(seen) < 11 {
+		data, _, err := rx.ReadPacketData()
+		if err == ErrTimeout {
+			break
+		}
+		if err != nil {
+			t.Fatal(err)
+		}
+		if len(data) == 60 && data[12] == 0x88 && data[13] == 0xb5 {
+			seen = append(seen, data[14])
+		}
+	}
+	if want := []byte{20, 21, 22, 23, 24, 26, 27, 28, 29, 30, 31}; !reflect.DeepEqual(seen, want) {
+		t.Errorf("received batch: got %v, want %v", seen, want)
+	}
+}
+
+func TestFanoutGroup(t *testing.T) {
+	txIface, rxIface, cleanup := testveth.Pair(t, "tx")
+	defer cleanup()
+	ns, err := netns.Get()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer ns.Close()
+
+	tx, err := NewTPacket(OptInterface(txIface), OptFrameSize(4096), OptBlockSize(4096*2), OptNumBlocks(4))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer tx.Close()
+
+	var g *FanoutGroup
+	var mu sync.Mutex
+	counts := make([]int, 2)
+	restartSelf := false
+	restarted := make(chan error, 1)
+	handler := func(member int, data []byte, ci gopacket.CaptureInfo) {
+		if len(data) == 60 && data[12] == 0x88 && data[13] == 0xb5 {
+			mu.Lock()
+			counts[member]++
+			restart := restartSelf
+			restartSelf = false
+			mu.Unlock()
+			if restart {
+				// The new member is opened by this goroutine, which must be
+				// in the namespace of the interfaces.  It exits after the
+				// handler returns, and takes its thread with it.
+				runtime.LockOSThread()
+				if err := netns.Set(ns); err != nil {
+					restarted <- err
+					return
+				}
+				// the group must not be locked while the handler runs
+				if _, err := g.SocketStats(); err != nil {
+					restarted <- err
+					return
+				}
+				restarted <- g.Restart(member)
+			}
+		}
+	}
+	// sends every packet to the second member
+	prog, err := bpf.Assemble([]bpf.Instruction{bpf.RetConstant{Val: 1}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	g, err = NewFanoutGroup(2, FanoutCBPF, 42, handler, OptFanoutCBPF(prog), OptInterface(rxIface), OptFrameSize(4096),
+		OptBlockSize(4096*8), OptNumBlocks(8), OptBlockTimeout(time.Millisecond), OptPollTimeout(10*time.Millisecond))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer g.Close()
+
+	send := func(n int) {
+		pkt := make([]byte, 60)
+		copy(pkt, []byte{0xff, 0xff, 0xff, 0xff, 0xff, 0xff, 0x02, 0, 0, 0, 0, 1, 0x88, 0xb5})
+		for i := 0; i < n; i++ {
+			if err := tx.WritePacketData(pkt); err != nil {
+				t.Fatal(err)
+			}
+		}
+	}
+	wait := func(want []int) {
+		deadline := time.Now().Add(2 * time.Second)
+		for {
+			mu.Lock()
+			got := append([]int(nil), counts...)
+			mu.Unlock()
+			if reflect.DeepEqual(got, want) {
+				return
+			}
+			if time.Now().After(deadline) {
+				t.Fatalf("packets per member: got %v, want %v", got, want)
+			}
+			time.Sleep(10 * time.Millisecond)
+		}
+	}
+
+	send(10)
+	wait([]int{0, 10})
+	if err := g.Restart(1); err != nil {
+		t.Fatal(err)
+	}
+	send(5)
+	wait([]int{0, 15})
+	for i := 0; i < g.Len(); i++ {
+		if err := g.Err(i); err != nil {
+			t.Errorf("member %d: %v", i, err)
+		}
+	}
+	for _, i := range []int{-1, g.Len()} {
+		if err := g.Err(i); err == nil {
+			t.Errorf("Err(%d): no error", i)
+		}
+		if err := g.Restart(i); err == nil {
+			t.Errorf("Restart(%d): no error", i)
+		}
+	}
+	stats, err := g.SocketStats()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if stats.Packets() < 15 {
+		t.Errorf("socket stats: got %d packets, want >= 15", stats.Packets())
+	}
+
+	// A handler may restart its own member.  Packets the old member receives
+	// before it leaves the group are lost, so send until the new one has one.
+	mu.Lock()
+	restartSelf = true
+	mu.Unlock()
+	send(1)
+	select {
+	case err := <-restarted:
+		if err != nil {
+			t.Fatal(err)
+		}
+	case <-time.After(2 * time.Second):
+		t.Fatal("handler did not restart its member")
+	}
+	for deadline := time.Now().Add(2 * time.Second); ; {
+		send(1)
+		time.Sleep(20 * time.Millisecond)
+		mu.Lock()
+		n := counts[1]
+		mu.Unlock()
+		if n > 16 {
+			break
+		}
+		if time.Now().After(deadline) {
+			t.Fatal("restarted member receives no packets")
+		}
+	}
+	if err := g.Close(); err != nil {
+		t.Error(err)
+	}
+}
+
+func TestTimestamps(t *testing.T) {
+	txIface, rxIface, cleanup := testveth.Pair(t, "tx")
+	defer cleanup()
+
+	if err := EnableHardwareTimestamps(txIface); err == nil {
+		t.Logf("veth supports hardware timestamps")
+	}
+	rx, err := NewTPacket(OptInterface(rxIface), OptFrameSize(4096), OptBlockSize(4096*8), OptNumBlocks(8),
+		OptBlockTimeout(time.Millisecond), OptPollTimeout(100*time.Millisecond), TPacketVersion3, TimestampSourceRawHardware)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer rx.Close()
+	tx, err := NewTPacket(OptInterface(txIface), OptFrameSize(4096), OptBlockSize(4096*2), OptNumBlocks(2),
+		OptPollTimeout(100*time.Millisecond), OptTXTimestamps(true))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer tx.Close()
+
+	pkt := make([]byte, 60)
+	copy(pkt, []byte{0xff, 0xff, 0xff, 0xff, 0xff, 0xff, 0x02, 0, 0, 0, 0, 1, 0x88, 0xb5})
+	before := time.Now()
+	if err := tx.WritePacketData(pkt); err != nil {
+		t.Fatal(err)
+	}
+	ts, source, err := tx.ReadTXTimestamp()
+	if err == ErrTimeout {
+		t.Log("no tx timestamp from veth")
+	} else if err != nil {
+		t.Fatal(err)
+	} else if source != TimestampSourceSoftware || ts.Before(before) || ts.After(time.Now()) {
+		t.Errorf("tx timestamp: got %v from %v, want software timestamp after %v", ts, source, before)
+	}
+
+	for {
+		data, ci, err := rx.ReadPacketData()
+		if err != nil {
+			t.Fatal(err)
+		}
+		if data[12] != 0x88 || data[13] != 0xb5 {
+			continue
+		}
+		var got interface{}
+		for _, a := range ci.AncillaryData {
+			if s, ok := a.(AncillaryTimestampSource); ok {
+				got = s.Source
+			}
+		}
+		// veth has no hardware timestamps, so the kernel falls back to software timestamps
+		if got != TimestampSourceSoftware {
+			t.Errorf("rx timestamp source: got %v, want %v", got, TimestampSourceSoftware)
+		}
+		if ci.Timestamp.Before(before) || ci.Timestamp.After(time.Now()) {
+			t.Errorf("rx timestamp %v not after %v", ci.Timestamp, before)
+		}
+		break
+	}
+}
@@ -0,0 +1,374 @@
+// Copyright 2012 Google, Inc. All rights reserved.
+//
+// Use of this source code is governed by a BSD-style license
+// that can be found in the LICENSE file in the root of the source
+// tree.
+
+// +build linux
+
+package afpacket
+
+import (
+	"errors"
+	"fmt"
+	"sync"
+	"time"
+	"unsafe"
+
+	"golang.org/x/net/bpf"
+	"golang.org/x/sys/unix"
+
+	"github.com/davidsonff/gopacket"
+)
+
+// SetFanoutCBPF sets the classic BPF program selecting the socket of a FanoutCBPF group for each packet.  The program returns the
+// index of the socket within the group, modulo the number of sockets.  The program is shared by the whole group, so it only needs to
+// be set on one member, after SetFanout.
+func (h *TPacket) SetFanoutCBPF(filter []bpf.RawInstruction) error {
+	var p unix.SockFprog
+	if len(filter) == 0 || len(filter) > int(^uint16(0)) {
+		return errors.New("invalid filter size")
+	}
+	p.Len = uint16(len(filter))
+	p.Filter = (*unix.SockFilter)(unsafe.Pointer(&filter[0]))
+
+	return setsockopt(h.fd, unix.SOL_PACKET, unix.PACKET_FANOUT_DATA, unsafe.Pointer(&p), unix.SizeofSockFprog)
+}
+
+// SetFanoutEBPF sets the eBPF program (of type BPF_PROG_TYPE_SOCKET_FILTER) selecting the socket of a FanoutEBPF group for each
+// packet, like SetFanoutCBPF.
+func (h *TPacket) SetFanoutEBPF(progFd int32) error {
+	return setsockopt(h.fd, unix.SOL_PACKET, unix.PACKET_FANOUT_DATA, unsafe.Pointer(&progFd), 4)
+}
+
+// OptFanoutCBPF is the classic BPF program for a FanoutCBPF group, see SetFanoutCBPF.
+// It can be passed into NewFanoutGroup.
+type OptFanoutCBPF []bpf.RawInstruction
+
+// OptFanoutEBPF is the file descriptor of the eBPF program for a FanoutEBPF group, see SetFanoutEBPF.
+// It can be passed into NewFanoutGroup.
+type OptFanoutEBPF int32
+
+// DefaultFanoutPollTimeout is the poll timeout of the members of a FanoutGroup, unless
+// OptPollTimeout is given.  It bounds the time it takes to stop a member.
+const DefaultFanoutPollTimeout = 100 * time.Millisecond
+
+// FanoutHandler is called by FanoutGroup for every packet read by a member.
+// The data is only valid until the handler returns.  Each member calls the
+// handler from its own goroutine, so the handler must be safe for concurrent
+// use.  The handler may call the methods of the FanoutGroup, including Restart
+// for its own member, except Close, which waits for the handlers to return.
+type FanoutHandler func(member int, data []byte, ci gopacket.CaptureInfo)
+
+type fanoutMember struct {
+	h    *TPacket
+	done chan struct{}
+	err  error
+
+	mu       sync.Mutex // guards below
+	handling bool       // the goroutine is running the handler
+	stopped  bool
+}
+
+// FanoutGroup is a set of TPackets sharing the packets of an interface with
+// PACKET_FANOUT.  Each member reads packets in its own goroutine, and passes
+// them to the handler.
+type FanoutGroup struct {
+	t       FanoutType
+	id      uint16
+	handler FanoutHandler
+	opts    []interface{}
+	cbpf    []bpf.RawInstruction
+	ebpf    int32
+
+	mu      sync.Mutex // guards below
+	members []*fanoutMember
+	closed  bool
+	// retired contains the socket stats of stopped members
+	retired SocketStatsV3
+}
+
+// NewFanoutGroup opens n TPackets, adds them to the fanout group with the
+// given type and id, and starts reading packets.  The options are passed to
+// NewTPacket, except for OptFanoutCBPF and OptFanoutEBPF, which are needed
+// for FanoutCBPF and FanoutEBPF.
+// If this function succeeds, the user should be sure to Close the returned
+// FanoutGroup when finished with it.
+func NewFanoutGroup(n int, t FanoutType, id uint16, handler FanoutHandler, opts ...interface{}) (*FanoutGroup, error) {
+	if n < 1 {
+		return nil, fmt.Errorf("fanout group size %d must be >= 1", n)
+	}
+	g := &FanoutGroup{
+		t:       t,
+		id:      id,
+		handler: handler,
+		opts:    []interface{}{OptPollTimeout(DefaultFanoutPollTimeout)},
+		ebpf:    -1,
+	}
+	for _, opt := range opts {
+		switch v := opt.(type) {
+		case OptFanoutCBPF:
+			g.cbpf = []bpf.RawInstruction(v)
+		case OptFanoutEBPF:
+			g.ebpf = int32(v)
+		default:
+			g.opts = append(g.opts, opt)
+		}
+	}
+	switch {
+	case t == FanoutCBPF && g.cbpf == nil:
+		return nil, errors.New("FanoutCBPF needs OptFanoutCBPF")
+	case t == FanoutEBPF && g.ebpf < 0:
+		return nil, errors.New("FanoutEBPF needs OptFanoutEBPF")
+	}
+	if _, err := parseOptions(g.opts...); err != nil {
+		return nil, err
+	}
+	g.members = make([]*fanoutMember, n)
+	for i := range g.members {
+		m, err := g.newMember()
+		if err != nil {
+			g.Close()
+			return nil, err
+		}
+		g.members[i] = m
+		go g.run(i, m)
+	}
+	return g, nil
+}
+
+func (g *FanoutGroup) newMember() (*fanoutMember, error) {
+	h, err := NewTPacket(g.opts...)
+	if err != nil {
+		return nil, err
+	}
+	if err = h.SetFanout(g.t, g.id); err != nil {
+		err = fmt.Errorf("setsockopt packet_fanout: %v", err)
+	} else if g.t == FanoutCBPF {
+		err = h.SetFanoutCBPF(g.cbpf)
+	} else if g.t == FanoutEBPF {
+		err = h.SetFanoutEBPF(g.ebpf)
+	}
+	if err != nil {
+		h.Close()
+		return nil, err
+	}
+	return &fanoutMember{
+		h:    h,
+		done: make(chan struct{}),
+	}, nil
+}
+
+// stop asks the goroutine of m to return, and returns whether it is running the handler.  Otherwise it returns within the poll
+// timeout.
+func (m *fanoutMember) stop() (handling bool) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.stopped = true
+	return m.handling
+}
+
+func (m *fanoutMember) isStopped() bool {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	return m.stopped
+}
+
+// handle passes a packet of member m to the handler, unless m was stopped, and returns whether m is still running.
+func (g *FanoutGroup) handle(i int, m *fanoutMember, data []byte, ci gopacket.CaptureInfo) bool {
+	m.mu.Lock()
+	if m.stopped {
+		m.mu.Unlock()
+		return false
+	}
+	m.handling = true
+	m.mu.Unlock()
+	g.handler(i, data, ci)
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.handling = false
+	return !m.stopped
+}
+
+func (g *FanoutGroup) run(i int, m *fanoutMember) {
+	defer g.retire(m)
+	for {
+		data, ci, err := m.h.ZeroCopyReadPacketData()
+		switch err {
+		case nil:
+			if !g.handle(i, m, data, ci) {
+				return
+			}
+		case ErrTimeout:
+			if m.isStopped() {
+				return
+			}
+		default:
+			m.err = err
+			return
+		}
+	}
+}
+
+// retire closes the TPacket of member m when its goroutine returns, and keeps its socket stats.  It doesn't wait for anything while
+// holding g.mu, so handlers may call the methods of the group.
+func (g *FanoutGroup) retire(m *fanoutMember) {
+	g.mu.Lock()
+	ss, ssv3, err := m.h.SocketStats()
+	if err == nil {
+		addSocketStats(&g.retired, ss, ssv3)
+	}
+	m.h.Close()
+	g.mu.Unlock()
+	close(m.done)
+}
+
+// stopErr returns the error that stopped member m, or nil if it is running.
+func (m *fanoutMember) stopErr() error {
+	select {
+	case <-m.done:
+		return m.err
+	default:
+		return nil
+	}
+}
+
+func addSocketStats(sum *SocketStatsV3, ss SocketStats, ssv3 SocketStatsV3) {
+	sum.tp_packets += ss.tp_packets + ssv3.tp_packets
+	sum.tp_drops += ss.tp_drops + ssv3.tp_drops
+	sum.tp_freeze_q_cnt += ssv3.tp_freeze_q_cnt
+}
+
+// Len returns the number of members of the group.
+func (g *FanoutGroup) Len() int {
+	g.mu.Lock()
+	defer g.mu.Unlock()
+	return len(g.members)
+}
+
+// member returns member i.  g.mu must be held.
+func (g *FanoutGroup) member(i int) (*fanoutMember, error) {
+	if i < 0 || i >= len(g.members) {
+		return nil, fmt.Errorf("fanout member %d out of range [0, %d)", i, len(g.members))
+	}
+	return g.members[i], nil
+}
+
+// Err returns the error that stopped member i, or nil if it is running.
+func (g *FanoutGroup) Err(i int) error {
+	g.mu.Lock()
+	defer g.mu.Unlock()
+	m, err := g.member(i)
+	if err != nil {
+		return err
+	}
+	return m.stopErr()
+}
+
+// Restart stops member i, and replaces it with a new TPacket in the same
+// fanout group.  Packets the old member has not read yet are lost.  If the
+// old member is running the handler, for example if the handler itself calls
+// Restart, Restart doesn't wait for the handler to return, and the old member
+// may receive some more packets until it does.  With FanoutCBPF and FanoutEBPF
+// the kernel may assign a different index within the group to the new member.
+// If the old member was stopped by an error, it is returned wrapped in a
+// *FanoutRestartError, and the new member is running nonetheless.
+func (g *FanoutGroup) Restart(i int) error {
+	g.mu.Lock()
+	defer g.mu.Unlock()
+	if g.closed {
+		return errors.New("fanout group closed")
+	}
+	old, err := g.member(i)
+	if err != nil {
+		return err
+	}
+	if !old.stop() {
+		// The old member leaves the group within the poll timeout.  It takes g.mu to retire.
+		g.mu.Unlock()
+		<-old.done
+		g.mu.Lock()
+		if g.closed {
+			return errors.New("fanout group closed")
+		}
+		if g.members[i] != old {
+			// restarted concurrently
+			return nil
+		}
+	}
+	stopErr := old.stopErr()
+	m, err := g.newMember()
+	if err != nil {
+		// Keep a stopped member, so Close and Restart still work.
+		m = &fanoutMember{h: &TPacket{fd: -1}, done: make(chan struct{}), err: err, stopped: true}
+		close(m.done)
+		g.members[i] = m
+		return err
+	}
+	g.members[i] = m
+	go g.run(i, m)
+	if stopErr != nil {
+		return &FanoutRestartError{Member: i, Err: stopErr}
+	}
+	return nil
+}
+
+// FanoutRestartError is returned by FanoutGroup.Restart if the restarted
+// member had been stopped by an error.  The new member is running.
+type FanoutRestartError struct {
+	Member int
+	Err    error
+}
+
+func (e *FanoutRestartError) Error() string {
+	return fmt.Sprintf("fanout member %d had stopped: %v", e.Member, e.Err)
+}
+
+// SocketStats returns the socket stats summed over all members, including
+// the members that were restarted.
+func (g *FanoutGroup) SocketStats() (SocketStatsV3, error) {
+	g.mu.Lock()
+	defer g.mu.Unlock()
+	sum := g.retired
+	for _, m := range g.members {
+		if m == nil || m.h.fd == -1 {
+			continue
+		}
+		ss, ssv3, err := m.h.SocketStats()
+		if err != nil {
+			return SocketStatsV3{}, err
+		}
+		addSocketStats(&sum, ss, ssv3)
+	}
+	return sum, nil
+}
+
+// Close stops all members and closes their TPackets.  It waits for running
+// handlers to return, so it must not be called by the handler, and returns
+// the first error that stopped a member.
+func (g *FanoutGroup) Close() error {
+	g.mu.Lock()
+	if g.closed {
+		g.mu.Unlock()
+		return nil
+	}
+	g.closed = true
+	var members []*fanoutMember
+	for _, m := range g.members {
+		if m != nil {
+			m.stop()
+			members = append(members, m)
+		}
+	}
+	g.mu.Unlock()
+
+	// The members take g.mu to retire.
+	var err error
+	for _, m := range members {
+		<-m.done
+		if m.err != nil && err == nil {
+			err = m.err
+		}
+	}
+	return err
+}
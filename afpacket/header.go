@@ -47,6 +47,8 @@ type header interface {
 	getIfaceIndex() int
 	// getVLAN returns the VLAN of a packet if it was provided out-of-band
 	getVLAN() int
+	// getTimestampSource returns the source of the timestamp returned by getTime.
+	getTimestampSource() OptTimestampSource
 	// next moves this header to point to the next packet it contains,
 	// returning true on success (in which case getTime and getData will
 	// return values for the new packet) or false if there are no more
@@ -84,6 +86,9 @@ func insertVlanHeader(data []byte, vlanTCI int, opts *options) []byte {
 func (h *v1header) getVLAN() int {
 	return -1
 }
+func (h *v1header) getTimestampSource() OptTimestampSource {
+	return timestampSource(uint32(h.tp_status))
+}
 func (h *v1header) getStatus() int {
 	return int(h.tp_status)
 }
@@ -110,6 +115,9 @@ func (h *v1header) next() bool {
 func (h *v2header) getVLAN() int {
 	return -1
 }
+func (h *v2header) getTimestampSource() OptTimestampSource {
+	return timestampSource(uint32(h.tp_status))
+}
 func (h *v2header) getStatus() int {
 	return int(h.tp_status)
 }
@@ -156,6 +164,10 @@ func (w *v3wrapper) getVLAN() int {
 	return -1
 }
 
+func (w *v3wrapper) getTimestampSource() OptTimestampSource {
+	return timestampSource(uint32(w.packet.tp_status))
+}
+
 func (w *v3wrapper) getStatus() int {
 	return int(w.blockhdr.block_status)
 }
@@ -106,6 +106,63 @@ type OptPollTimeout time.Duration
 // be provided if available.
 type OptAddVLANHeader bool
 
+// OptTXRing enables a PACKET_TX_RING for transmitting packets, in addition to
+// the receive ring.  The TX ring uses the same frame size and number of blocks
+// as the receive ring.  Packets are queued into the ring with WriteTXFrame and
+// transmitted with a single syscall by FlushTX; WritePacketData goes through
+// the ring as well.  The TX ring requires TPacketVersion2 or TPacketVersion3
+// (kernel 4.11 or later), and SocketRaw.
+// It can be passed into NewTPacket.
+type OptTXRing bool
+
+// OptQdiscBypass sets PACKET_QDISC_BYPASS, which makes transmitted packets
+// bypass the kernel's queueing discipline layer.  This increases the transmit
+// rate, but packets are dropped instead of queued if the NIC's TX queue is
+// full, and they are not seen by other packet sockets.
+// It can be passed into NewTPacket.
+type OptQdiscBypass bool
+
+// OptTimestampSource selects the timestamps the kernel reports for received
+// packets (PACKET_TIMESTAMP).  The source actually used for each packet is
+// reported by an AncillaryTimestampSource in CaptureInfo.AncillaryData.
+// It can be passed into NewTPacket.
+type OptTimestampSource int
+
+// String returns a string representation of the timestamp source.
+func (t OptTimestampSource) String() string {
+	switch t {
+	case TimestampSourceDefault:
+		return "Default"
+	case TimestampSourceSoftware:
+		return "Software"
+	case TimestampSourceRawHardware:
+		return "RawHardware"
+	}
+	return "UnknownTimestampSource"
+}
+
+// Timestamp sources for use with NewTPacket.
+const (
+	// TimestampSourceDefault leaves the kernel default, which are software
+	// timestamps, and doesn't report the source in CaptureInfo.
+	TimestampSourceDefault = OptTimestampSource(0)
+	// TimestampSourceSoftware requests the kernel's software timestamps.
+	TimestampSourceSoftware = OptTimestampSource(unix.SOF_TIMESTAMPING_SOFTWARE)
+	// TimestampSourceRawHardware requests the timestamps of the NIC, which
+	// need to be enabled with EnableHardwareTimestamps.  Software timestamps
+	// are used for packets without a hardware timestamp.
+	TimestampSourceRawHardware = OptTimestampSource(unix.SOF_TIMESTAMPING_RAW_HARDWARE)
+)
+
+// OptTXTimestamps enables timestamps for packets sent with WritePacketData
+// (SO_TIMESTAMPING).  The kernel queues a timestamp for every transmitted
+// packet, which must be read with ReadTXTimestamp: pending timestamps
+// make poll return immediately, so reading packets spins until they are read.
+// Hardware timestamps are requested if OptTimestampSource is
+// TimestampSourceRawHardware.
+// It can be passed into NewTPacket.
+type OptTXTimestamps bool
+
 // Default constants used by options.
 const (
 	DefaultFrameSize    = 4096                   // Default value for OptFrameSize.
@@ -126,6 +183,10 @@ type options struct {
 	version        OptTPacketVersion
 	socktype       OptSocketType
 	iface          string
+	txRing         bool
+	qdiscBypass    bool
+	tsSource       OptTimestampSource
+	txTimestamps   bool
 }
 
 var defaultOpts = options{
@@ -160,6 +221,14 @@ func parseOptions(opts ...interface{}) (ret options, err error) {
 			ret.socktype = v
 		case OptAddVLANHeader:
 			ret.addVLANHeader = bool(v)
+		case OptTXRing:
+			ret.txRing = bool(v)
+		case OptQdiscBypass:
+			ret.qdiscBypass = bool(v)
+		case OptTimestampSource:
+			ret.tsSource = v
+		case OptTXTimestamps:
+			ret.txTimestamps = bool(v)
 		default:
 			err = errors.New("unknown type in options")
 			return
@@ -183,6 +252,12 @@ func (o options) check() error {
 		return fmt.Errorf("block timeout %v must be > %v", o.blockTimeout, time.Millisecond)
 	case o.version < tpacketVersionMin || o.version > tpacketVersionMax:
 		return fmt.Errorf("tpacket version %v is invalid", o.version)
+	case o.tsSource != TimestampSourceDefault && o.tsSource != TimestampSourceSoftware && o.tsSource != TimestampSourceRawHardware:
+		return fmt.Errorf("timestamp source %d is invalid", int(o.tsSource))
+	case o.txRing && o.version == TPacketVersion1:
+		return fmt.Errorf("tx ring is not supported with tpacket version %v", o.version)
+	case o.txRing && o.socktype != SocketRaw:
+		return fmt.Errorf("tx ring is not supported with socket type %v", o.socktype)
 	}
 	return nil
 }
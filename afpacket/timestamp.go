@@ -0,0 +1,160 @@
+// Copyright 2012 Google, Inc. All rights reserved.
+//
+// Use of this source code is governed by a BSD-style license
+// that can be found in the LICENSE file in the root of the source
+// tree.
+
+// +build linux
+
+package afpacket
+
+import (
+	"errors"
+	"fmt"
+	"net"
+	"time"
+	"unsafe"
+
+	"golang.org/x/sys/unix"
+)
+
+// AncillaryTimestampSource structures are used to pass the source of the
+// packet timestamp via CaptureInfo, if OptTimestampSource is given.
+type AncillaryTimestampSource struct {
+	// Source is the source of the timestamp: TimestampSourceSoftware or
+	// TimestampSourceRawHardware, or TimestampSourceDefault if the kernel
+	// had no timestamp, and the time the packet was put into the ring is
+	// used.
+	Source OptTimestampSource
+}
+
+// timestampSource returns the timestamp source reported in a tpacket status.
+func timestampSource(status uint32) OptTimestampSource {
+	switch {
+	case status&unix.TP_STATUS_TS_RAW_HARDWARE != 0:
+		return TimestampSourceRawHardware
+	case status&unix.TP_STATUS_TS_SOFTWARE != 0:
+		return TimestampSourceSoftware
+	}
+	return TimestampSourceDefault
+}
+
+// setTimestamping applies OptTimestampSource and OptTXTimestamps to the socket.
+func (h *TPacket) setTimestamping() error {
+	flags := 0
+	if h.opts.tsSource != TimestampSourceDefault {
+		if err := unix.SetsockoptInt(h.fd, unix.SOL_PACKET, unix.PACKET_TIMESTAMP, int(h.opts.tsSource)); err != nil {
+			return fmt.Errorf("setsockopt packet_timestamp: %v", err)
+		}
+		// Without a socket asking for receive timestamps, the kernel doesn't
+		// timestamp packets, and the ring gets the time the packet is copied.
+		flags |= unix.SOF_TIMESTAMPING_RX_SOFTWARE | unix.SOF_TIMESTAMPING_SOFTWARE
+		if h.opts.tsSource == TimestampSourceRawHardware {
+			flags |= unix.SOF_TIMESTAMPING_RX_HARDWARE | unix.SOF_TIMESTAMPING_RAW_HARDWARE
+		}
+	}
+	if h.opts.txTimestamps {
+		flags |= unix.SOF_TIMESTAMPING_TX_SOFTWARE | unix.SOF_TIMESTAMPING_SOFTWARE | unix.SOF_TIMESTAMPING_OPT_TSONLY
+		if h.opts.tsSource == TimestampSourceRawHardware {
+			flags |= unix.SOF_TIMESTAMPING_TX_HARDWARE | unix.SOF_TIMESTAMPING_RAW_HARDWARE
+		}
+	}
+	if flags != 0 {
+		if err := unix.SetsockoptInt(h.fd, unix.SOL_SOCKET, unix.SO_TIMESTAMPING, flags); err != nil {
+			return fmt.Errorf("setsockopt so_timestamping: %v", err)
+		}
+	}
+	return nil
+}
+
+// ReadTXTimestamp returns the timestamp of the next packet transmitted with
+// WritePacketData, in the order of transmission, and its source.  Hardware
+// timestamps are preferred if both are available.  OptTXTimestamps must be
+// given.  ReadTXTimestamp waits up to OptPollTimeout for the timestamp, and
+// returns ErrTimeout if there is none.
+func (h *TPacket) ReadTXTimestamp() (time.Time, OptTimestampSource, error) {
+	if !h.opts.txTimestamps {
+		return time.Time{}, TimestampSourceDefault, errors.New("tx timestamps not enabled")
+	}
+	var buf [64]byte
+	oob := make([]byte, unix.CmsgSpace(int(unsafe.Sizeof(unix.ScmTimestamping{})))+unix.CmsgSpace(int(unsafe.Sizeof(unix.SockExtendedErr{}))+unix.SizeofSockaddrAny))
+	for {
+		_, oobn, _, _, err := unix.Recvmsg(h.fd, buf[:], oob, unix.MSG_ERRQUEUE|unix.MSG_DONTWAIT)
+		switch err {
+		case nil:
+		case unix.EAGAIN, unix.EINTR:
+			// Pending errors are always reported, no need to ask for them.
+			pollset := [1]unix.PollFd{{Fd: int32(h.fd)}}
+			n, err := unix.Poll(pollset[:], int(h.opts.pollTimeout/time.Millisecond))
+			if n == 0 && err == nil {
+				return time.Time{}, TimestampSourceDefault, ErrTimeout
+			}
+			if err != nil && err != unix.EINTR {
+				return time.Time{}, TimestampSourceDefault, err
+			}
+			continue
+		default:
+			return time.Time{}, TimestampSourceDefault, err
+		}
+		msgs, err := unix.ParseSocketControlMessage(oob[:oobn])
+		if err != nil {
+			return time.Time{}, TimestampSourceDefault, err
+		}
+		for _, msg := range msgs {
+			if msg.Header.Level != unix.SOL_SOCKET || msg.Header.Type != unix.SCM_TIMESTAMPING || len(msg.Data) < int(unsafe.Sizeof(unix.ScmTimestamping{})) {
+				continue
+			}
+			ts := (*unix.ScmTimestamping)(unsafe.Pointer(&msg.Data[0]))
+			// ts.Ts[1] is unused (formerly SYS_HARDWARE)
+			if sec, nsec := ts.Ts[2].Unix(); sec != 0 || nsec != 0 {
+				return time.Unix(sec, nsec), TimestampSourceRawHardware, nil
+			}
+			sec, nsec := ts.Ts[0].Unix()
+			return time.Unix(sec, nsec), TimestampSourceSoftware, nil
+		}
+		// an error without timestamp; skip it
+	}
+}
+
+// hwtstampConfig is struct hwtstamp_config from linux/net_tstamp.h.
+type hwtstampConfig struct {
+	flags    int32
+	txType   int32
+	rxFilter int32
+}
+
+// ifreqHwtstamp is struct ifreq with a pointer to a hwtstamp_config.
+type ifreqHwtstamp struct {
+	name [unix.IFNAMSIZ]byte
+	data *hwtstampConfig
+	_    [16]byte
+}
+
+const (
+	hwtstampTXOn      = 1 // HWTSTAMP_TX_ON
+	hwtstampFilterAll = 1 // HWTSTAMP_FILTER_ALL
+)
+
+// EnableHardwareTimestamps configures the NIC of the named interface to
+// timestamp all received and transmitted packets (SIOCSHWTSTAMP), which is
+// needed for TimestampSourceRawHardware.  This affects all sockets using the
+// interface, and needs CAP_NET_ADMIN.  An error is returned if the NIC doesn't
+// support hardware timestamps.
+func EnableHardwareTimestamps(iface string) error {
+	if _, err := net.InterfaceByName(iface); err != nil {
+		return fmt.Errorf("InterfaceByName: %v", err)
+	}
+	fd, err := unix.Socket(unix.AF_INET, unix.SOCK_DGRAM, 0)
+	if err != nil {
+		return err
+	}
+	defer unix.Close(fd)
+	config := hwtstampConfig{txType: hwtstampTXOn, rxFilter: hwtstampFilterAll}
+	var req ifreqHwtstamp
+	copy(req.name[:unix.IFNAMSIZ-1], iface)
+	req.data = &config
+	if _, _, errno := unix.Syscall(unix.SYS_IOCTL, uintptr(fd), unix.SIOCSHWTSTAMP, uintptr(unsafe.Pointer(&req))); errno != 0 {
+		return fmt.Errorf("ioctl siocshwtstamp: %v", errno)
+	}
+	return nil
+}
@@ -0,0 +1,282 @@
+// Copyright 2012 Google, Inc. All rights reserved.
+//
+// Use of this source code is governed by a BSD-style license
+// that can be found in the LICENSE file in the root of the source
+// tree.
+
+// +build linux
+
+package afpacket
+
+import (
+	"errors"
+	"fmt"
+	"sync/atomic"
+	"syscall"
+	"unsafe"
+
+	"golang.org/x/sys/unix"
+)
+
+// #include <linux/if_packet.h>
+import "C"
+
+// ErrNoTXRing is returned by the TX ring functions if the TPacket was created without OptTXRing.
+var ErrNoTXRing = errors.New("tx ring not enabled")
+
+// ErrTXRingFull is returned by WriteTXFrame if all frames of the TX ring are queued.  FlushTX needs to be called before more
+// frames can be queued.
+var ErrTXRingFull = errors.New("tx ring full")
+
+// ErrTXWrongFormat is returned by WritePacketData if the kernel rejected the packet, e.g. because it exceeds the MTU of the interface.
+var ErrTXWrongFormat = errors.New("tx frame has wrong format")
+
+// TXFrameStatus is the status of a frame in the TX ring.
+type TXFrameStatus int
+
+// TXFrameStatus values.
+const (
+	// TXFrameAvailable frames can be filled.  Queued frames become available again once the kernel has transmitted them.
+	TXFrameAvailable TXFrameStatus = unix.TP_STATUS_AVAILABLE
+	// TXFrameSendRequest frames are queued, and will be transmitted by the next FlushTX.
+	TXFrameSendRequest TXFrameStatus = unix.TP_STATUS_SEND_REQUEST
+	// TXFrameSending frames are being transmitted by the kernel.
+	TXFrameSending TXFrameStatus = unix.TP_STATUS_SENDING
+	// TXFrameWrongFormat frames were rejected by the kernel.
+	TXFrameWrongFormat TXFrameStatus = unix.TP_STATUS_WRONG_FORMAT
+)
+
+func (s TXFrameStatus) String() string {
+	switch s {
+	case TXFrameAvailable:
+		return "Available"
+	case TXFrameSendRequest:
+		return "SendRequest"
+	case TXFrameSending:
+		return "Sending"
+	case TXFrameWrongFormat:
+		return "WrongFormat"
+	}
+	return "UnknownStatus"
+}
+
+// TXStats is a set of counters detailing the work of the TX ring so far.
+type TXStats struct {
+	// Queued is the number of frames queued with WriteTXFrame.
+	Queued int64
+	// Sent is the number of queued frames that were transmitted.
+	Sent int64
+	// Failed is the number of queued frames that were rejected by the kernel.
+	Failed int64
+	// Flushes is the number of send syscalls made to flush the ring.
+	Flushes int64
+}
+
+// txRing is the user space view of a PACKET_TX_RING.  Frames are queued at head, and handed to the kernel in order; frames between
+// tail and head have not been reaped yet.
+type txRing struct {
+	ring       []byte
+	version    OptTPacketVersion
+	frameSize  int
+	frames     int
+	dataOffset int
+	head       int
+	tail       int
+	pending    int
+	stats      TXStats
+}
+
+func newTXRing(ring []byte, frameSize int, version OptTPacketVersion) txRing {
+	t := txRing{
+		ring:      ring,
+		version:   version,
+		frameSize: frameSize,
+		frames:    len(ring) / frameSize,
+	}
+	// Without PACKET_TX_HAS_OFF the kernel expects the packet data right after the header.
+	if version == TPacketVersion3 {
+		t.dataOffset = tpAlign(int(C.sizeof_struct_tpacket3_hdr))
+	} else {
+		t.dataOffset = tpAlign(int(C.sizeof_struct_tpacket2_hdr))
+	}
+	return t
+}
+
+func (t *txRing) frame(i int) unsafe.Pointer {
+	return unsafe.Pointer(&t.ring[i*t.frameSize])
+}
+
+func (t *txRing) statusPtr(i int) *uint32 {
+	if t.version == TPacketVersion3 {
+		return (*uint32)(unsafe.Pointer(&(*C.struct_tpacket3_hdr)(t.frame(i)).tp_status))
+	}
+	return (*uint32)(unsafe.Pointer(&(*C.struct_tpacket2_hdr)(t.frame(i)).tp_status))
+}
+
+// txStatusTimestamp are the status bits reporting the source of the transmit timestamp.
+const txStatusTimestamp = unix.TP_STATUS_TS_SOFTWARE | unix.TP_STATUS_TS_SYS_HARDWARE | unix.TP_STATUS_TS_RAW_HARDWARE
+
+func (t *txRing) status(i int) TXFrameStatus {
+	return TXFrameStatus(atomic.LoadUint32(t.statusPtr(i)) &^ txStatusTimestamp)
+}
+
+func (t *txRing) setStatus(i int, s TXFrameStatus) {
+	atomic.StoreUint32(t.statusPtr(i), uint32(s))
+}
+
+func (t *txRing) maxLength() int {
+	return t.frameSize - t.dataOffset
+}
+
+// data returns the packet data of frame i.
+func (t *txRing) data(i int) []byte {
+	var length int
+	if t.version == TPacketVersion3 {
+		length = int((*C.struct_tpacket3_hdr)(t.frame(i)).tp_len)
+	} else {
+		length = int((*C.struct_tpacket2_hdr)(t.frame(i)).tp_len)
+	}
+	start := i*t.frameSize + t.dataOffset
+	return t.ring[start : start+length]
+}
+
+// fill copies pkt into frame i, which must not be owned by the kernel.
+func (t *txRing) fill(i int, pkt []byte) {
+	start := i*t.frameSize + t.dataOffset
+	copy(t.ring[start:start+len(pkt)], pkt)
+	if t.version == TPacketVersion3 {
+		hdr := (*C.struct_tpacket3_hdr)(t.frame(i))
+		hdr.tp_len = C.__u32(len(pkt))
+		hdr.tp_snaplen = C.__u32(len(pkt))
+		hdr.tp_next_offset = 0
+	} else {
+		hdr := (*C.struct_tpacket2_hdr)(t.frame(i))
+		hdr.tp_len = C.__u32(len(pkt))
+		hdr.tp_snaplen = C.__u32(len(pkt))
+	}
+}
+
+// reap moves tail past the frames the kernel is done with, and returns the number of frames transmitted and rejected.  The kernel
+// stops at a rejected frame, so it is removed from the ring by moving the frames queued after it up by one.
+func (t *txRing) reap() (sent, failed int) {
+	for t.pending > 0 {
+		switch t.status(t.tail) {
+		case TXFrameAvailable:
+			t.tail = (t.tail + 1) % t.frames
+			t.pending--
+			sent++
+		case TXFrameWrongFormat:
+			t.dropTail()
+			failed++
+		default:
+			return
+		}
+	}
+	return
+}
+
+func (t *txRing) dropTail() {
+	prev := t.tail
+	for n := 1; n < t.pending; n++ {
+		next := (prev + 1) % t.frames
+		t.fill(prev, t.data(next))
+		t.setStatus(prev, TXFrameSendRequest)
+		prev = next
+	}
+	t.setStatus(prev, TXFrameAvailable)
+	t.head = prev
+	t.pending--
+}
+
+// wrongFormatPending returns whether a frame was rejected, but can't be reaped yet because frames before it are still being
+// transmitted.
+func (t *txRing) wrongFormatPending() bool {
+	for n, i := 0, t.tail; n < t.pending; n, i = n+1, (i+1)%t.frames {
+		if t.status(i) == TXFrameWrongFormat {
+			return true
+		}
+	}
+	return false
+}
+
+// WriteTXFrame queues a packet into the next free frame of the TX ring.  The packet is not transmitted until FlushTX is called,
+// which allows to transmit many packets with a single syscall.  ErrTXRingFull is returned if no frame is free.
+func (h *TPacket) WriteTXFrame(pkt []byte) error {
+	h.txMu.Lock()
+	defer h.txMu.Unlock()
+	t := &h.tx
+	if t.ring == nil {
+		return ErrNoTXRing
+	}
+	if len(pkt) > t.maxLength() {
+		return fmt.Errorf("packet length %d exceeds tx frame capacity %d", len(pkt), t.maxLength())
+	}
+	if t.pending == t.frames {
+		if t.reap(); t.pending == t.frames {
+			return ErrTXRingFull
+		}
+	}
+	t.fill(t.head, pkt)
+	t.setStatus(t.head, TXFrameSendRequest)
+	t.head = (t.head + 1) % t.frames
+	t.pending++
+	t.stats.Queued++
+	return nil
+}
+
+// FlushTX transmits the frames queued with WriteTXFrame, and returns the number of frames transmitted and rejected by the kernel since
+// the last call.  Rejected frames (TXFrameWrongFormat) are dropped, and the frames queued after them are still transmitted.
+// FlushTX blocks until the kernel has handed all frames to the driver.
+func (h *TPacket) FlushTX() (sent, failed int, err error) {
+	h.txMu.Lock()
+	defer h.txMu.Unlock()
+	t := &h.tx
+	if t.ring == nil {
+		return 0, 0, ErrNoTXRing
+	}
+	for t.pending > 0 {
+		_, _, errno := unix.Syscall6(unix.SYS_SENDTO, uintptr(h.fd), 0, 0, 0, 0, 0)
+		t.stats.Flushes++
+		s, f := t.reap()
+		sent += s
+		failed += f
+		if errno == syscall.EINTR || f > 0 || (errno != 0 && t.wrongFormatPending()) {
+			// A frame was rejected; send the frames following it.  The
+			// next send also waits for the frames before it to complete.
+			continue
+		}
+		if errno != 0 {
+			err = errno
+		}
+		break
+	}
+	t.stats.Sent += int64(sent)
+	t.stats.Failed += int64(failed)
+	return
+}
+
+// TXFrameStatus returns the status of the i-th frame of the TX ring, counted from the oldest frame that has not been reported by
+// FlushTX yet.  Frames from TXPending() on are TXFrameAvailable.
+func (h *TPacket) TXFrameStatus(i int) TXFrameStatus {
+	h.txMu.Lock()
+	defer h.txMu.Unlock()
+	t := &h.tx
+	if t.ring == nil || i < 0 || i >= t.frames {
+		return TXFrameAvailable
+	}
+	return t.status((t.tail + i) % t.frames)
+}
+
+// TXPending returns the number of frames queued with WriteTXFrame that have not been reported by FlushTX yet.
+func (h *TPacket) TXPending() int {
+	h.txMu.Lock()
+	defer h.txMu.Unlock()
+	return h.tx.pending
+}
+
+// TXStats returns statistics on the TX ring.
+func (h *TPacket) TXStats() TXStats {
+	h.txMu.Lock()
+	defer h.txMu.Unlock()
+	return h.tx.stats
+}
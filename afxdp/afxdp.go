@@ -0,0 +1,491 @@
+// Copyright 2012 Google, Inc. All rights reserved.
+//
+// Use of this source code is governed by a BSD-style license
+// that can be found in the LICENSE file in the root of the source
+// tree.
+
+//go:build linux
+// +build linux
+
+// Package afxdp provides Go bindings for reading and writing packets with
+// Linux AF_XDP sockets, without cgo.
+//
+// An AF_XDP socket is bound to one queue of an interface.  An XDP program
+// attached to the interface redirects the packets of the queue to the socket,
+// which receives them in a memory area shared with the kernel (the UMEM).
+// Unless a Program is given, NewSocket loads and attaches a program that
+// redirects the packets of every queue that has a socket, and passes all
+// others to the network stack.
+//
+// XDPModeGeneric together with BindModeCopy works with every interface,
+// including veth interfaces, which is useful for testing.  Driver mode and
+// zero copy need support by the driver.
+//
+//  s, _ := afxdp.NewSocket(afxdp.OptInterface("eth0"), afxdp.OptQueueID(0))
+//  defer s.Close()
+//  data, ci, _ := s.ZeroCopyReadPacketData()
+package afxdp
+
+import (
+	"errors"
+	"fmt"
+	"net"
+	"runtime"
+	"sync"
+	"sync/atomic"
+	"time"
+	"unsafe"
+
+	"golang.org/x/sys/unix"
+
+	"github.com/davidsonff/gopacket"
+)
+
+// ErrTimeout is returned if no packet arrived, or no frame for transmitting
+// became free, within OptPollTimeout.
+var ErrTimeout = errors.New("xdp poll timeout expired")
+
+// ErrPoll is returned if poll reports an error on the socket.
+var ErrPoll = errors.New("xdp poll failed")
+
+// Stats is a set of counters detailing the work Socket has done so far.
+type Stats struct {
+	// Packets is the total number of packets returned to the caller.
+	Packets int64
+	// Polls is the number of blocking syscalls made waiting for packets
+	// or free frames.
+	Polls int64
+}
+
+// SocketStats are the counters the kernel keeps for an AF_XDP socket.
+type SocketStats struct {
+	// RXDropped is the number of packets dropped because the RX ring or the
+	// fill ring was full or empty.
+	RXDropped uint64
+	// RXInvalidDescs is the number of invalid descriptors in the fill ring.
+	RXInvalidDescs uint64
+	// TXInvalidDescs is the number of invalid descriptors in the TX ring.
+	TXInvalidDescs uint64
+}
+
+// queue is one of the four single producer, single consumer rings shared with
+// the kernel.  The fill and TX rings are produced by user space, the RX and
+// completion rings by the kernel.
+type queue struct {
+	mem      []byte
+	producer *uint32
+	consumer *uint32
+	descs    unsafe.Pointer
+	mask     uint32
+}
+
+func newQueue(fd int, pgoff int64, off unix.XDPRingOffset, size int, descSize uintptr) (queue, error) {
+	mem, err := unix.Mmap(fd, pgoff, int(off.Desc)+size*int(descSize), unix.PROT_READ|unix.PROT_WRITE, unix.MAP_SHARED|unix.MAP_POPULATE)
+	if err != nil {
+		return queue{}, err
+	}
+	return queue{
+		mem:      mem,
+		producer: (*uint32)(unsafe.Pointer(&mem[off.Producer])),
+		consumer: (*uint32)(unsafe.Pointer(&mem[off.Consumer])),
+		descs:    unsafe.Pointer(&mem[off.Desc]),
+		mask:     uint32(size - 1),
+	}, nil
+}
+
+// available returns the number of entries the consumer can take.
+func (q *queue) available() uint32 {
+	return atomic.LoadUint32(q.producer) - atomic.LoadUint32(q.consumer)
+}
+
+// addr returns the address at index i of a fill or completion ring.
+func (q *queue) addr(i uint32) *uint64 {
+	return (*uint64)(unsafe.Pointer(uintptr(q.descs) + uintptr(i&q.mask)*8))
+}
+
+// desc returns the descriptor at index i of an RX or TX ring.
+func (q *queue) desc(i uint32) *unix.XDPDesc {
+	return (*unix.XDPDesc)(unsafe.Pointer(uintptr(q.descs) + uintptr(i&q.mask)*unsafe.Sizeof(unix.XDPDesc{})))
+}
+
+func (q *queue) close() {
+	if q.mem != nil {
+		unix.Munmap(q.mem)
+		q.mem = nil
+	}
+}
+
+// Socket is an AF_XDP socket bound to a queue of an interface.  It
+// implements gopacket.PacketDataSource and gopacket.ZeroCopyPacketDataSource.
+// Reading and writing may happen concurrently, but only one goroutine should
+// read, and one write, at a time.
+type Socket struct {
+	fd      int
+	ifindex int
+	opts    options
+	umem    []byte
+	program *Program
+	// ownProgram is set if the socket loaded the program itself
+	ownProgram bool
+
+	rxMu sync.Mutex // guards below
+	fill queue
+	rx   queue
+	// held is the frame returned by the last ZeroCopyReadPacketData
+	held     uint64
+	haveHeld bool
+
+	txMu sync.Mutex // guards below
+	tx   queue
+	comp queue
+	// txFree are the frames available for transmitting
+	txFree []uint64
+
+	stats Stats
+}
+
+// NewSocket returns a new Socket for reading packets from and writing
+// packets to a queue of an interface.  OptInterface must be given; the
+// behavior may be modified further by passing in any/all of afxdp.Opt* to
+// this function.  A *Program can be passed to share one program between the
+// sockets for several queues of an interface.
+// If this function succeeds, the user should be sure to Close the returned
+// Socket when finished with it.
+func NewSocket(opts ...interface{}) (s *Socket, err error) {
+	s = &Socket{fd: -1}
+	if s.opts, err = parseOptions(opts...); err != nil {
+		return nil, err
+	}
+	iface, err := net.InterfaceByName(s.opts.iface)
+	if err != nil {
+		return nil, fmt.Errorf("InterfaceByName: %v", err)
+	}
+	s.ifindex = iface.Index
+	if s.fd, err = unix.Socket(unix.AF_XDP, unix.SOCK_RAW, 0); err != nil {
+		return nil, fmt.Errorf("socket af_xdp: %v", err)
+	}
+	runtime.SetFinalizer(s, (*Socket).Close)
+	if err = s.setUp(); err != nil {
+		s.Close()
+		return nil, err
+	}
+	return s, nil
+}
+
+func (s *Socket) setUp() error {
+	o := &s.opts
+	frames := o.rxRingSize + o.txRingSize
+	var err error
+	if s.umem, err = unix.Mmap(-1, 0, frames*o.frameSize, unix.PROT_READ|unix.PROT_WRITE, unix.MAP_PRIVATE|unix.MAP_ANONYMOUS|unix.MAP_POPULATE); err != nil {
+		return fmt.Errorf("mmap umem: %v", err)
+	}
+	reg := unix.XDPUmemReg{
+		Addr: uint64(uintptr(unsafe.Pointer(&s.umem[0]))),
+		Len:  uint64(len(s.umem)),
+		Size: uint32(o.frameSize),
+	}
+	if err := setsockopt(s.fd, unix.SOL_XDP, unix.XDP_UMEM_REG, unsafe.Pointer(&reg), unsafe.Sizeof(reg)); err != nil {
+		return fmt.Errorf("setsockopt xdp_umem_reg: %v", err)
+	}
+	for _, opt := range []struct{ name, size int }{
+		{unix.XDP_UMEM_FILL_RING, o.rxRingSize},
+		{unix.XDP_RX_RING, o.rxRingSize},
+		{unix.XDP_UMEM_COMPLETION_RING, o.txRingSize},
+		{unix.XDP_TX_RING, o.txRingSize},
+	} {
+		if err := unix.SetsockoptInt(s.fd, unix.SOL_XDP, opt.name, opt.size); err != nil {
+			return fmt.Errorf("setsockopt ring size %d: %v", opt.size, err)
+		}
+	}
+	var off unix.XDPMmapOffsets
+	offlen := uint32(unsafe.Sizeof(off))
+	if err := getsockopt(s.fd, unix.SOL_XDP, unix.XDP_MMAP_OFFSETS, unsafe.Pointer(&off), unsafe.Pointer(&offlen)); err != nil {
+		return fmt.Errorf("getsockopt xdp_mmap_offsets: %v", err)
+	}
+	if s.fill, err = newQueue(s.fd, unix.XDP_UMEM_PGOFF_FILL_RING, off.Fr, o.rxRingSize, 8); err != nil {
+		return fmt.Errorf("mmap fill ring: %v", err)
+	}
+	if s.comp, err = newQueue(s.fd, unix.XDP_UMEM_PGOFF_COMPLETION_RING, off.Cr, o.txRingSize, 8); err != nil {
+		return fmt.Errorf("mmap completion ring: %v", err)
+	}
+	if s.rx, err = newQueue(s.fd, unix.XDP_PGOFF_RX_RING, off.Rx, o.rxRingSize, unsafe.Sizeof(unix.XDPDesc{})); err != nil {
+		return fmt.Errorf("mmap rx ring: %v", err)
+	}
+	if s.tx, err = newQueue(s.fd, unix.XDP_PGOFF_TX_RING, off.Tx, o.txRingSize, unsafe.Sizeof(unix.XDPDesc{})); err != nil {
+		return fmt.Errorf("mmap tx ring: %v", err)
+	}
+
+	// The first frames receive packets, the others transmit them.
+	for i := 0; i < o.rxRingSize; i++ {
+		*s.fill.addr(uint32(i)) = uint64(i * o.frameSize)
+	}
+	atomic.StoreUint32(s.fill.producer, uint32(o.rxRingSize))
+	s.txFree = make([]uint64, 0, o.txRingSize)
+	for i := o.rxRingSize; i < frames; i++ {
+		s.txFree = append(s.txFree, uint64(i*o.frameSize))
+	}
+
+	sa := &unix.SockaddrXDP{
+		Flags:   uint16(o.bindMode),
+		Ifindex: uint32(s.ifindex),
+		QueueID: uint32(o.queueID),
+	}
+	if err := unix.Bind(s.fd, sa); err != nil {
+		return fmt.Errorf("bind %s queue %d in %v mode: %v", o.iface, o.queueID, o.bindMode, err)
+	}
+
+	if s.program = o.program; s.program == nil {
+		if s.program, err = NewProgram(o.queueID + 1); err != nil {
+			return err
+		}
+		s.ownProgram = true
+		if err := s.program.Attach(s.ifindex, o.xdpMode); err != nil {
+			return err
+		}
+	}
+	return s.program.Register(o.queueID, s.fd)
+}
+
+// FD returns the file descriptor of the socket.
+func (s *Socket) FD() int {
+	return s.fd
+}
+
+// Close removes the socket from the program, detaches the program if the
+// socket loaded it, and releases the socket and its rings.  It should not
+// be used after the Close call.
+func (s *Socket) Close() {
+	s.rxMu.Lock()
+	defer s.rxMu.Unlock()
+	s.txMu.Lock()
+	defer s.txMu.Unlock()
+	if s.fd == -1 {
+		return // already closed.
+	}
+	if s.program != nil {
+		if s.ownProgram {
+			s.program.Close()
+		} else {
+			s.program.Unregister(s.opts.queueID)
+		}
+		s.program = nil
+	}
+	s.fill.close()
+	s.comp.close()
+	s.rx.close()
+	s.tx.close()
+	unix.Close(s.fd)
+	s.fd = -1
+	if s.umem != nil {
+		unix.Munmap(s.umem)
+		s.umem = nil
+	}
+	runtime.SetFinalizer(s, nil)
+}
+
+// poll waits for events on the socket.  It returns ErrTimeout if none
+// occurred within OptPollTimeout.
+func (s *Socket) poll(events int16) error {
+	tm := int(s.opts.pollTimeout / time.Millisecond)
+	if s.opts.pollTimeout < 0 {
+		tm = -1
+	}
+	for {
+		pollset := [1]unix.PollFd{{Fd: int32(s.fd), Events: events}}
+		n, err := unix.Poll(pollset[:], tm)
+		atomic.AddInt64(&s.stats.Polls, 1)
+		switch {
+		case err == unix.EINTR:
+			continue
+		case err != nil:
+			return err
+		case n == 0:
+			return ErrTimeout
+		case pollset[0].Revents&unix.POLLERR != 0:
+			return ErrPoll
+		}
+		return nil
+	}
+}
+
+// ZeroCopyReadPacketData reads the next packet off the wire, and returns its
+// data.  The slice returned by ZeroCopyReadPacketData points into the UMEM,
+// and is handed back to the kernel by the next call to ZeroCopyReadPacketData
+// or ReadPacketData, so it must not be used afterwards.
+func (s *Socket) ZeroCopyReadPacketData() (data []byte, ci gopacket.CaptureInfo, err error) {
+	s.rxMu.Lock()
+	defer s.rxMu.Unlock()
+	if s.fd == -1 {
+		return nil, ci, errors.New("socket closed")
+	}
+	if s.haveHeld {
+		// The fill ring has room for all receive frames.
+		prod := atomic.LoadUint32(s.fill.producer)
+		*s.fill.addr(prod) = s.held
+		atomic.StoreUint32(s.fill.producer, prod+1)
+		s.haveHeld = false
+	}
+	for s.rx.available() == 0 {
+		if err = s.poll(unix.POLLIN); err != nil {
+			return nil, ci, err
+		}
+	}
+	cons := atomic.LoadUint32(s.rx.consumer)
+	desc := *s.rx.desc(cons)
+	atomic.StoreUint32(s.rx.consumer, cons+1)
+	// The address may include an offset into the frame.
+	s.held = desc.Addr &^ uint64(s.opts.frameSize-1)
+	s.haveHeld = true
+
+	data = s.umem[desc.Addr : desc.Addr+uint64(desc.Len)]
+	ci.Timestamp = time.Now()
+	ci.CaptureLength = len(data)
+	ci.Length = len(data)
+	ci.InterfaceIndex = s.ifindex
+	atomic.AddInt64(&s.stats.Packets, 1)
+	return data, ci, nil
+}
+
+// ReadPacketData reads the next packet, copies it into a new buffer, and
+// returns that buffer.
+func (s *Socket) ReadPacketData() (data []byte, ci gopacket.CaptureInfo, err error) {
+	var d []byte
+	d, ci, err = s.ZeroCopyReadPacketData()
+	if err != nil {
+		return
+	}
+	data = make([]byte, len(d))
+	copy(data, d)
+	return
+}
+
+// reclaim moves the frames the kernel finished transmitting to the free list.
+// s.txMu must be held.
+func (s *Socket) reclaim() {
+	n := s.comp.available()
+	if n == 0 {
+		return
+	}
+	cons := atomic.LoadUint32(s.comp.consumer)
+	for i := uint32(0); i < n; i++ {
+		s.txFree = append(s.txFree, *s.comp.addr(cons + i)&^uint64(s.opts.frameSize-1))
+	}
+	atomic.StoreUint32(s.comp.consumer, cons+n)
+}
+
+// kick asks the kernel to transmit the packets in the TX ring.
+func (s *Socket) kick() error {
+	_, _, errno := unix.Syscall6(unix.SYS_SENDTO, uintptr(s.fd), 0, 0, unix.MSG_DONTWAIT, 0, 0)
+	switch errno {
+	case 0, unix.EAGAIN, unix.EBUSY, unix.ENOBUFS:
+		// The kernel is still busy with earlier packets, and picks the
+		// new ones up later.
+		return nil
+	}
+	return errno
+}
+
+// WritePacketData transmits a packet on the queue of the socket.  The packet
+// is copied into a free UMEM frame; if there is none, WritePacketData waits
+// up to OptPollTimeout for the kernel to complete an earlier transmission,
+// and returns ErrTimeout otherwise.
+func (s *Socket) WritePacketData(pkt []byte) error {
+	s.txMu.Lock()
+	defer s.txMu.Unlock()
+	if err := s.enqueue(pkt); err != nil {
+		return err
+	}
+	return s.kick()
+}
+
+// WritePacketDataBatch transmits packets like WritePacketData, but asks the
+// kernel to transmit them only once all are queued.  It returns the number of
+// packets queued.
+func (s *Socket) WritePacketDataBatch(pkts [][]byte) (int, error) {
+	s.txMu.Lock()
+	defer s.txMu.Unlock()
+	for i, pkt := range pkts {
+		if err := s.enqueue(pkt); err != nil {
+			if i > 0 {
+				s.kick()
+			}
+			return i, err
+		}
+	}
+	return len(pkts), s.kick()
+}
+
+// enqueue copies pkt into a free UMEM frame, and puts the frame on the TX
+// ring.  s.txMu must be held.
+func (s *Socket) enqueue(pkt []byte) error {
+	if len(pkt) > s.opts.frameSize {
+		return fmt.Errorf("packet of %d bytes exceeds frame size %d", len(pkt), s.opts.frameSize)
+	}
+	if s.fd == -1 {
+		return errors.New("socket closed")
+	}
+	s.reclaim()
+	for len(s.txFree) == 0 {
+		if err := s.kick(); err != nil {
+			return err
+		}
+		if s.reclaim(); len(s.txFree) > 0 {
+			break
+		}
+		if err := s.poll(unix.POLLOUT); err != nil {
+			return err
+		}
+		s.reclaim()
+	}
+	addr := s.txFree[len(s.txFree)-1]
+	s.txFree = s.txFree[:len(s.txFree)-1]
+	copy(s.umem[addr:], pkt)
+
+	// Every frame not on the free list takes at most one TX ring entry, so
+	// there is room for this one.
+	prod := atomic.LoadUint32(s.tx.producer)
+	*s.tx.desc(prod) = unix.XDPDesc{Addr: addr, Len: uint32(len(pkt))}
+	atomic.StoreUint32(s.tx.producer, prod+1)
+	return nil
+}
+
+// Stats returns statistics on the packets the Socket has seen so far.
+func (s *Socket) Stats() (Stats, error) {
+	return Stats{
+		Packets: atomic.LoadInt64(&s.stats.Packets),
+		Polls:   atomic.LoadInt64(&s.stats.Polls),
+	}, nil
+}
+
+// SocketStats returns the counters the kernel keeps for the socket.  Unlike
+// with AF_PACKET, the counters are not reset by reading them.
+func (s *Socket) SocketStats() (SocketStats, error) {
+	var st unix.XDPStatistics
+	stlen := uint32(unsafe.Sizeof(st))
+	if err := getsockopt(s.fd, unix.SOL_XDP, unix.XDP_STATISTICS, unsafe.Pointer(&st), unsafe.Pointer(&stlen)); err != nil {
+		return SocketStats{}, fmt.Errorf("getsockopt xdp_statistics: %v", err)
+	}
+	return SocketStats{
+		RXDropped:      st.Rx_dropped,
+		RXInvalidDescs: st.Rx_invalid_descs,
+		TXInvalidDescs: st.Tx_invalid_descs,
+	}, nil
+}
+
+// setsockopt provides access to the setsockopt syscall.
+func setsockopt(fd, level, name int, val unsafe.Pointer, vallen uintptr) error {
+	_, _, errno := unix.Syscall6(unix.SYS_SETSOCKOPT, uintptr(fd), uintptr(level), uintptr(name), uintptr(val), vallen, 0)
+	if errno != 0 {
+		return errno
+	}
+	return nil
+}
+
+// getsockopt provides access to the getsockopt syscall.
+func getsockopt(fd, level, name int, val, vallen unsafe.Pointer) error {
+	_, _, errno := unix.Syscall6(unix.SYS_GETSOCKOPT, uintptr(fd), uintptr(level), uintptr(name), uintptr(val), uintptr(vallen), 0)
+	if errno != 0 {
+		return errno
+	}
+	return nil
+}
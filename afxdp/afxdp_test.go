@@ -0,0 +1,206 @@
+// Copyright 2012 Google, Inc. All rights reserved.
+//
+// Use of this source code is governed by a BSD-style license
+// that can be found in the LICENSE file in the root of the source
+// tree.
+
+//go:build linux
+// +build linux
+
+package afxdp
+
+import (
+	"bytes"
+	"testing"
+	"time"
+
+	"github.com/vishvananda/netlink"
+	"golang.org/x/sys/unix"
+
+	"github.com/davidsonff/gopacket/internal/testveth"
+)
+
+func TestParseOptions(t *testing.T) {
+	wanted1 := defaultOpts
+	wanted1.iface = "eth0"
+	wanted2 := wanted1
+	wanted2.queueID = 3
+	wanted2.frameSize = 4096
+	wanted2.rxRingSize = 64
+	wanted2.txRingSize = 32
+	wanted2.xdpMode = XDPModeGeneric
+	wanted2.bindMode = BindModeCopy
+	for i, test := range []struct {
+		opts []interface{}
+		want options
+		err  bool
+	}{
+		{opts: []interface{}{OptInterface("eth0")}, want: wanted1},
+		{opts: []interface{}{OptInterface("eth0"), OptQueueID(3), OptFrameSize(4096), OptRXRingSize(64), OptTXRingSize(32), XDPModeGeneric, BindModeCopy}, want: wanted2},
+		{opts: []interface{}{}, err: true},
+		{opts: []interface{}{OptInterface("eth0"), OptQueueID(-1)}, err: true},
+		{opts: []interface{}{OptInterface("eth0"), OptFrameSize(1024)}, err: true},
+		{opts: []interface{}{OptInterface("eth0"), OptFrameSize(3000)}, err: true},
+		{opts: []interface{}{OptInterface("eth0"), OptRXRingSize(100)}, err: true},
+		{opts: []interface{}{OptInterface("eth0"), OptTXRingSize(0)}, err: true},
+		{opts: []interface{}{OptInterface("eth0"), OptXDPMode(8)}, err: true},
+		{opts: []interface{}{OptInterface("eth0"), OptBindMode(1)}, err: true},
+		{opts: []interface{}{OptInterface("eth0"), 5}, err: true},
+	} {
+		got, err := parseOptions(test.opts...)
+		t.Logf("got: %+v\nerr: %v", got, err)
+		if test.err && err == nil || !test.err && err != nil {
+			t.Errorf("%d error mismatch, want error? %v.  error: %v", i, test.err, err)
+		}
+		if !test.err && got != test.want {
+			t.Errorf("%d opts mismatch, want\n%+v", i, test.want)
+		}
+	}
+}
+
+// packetSocket returns an AF_PACKET socket bound to the interface.
+func packetSocket(t *testing.T, iface string) (int, int) {
+	link, err := netlink.LinkByName(iface)
+	if err != nil {
+		t.Fatal(err)
+	}
+	fd, err := unix.Socket(unix.AF_PACKET, unix.SOCK_RAW, int(htons(unix.ETH_P_ALL)))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := unix.Bind(fd, &unix.SockaddrLinklayer{Protocol: htons(unix.ETH_P_ALL), Ifindex: link.Attrs().Index}); err != nil {
+		unix.Close(fd)
+		t.Fatal(err)
+	}
+	tv := unix.NsecToTimeval(int64(time.Second))
+	if err := unix.SetsockoptTimeval(fd, unix.SOL_SOCKET, unix.SO_RCVTIMEO, &tv); err != nil {
+		unix.Close(fd)
+		t.Fatal(err)
+	}
+	return fd, link.Attrs().Index
+}
+
+func htons(i uint16) uint16 {
+	return (i<<8)&0xff00 | i>>8
+}
+
+func testFrame(i byte) []byte {
+	frame := make([]byte, 60)
+	copy(frame, []byte{0xff, 0xff, 0xff, 0xff, 0xff, 0xff, 0x02, 0, 0, 0, 0, 1, 0x88, 0xb5})
+	frame[14] = i
+	return frame
+}
+
+func TestSocket(t *testing.T) {
+	peerIface, iface, cleanup := testveth.Pair(t, "xdp")
+	defer cleanup()
+
+	s, err := NewSocket(OptInterface(iface), OptRXRingSize(64), OptTXRingSize(4), OptPollTimeout(time.Second), XDPModeGeneric, BindModeCopy)
+	if err != nil {
+		t.Skipf("can't open af_xdp socket: %v", err)
+	}
+	defer s.Close()
+	peer, peerIndex := packetSocket(t, peerIface)
+	defer unix.Close(peer)
+
+	// receive
+	for i := byte(0); i < 8; i++ {
+		if err := unix.Sendto(peer, testFrame(i), 0, &unix.SockaddrLinklayer{Ifindex: peerIndex, Halen: 6}); err != nil {
+			t.Fatal(err)
+		}
+	}
+	for i := byte(0); i < 8; {
+		data, ci, err := s.ZeroCopyReadPacketData()
+		if err != nil {
+			t.Fatalf("packet %d: %v", i, err)
+		}
+		if len(data) < 14 || data[12] != 0x88 || data[13] != 0xb5 {
+			// e.g. IPv6 neighbor discovery of the new interfaces
+			continue
+		}
+		if !bytes.Equal(data, testFrame(i)) {
+			t.Errorf("packet %d: got %x", i, data)
+		}
+		if ci.CaptureLength != 60 || ci.Length != 60 || ci.InterfaceIndex != s.ifindex {
+			t.Errorf("packet %d: bad capture info %+v", i, ci)
+		}
+		i++
+	}
+	if stats, _ := s.Stats(); stats.Packets < 8 {
+		t.Errorf("got %d packets", stats.Packets)
+	}
+	if ss, err := s.SocketStats(); err != nil || ss.RXDropped != 0 {
+		t.Errorf("socket stats %+v, %v", ss, err)
+	}
+
+	// transmit more packets than there are tx frames
+	for i := byte(0); i < 8; i++ {
+		if err := s.WritePacketData(testFrame(100 + i)); err != nil {
+			t.Fatalf("packet %d: %v", i, err)
+		}
+	}
+	// and as a batch
+	var batch [][]byte
+	for i := byte(8); i < 16; i++ {
+		batch = append(batch, testFrame(100+i))
+	}
+	if n, err := s.WritePacketDataBatch(batch); n != 8 || err != nil {
+		t.Fatalf("batch: wrote %d packets: %v", n, err)
+	}
+	buf := make([]byte, 2048)
+	for i := byte(0); i < 16; {
+		n, from, err := unix.Recvfrom(peer, buf, 0)
+		if err != nil {
+			t.Fatalf("packet %d: %v", i, err)
+		}
+		if from.(*unix.SockaddrLinklayer).Pkttype == unix.PACKET_OUTGOING || n < 14 || buf[12] != 0x88 || buf[13] != 0xb5 {
+			continue
+		}
+		if !bytes.Equal(buf[:n], testFrame(100+i)) {
+			t.Errorf("packet %d: got %x", i, buf[:n])
+		}
+		i++
+	}
+	if err := s.WritePacketData(make([]byte, 4096)); err == nil {
+		t.Error("oversized packet accepted")
+	}
+}
+
+func TestSharedProgram(t *testing.T) {
+	_, iface, cleanup := testveth.Pair(t, "xdp")
+	defer cleanup()
+
+	p, err := NewProgram(1)
+	if err != nil {
+		t.Skipf("can't load xdp program: %v", err)
+	}
+	defer p.Close()
+	link, err := netlink.LinkByName(iface)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := p.Attach(link.Attrs().Index, XDPModeGeneric); err != nil {
+		t.Fatal(err)
+	}
+	s, err := NewSocket(OptInterface(iface), p, BindModeCopy)
+	if err != nil {
+		t.Fatal(err)
+	}
+	s.Close()
+	// Closing the socket leaves a shared program attached.
+	if link, err = netlink.LinkByName(iface); err != nil {
+		t.Fatal(err)
+	}
+	if xdp := link.Attrs().Xdp; xdp == nil || !xdp.Attached {
+		t.Error("program detached by socket")
+	}
+	if err := p.Close(); err != nil {
+		t.Fatal(err)
+	}
+	if link, err = netlink.LinkByName(iface); err != nil {
+		t.Fatal(err)
+	}
+	if xdp := link.Attrs().Xdp; xdp != nil && xdp.Attached {
+		t.Error("program still attached")
+	}
+}
@@ -0,0 +1,190 @@
+// Copyright 2012 Google, Inc. All rights reserved.
+//
+// Use of this source code is governed by a BSD-style license
+// that can be found in the LICENSE file in the root of the source
+// tree.
+
+//go:build linux
+// +build linux
+
+package afxdp
+
+import (
+	"errors"
+	"fmt"
+	"time"
+
+	"golang.org/x/sys/unix"
+)
+
+// OptInterface is the interface to bind to.
+// It can be passed into NewSocket.
+type OptInterface string
+
+// OptQueueID is the receive and transmit queue of the interface to bind to.
+// It can be passed into NewSocket.
+type OptQueueID int
+
+// OptFrameSize is the size of a UMEM frame, which limits the size of a
+// packet.  It must be a power of two between 2048 and the page size.
+// It can be passed into NewSocket.
+type OptFrameSize int
+
+// OptRXRingSize is the number of descriptors of the RX and fill rings.  The
+// same number of UMEM frames is used for receiving packets.  It must be a
+// power of two.
+// It can be passed into NewSocket.
+type OptRXRingSize int
+
+// OptTXRingSize is the number of descriptors of the TX and completion rings.
+// The same number of UMEM frames is used for transmitting packets.  It must
+// be a power of two.
+// It can be passed into NewSocket.
+type OptTXRingSize int
+
+// OptPollTimeout is the time ZeroCopyReadPacketData and WritePacketData
+// wait for the rings, after which ErrTimeout is returned.  A negative value
+// waits forever.
+// It can be passed into NewSocket.
+type OptPollTimeout time.Duration
+
+// OptXDPMode is the mode the XDP program is attached in.
+// It can be passed into NewSocket.
+type OptXDPMode int
+
+// String returns a string representation of the mode.
+func (m OptXDPMode) String() string {
+	switch m {
+	case XDPModeAuto:
+		return "Auto"
+	case XDPModeGeneric:
+		return "Generic"
+	case XDPModeDriver:
+		return "Driver"
+	}
+	return "UnknownXDPMode"
+}
+
+// XDP modes for use with NewSocket and Program.Attach.
+const (
+	// XDPModeAuto uses the driver mode if the driver supports XDP, and the
+	// generic mode otherwise.
+	XDPModeAuto = OptXDPMode(0)
+	// XDPModeGeneric (SKB mode) works with every interface, but packets are
+	// copied after the kernel allocated a socket buffer for them.
+	XDPModeGeneric = OptXDPMode(unix.XDP_FLAGS_SKB_MODE)
+	// XDPModeDriver runs the program in the driver, before any allocation.
+	XDPModeDriver = OptXDPMode(unix.XDP_FLAGS_DRV_MODE)
+)
+
+// OptBindMode selects whether packets are copied between the driver and the
+// UMEM.
+// It can be passed into NewSocket.
+type OptBindMode int
+
+// String returns a string representation of the bind mode.
+func (m OptBindMode) String() string {
+	switch m {
+	case BindModeAuto:
+		return "Auto"
+	case BindModeCopy:
+		return "Copy"
+	case BindModeZeroCopy:
+		return "ZeroCopy"
+	}
+	return "UnknownBindMode"
+}
+
+// Bind modes for use with NewSocket.
+const (
+	// BindModeAuto uses zero copy if the driver supports it.
+	BindModeAuto = OptBindMode(0)
+	// BindModeCopy always copies the packets.  This is the only mode
+	// available with XDPModeGeneric.
+	BindModeCopy = OptBindMode(unix.XDP_COPY)
+	// BindModeZeroCopy lets the driver use the UMEM directly, and fails if
+	// the driver doesn't support it.
+	BindModeZeroCopy = OptBindMode(unix.XDP_ZEROCOPY)
+)
+
+// Default constants used by options.
+const (
+	DefaultFrameSize   = 2048                  // Default value for OptFrameSize.
+	DefaultRXRingSize  = 2048                  // Default value for OptRXRingSize.
+	DefaultTXRingSize  = 2048                  // Default value for OptTXRingSize.
+	DefaultPollTimeout = -1 * time.Millisecond // Default value for OptPollTimeout. This blocks forever.
+)
+
+type options struct {
+	iface       string
+	queueID     int
+	frameSize   int
+	rxRingSize  int
+	txRingSize  int
+	pollTimeout time.Duration
+	xdpMode     OptXDPMode
+	bindMode    OptBindMode
+	program     *Program
+}
+
+var defaultOpts = options{
+	frameSize:   DefaultFrameSize,
+	rxRingSize:  DefaultRXRingSize,
+	txRingSize:  DefaultTXRingSize,
+	pollTimeout: DefaultPollTimeout,
+}
+
+func parseOptions(opts ...interface{}) (ret options, err error) {
+	ret = defaultOpts
+	for _, opt := range opts {
+		switch v := opt.(type) {
+		case OptInterface:
+			ret.iface = string(v)
+		case OptQueueID:
+			ret.queueID = int(v)
+		case OptFrameSize:
+			ret.frameSize = int(v)
+		case OptRXRingSize:
+			ret.rxRingSize = int(v)
+		case OptTXRingSize:
+			ret.txRingSize = int(v)
+		case OptPollTimeout:
+			ret.pollTimeout = time.Duration(v)
+		case OptXDPMode:
+			ret.xdpMode = v
+		case OptBindMode:
+			ret.bindMode = v
+		case *Program:
+			ret.program = v
+		default:
+			err = errors.New("unknown type in options")
+			return
+		}
+	}
+	err = ret.check()
+	return
+}
+
+func isPowerOfTwo(x int) bool {
+	return x > 0 && x&(x-1) == 0
+}
+
+func (o options) check() error {
+	switch {
+	case o.iface == "":
+		return errors.New("no interface given")
+	case o.queueID < 0:
+		return fmt.Errorf("queue id %d must be >= 0", o.queueID)
+	case !isPowerOfTwo(o.frameSize) || o.frameSize < 2048 || o.frameSize > unix.Getpagesize():
+		return fmt.Errorf("frame size %d must be a power of two between 2048 and page size %d", o.frameSize, unix.Getpagesize())
+	case !isPowerOfTwo(o.rxRingSize):
+		return fmt.Errorf("rx ring size %d must be a power of two", o.rxRingSize)
+	case !isPowerOfTwo(o.txRingSize):
+		return fmt.Errorf("tx ring size %d must be a power of two", o.txRingSize)
+	case o.xdpMode != XDPModeAuto && o.xdpMode != XDPModeGeneric && o.xdpMode != XDPModeDriver:
+		return fmt.Errorf("xdp mode %v is invalid", o.xdpMode)
+	case o.bindMode != BindModeAuto && o.bindMode != BindModeCopy && o.bindMode != BindModeZeroCopy:
+		return fmt.Errorf("bind mode %v is invalid", o.bindMode)
+	}
+	return nil
+}
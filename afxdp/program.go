@@ -0,0 +1,239 @@
+// Copyright 2012 Google, Inc. All rights reserved.
+//
+// Use of this source code is governed by a BSD-style license
+// that can be found in the LICENSE file in the root of the source
+// tree.
+
+//go:build linux
+// +build linux
+
+package afxdp
+
+import (
+	"bytes"
+	"fmt"
+	"runtime"
+	"sync"
+	"unsafe"
+
+	"github.com/vishvananda/netlink"
+	"golang.org/x/sys/unix"
+)
+
+// bpfInstruction is struct bpf_insn.
+type bpfInstruction struct {
+	code uint8
+	regs uint8 // dst_reg:4, src_reg:4
+	off  int16
+	imm  int32
+}
+
+// eBPF opcodes and helpers used by the redirect program
+const (
+	bpfLdxMemW        = unix.BPF_LDX | unix.BPF_MEM | unix.BPF_W
+	bpfLdImm64        = unix.BPF_LD | unix.BPF_IMM | 0x18 // BPF_DW
+	bpfMov64Imm       = 0x07 | 0xb0 | unix.BPF_K          // BPF_ALU64 | BPF_MOV | BPF_K
+	bpfCall           = 0x05 | 0x80                       // BPF_JMP | BPF_CALL
+	bpfExit           = 0x05 | 0x90                       // BPF_JMP | BPF_EXIT
+	bpfFuncRedirectMp = 51                                // bpf_redirect_map
+	xdpPass           = 2                                 // XDP_PASS
+	xdpMdRxQueueIndex = 16                                // offsetof(struct xdp_md, rx_queue_index)
+)
+
+// redirectProgram returns the instructions of
+//
+//	return bpf_redirect_map(&xsks_map, ctx->rx_queue_index, XDP_PASS);
+//
+// which redirects the packets of every queue with a socket in the map to that socket, and passes all other packets to the network
+// stack.  Using the lower bits of the flags as the action for missing entries needs Linux 5.3.
+func redirectProgram(mapFd int) []bpfInstruction {
+	return []bpfInstruction{
+		{code: bpfLdxMemW, regs: 2 | 1<<4, off: xdpMdRxQueueIndex}, // r2 = ctx->rx_queue_index
+		{code: bpfLdImm64, regs: 1 | unix.BPF_PSEUDO_MAP_FD<<4, imm: int32(mapFd)},
+		{}, // second half of the 64 bit immediate
+		{code: bpfMov64Imm, regs: 3, imm: xdpPass}, // r3 = XDP_PASS
+		{code: bpfCall, imm: bpfFuncRedirectMp},
+		{code: bpfExit},
+	}
+}
+
+// bpfMapCreateAttr is the part of union bpf_attr used by BPF_MAP_CREATE.
+type bpfMapCreateAttr struct {
+	mapType    uint32
+	keySize    uint32
+	valueSize  uint32
+	maxEntries uint32
+	mapFlags   uint32
+}
+
+// bpfMapElemAttr is the part of union bpf_attr used by BPF_MAP_*_ELEM.
+type bpfMapElemAttr struct {
+	mapFd uint32
+	_     uint32
+	key   uint64
+	value uint64
+	flags uint64
+}
+
+// bpfProgLoadAttr is the part of union bpf_attr used by BPF_PROG_LOAD.
+type bpfProgLoadAttr struct {
+	progType    uint32
+	insnCnt     uint32
+	insns       uint64
+	license     uint64
+	logLevel    uint32
+	logSize     uint32
+	logBuf      uint64
+	kernVersion uint32
+	progFlags   uint32
+	progName    [unix.BPF_OBJ_NAME_LEN]byte
+}
+
+func bpf(cmd int, attr unsafe.Pointer, size uintptr) (int, error) {
+	r, _, errno := unix.Syscall(unix.SYS_BPF, uintptr(cmd), uintptr(attr), size)
+	if errno != 0 {
+		return -1, errno
+	}
+	return int(r), nil
+}
+
+// Program is an XDP program redirecting the packets of the queues of an interface to the AF_XDP sockets registered for them.  Unless a
+// Program is passed to NewSocket, every socket loads and attaches its own Program.  As an interface has only one XDP program, sockets
+// for several queues of the same interface need to share a Program.
+type Program struct {
+	mu      sync.Mutex
+	progFd  int
+	mapFd   int
+	ifindex int
+	flags   int
+}
+
+// NewProgram creates the queue to socket map (BPF_MAP_TYPE_XSKMAP) for queues 0 to maxQueues-1, and loads the redirect program.
+func NewProgram(maxQueues int) (*Program, error) {
+	if maxQueues < 1 {
+		return nil, fmt.Errorf("max queues %d must be >= 1", maxQueues)
+	}
+	mattr := bpfMapCreateAttr{
+		mapType:    unix.BPF_MAP_TYPE_XSKMAP,
+		keySize:    4,
+		valueSize:  4,
+		maxEntries: uint32(maxQueues),
+	}
+	mapFd, err := bpf(unix.BPF_MAP_CREATE, unsafe.Pointer(&mattr), unsafe.Sizeof(mattr))
+	if err != nil {
+		return nil, fmt.Errorf("bpf map create: %v", err)
+	}
+	insns := redirectProgram(mapFd)
+	license := []byte("Dual BSD/GPL\x00")
+	log := make([]byte, 4096)
+	pattr := bpfProgLoadAttr{
+		progType: unix.BPF_PROG_TYPE_XDP,
+		insnCnt:  uint32(len(insns)),
+		insns:    uint64(uintptr(unsafe.Pointer(&insns[0]))),
+		license:  uint64(uintptr(unsafe.Pointer(&license[0]))),
+		logLevel: 1,
+		logSize:  uint32(len(log)),
+		logBuf:   uint64(uintptr(unsafe.Pointer(&log[0]))),
+	}
+	copy(pattr.progName[:], "xsk_redirect")
+	progFd, err := bpf(unix.BPF_PROG_LOAD, unsafe.Pointer(&pattr), unsafe.Sizeof(pattr))
+	runtime.KeepAlive(insns)
+	runtime.KeepAlive(license)
+	runtime.KeepAlive(log)
+	if err != nil {
+		unix.Close(mapFd)
+		if n := bytes.IndexByte(log, 0); n >= 0 {
+			log = log[:n]
+		}
+		return nil, fmt.Errorf("bpf prog load: %v: %s", err, log)
+	}
+	p := &Program{
+		progFd:  progFd,
+		mapFd:   mapFd,
+		ifindex: -1,
+	}
+	runtime.SetFinalizer(p, (*Program).Close)
+	return p, nil
+}
+
+// Attach attaches the program to the interface.  If the interface already has an XDP program, it is replaced.
+func (p *Program) Attach(ifindex int, mode OptXDPMode) error {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	link, err := netlink.LinkByIndex(ifindex)
+	if err != nil {
+		return err
+	}
+	if err := netlink.LinkSetXdpFdWithFlags(link, p.progFd, int(mode)); err != nil {
+		return fmt.Errorf("attaching xdp program in %v mode: %v", mode, err)
+	}
+	p.ifindex = ifindex
+	p.flags = int(mode)
+	return nil
+}
+
+// Detach removes the program from the interface it was attached to.
+func (p *Program) Detach() error {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	return p.detach()
+}
+
+func (p *Program) detach() error {
+	if p.ifindex < 0 {
+		return nil
+	}
+	link, err := netlink.LinkByIndex(p.ifindex)
+	if err != nil {
+		return err
+	}
+	p.ifindex = -1
+	return netlink.LinkSetXdpFdWithFlags(link, -1, p.flags)
+}
+
+// Register redirects the packets of the queue to the AF_XDP socket fd.
+func (p *Program) Register(queueID, fd int) error {
+	key, value := uint32(queueID), uint32(fd)
+	attr := bpfMapElemAttr{
+		mapFd: uint32(p.mapFd),
+		key:   uint64(uintptr(unsafe.Pointer(&key))),
+		value: uint64(uintptr(unsafe.Pointer(&value))),
+	}
+	_, err := bpf(unix.BPF_MAP_UPDATE_ELEM, unsafe.Pointer(&attr), unsafe.Sizeof(attr))
+	runtime.KeepAlive(&key)
+	runtime.KeepAlive(&value)
+	if err != nil {
+		return fmt.Errorf("bpf map update: %v", err)
+	}
+	return nil
+}
+
+// Unregister passes the packets of the queue to the network stack again.
+func (p *Program) Unregister(queueID int) error {
+	key := uint32(queueID)
+	attr := bpfMapElemAttr{
+		mapFd: uint32(p.mapFd),
+		key:   uint64(uintptr(unsafe.Pointer(&key))),
+	}
+	_, err := bpf(unix.BPF_MAP_DELETE_ELEM, unsafe.Pointer(&attr), unsafe.Sizeof(attr))
+	runtime.KeepAlive(&key)
+	if err != nil && err != unix.ENOENT {
+		return fmt.Errorf("bpf map delete: %v", err)
+	}
+	return nil
+}
+
+// Close detaches the program, and releases the program and the map.
+func (p *Program) Close() error {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	if p.progFd == -1 {
+		return nil
+	}
+	err := p.detach()
+	unix.Close(p.progFd)
+	unix.Close(p.mapFd)
+	p.progFd, p.mapFd = -1, -1
+	runtime.SetFinalizer(p, nil)
+	return err
+}
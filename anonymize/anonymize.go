@@ -0,0 +1,498 @@
+// Copyright 2012 Google, Inc. All rights reserved.
+//
+// Use of this source code is governed by a BSD-style license
+// that can be found in the LICENSE file in the root of the source
+// tree.
+
+// Package anonymize removes sensitive information from captured packets, so
+// that captures can be shared.
+//
+// IPv4 and IPv6 addresses are anonymized with the keyed, prefix-preserving
+// Crypto-PAn scheme, so that the structure of the networks is kept: hosts in
+// the same subnet stay in the same (anonymized) subnet.  MAC addresses are
+// replaced by keyed pseudonyms, optionally keeping the vendor part (OUI).
+// Payloads above a chosen layer can be zeroed.
+//
+// Besides the Ethernet, IPv4 and IPv6 headers, addresses are anonymized
+// consistently in ARP packets, the packets quoted by ICMP and ICMPv6 errors,
+// ICMP redirects, IPv6 neighbor discovery, DNS A and AAAA records, and DHCPv4
+// messages.  Checksums are recomputed.  Other places addresses can appear,
+// like IP options or host names, are not changed.
+//
+// Usage:
+//
+//	a, _ := anonymize.New(anonymize.Options{Key: key, PreserveOUI: true, Scrub: anonymize.ScrubAboveTransport})
+//	src, _ := pcapgo.NewReader(in)
+//	dst := pcapgo.NewWriter(out)
+//	dst.WriteFileHeader(65536, layers.LinkTypeEthernet)
+//	n, err := a.Copy(dst, src)
+package anonymize
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/binary"
+	"fmt"
+	"hash/crc32"
+	"io"
+	"net"
+
+	"github.com/davidsonff/gopacket"
+	"github.com/davidsonff/gopacket/layers"
+)
+
+// ScrubLevel selects the payloads which are zeroed.
+type ScrubLevel int
+
+// ScrubLevel values.
+const (
+	// ScrubNone keeps all payloads.
+	ScrubNone ScrubLevel = iota
+	// ScrubAboveTransport zeroes the data carried by TCP, UDP, SCTP, ICMP
+	// and ICMPv6.  The packets quoted by ICMP errors are anonymized instead.
+	ScrubAboveTransport
+	// ScrubAboveNetwork zeroes everything after the IPv4 and IPv6 headers.
+	ScrubAboveNetwork
+)
+
+// Options configures an Anonymizer.
+type Options struct {
+	// Key is the secret key of KeySize bytes.  It is used for Crypto-PAn, and
+	// to derive the MAC pseudonyms.  Captures anonymized with the same key
+	// use the same addresses.
+	Key []byte
+	// PreserveOUI keeps the first three bytes of MAC addresses, which
+	// identify the vendor of the interface.
+	PreserveOUI bool
+	// Scrub selects the payloads which are zeroed.
+	Scrub ScrubLevel
+}
+
+// Anonymizer anonymizes packets.  It is safe for concurrent use.
+type Anonymizer struct {
+	opts    Options
+	pan     *CryptoPAn
+	decoder gopacket.Decoder
+}
+
+// New returns an Anonymizer for Ethernet packets.
+func New(opts Options) (*Anonymizer, error) {
+	return NewWithDecoder(opts, layers.LayerTypeEthernet)
+}
+
+// NewWithDecoder returns an Anonymizer decoding packets with the given
+// decoder, for example layers.LinkTypeRaw.
+func NewWithDecoder(opts Options, decoder gopacket.Decoder) (*Anonymizer, error) {
+	pan, err := NewCryptoPAn(opts.Key)
+	if err != nil {
+		return nil, err
+	}
+	opts.Key = append([]byte(nil), opts.Key...)
+	return &Anonymizer{opts: opts, pan: pan, decoder: decoder}, nil
+}
+
+// IP returns the anonymized address of ip.  The unspecified, broadcast and
+// multicast addresses are returned unchanged, since they carry no information
+// about the network, and protocols rely on them.
+func (a *Anonymizer) IP(ip net.IP) net.IP {
+	if ip.IsUnspecified() || ip.Equal(net.IPv4bcast) || ip.IsMulticast() {
+		return ip
+	}
+	return a.pan.Anonymize(ip)
+}
+
+// MAC returns the pseudonym of mac.  Broadcast and multicast addresses are
+// returned unchanged.  Without Options.PreserveOUI, pseudonyms are locally
+// administered addresses.
+func (a *Anonymizer) MAC(mac net.HardwareAddr) net.HardwareAddr {
+	if len(mac) != 6 || mac[0]&0x01 != 0 {
+		return mac
+	}
+	h := hmac.New(sha256.New, a.opts.Key)
+	h.Write([]byte("mac"))
+	h.Write(mac)
+	sum := h.Sum(nil)
+	ret := make(net.HardwareAddr, 6)
+	if a.opts.PreserveOUI {
+		copy(ret, mac[:3])
+		copy(ret[3:], sum)
+	} else {
+		copy(ret, sum)
+		ret[0] = ret[0]&^0x01 | 0x02
+	}
+	return ret
+}
+
+// ip anonymizes the address in place.  IPv4-mapped IPv6 addresses are
+// anonymized like the IPv4 address they hold, and keep their ::ffff: prefix.
+func (a *Anonymizer) ip(ip []byte) {
+	if len(ip) == net.IPv4len || len(ip) == net.IPv6len {
+		anon := a.IP(net.IP(ip))
+		copy(ip[len(ip)-len(anon):], anon)
+	}
+}
+
+// mac anonymizes the MAC address in place.
+func (a *Anonymizer) mac(mac []byte) {
+	copy(mac, a.MAC(net.HardwareAddr(mac)))
+}
+
+var castagnoli = crc32.MakeTable(crc32.Castagnoli)
+
+// Anonymize returns an anonymized copy of the packet data.  The packet keeps
+// its length.  The bytes from the first layer which fails to decode onwards
+// are zeroed, since their addresses can't be found.
+func (a *Anonymizer) Anonymize(data []byte) []byte {
+	return a.anonymize(data, false)
+}
+
+// anonymize returns an anonymized copy of data.  Checksums are not computed
+// for truncated packets.
+func (a *Anonymizer) anonymize(data []byte, truncated bool) []byte {
+	buf := append([]byte(nil), data...)
+	p := gopacket.NewPacket(buf, a.decoder, gopacket.NoCopy)
+	a.layers(p.Layers(), truncated || p.Metadata().Truncated, false)
+	return buf
+}
+
+// layers anonymizes the decoded layers in place, and recomputes their
+// checksums.  The transport checksums of truncated and quoted packets can't
+// be computed.
+func (a *Anonymizer) layers(ls []gopacket.Layer, truncated, quoted bool) {
+	var network gopacket.NetworkLayer
+	for i, l := range ls {
+		switch l := l.(type) {
+		case *gopacket.DecodeFailure:
+			zero(l.LayerContents())
+			zero(undecoded(ls[:i]))
+			return
+		case *layers.Ethernet:
+			a.mac(l.SrcMAC)
+			a.mac(l.DstMAC)
+		case *layers.ARP:
+			if l.HwAddressSize == 6 {
+				a.mac(l.SourceHwAddress)
+				a.mac(l.DstHwAddress)
+			}
+			if l.Protocol == layers.EthernetTypeIPv4 && l.ProtAddressSize == 4 {
+				a.ip(l.SourceProtAddress)
+				a.ip(l.DstProtAddress)
+			}
+		case *layers.IPv4:
+			a.ip(l.SrcIP)
+			a.ip(l.DstIP)
+			if header := l.LayerContents(); len(header) >= 20 {
+				header[10], header[11] = 0, 0
+				binary.BigEndian.PutUint16(header[10:], checksum(header, 0))
+			}
+			network = l
+			if a.opts.Scrub == ScrubAboveNetwork {
+				zero(l.LayerPayload())
+				return
+			}
+		case *layers.IPv6:
+			a.ip(l.SrcIP)
+			a.ip(l.DstIP)
+			network = l
+			if a.opts.Scrub == ScrubAboveNetwork {
+				zero(l.LayerPayload())
+				return
+			}
+		case *layers.ICMPv4:
+			a.icmpv4(l)
+			a.fixChecksum(l, 2, nil, 0, truncated || quoted)
+			return
+		case *layers.ICMPv6:
+			a.icmpv6(l)
+			a.fixChecksum(l, 2, network, layers.IPProtocolICMPv6, truncated || quoted)
+			return
+		case *layers.UDP:
+			if a.opts.Scrub == ScrubNone && (l.SrcPort == 67 || l.SrcPort == 68 || l.DstPort == 67 || l.DstPort == 68) {
+				a.dhcpv4(l.LayerPayload())
+			}
+			if a.opts.Scrub == ScrubNone {
+				// DNS follows
+				defer a.fixChecksum(l, 6, network, layers.IPProtocolUDP, truncated || quoted || l.Checksum == 0)
+				continue
+			}
+			zero(l.LayerPayload())
+			a.fixChecksum(l, 6, network, layers.IPProtocolUDP, truncated || quoted || l.Checksum == 0)
+			return
+		case *layers.TCP:
+			if a.opts.Scrub != ScrubNone {
+				zero(l.LayerPayload())
+			}
+			a.fixChecksum(l, 16, network, layers.IPProtocolTCP, truncated || quoted)
+			return
+		case *layers.SCTP:
+			// The CRC32c covers only the SCTP packet, not the addresses.
+			if a.opts.Scrub != ScrubNone {
+				zero(l.LayerPayload())
+				if !truncated && !quoted {
+					header := l.LayerContents()
+					segment := header[:len(header)+len(l.LayerPayload())]
+					header[8], header[9], header[10], header[11] = 0, 0, 0, 0
+					binary.LittleEndian.PutUint32(header[8:], crc32.Checksum(segment, castagnoli))
+				}
+			}
+			return
+		case *layers.DNS:
+			for _, rrs := range [][]layers.DNSResourceRecord{l.Answers, l.Authorities, l.Additionals} {
+				for _, rr := range rrs {
+					if rr.Type == layers.DNSTypeA || rr.Type == layers.DNSTypeAAAA {
+						a.ip(rr.IP)
+					}
+				}
+			}
+		}
+	}
+}
+
+// undecoded returns the bytes following the last layer of ls which was
+// decoded.  Some decoders add their layer with empty contents when they fail,
+// like IPv4 for a short header.
+func undecoded(ls []gopacket.Layer) []byte {
+	for i := len(ls) - 1; i >= 0; i-- {
+		if len(ls[i].LayerContents()) > 0 {
+			return ls[i].LayerPayload()
+		}
+	}
+	return nil
+}
+
+// icmpv4 anonymizes the addresses in an ICMP message.
+func (a *Anonymizer) icmpv4(l *layers.ICMPv4) {
+	payload := l.LayerPayload()
+	switch l.TypeCode.Type() {
+	case layers.ICMPv4TypeRedirect:
+		// the gateway address
+		a.ip(l.LayerContents()[4:8])
+		fallthrough
+	case layers.ICMPv4TypeDestinationUnreachable, layers.ICMPv4TypeSourceQuench, layers.ICMPv4TypeTimeExceeded,
+		layers.ICMPv4TypeParameterProblem:
+		a.quoted(payload, layers.LayerTypeIPv4)
+	default:
+		if a.opts.Scrub != ScrubNone {
+			zero(payload)
+		}
+	}
+}
+
+// icmpv6 anonymizes the addresses in an ICMPv6 message.
+func (a *Anonymizer) icmpv6(l *layers.ICMPv6) {
+	// payload starts after type, code and checksum
+	payload := l.LayerPayload()
+	if len(payload) < 4 {
+		return
+	}
+	switch l.TypeCode.Type() {
+	case layers.ICMPv6TypeDestinationUnreachable, layers.ICMPv6TypePacketTooBig, layers.ICMPv6TypeTimeExceeded,
+		layers.ICMPv6TypeParameterProblem:
+		a.quoted(payload[4:], layers.LayerTypeIPv6)
+	case layers.ICMPv6TypeRouterSolicitation:
+		a.ndpOptions(payload[4:])
+	case layers.ICMPv6TypeRouterAdvertisement:
+		if len(payload) >= 12 {
+			a.ndpOptions(payload[12:])
+		}
+	case layers.ICMPv6TypeNeighborSolicitation, layers.ICMPv6TypeNeighborAdvertisement:
+		if len(payload) >= 20 {
+			a.ip(payload[4:20])
+			a.ndpOptions(payload[20:])
+		}
+	case layers.ICMPv6TypeRedirect:
+		if len(payload) >= 36 {
+			a.ip(payload[4:20])
+			a.ip(payload[20:36])
+			a.ndpOptions(payload[36:])
+		}
+	default:
+		if a.opts.Scrub != ScrubNone {
+			zero(payload)
+		}
+	}
+}
+
+// ndpOptions anonymizes the link-layer addresses in neighbor discovery
+// options.
+func (a *Anonymizer) ndpOptions(opts []byte) {
+	for len(opts) >= 8 {
+		n := int(opts[1]) * 8
+		if n == 0 || n > len(opts) {
+			return
+		}
+		switch opts[0] {
+		case 1, 2: // source and target link-layer address
+			a.mac(opts[2:8])
+		case 4: // redirected header
+			a.quoted(opts[8:n], layers.LayerTypeIPv6)
+		}
+		opts = opts[n:]
+	}
+}
+
+// quoted anonymizes the start of a packet quoted in an ICMP error.
+func (a *Anonymizer) quoted(data []byte, first gopacket.LayerType) {
+	p := gopacket.NewPacket(data, first, gopacket.NoCopy)
+	a.layers(p.Layers(), true, true)
+}
+
+// DHCPv4 options carrying addresses
+var dhcpAddressOptions = map[byte]bool{
+	3:   true, // router
+	4:   true, // time server
+	5:   true, // name server
+	6:   true, // domain name server
+	7:   true, // log server
+	28:  true, // broadcast address
+	42:  true, // NTP servers
+	44:  true, // NetBIOS name servers
+	50:  true, // requested IP address
+	54:  true, // server identifier
+	118: true, // subnet selection
+}
+
+// dhcpv4 anonymizes the addresses of a DHCPv4 message.
+func (a *Anonymizer) dhcpv4(msg []byte) {
+	if len(msg) < 240 || binary.BigEndian.Uint32(msg[236:240]) != 0x63825363 {
+		return
+	}
+	// ciaddr, yiaddr, siaddr, giaddr
+	for i := 12; i < 28; i += 4 {
+		a.ip(msg[i : i+4])
+	}
+	if layers.LinkType(msg[1]) == layers.LinkTypeEthernet && msg[2] == 6 {
+		a.mac(msg[28:34])
+	}
+	opts := msg[240:]
+	for len(opts) > 0 {
+		code := opts[0]
+		if code == 0 {
+			opts = opts[1:]
+			continue
+		}
+		if code == 255 || len(opts) < 2 || int(opts[1]) > len(opts)-2 {
+			return
+		}
+		n := 2 + int(opts[1])
+		data := opts[2:n]
+		switch {
+		case dhcpAddressOptions[code]:
+			for len(data) >= 4 {
+				a.ip(data[:4])
+				data = data[4:]
+			}
+		case code == 61 && len(data) == 7 && data[0] == 1: // client identifier with a MAC
+			a.mac(data[1:])
+		}
+		opts = opts[n:]
+	}
+}
+
+func zero(b []byte) {
+	for i := range b {
+		b[i] = 0
+	}
+}
+
+// fixChecksum recomputes the checksum at offset off of the header of a
+// transport layer.  With a network layer, the checksum includes the pseudo
+// header.
+func (a *Anonymizer) fixChecksum(l gopacket.Layer, off int, network gopacket.NetworkLayer, proto layers.IPProtocol, skip bool) {
+	header := l.LayerContents()
+	if skip || len(header) < off+2 {
+		return
+	}
+	// The payload follows the header in the same buffer.
+	segment := header[:len(header)+len(l.LayerPayload())]
+	var sum uint32
+	switch n := network.(type) {
+	case *layers.IPv4:
+		sum = pseudoHeaderSum(n.SrcIP, n.DstIP, proto, len(segment))
+	case *layers.IPv6:
+		sum = pseudoHeaderSum(n.SrcIP, n.DstIP, proto, len(segment))
+	case nil:
+	default:
+		return
+	}
+	header[off], header[off+1] = 0, 0
+	c := checksum(segment, sum)
+	if c == 0 && proto == layers.IPProtocolUDP {
+		c = 0xffff
+	}
+	binary.BigEndian.PutUint16(header[off:], c)
+}
+
+func pseudoHeaderSum(src, dst []byte, proto layers.IPProtocol, length int) uint32 {
+	var sum uint32
+	for _, addr := range [][]byte{src, dst} {
+		for i := 0; i+1 < len(addr); i += 2 {
+			sum += uint32(addr[i])<<8 | uint32(addr[i+1])
+		}
+	}
+	return sum + uint32(proto) + uint32(length)&0xffff + uint32(length)>>16
+}
+
+// checksum returns the Internet checksum of data, starting with sum.
+func checksum(data []byte, sum uint32) uint16 {
+	for ; len(data) >= 2; data = data[2:] {
+		sum += uint32(data[0])<<8 | uint32(data[1])
+	}
+	if len(data) == 1 {
+		sum += uint32(data[0]) << 8
+	}
+	for sum > 0xffff {
+		sum = sum&0xffff + sum>>16
+	}
+	return ^uint16(sum)
+}
+
+type writer struct {
+	a *Anonymizer
+	w gopacket.PacketDataWriter
+}
+
+func (w writer) WritePacket(ci gopacket.CaptureInfo, data []byte) error {
+	return w.w.WritePacket(ci, w.a.anonymize(data, ci.CaptureLength < ci.Length))
+}
+
+func (w writer) WritePackets(ci []gopacket.CaptureInfo, data [][]byte) (int, error) {
+	if len(ci) != len(data) {
+		return 0, fmt.Errorf("batch has %d capture infos for %d packets", len(ci), len(data))
+	}
+	out := make([][]byte, len(data))
+	for i := range data {
+		out[i] = w.a.anonymize(data[i], ci[i].CaptureLength < ci[i].Length)
+	}
+	return w.w.WritePackets(ci, out)
+}
+
+func (w writer) Close() error {
+	return w.w.Close()
+}
+
+// Writer returns a gopacket.PacketDataWriter which anonymizes every packet
+// before passing it to w, for example a pcapgo.Writer or pcapgo.NgWriter.  w
+// is wrapped with gopacket.NewPacketDataWriter, so Close closes or flushes it.
+func (a *Anonymizer) Writer(w gopacket.CaptureInfoWriter) gopacket.PacketDataWriter {
+	return writer{a, gopacket.NewPacketDataWriter(w)}
+}
+
+// Copy anonymizes all packets of src until io.EOF, writes them to dst, and
+// returns the number of packets written.
+func (a *Anonymizer) Copy(dst gopacket.CaptureInfoWriter, src gopacket.PacketDataSource) (int, error) {
+	n := 0
+	for {
+		data, ci, err := src.ReadPacketData()
+		if err == io.EOF {
+			return n, nil
+		}
+		if err != nil {
+			return n, err
+		}
+		if err := dst.WritePacket(ci, a.anonymize(data, ci.CaptureLength < ci.Length)); err != nil {
+			return n, err
+		}
+		n++
+	}
+}
@@ -0,0 +1,467 @@
+// Copyright 2012 Google, Inc. All rights reserved.
+//
+// Use of this source code is governed by a BSD-style license
+// that can be found in the LICENSE file in the root of the source
+// tree.
+
+package anonymize
+
+import (
+	"bytes"
+	"encoding/binary"
+	"io"
+	"net"
+	"testing"
+
+	"github.com/davidsonff/gopacket"
+	"github.com/davidsonff/gopacket/layers"
+)
+
+// The key and vectors of the reference implementation.
+var testKey = []byte{21, 34, 23, 141, 51, 164, 207, 128, 19, 10, 91, 22, 73, 144, 125, 16,
+	216, 152, 143, 131, 121, 121, 101, 39, 98, 87, 76, 45, 42, 132, 34, 2}
+
+func TestCryptoPAn(t *testing.T) {
+	c, err := NewCryptoPAn(testKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, test := range []struct{ in, want string }{
+		{"128.11.68.132", "135.242.180.132"},
+		{"129.118.74.4", "134.136.186.123"},
+		{"130.132.252.244", "133.68.164.234"},
+		{"141.223.7.43", "141.167.8.160"},
+		{"24.0.250.221", "100.15.198.226"},
+		{"64.14.118.196", "0.255.183.58"},
+	} {
+		if got := c.Anonymize(net.ParseIP(test.in)); !got.Equal(net.ParseIP(test.want)) {
+			t.Errorf("%s: got %s, want %s", test.in, got, test.want)
+		}
+	}
+	if _, err := NewCryptoPAn(testKey[:16]); err == nil {
+		t.Error("short key accepted")
+	}
+}
+
+// commonPrefix returns the number of leading bits a and b have in common.
+func commonPrefix(a, b net.IP) int {
+	for i := range a {
+		if x := a[i] ^ b[i]; x != 0 {
+			n := i * 8
+			for ; x&0x80 == 0; x <<= 1 {
+				n++
+			}
+			return n
+		}
+	}
+	return len(a) * 8
+}
+
+func TestCryptoPAnPrefix(t *testing.T) {
+	c, _ := NewCryptoPAn(testKey)
+	addrs := []string{
+		"10.0.0.1", "10.0.0.2", "10.0.1.1", "10.128.0.1", "192.168.1.1", "11.0.0.1",
+		"2001:db8::1", "2001:db8::2", "2001:db8:1::1", "fe80::1",
+	}
+	for _, x := range addrs {
+		for _, y := range addrs {
+			a, b := net.ParseIP(x), net.ParseIP(y)
+			if (a.To4() == nil) != (b.To4() == nil) {
+				continue
+			}
+			if v4 := a.To4(); v4 != nil {
+				a, b = v4, b.To4()
+			}
+			if got, want := commonPrefix(c.Anonymize(a), c.Anonymize(b)), commonPrefix(a, b); got != want {
+				t.Errorf("%s, %s: common prefix %d, want %d", x, y, got, want)
+			}
+		}
+	}
+}
+
+func TestMAC(t *testing.T) {
+	mac := net.HardwareAddr{0x00, 0x1b, 0x21, 0x12, 0x34, 0x56}
+	other := net.HardwareAddr{0x00, 0x1b, 0x21, 0x12, 0x34, 0x57}
+	a, _ := New(Options{Key: testKey})
+	got := a.MAC(mac)
+	if bytes.Equal(got, mac) || !bytes.Equal(got, a.MAC(mac)) || bytes.Equal(got, a.MAC(other)) {
+		t.Errorf("bad pseudonyms %v %v", got, a.MAC(other))
+	}
+	if got[0]&0x03 != 0x02 {
+		t.Errorf("%v is not a locally administered unicast address", got)
+	}
+	if bcast := (net.HardwareAddr{0xff, 0xff, 0xff, 0xff, 0xff, 0xff}); !bytes.Equal(a.MAC(bcast), bcast) {
+		t.Error("broadcast address changed")
+	}
+
+	a, _ = New(Options{Key: testKey, PreserveOUI: true})
+	if got := a.MAC(mac); !bytes.Equal(got[:3], mac[:3]) || bytes.Equal(got, mac) {
+		t.Errorf("OUI not preserved: %v", got)
+	}
+}
+
+var (
+	srcMAC = net.HardwareAddr{0x00, 0x1b, 0x21, 0x00, 0x00, 0x01}
+	dstMAC = net.HardwareAddr{0x00, 0x1b, 0x21, 0x00, 0x00, 0x02}
+	srcIP  = net.IP{10, 1, 2, 3}
+	dstIP  = net.IP{10, 1, 2, 4}
+	srcIP6 = net.ParseIP("2001:db8::1")
+	dstIP6 = net.ParseIP("2001:db8::2")
+)
+
+func serialize(t *testing.T, ls ...gopacket.SerializableLayer) []byte {
+	buf := gopacket.NewSerializeBuffer()
+	if err := gopacket.SerializeLayers(buf, gopacket.SerializeOptions{FixLengths: true, ComputeChecksums: true}, ls...); err != nil {
+		t.Fatal(err)
+	}
+	return buf.Bytes()
+}
+
+func eth(t layers.EthernetType) *layers.Ethernet {
+	return &layers.Ethernet{SrcMAC: srcMAC, DstMAC: dstMAC, EthernetType: t}
+}
+
+func ipv4(proto layers.IPProtocol) *layers.IPv4 {
+	return &layers.IPv4{Version: 4, TTL: 64, Protocol: proto, SrcIP: srcIP, DstIP: dstIP}
+}
+
+// checkChecksums verifies the checksums of the packet, by comparing it to a
+// copy with its checksums recomputed.
+func checkChecksums(t *testing.T, data []byte) {
+	t.Helper()
+	p := gopacket.NewPacket(data, layers.LayerTypeEthernet, gopacket.Default)
+	var ls []gopacket.SerializableLayer
+	for _, l := range p.Layers() {
+		switch l := l.(type) {
+		case *layers.TCP:
+			l.SetNetworkLayerForChecksum(p.NetworkLayer())
+		case *layers.UDP:
+			l.SetNetworkLayerForChecksum(p.NetworkLayer())
+		case *layers.ICMPv6:
+			l.SetNetworkLayerForChecksum(p.NetworkLayer())
+		case *layers.DNS:
+			// keep the encoding of the names
+			ls = append(ls, gopacket.Payload(l.LayerContents()))
+			continue
+		}
+		if s, ok := l.(gopacket.SerializableLayer); ok {
+			ls = append(ls, s)
+		} else {
+			ls = append(ls, gopacket.Payload(l.LayerContents()))
+		}
+	}
+	buf := gopacket.NewSerializeBuffer()
+	if err := gopacket.SerializeLayers(buf, gopacket.SerializeOptions{ComputeChecksums: true}, ls...); err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(buf.Bytes(), data) {
+		t.Errorf("bad checksums:\n got %x\nwant %x", data, buf.Bytes())
+	}
+}
+
+func TestAnonymize(t *testing.T) {
+	a, _ := New(Options{Key: testKey})
+	aSrc, aDst := a.IP(srcIP), a.IP(dstIP)
+	aSrc6, aDst6 := a.IP(srcIP6), a.IP(dstIP6)
+	aSrcMAC, aDstMAC := a.MAC(srcMAC), a.MAC(dstMAC)
+
+	t.Run("tcp", func(t *testing.T) {
+		ip := ipv4(layers.IPProtocolTCP)
+		tcp := &layers.TCP{SrcPort: 1234, DstPort: 80, SYN: true}
+		tcp.SetNetworkLayerForChecksum(ip)
+		out := a.Anonymize(serialize(t, eth(layers.EthernetTypeIPv4), ip, tcp, gopacket.Payload("hello")))
+		p := gopacket.NewPacket(out, layers.LayerTypeEthernet, gopacket.Default)
+		e := p.Layer(layers.LayerTypeEthernet).(*layers.Ethernet)
+		i := p.Layer(layers.LayerTypeIPv4).(*layers.IPv4)
+		if !bytes.Equal(e.SrcMAC, aSrcMAC) || !bytes.Equal(e.DstMAC, aDstMAC) || !i.SrcIP.Equal(aSrc) || !i.DstIP.Equal(aDst) {
+			t.Errorf("bad addresses %v", p)
+		}
+		if app := p.ApplicationLayer(); app == nil || string(app.Payload()) != "hello" {
+			t.Errorf("payload changed: %v", p)
+		}
+		checkChecksums(t, out)
+	})
+
+	t.Run("arp", func(t *testing.T) {
+		arp := &layers.ARP{
+			AddrType: layers.LinkTypeEthernet, Protocol: layers.EthernetTypeIPv4,
+			HwAddressSize: 6, ProtAddressSize: 4, Operation: layers.ARPReply,
+			SourceHwAddress: srcMAC, SourceProtAddress: srcIP,
+			DstHwAddress: dstMAC, DstProtAddress: dstIP,
+		}
+		out := a.Anonymize(serialize(t, eth(layers.EthernetTypeARP), arp))
+		got := gopacket.NewPacket(out, layers.LayerTypeEthernet, gopacket.Default).Layer(layers.LayerTypeARP).(*layers.ARP)
+		if !bytes.Equal(got.SourceHwAddress, aSrcMAC) || !bytes.Equal(got.DstHwAddress, aDstMAC) ||
+			!net.IP(got.SourceProtAddress).Equal(aSrc) || !net.IP(got.DstProtAddress).Equal(aDst) {
+			t.Errorf("bad addresses %+v", got)
+		}
+	})
+
+	t.Run("icmp error", func(t *testing.T) {
+		// the reply to a UDP packet from src to dst
+		quotedIP := ipv4(layers.IPProtocolUDP)
+		udp := &layers.UDP{SrcPort: 1234, DstPort: 53}
+		udp.SetNetworkLayerForChecksum(quotedIP)
+		quoted := serialize(t, quotedIP, udp, gopacket.Payload("query"))[:28]
+		ip := ipv4(layers.IPProtocolICMPv4)
+		ip.SrcIP, ip.DstIP = dstIP, srcIP
+		icmp := &layers.ICMPv4{TypeCode: layers.CreateICMPv4TypeCode(layers.ICMPv4TypeDestinationUnreachable, layers.ICMPv4CodePort)}
+		out := a.Anonymize(serialize(t, eth(layers.EthernetTypeIPv4), ip, icmp, gopacket.Payload(quoted)))
+		p := gopacket.NewPacket(out[42:], layers.LayerTypeIPv4, gopacket.Default)
+		i := p.Layer(layers.LayerTypeIPv4).(*layers.IPv4)
+		if !i.SrcIP.Equal(aSrc) || !i.DstIP.Equal(aDst) {
+			t.Errorf("bad quoted addresses %v", p)
+		}
+		if c := checksum(out[42:62], 0); c != 0 {
+			t.Errorf("bad quoted header checksum")
+		}
+		checkChecksums(t, out)
+	})
+
+	t.Run("icmpv6 neighbor advertisement", func(t *testing.T) {
+		ip := &layers.IPv6{Version: 6, HopLimit: 255, NextHeader: layers.IPProtocolICMPv6, SrcIP: srcIP6, DstIP: dstIP6}
+		icmp := &layers.ICMPv6{TypeCode: layers.CreateICMPv6TypeCode(layers.ICMPv6TypeNeighborAdvertisement, 0)}
+		icmp.SetNetworkLayerForChecksum(ip)
+		na := &layers.ICMPv6NeighborAdvertisement{
+			Flags:         0x60,
+			TargetAddress: srcIP6,
+			Options:       layers.ICMPv6Options{{Type: layers.ICMPv6OptTargetAddress, Data: srcMAC}},
+		}
+		out := a.Anonymize(serialize(t, eth(layers.EthernetTypeIPv6), ip, icmp, na))
+		p := gopacket.NewPacket(out, layers.LayerTypeEthernet, gopacket.Default)
+		got, ok := p.Layer(layers.LayerTypeICMPv6NeighborAdvertisement).(*layers.ICMPv6NeighborAdvertisement)
+		if !ok {
+			t.Fatalf("not decoded: %v", p)
+		}
+		if !got.TargetAddress.Equal(aSrc6) || !bytes.Equal(got.Options[0].Data, aSrcMAC) {
+			t.Errorf("bad addresses %+v", got)
+		}
+		if i := p.Layer(layers.LayerTypeIPv6).(*layers.IPv6); !i.SrcIP.Equal(aSrc6) || !i.DstIP.Equal(aDst6) {
+			t.Errorf("bad addresses %v", i)
+		}
+		checkChecksums(t, out)
+	})
+
+	t.Run("dns", func(t *testing.T) {
+		ip := ipv4(layers.IPProtocolUDP)
+		udp := &layers.UDP{SrcPort: 53, DstPort: 1234}
+		udp.SetNetworkLayerForChecksum(ip)
+		dns := &layers.DNS{
+			ID: 1, QR: true, ResponseCode: layers.DNSResponseCodeNoErr,
+			Questions: []layers.DNSQuestion{{Name: []byte("example.com"), Type: layers.DNSTypeA, Class: layers.DNSClassIN}},
+			Answers: []layers.DNSResourceRecord{
+				{Name: []byte("example.com"), Type: layers.DNSTypeA, Class: layers.DNSClassIN, TTL: 60, IP: srcIP},
+				{Name: []byte("example.com"), Type: layers.DNSTypeAAAA, Class: layers.DNSClassIN, TTL: 60, IP: srcIP6},
+			},
+		}
+		out := a.Anonymize(serialize(t, eth(layers.EthernetTypeIPv4), ip, udp, dns))
+		got := gopacket.NewPacket(out, layers.LayerTypeEthernet, gopacket.Default).Layer(layers.LayerTypeDNS).(*layers.DNS)
+		if !got.Answers[0].IP.Equal(aSrc) || !got.Answers[1].IP.Equal(aSrc6) {
+			t.Errorf("bad addresses %v %v", got.Answers[0].IP, got.Answers[1].IP)
+		}
+		checkChecksums(t, out)
+	})
+
+	t.Run("ipv4-mapped ipv6", func(t *testing.T) {
+		mapped := srcIP.To16()
+		ip := &layers.IPv6{Version: 6, HopLimit: 64, NextHeader: layers.IPProtocolUDP, SrcIP: mapped, DstIP: dstIP6}
+		udp := &layers.UDP{SrcPort: 53, DstPort: 1234}
+		udp.SetNetworkLayerForChecksum(ip)
+		dns := &layers.DNS{
+			ID: 1, QR: true, ResponseCode: layers.DNSResponseCodeNoErr,
+			Answers: []layers.DNSResourceRecord{
+				{Name: []byte("example.com"), Type: layers.DNSTypeAAAA, Class: layers.DNSClassIN, TTL: 60, IP: mapped},
+			},
+		}
+		out := a.Anonymize(serialize(t, eth(layers.EthernetTypeIPv6), ip, udp, dns))
+		p := gopacket.NewPacket(out, layers.LayerTypeEthernet, gopacket.Default)
+		// net.IP.Equal treats mapped and IPv4 addresses alike, so the 16 bytes are compared
+		want := aSrc.To16()
+		if got := p.Layer(layers.LayerTypeIPv6).(*layers.IPv6); !bytes.Equal(got.SrcIP, want) || !got.DstIP.Equal(aDst6) {
+			t.Errorf("bad addresses %v %v, want source %v", got.SrcIP, got.DstIP, want)
+		}
+		if got := p.Layer(layers.LayerTypeDNS).(*layers.DNS); !bytes.Equal(got.Answers[0].IP.To16(), want) {
+			t.Errorf("bad address %v, want %v", got.Answers[0].IP, want)
+		}
+		if bytes.Contains(out, srcIP) {
+			t.Errorf("original address left in %x", out)
+		}
+		checkChecksums(t, out)
+	})
+
+	t.Run("dhcp", func(t *testing.T) {
+		ip := ipv4(layers.IPProtocolUDP)
+		udp := &layers.UDP{SrcPort: 67, DstPort: 68}
+		udp.SetNetworkLayerForChecksum(ip)
+		dhcp := &layers.DHCPv4{
+			Operation: layers.DHCPOpReply, HardwareType: layers.LinkTypeEthernet, HardwareLen: 6,
+			ClientIP: net.IPv4zero, YourClientIP: dstIP, NextServerIP: srcIP, RelayAgentIP: net.IPv4zero,
+			ClientHWAddr: dstMAC,
+			Options: layers.DHCPOptions{
+				layers.NewDHCPOption(layers.DHCPOptMessageType, []byte{byte(layers.DHCPMsgTypeAck)}),
+				layers.NewDHCPOption(layers.DHCPOptServerID, srcIP),
+				layers.NewDHCPOption(layers.DHCPOptRouter, srcIP),
+				layers.NewDHCPOption(layers.DHCPOptClientID, append([]byte{1}, dstMAC...)),
+			},
+		}
+		out := a.Anonymize(serialize(t, eth(layers.EthernetTypeIPv4), ip, udp, dhcp))
+		p := gopacket.NewPacket(out, layers.LayerTypeEthernet, gopacket.Default)
+		got, ok := p.Layer(layers.LayerTypeDHCPv4).(*layers.DHCPv4)
+		if !ok {
+			t.Fatalf("not decoded: %v", p)
+		}
+		if !got.YourClientIP.Equal(aDst) || !got.NextServerIP.Equal(aSrc) || !got.ClientIP.Equal(net.IPv4zero) ||
+			!bytes.Equal(got.ClientHWAddr, aDstMAC) {
+			t.Errorf("bad addresses %v", got)
+		}
+		for _, o := range got.Options {
+			switch o.Type {
+			case layers.DHCPOptServerID, layers.DHCPOptRouter:
+				if !net.IP(o.Data).Equal(aSrc) {
+					t.Errorf("bad option %v", o)
+				}
+			case layers.DHCPOptClientID:
+				if !bytes.Equal(o.Data[1:], aDstMAC) {
+					t.Errorf("bad option %v", o)
+				}
+			}
+		}
+		checkChecksums(t, out)
+	})
+}
+
+func TestScrub(t *testing.T) {
+	ip := ipv4(layers.IPProtocolUDP)
+	udp := &layers.UDP{SrcPort: 1234, DstPort: 5678}
+	udp.SetNetworkLayerForChecksum(ip)
+	in := serialize(t, eth(layers.EthernetTypeIPv4), ip, udp, gopacket.Payload("secret"))
+
+	for _, test := range []struct {
+		scrub ScrubLevel
+		zero  int // offset of the first zeroed byte
+	}{
+		{ScrubAboveTransport, 42},
+		{ScrubAboveNetwork, 34},
+	} {
+		a, _ := New(Options{Key: testKey, Scrub: test.scrub})
+		out := a.Anonymize(in)
+		if len(out) != len(in) {
+			t.Fatalf("length changed")
+		}
+		if !bytes.Equal(out[test.zero:], make([]byte, len(in)-test.zero)) ||
+			(test.zero > 34 && bytes.Equal(out[34:test.zero], make([]byte, test.zero-34))) {
+			t.Errorf("scrub %d: got %x", test.scrub, out)
+		}
+		if test.scrub == ScrubAboveTransport {
+			checkChecksums(t, out)
+		}
+	}
+}
+
+type packets struct {
+	data [][]byte
+	ci   []gopacket.CaptureInfo
+}
+
+func (p *packets) ReadPacketData() ([]byte, gopacket.CaptureInfo, error) {
+	if len(p.data) == 0 {
+		return nil, gopacket.CaptureInfo{}, io.EOF
+	}
+	data := p.data[0]
+	p.data = p.data[1:]
+	return data, gopacket.CaptureInfo{CaptureLength: len(data), Length: len(data)}, nil
+}
+
+func (p *packets) WritePacket(ci gopacket.CaptureInfo, data []byte) error {
+	p.data = append(p.data, data)
+	p.ci = append(p.ci, ci)
+	return nil
+}
+
+func TestCopy(t *testing.T) {
+	a, _ := New(Options{Key: testKey})
+	ip := ipv4(layers.IPProtocolUDP)
+	udp := &layers.UDP{SrcPort: 1234, DstPort: 5678}
+	udp.SetNetworkLayerForChecksum(ip)
+	in := serialize(t, eth(layers.EthernetTypeIPv4), ip, udp, gopacket.Payload("data"))
+
+	dst := &packets{}
+	n, err := a.Copy(dst, &packets{data: [][]byte{in, in}})
+	if err != nil || n != 2 {
+		t.Fatalf("got %d, %v", n, err)
+	}
+	want := a.Anonymize(in)
+	for _, data := range dst.data {
+		if !bytes.Equal(data, want) {
+			t.Errorf("got %x, want %x", data, want)
+		}
+	}
+
+	// A truncated packet keeps its transport checksum.
+	dst = &packets{}
+	truncated := in[:len(in)-2]
+	ci := gopacket.CaptureInfo{CaptureLength: len(truncated), Length: len(in)}
+	if err := a.Writer(dst).WritePacket(ci, truncated); err != nil {
+		t.Fatal(err)
+	}
+	if got := dst.data[0]; binary.BigEndian.Uint16(got[40:]) != binary.BigEndian.Uint16(in[40:]) || !bytes.Equal(got[:40], want[:40]) {
+		t.Errorf("got %x, want %x", got, want)
+	}
+
+	dst = &packets{}
+	full := gopacket.CaptureInfo{CaptureLength: len(in), Length: len(in)}
+	if n, err := a.Writer(dst).WritePackets([]gopacket.CaptureInfo{full, full}, [][]byte{in, in}); err != nil || n != 2 {
+		t.Fatalf("WritePackets: %d, %v", n, err)
+	}
+	for _, data := range dst.data {
+		if !bytes.Equal(data, want) {
+			t.Errorf("WritePackets: got %x, want %x", data, want)
+		}
+	}
+}
+
+func TestTruncated(t *testing.T) {
+	a, _ := New(Options{Key: testKey})
+	ip := ipv4(layers.IPProtocolTCP)
+	tcp := &layers.TCP{SrcPort: 1234, DstPort: 80, SYN: true}
+	tcp.SetNetworkLayerForChecksum(ip)
+	ip6 := &layers.IPv6{Version: 6, HopLimit: 64, NextHeader: layers.IPProtocolUDP, SrcIP: srcIP6, DstIP: dstIP6}
+	udp := &layers.UDP{SrcPort: 53, DstPort: 1234}
+	udp.SetNetworkLayerForChecksum(ip6)
+	dns := &layers.DNS{
+		ID: 1, QR: true,
+		Answers: []layers.DNSResourceRecord{{Name: []byte("example.com"), Type: layers.DNSTypeA, Class: layers.DNSClassIN, IP: srcIP}},
+	}
+	icmpIP := ipv4(layers.IPProtocolICMPv4)
+	icmp := &layers.ICMPv4{TypeCode: layers.CreateICMPv4TypeCode(layers.ICMPv4TypeTimeExceeded, 0)}
+	quoted := serialize(t, ipv4(layers.IPProtocolTCP), tcp)
+
+	for _, in := range [][]byte{
+		serialize(t, eth(layers.EthernetTypeIPv4), ip, tcp, gopacket.Payload("hello")),
+		serialize(t, eth(layers.EthernetTypeIPv6), ip6, udp, dns),
+		serialize(t, eth(layers.EthernetTypeIPv4), icmpIP, icmp, gopacket.Payload(quoted)),
+	} {
+		for n := 0; n <= len(in); n++ {
+			out := a.Anonymize(in[:n])
+			if len(out) != n {
+				t.Fatalf("%d bytes: got %d bytes", n, len(out))
+			}
+			dst := &packets{}
+			ci := gopacket.CaptureInfo{CaptureLength: n, Length: len(in)}
+			if err := a.Writer(dst).WritePacket(ci, in[:n]); err != nil || len(dst.data[0]) != n {
+				t.Errorf("%d bytes: Writer got %x, %v", n, dst.data[0], err)
+			}
+			if _, err := a.Copy(&packets{}, &packets{data: [][]byte{in[:n]}}); err != nil {
+				t.Errorf("%d bytes: %v", n, err)
+			}
+		}
+	}
+
+	// An IPv4 header cut in the source address can't be anonymized, and is
+	// removed.
+	in := serialize(t, eth(layers.EthernetTypeIPv4), ip, tcp)[:28]
+	out := a.Anonymize(in)
+	if !bytes.Equal(out[:6], a.MAC(dstMAC)) || !bytes.Equal(out[14:], make([]byte, 14)) {
+		t.Errorf("got %x", out)
+	}
+}
@@ -0,0 +1,77 @@
+// Copyright 2012 Google, Inc. All rights reserved.
+//
+// Use of this source code is governed by a BSD-style license
+// that can be found in the LICENSE file in the root of the source
+// tree.
+
+package anonymize
+
+import (
+	"crypto/aes"
+	"crypto/cipher"
+	"fmt"
+	"net"
+)
+
+// KeySize is the size of a Crypto-PAn key.
+const KeySize = 32
+
+// CryptoPAn is the prefix-preserving IP address anonymization of Xu, Fan,
+// Ammar and Moon: two addresses sharing a prefix of n bits are anonymized to
+// two addresses sharing a prefix of n bits.  The mapping is a one to one
+// mapping determined by the key, so the same key gives consistent results
+// across captures.  IPv6 addresses are anonymized like IPv4 addresses, over
+// 128 bits.
+//
+// A CryptoPAn is safe for concurrent use.
+type CryptoPAn struct {
+	block cipher.Block
+	pad   [aes.BlockSize]byte
+}
+
+// NewCryptoPAn returns a CryptoPAn using the given key of KeySize bytes.  The
+// first half is the AES key, the second half is encrypted to the padding.
+func NewCryptoPAn(key []byte) (*CryptoPAn, error) {
+	if len(key) != KeySize {
+		return nil, fmt.Errorf("anonymize: Crypto-PAn key must be %d bytes, not %d", KeySize, len(key))
+	}
+	block, err := aes.NewCipher(key[:16])
+	if err != nil {
+		return nil, err
+	}
+	c := &CryptoPAn{block: block}
+	block.Encrypt(c.pad[:], key[16:])
+	return c, nil
+}
+
+// Anonymize returns the anonymized address of ip.  IPv4 addresses are
+// returned in their 4 byte form.
+func (c *CryptoPAn) Anonymize(ip net.IP) net.IP {
+	if v4 := ip.To4(); v4 != nil {
+		ip = v4
+	}
+	ret := make(net.IP, len(ip))
+	c.anonymize(ret, ip)
+	return ret
+}
+
+// anonymize writes the anonymized address of addr, which must not be longer
+// than the block size, into dst.
+func (c *CryptoPAn) anonymize(dst, addr []byte) {
+	var in, out [aes.BlockSize]byte
+	otp := make([]byte, len(addr))
+	// The bit at pos of the one time pad is the first bit of the encrypted
+	// first pos bits of addr, padded with the rest of the padding.
+	in = c.pad
+	for pos := 0; pos < len(addr)*8; pos++ {
+		c.block.Encrypt(out[:], in[:])
+		i, mask := pos/8, byte(0x80>>uint(pos%8))
+		if out[0]&0x80 != 0 {
+			otp[i] |= mask
+		}
+		in[i] = in[i]&^mask | addr[i]&mask
+	}
+	for i := range addr {
+		dst[i] = addr[i] ^ otp[i]
+	}
+}
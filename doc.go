@@ -17,6 +17,7 @@ useful, including:
  * pcap: C bindings to use libpcap to read packets off the wire.
  * pfring: C bindings to use PF_RING to read packets off the wire.
  * afpacket: C bindings for Linux's AF_PACKET to read packets off the wire.
+ * afxdp: Linux AF_XDP sockets to read and write packets without cgo.
  * tcpassembly: TCP stream reassembly
 
 Also, if you're looking to dive right into code, see the examples subdirectory
@@ -0,0 +1,74 @@
+// Copyright 2018 The GoPacket Authors. All rights reserved.
+//
+// Use of this source code is governed by a BSD-style license
+// that can be found in the LICENSE file in the root of the source
+// tree.
+
+// The capinfo binary prints a summary of capture files, like capinfos. Any
+// format supported by pcapgo.OpenCapture can be read, compressed or not.
+//
+//	capinfo capture.pcap capture.pcapng.gz capture.snoop
+package main
+
+import (
+	"flag"
+	"fmt"
+	"io"
+	"log"
+	"time"
+
+	"github.com/davidsonff/gopacket/examples/util"
+	"github.com/davidsonff/gopacket/pcapgo"
+)
+
+func info(name string) error {
+	r, format, err := pcapgo.OpenCaptureFile(name, pcapgo.DefaultCaptureReaderOptions)
+	if err != nil {
+		return err
+	}
+	defer r.Close()
+	var packets, bytes int
+	var first, last time.Time
+	for {
+		_, ci, err := r.ZeroCopyReadPacketData()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return err
+		}
+		if packets == 0 {
+			first = ci.Timestamp
+		}
+		last = ci.Timestamp
+		packets++
+		bytes += ci.Length
+	}
+	fmt.Printf("File name:       %s\n", name)
+	fmt.Printf("File format:     %s\n", format)
+	fmt.Printf("Link type:       %s\n", r.LinkType())
+	fmt.Printf("Resolution:      %s\n", r.Resolution())
+	fmt.Printf("Packets:         %d\n", packets)
+	fmt.Printf("Data size:       %d bytes\n", bytes)
+	if packets > 0 {
+		fmt.Printf("First packet:    %s\n", first)
+		fmt.Printf("Last packet:     %s\n", last)
+		fmt.Printf("Duration:        %s\n", last.Sub(first))
+	}
+	return nil
+}
+
+func main() {
+	defer util.Run()()
+	if flag.NArg() == 0 {
+		log.Fatal("usage: capinfo file...")
+	}
+	for i, name := range flag.Args() {
+		if i > 0 {
+			fmt.Println()
+		}
+		if err := info(name); err != nil {
+			log.Fatalf("%s: %v", name, err)
+		}
+	}
+}
@@ -0,0 +1,102 @@
+// Copyright 2018 The GoPacket Authors. All rights reserved.
+//
+// Use of this source code is governed by a BSD-style license
+// that can be found in the LICENSE file in the root of the source
+// tree.
+
+// The pcapconvert binary converts a capture file of any format supported by
+// pcapgo.OpenCapture to pcap, pcapng or snoop.
+//
+//	pcapconvert -F snoop -w out.snoop capture.pcapng.gz
+//	pcapconvert -F pcapng -spb -w out.pcapng capture.erf
+package main
+
+import (
+	"bufio"
+	"flag"
+	"fmt"
+	"io"
+	"log"
+	"os"
+
+	"github.com/davidsonff/gopacket"
+	"github.com/davidsonff/gopacket/examples/util"
+	"github.com/davidsonff/gopacket/pcapgo"
+)
+
+var format = flag.String("F", "pcapng", "Output format: pcap, pcapng or snoop")
+var output = flag.String("w", "", "File to write to")
+var simple = flag.Bool("spb", false, "pcapng: write simple packet blocks, without timestamps")
+
+type packetWriter interface {
+	WritePacket(ci gopacket.CaptureInfo, data []byte) error
+}
+
+func main() {
+	defer util.Run()()
+	if *output == "" || flag.NArg() != 1 {
+		log.Fatal("usage: pcapconvert -F pcap|pcapng|snoop -w output input")
+	}
+	r, _, err := pcapgo.OpenCaptureFile(flag.Arg(0), pcapgo.DefaultCaptureReaderOptions)
+	if err != nil {
+		log.Fatal(err)
+	}
+	defer r.Close()
+	f, err := os.Create(*output)
+	if err != nil {
+		log.Fatal(err)
+	}
+	defer f.Close()
+	out := bufio.NewWriter(f)
+
+	var w packetWriter
+	switch *format {
+	case "pcap":
+		pw := pcapgo.NewWriterNanos(out)
+		err = pw.WriteFileHeader(65536, r.LinkType())
+		w = pw
+	case "pcapng":
+		intf := pcapgo.DefaultNgInterface
+		intf.LinkType = r.LinkType()
+		options := pcapgo.DefaultNgWriterOptions
+		options.SimplePackets = *simple
+		var ng *pcapgo.NgWriter
+		ng, err = pcapgo.NewNgWriterInterface(out, intf, options)
+		w = ng
+	case "snoop":
+		sw := pcapgo.NewSnoopWriter(out)
+		err = sw.WriteFileHeader(r.LinkType())
+		w = sw
+	default:
+		log.Fatalf("unknown format %q", *format)
+	}
+	if err != nil {
+		log.Fatal(err)
+	}
+
+	n := 0
+	for {
+		data, ci, err := r.ZeroCopyReadPacketData()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			log.Fatal(err)
+		}
+		// the interfaces of the input are not preserved
+		ci.InterfaceIndex = 0
+		if err := w.WritePacket(ci, data); err != nil {
+			log.Fatal(err)
+		}
+		n++
+	}
+	if ng, ok := w.(*pcapgo.NgWriter); ok {
+		if err := ng.Flush(); err != nil {
+			log.Fatal(err)
+		}
+	}
+	if err := out.Flush(); err != nil {
+		log.Fatal(err)
+	}
+	fmt.Printf("%d packets written to %s\n", n, *output)
+}
@@ -0,0 +1,130 @@
+// Copyright 2018 The GoPacket Authors. All rights reserved.
+//
+// Use of this source code is governed by a BSD-style license
+// that can be found in the LICENSE file in the root of the source
+// tree.
+
+// The pcapedit binary merges, splits, slices, deduplicates and truncates
+// pcap and pcapng files, like mergecap and editcap, using pcapgo.
+//
+//	pcapedit -m merge -w merged.pcapng a.pcap b.pcapng
+//	pcapedit -m split -w part.pcap -c 1000 capture.pcap
+//	pcapedit -m edit -w out.pcap -start 2018-01-01T10:00:00Z -D 1ms -s 96 capture.pcap
+package main
+
+import (
+	"flag"
+	"fmt"
+	"io"
+	"log"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"github.com/davidsonff/gopacket/examples/util"
+	"github.com/davidsonff/gopacket/pcapgo"
+)
+
+var mode = flag.String("m", "edit", "Mode: merge, split or edit")
+var output = flag.String("w", "", "File to write to; split inserts the file number before the extension")
+var appendInputs = flag.Bool("a", false, "merge: concatenate the inputs instead of merging them chronologically")
+var packets = flag.Int("c", 0, "split: maximum number of packets per file")
+var duration = flag.Duration("G", 0, "split: maximum duration per file")
+var size = flag.Int64("C", 0, "split: maximum size per file in bytes")
+var start = flag.String("start", "", "Keep packets from this time on (RFC3339)")
+var end = flag.String("end", "", "Keep packets before this time (RFC3339)")
+var first = flag.Int("first", 0, "Keep packets from this packet number on (starting at 1)")
+var last = flag.Int("last", 0, "Keep packets up to this packet number")
+var dedup = flag.Duration("D", 0, "Drop packets identical to a packet seen in this time window")
+var snaplen = flag.Uint("s", 0, "Truncate packets to this length")
+
+func parseTime(s string) time.Time {
+	if s == "" {
+		return time.Time{}
+	}
+	t, err := time.Parse(time.RFC3339Nano, s)
+	if err != nil {
+		log.Fatalf("invalid time %q: %v", s, err)
+	}
+	return t
+}
+
+func openInput(name string) *os.File {
+	f, err := os.Open(name)
+	if err != nil {
+		log.Fatal(err)
+	}
+	return f
+}
+
+func createOutput(name string) *os.File {
+	f, err := os.Create(name)
+	if err != nil {
+		log.Fatal(err)
+	}
+	return f
+}
+
+func main() {
+	defer util.Run()()
+	if *output == "" || flag.NArg() == 0 {
+		log.Fatal("usage: pcapedit -m merge|split|edit -w output [options] input...")
+	}
+	editOptions := pcapgo.EditOptions{
+		StartTime:   parseTime(*start),
+		EndTime:     parseTime(*end),
+		FirstPacket: *first,
+		LastPacket:  *last,
+		DedupWindow: *dedup,
+		Snaplen:     uint32(*snaplen),
+	}
+
+	var n int
+	var err error
+	switch *mode {
+	case "merge":
+		var inputs []io.Reader
+		for _, name := range flag.Args() {
+			f := openInput(name)
+			defer f.Close()
+			inputs = append(inputs, f)
+		}
+		out := createOutput(*output)
+		defer out.Close()
+		options := pcapgo.DefaultMergeOptions
+		options.Append = *appendInputs
+		if n, err = pcapgo.Merge(out, inputs, options); err == nil {
+			fmt.Printf("%d packets written to %s\n", n, *output)
+		}
+	case "split":
+		in := openInput(flag.Arg(0))
+		defer in.Close()
+		ext := filepath.Ext(*output)
+		prefix := strings.TrimSuffix(*output, ext)
+		n, err = pcapgo.Split(in, func(i int) (io.WriteCloser, error) {
+			return os.Create(fmt.Sprintf("%s_%05d%s", prefix, i, ext))
+		}, pcapgo.SplitOptions{
+			Packets:     *packets,
+			Duration:    *duration,
+			Bytes:       *size,
+			EditOptions: editOptions,
+		})
+		if err == nil {
+			fmt.Printf("%d files written\n", n)
+		}
+	case "edit":
+		in := openInput(flag.Arg(0))
+		defer in.Close()
+		out := createOutput(*output)
+		defer out.Close()
+		if n, err = pcapgo.Edit(out, in, editOptions); err == nil {
+			fmt.Printf("%d packets written to %s\n", n, *output)
+		}
+	default:
+		log.Fatalf("unknown mode %q", *mode)
+	}
+	if err != nil {
+		log.Fatal(err)
+	}
+}
@@ -0,0 +1,69 @@
+// Copyright 2012 Google, Inc. All rights reserved.
+//
+// Use of this source code is governed by a BSD-style license
+// that can be found in the LICENSE file in the root of the source
+// tree.
+
+// +build linux
+
+// Package testveth provides veth pairs in private network namespaces to the
+// tests of the packages capturing from live interfaces.
+package testveth
+
+import (
+	"runtime"
+	"testing"
+
+	"github.com/vishvananda/netlink"
+	"github.com/vishvananda/netns"
+)
+
+// Pair creates a veth pair in a new network namespace, and sets both
+// interfaces up.  The interfaces are named prefix+"0" and prefix+"1".  The
+// calling goroutine is locked to its thread, which stays in the namespace
+// until the returned cleanup function is called.  The test is skipped if the
+// namespace or the pair can't be created, e.g. without CAP_NET_ADMIN.
+func Pair(t testing.TB, prefix string) (string, string, func()) {
+	runtime.LockOSThread()
+	origNs, err := netns.Get()
+	if err != nil {
+		runtime.UnlockOSThread()
+		t.Skipf("can't get network namespace: %v", err)
+	}
+	ns, err := netns.New()
+	if err != nil {
+		origNs.Close()
+		runtime.UnlockOSThread()
+		t.Skipf("can't create network namespace: %v", err)
+	}
+	cleanup := func() {
+		netns.Set(origNs)
+		ns.Close()
+		origNs.Close()
+		runtime.UnlockOSThread()
+	}
+	name, peerName := prefix+"0", prefix+"1"
+	veth := &netlink.Veth{
+		LinkAttrs: netlink.LinkAttrs{
+			Name: name,
+			MTU:  1500,
+		},
+		PeerName: peerName,
+	}
+	if err := netlink.LinkAdd(veth); err != nil {
+		cleanup()
+		t.Skipf("can't create veth pair: %v", err)
+	}
+	peer, err := netlink.LinkByName(peerName)
+	if err != nil {
+		cleanup()
+		t.Fatal(err)
+	}
+	for _, link := range []netlink.Link{veth, peer} {
+		if err := netlink.LinkSetUp(link); err != nil {
+			cleanup()
+			t.Fatal(err)
+		}
+	}
+	return name, peerName, cleanup
+}
@@ -89,43 +89,45 @@ type LinkType uint8
 
 const (
 	// According to pcap-linktype(7) and http://www.tcpdump.org/linktypes.html
-	LinkTypeNull           LinkType = 0
-	LinkTypeEthernet       LinkType = 1
-	LinkTypeAX25           LinkType = 3
-	LinkTypeTokenRing      LinkType = 6
-	LinkTypeArcNet         LinkType = 7
-	LinkTypeSLIP           LinkType = 8
-	LinkTypePPP            LinkType = 9
-	LinkTypeFDDI           LinkType = 10
-	LinkTypePPP_HDLC       LinkType = 50
-	LinkTypePPPEthernet    LinkType = 51
-	LinkTypeATM_RFC1483    LinkType = 100
-	LinkTypeRaw            LinkType = 101
-	LinkTypeC_HDLC         LinkType = 104
-	LinkTypeIEEE802_11     LinkType = 105
-	LinkTypeFRelay         LinkType = 107
-	LinkTypeLoop           LinkType = 108
-	LinkTypeLinuxSLL       LinkType = 113
-	LinkTypeLTalk          LinkType = 114
-	LinkTypePFLog          LinkType = 117
-	LinkTypePrismHeader    LinkType = 119
-	LinkTypeIPOverFC       LinkType = 122
-	LinkTypeSunATM         LinkType = 123
-	LinkTypeIEEE80211Radio LinkType = 127
-	LinkTypeARCNetLinux    LinkType = 129
-	LinkTypeIPOver1394     LinkType = 138
-	LinkTypeMTP2Phdr       LinkType = 139
-	LinkTypeMTP2           LinkType = 140
-	LinkTypeMTP3           LinkType = 141
-	LinkTypeSCCP           LinkType = 142
-	LinkTypeDOCSIS         LinkType = 143
-	LinkTypeLinuxIRDA      LinkType = 144
-	LinkTypeLinuxLAPD      LinkType = 177
-	LinkTypeLinuxUSB       LinkType = 220
-	LinkTypeFC2            LinkType = 224
-	LinkTypeFC2Framed      LinkType = 225
-	LinkTypeIPv4           LinkType = 228
-	LinkTypeIPv6           LinkType = 229
+	LinkTypeNull                   LinkType = 0
+	LinkTypeEthernet               LinkType = 1
+	LinkTypeAX25                   LinkType = 3
+	LinkTypeTokenRing              LinkType = 6
+	LinkTypeArcNet                 LinkType = 7
+	LinkTypeSLIP                   LinkType = 8
+	LinkTypePPP                    LinkType = 9
+	LinkTypeFDDI                   LinkType = 10
+	LinkTypePPP_HDLC               LinkType = 50
+	LinkTypePPPEthernet            LinkType = 51
+	LinkTypeATM_RFC1483            LinkType = 100
+	LinkTypeRaw                    LinkType = 101
+	LinkTypeC_HDLC                 LinkType = 104
+	LinkTypeIEEE802_11             LinkType = 105
+	LinkTypeFRelay                 LinkType = 107
+	LinkTypeLoop                   LinkType = 108
+	LinkTypeLinuxSLL               LinkType = 113
+	LinkTypeLTalk                  LinkType = 114
+	LinkTypePFLog                  LinkType = 117
+	LinkTypePrismHeader            LinkType = 119
+	LinkTypeIPOverFC               LinkType = 122
+	LinkTypeSunATM                 LinkType = 123
+	LinkTypeIEEE80211Radio         LinkType = 127
+	LinkTypeARCNetLinux            LinkType = 129
+	LinkTypeIPOver1394             LinkType = 138
+	LinkTypeMTP2Phdr               LinkType = 139
+	LinkTypeMTP2                   LinkType = 140
+	LinkTypeMTP3                   LinkType = 141
+	LinkTypeSCCP                   LinkType = 142
+	LinkTypeDOCSIS                 LinkType = 143
+	LinkTypeLinuxIRDA              LinkType = 144
+	LinkTypeLinuxLAPD              LinkType = 177
+	LinkTypeBluetoothHCIH4         LinkType = 187
+	LinkTypeBluetoothHCIH4WithPhdr LinkType = 201
+	LinkTypeLinuxUSB               LinkType = 220
+	LinkTypeFC2                    LinkType = 224
+	LinkTypeFC2Framed              LinkType = 225
+	LinkTypeIPv4                   LinkType = 228
+	LinkTypeIPv6                   LinkType = 229
 )
 
 // PPPoECode is the PPPoE code enum, taken from http://tools.ietf.org/html/rfc2516
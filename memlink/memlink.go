@@ -0,0 +1,330 @@
+// Copyright 2012 Google, Inc. All rights reserved.
+//
+// Use of this source code is governed by a BSD-style license
+// that can be found in the LICENSE file in the root of the source
+// tree.
+
+// Package memlink provides in-memory links, to test code reading and writing
+// packets without a real interface or libpcap.
+//
+// A link connects two endpoints.  Each endpoint is a
+// gopacket.PacketDataSource and gopacket.ZeroCopyPacketDataSource for the
+// packets its peer writes, and has a WritePacketData method like pcap.Handle,
+// so it can be used with gopacket.NewPacketSource and
+// gopacket.NewRawPacketDataWriter.  The link can delay, lose, reorder and
+// duplicate packets, and reject packets exceeding its MTU, similar to Linux's
+// netem.  The random decisions are taken from a seeded generator, so they are
+// the same every time a test runs.
+//
+// Usage:
+//
+//	client, server, _ := memlink.New(memlink.Options{Latency: time.Millisecond, Loss: 0.1})
+//	go serve(server)
+//	client.WritePacketData(request)
+//	src := gopacket.NewPacketSource(client, layers.LayerTypeEthernet)
+//	reply, err := src.NextPacket()
+package memlink
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"math/rand"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/davidsonff/gopacket"
+	"github.com/davidsonff/gopacket/layers"
+	"github.com/davidsonff/gopacket/pcapgo"
+)
+
+// ErrClosed is returned by WritePacketData once the link is closed.
+var ErrClosed = errors.New("link closed")
+
+// ErrTimeout is returned by ReadPacketData if no packet arrived within
+// Options.ReadTimeout.
+var ErrTimeout = errors.New("read timeout")
+
+// ErrTooBig is returned by WritePacketData for packets exceeding the MTU.
+var ErrTooBig = errors.New("packet exceeds MTU")
+
+// Options configures a link.  The zero value is a perfect link, delivering
+// packets immediately.
+type Options struct {
+	// Latency delays every packet.
+	Latency time.Duration
+	// Jitter adds a random delay of up to Jitter to every packet.  Packets
+	// keep their order, unless Reorder is set.
+	Jitter time.Duration
+	// Loss is the probability for a packet to be lost.
+	Loss float64
+	// Duplicate is the probability for a packet to be delivered twice.
+	Duplicate float64
+	// Reorder is the probability for a packet to be delivered without
+	// Latency and Jitter, overtaking the packets in flight, like netem's
+	// reorder.  It has no effect without Latency or Jitter.
+	Reorder float64
+	// MTU is the largest packet payload accepted, not counting the link
+	// layer header of 14 bytes with LinkTypeEthernet.  0 accepts packets of
+	// any length.
+	MTU int
+	// LinkType is the link type of the packets, used for the MTU and the
+	// tap.  It defaults to LinkTypeEthernet.
+	LinkType layers.LinkType
+	// ReadTimeout makes reads return ErrTimeout if no packet arrived in
+	// time.  0 blocks until a packet arrives or the link is closed.
+	ReadTimeout time.Duration
+	// Seed seeds the random decisions of the link.
+	Seed int64
+	// Tap, if set, receives a pcapng capture of the packets entering the
+	// link.  Each endpoint is an interface named after Names, and packets
+	// are recorded as outbound on the interface of the endpoint writing
+	// them.  Lost packets are not recorded, duplicated packets twice.
+	Tap io.Writer
+	// Names are the names of the two endpoints in the tap.  They default
+	// to "a" and "b".
+	Names [2]string
+}
+
+func (o *Options) check() error {
+	for _, p := range []float64{o.Loss, o.Duplicate, o.Reorder} {
+		if p < 0 || p > 1 {
+			return fmt.Errorf("probability %v not in [0, 1]", p)
+		}
+	}
+	if o.Latency < 0 || o.Jitter < 0 || o.ReadTimeout < 0 {
+		return errors.New("negative duration")
+	}
+	if o.MTU < 0 {
+		return fmt.Errorf("negative MTU %d", o.MTU)
+	}
+	return nil
+}
+
+// Stats holds the counters of an endpoint.
+type Stats struct {
+	// Sent is the number of packets written by the endpoint, and accepted
+	// by the link.
+	Sent int64
+	// Received is the number of packets read by the endpoint.
+	Received int64
+	// Lost, Duplicated and Reordered are the number of packets written by
+	// the endpoint that the link lost, duplicated and reordered.
+	Lost, Duplicated, Reordered int64
+}
+
+// link is the state shared by the two endpoints.
+type link struct {
+	mu      sync.Mutex
+	opts    Options
+	maxLen  int
+	rand    *rand.Rand
+	tap     *pcapgo.NgWriter
+	closed  bool
+	changed chan struct{} // closed and replaced when packets arrive or the link closes
+}
+
+// Endpoint is one end of a link.
+type Endpoint struct {
+	link  *link
+	index int
+	peer  *Endpoint
+	// queue holds the packets in flight to this endpoint, ordered by
+	// arrival.
+	queue []packet
+	stats Stats
+}
+
+type packet struct {
+	at   time.Time
+	data []byte
+}
+
+// New returns the two endpoints of a new link.
+func New(opts Options) (*Endpoint, *Endpoint, error) {
+	if err := opts.check(); err != nil {
+		return nil, nil, err
+	}
+	if opts.LinkType == layers.LinkTypeNull {
+		opts.LinkType = layers.LinkTypeEthernet
+	}
+	if opts.Names == [2]string{} {
+		opts.Names = [2]string{"a", "b"}
+	}
+	l := &link{
+		opts:    opts,
+		rand:    rand.New(rand.NewSource(opts.Seed)),
+		changed: make(chan struct{}),
+	}
+	if opts.MTU > 0 {
+		l.maxLen = opts.MTU
+		if opts.LinkType == layers.LinkTypeEthernet {
+			l.maxLen += 14
+		}
+	}
+	if opts.Tap != nil {
+		var err error
+		intf := pcapgo.NgInterface{Name: opts.Names[0], LinkType: opts.LinkType}
+		if l.tap, err = pcapgo.NewNgWriterInterface(opts.Tap, intf, pcapgo.DefaultNgWriterOptions); err != nil {
+			return nil, nil, err
+		}
+		intf.Name = opts.Names[1]
+		if _, err = l.tap.AddInterface(intf); err != nil {
+			return nil, nil, err
+		}
+	}
+	a := &Endpoint{link: l, index: 0}
+	b := &Endpoint{link: l, index: 1, peer: a}
+	a.peer = b
+	return a, b, nil
+}
+
+// Stats returns the counters of the endpoint.
+func (e *Endpoint) Stats() Stats {
+	e.link.mu.Lock()
+	defer e.link.mu.Unlock()
+	return e.stats
+}
+
+// notify wakes up the readers.  l.mu must be held.
+func (l *link) notify() {
+	close(l.changed)
+	l.changed = make(chan struct{})
+}
+
+// chance returns true with probability p.  l.mu must be held.
+func (l *link) chance(p float64) bool {
+	return p > 0 && l.rand.Float64() < p
+}
+
+// WritePacketData sends a copy of data to the peer of the endpoint.  A packet
+// lost by the link is not an error.
+func (e *Endpoint) WritePacketData(data []byte) error {
+	l := e.link
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	if l.closed {
+		return ErrClosed
+	}
+	if l.maxLen > 0 && len(data) > l.maxLen {
+		return ErrTooBig
+	}
+	if l.chance(l.opts.Loss) {
+		e.stats.Lost++
+		return nil
+	}
+	e.stats.Sent++
+	copies := 1
+	if l.chance(l.opts.Duplicate) {
+		e.stats.Duplicated++
+		copies = 2
+	}
+	now := time.Now()
+	for i := 0; i < copies; i++ {
+		delay := l.opts.Latency
+		if l.opts.Jitter > 0 {
+			delay += time.Duration(l.rand.Int63n(int64(l.opts.Jitter)))
+		}
+		if l.chance(l.opts.Reorder) {
+			e.stats.Reordered++
+			delay = 0
+		}
+		at := now.Add(delay)
+		// Without reordering, a packet never overtakes the packets in
+		// flight, whatever its jitter.
+		q := e.peer.queue
+		if delay > 0 && len(q) > 0 && q[len(q)-1].at.After(at) {
+			at = q[len(q)-1].at
+		}
+		p := packet{at: at, data: append([]byte(nil), data...)}
+		pos := sort.Search(len(q), func(i int) bool { return q[i].at.After(at) })
+		q = append(q, packet{})
+		copy(q[pos+1:], q[pos:])
+		q[pos] = p
+		e.peer.queue = q
+		if l.tap != nil {
+			ci := gopacket.CaptureInfo{Timestamp: now, CaptureLength: len(data), Length: len(data), InterfaceIndex: e.index}
+			flags := pcapgo.NewNgPacketFlags(pcapgo.NgPacketDirectionOutbound, 0, 0)
+			if err := l.tap.WritePacketWithOptions(ci, p.data, pcapgo.NgPacketOptions{Flags: flags}); err != nil {
+				return err
+			}
+		}
+	}
+	l.notify()
+	return nil
+}
+
+// ZeroCopyReadPacketData returns the next packet written by the peer.  It
+// blocks until the packet arrives.  Once the link is closed, it returns the
+// packets still in flight, and then io.EOF.  The returned buffer belongs to
+// the endpoint, and must not be used after the next call.
+func (e *Endpoint) ZeroCopyReadPacketData() (data []byte, ci gopacket.CaptureInfo, err error) {
+	l := e.link
+	var timeout <-chan time.Time
+	if l.opts.ReadTimeout > 0 {
+		t := time.NewTimer(l.opts.ReadTimeout)
+		defer t.Stop()
+		timeout = t.C
+	}
+	for {
+		l.mu.Lock()
+		var wait *time.Timer
+		if len(e.queue) > 0 {
+			p := e.queue[0]
+			d := time.Until(p.at)
+			if d <= 0 {
+				e.queue[0] = packet{}
+				e.queue = e.queue[1:]
+				e.stats.Received++
+				l.mu.Unlock()
+				ci = gopacket.CaptureInfo{Timestamp: p.at, CaptureLength: len(p.data), Length: len(p.data), InterfaceIndex: e.index}
+				return p.data, ci, nil
+			}
+			wait = time.NewTimer(d)
+		} else if l.closed {
+			l.mu.Unlock()
+			return nil, ci, io.EOF
+		}
+		changed := l.changed
+		l.mu.Unlock()
+
+		var arrived <-chan time.Time
+		if wait != nil {
+			arrived = wait.C
+		}
+		select {
+		case <-changed:
+		case <-arrived:
+		case <-timeout:
+			return nil, ci, ErrTimeout
+		}
+		if wait != nil {
+			wait.Stop()
+		}
+	}
+}
+
+// ReadPacketData returns the next packet written by the peer, like
+// ZeroCopyReadPacketData.  The returned buffer belongs to the caller.
+func (e *Endpoint) ReadPacketData() (data []byte, ci gopacket.CaptureInfo, err error) {
+	// Every packet in flight has its own buffer already.
+	return e.ZeroCopyReadPacketData()
+}
+
+// Close closes the link for both endpoints, and flushes the tap.  Writes
+// fail afterwards, and reads return the packets still in flight.
+func (e *Endpoint) Close() error {
+	l := e.link
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	if l.closed {
+		return nil
+	}
+	l.closed = true
+	l.notify()
+	if l.tap != nil {
+		return l.tap.Flush()
+	}
+	return nil
+}
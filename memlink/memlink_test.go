@@ -0,0 +1,294 @@
+// Copyright 2012 Google, Inc. All rights reserved.
+//
+// Use of this source code is governed by a BSD-style license
+// that can be found in the LICENSE file in the root of the source
+// tree.
+
+package memlink
+
+import (
+	"bytes"
+	"io"
+	"net"
+	"reflect"
+	"testing"
+	"time"
+
+	"github.com/davidsonff/gopacket"
+	"github.com/davidsonff/gopacket/layers"
+	"github.com/davidsonff/gopacket/pcapgo"
+)
+
+// frame returns an Ethernet frame of 60 bytes numbered i.
+func frame(i int) []byte {
+	data := make([]byte, 60)
+	copy(data, []byte{0xff, 0xff, 0xff, 0xff, 0xff, 0xff, 0x02, 0, 0, 0, 0, 1, 0x88, 0xb5})
+	data[14], data[15] = byte(i>>8), byte(i)
+	return data
+}
+
+func number(data []byte) int {
+	return int(data[14])<<8 | int(data[15])
+}
+
+// transfer writes n frames from a to b, and returns the numbers of the frames
+// b received.
+func transfer(t *testing.T, a, b *Endpoint, n int) []int {
+	t.Helper()
+	for i := 0; i < n; i++ {
+		if err := a.WritePacketData(frame(i)); err != nil {
+			t.Fatal(err)
+		}
+	}
+	a.Close()
+	var got []int
+	for {
+		data, ci, err := b.ReadPacketData()
+		if err == io.EOF {
+			return got
+		}
+		if err != nil {
+			t.Fatal(err)
+		}
+		if ci.CaptureLength != len(data) || ci.Length != len(data) || ci.InterfaceIndex != b.index {
+			t.Errorf("bad capture info %+v", ci)
+		}
+		got = append(got, number(data))
+	}
+}
+
+func TestLink(t *testing.T) {
+	a, b, err := New(Options{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, e := range []*Endpoint{a, b} {
+		if err := e.WritePacketData(frame(e.index)); err != nil {
+			t.Fatal(err)
+		}
+	}
+	buf := frame(0)
+	a.WritePacketData(buf)
+	buf[14] = 0xff // the link has its own copy
+	if data, _, err := a.ZeroCopyReadPacketData(); err != nil || number(data) != 1 {
+		t.Errorf("a got %x, %v", data, err)
+	}
+	for i := 0; i < 2; i++ {
+		if data, _, err := b.ReadPacketData(); err != nil || number(data) != 0 {
+			t.Errorf("b got %x, %v", data, err)
+		}
+	}
+	if err := b.Close(); err != nil {
+		t.Fatal(err)
+	}
+	if err := a.WritePacketData(frame(0)); err != ErrClosed {
+		t.Errorf("write after close: %v", err)
+	}
+	if _, _, err := a.ReadPacketData(); err != io.EOF {
+		t.Errorf("read after close: %v", err)
+	}
+	if sa, sb := a.Stats(), b.Stats(); sa != (Stats{Sent: 2, Received: 1}) || sb != (Stats{Sent: 1, Received: 2}) {
+		t.Errorf("stats %+v %+v", sa, sb)
+	}
+}
+
+func TestImpairments(t *testing.T) {
+	const n = 1000
+	run := func(opts Options) ([]int, Stats) {
+		a, b, err := New(opts)
+		if err != nil {
+			t.Fatal(err)
+		}
+		got := transfer(t, a, b, n)
+		stats := a.Stats()
+		if stats.Sent+stats.Lost != n || int64(len(got)) != stats.Sent+stats.Duplicated || b.Stats().Received != int64(len(got)) {
+			t.Errorf("%+v: got %d packets, stats %+v", opts, len(got), stats)
+		}
+		return got, stats
+	}
+	sorted := func(s []int) bool {
+		for i := 1; i < len(s); i++ {
+			if s[i] < s[i-1] {
+				return false
+			}
+		}
+		return true
+	}
+
+	for _, opts := range []Options{
+		{Loss: 0.2, Seed: 1},
+		{Duplicate: 0.2, Seed: 2},
+		{Latency: time.Millisecond, Jitter: time.Millisecond, Loss: 0.1, Duplicate: 0.1, Seed: 3},
+	} {
+		got, stats := run(opts)
+		if !sorted(got) {
+			t.Errorf("%+v: packets reordered", opts)
+		}
+		if opts.Loss > 0 && (float64(stats.Lost) < n*opts.Loss/2 || float64(stats.Lost) > n*opts.Loss*2) {
+			t.Errorf("%+v: lost %d packets", opts, stats.Lost)
+		}
+		if opts.Duplicate > 0 && (float64(stats.Duplicated) < n*opts.Duplicate/2 || float64(stats.Duplicated) > n*opts.Duplicate*2) {
+			t.Errorf("%+v: duplicated %d packets", opts, stats.Duplicated)
+		}
+		// The same seed gives the same result.
+		if again, _ := run(opts); !reflect.DeepEqual(got, again) {
+			t.Errorf("%+v: not deterministic", opts)
+		}
+	}
+
+	opts := Options{Latency: 20 * time.Millisecond, Reorder: 0.1, Seed: 4}
+	got, stats := run(opts)
+	if sorted(got) || stats.Reordered == 0 {
+		t.Errorf("%+v: %d packets reordered", opts, stats.Reordered)
+	}
+}
+
+func TestOptions(t *testing.T) {
+	for _, opts := range []Options{
+		{Loss: -0.1},
+		{Duplicate: 1.1},
+		{Latency: -time.Second},
+		{MTU: -1},
+	} {
+		if _, _, err := New(opts); err == nil {
+			t.Errorf("%+v: no error", opts)
+		}
+	}
+
+	a, b, _ := New(Options{MTU: 1500, Latency: 50 * time.Millisecond, ReadTimeout: 10 * time.Millisecond})
+	if err := a.WritePacketData(make([]byte, 1515)); err != ErrTooBig {
+		t.Errorf("oversized packet: %v", err)
+	}
+	if err := a.WritePacketData(make([]byte, 1514)); err != nil {
+		t.Fatal(err)
+	}
+	start := time.Now()
+	if _, _, err := b.ReadPacketData(); err != ErrTimeout {
+		t.Errorf("read before latency: %v", err)
+	}
+	for {
+		_, ci, err := b.ReadPacketData()
+		if err == ErrTimeout {
+			continue
+		}
+		if err != nil {
+			t.Fatal(err)
+		}
+		if d := time.Since(start); d < 40*time.Millisecond || ci.Timestamp.Before(start.Add(40*time.Millisecond)) {
+			t.Errorf("packet arrived after %v, at %v", d, ci.Timestamp.Sub(start))
+		}
+		break
+	}
+}
+
+func TestTap(t *testing.T) {
+	var tap bytes.Buffer
+	a, b, err := New(Options{Tap: &tap, Names: [2]string{"client", "server"}, Duplicate: 0.5, Seed: 1})
+	if err != nil {
+		t.Fatal(err)
+	}
+	for i := 0; i < 4; i++ {
+		a.WritePacketData(frame(i))
+	}
+	b.WritePacketData(frame(100))
+	a.Close()
+	sa, sb := a.Stats(), b.Stats()
+
+	r, err := pcapgo.NewNgReader(&tap, pcapgo.DefaultNgReaderOptions)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var got []int
+	for {
+		data, ci, opts, err := r.ReadPacketDataWithOptions()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			t.Fatal(err)
+		}
+		want := 0
+		if number(data) == 100 {
+			want = 1
+		}
+		if ci.InterfaceIndex != want || opts.Flags.Direction() != pcapgo.NgPacketDirectionOutbound {
+			t.Errorf("packet %d: interface %d, flags %v", number(data), ci.InterfaceIndex, opts.Flags)
+		}
+		got = append(got, number(data))
+	}
+	if int64(len(got)) != sa.Sent+sa.Duplicated+sb.Sent+sb.Duplicated || got[len(got)-1] != 100 {
+		t.Errorf("tap recorded %v, stats %+v %+v", got, sa, sb)
+	}
+	if intf, err := r.Interface(1); err != nil || intf.Name != "server" || intf.LinkType != layers.LinkTypeEthernet {
+		t.Errorf("interface %+v, %v", intf, err)
+	}
+}
+
+// TestARP resolves addresses with ARP, like examples/arpscan, over a lossy
+// link.
+func TestARP(t *testing.T) {
+	client, server, err := New(Options{Latency: time.Millisecond, Loss: 0.3, Seed: 5, ReadTimeout: 20 * time.Millisecond})
+	if err != nil {
+		t.Fatal(err)
+	}
+	clientMAC := net.HardwareAddr{0x02, 0, 0, 0, 0, 1}
+	serverMAC := net.HardwareAddr{0x02, 0, 0, 0, 0, 2}
+	clientIP, serverIP := net.IP{10, 0, 0, 1}, net.IP{10, 0, 0, 2}
+
+	arp := func(w *Endpoint, op uint16, srcMAC, dstMAC net.HardwareAddr, srcIP, dstIP net.IP) {
+		eth := &layers.Ethernet{SrcMAC: srcMAC, DstMAC: dstMAC, EthernetType: layers.EthernetTypeARP}
+		if op == layers.ARPRequest {
+			eth.DstMAC = layers.EthernetBroadcast
+		}
+		a := &layers.ARP{
+			AddrType: layers.LinkTypeEthernet, Protocol: layers.EthernetTypeIPv4,
+			HwAddressSize: 6, ProtAddressSize: 4, Operation: op,
+			SourceHwAddress: srcMAC, SourceProtAddress: srcIP,
+			DstHwAddress: dstMAC, DstProtAddress: dstIP,
+		}
+		buf := gopacket.NewSerializeBuffer()
+		gopacket.SerializeLayers(buf, gopacket.SerializeOptions{FixLengths: true}, eth, a)
+		w.WritePacketData(buf.Bytes())
+	}
+
+	// The server answers requests for its address until the link closes.
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		src := gopacket.NewPacketSource(server, layers.LayerTypeEthernet)
+		for {
+			p, err := src.NextPacket()
+			if err == ErrTimeout {
+				continue
+			}
+			if err != nil {
+				return
+			}
+			req, ok := p.Layer(layers.LayerTypeARP).(*layers.ARP)
+			if ok && req.Operation == layers.ARPRequest && net.IP(req.DstProtAddress).Equal(serverIP) {
+				arp(server, layers.ARPReply, serverMAC, req.SourceHwAddress, serverIP, req.SourceProtAddress)
+			}
+		}
+	}()
+
+	src := gopacket.NewPacketSource(client, layers.LayerTypeEthernet)
+	var resolved net.HardwareAddr
+	for tries := 0; resolved == nil && tries < 20; tries++ {
+		arp(client, layers.ARPRequest, clientMAC, net.HardwareAddr{0, 0, 0, 0, 0, 0}, clientIP, serverIP)
+		p, err := src.NextPacket()
+		if err == ErrTimeout {
+			continue
+		}
+		if err != nil {
+			t.Fatal(err)
+		}
+		if reply, ok := p.Layer(layers.LayerTypeARP).(*layers.ARP); ok && reply.Operation == layers.ARPReply {
+			resolved = reply.SourceHwAddress
+		}
+	}
+	client.Close()
+	<-done
+	if !bytes.Equal(resolved, serverMAC) {
+		t.Errorf("resolved %v, want %v", resolved, serverMAC)
+	}
+}
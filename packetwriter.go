@@ -0,0 +1,215 @@
+// Copyright 2012 Google, Inc. All rights reserved.
+//
+// Use of this source code is governed by a BSD-style license
+// that can be found in the LICENSE file in the root of the source
+// tree.
+
+package gopacket
+
+import (
+	"fmt"
+	"io"
+)
+
+// PacketDataWriter is an interface for some destination of packet data, the
+// counterpart of PacketDataSource.  Files and live interfaces are wrapped into
+// a PacketDataWriter with NewPacketDataWriter and NewRawPacketDataWriter, so
+// that pipelines can be composed without knowing the backends, for example
+// with Tee and MultiWriter.
+type PacketDataWriter interface {
+	// WritePacket writes a single packet.  Writers to files store ci with
+	// the packet, writers to live interfaces ignore it.
+	WritePacket(ci CaptureInfo, data []byte) error
+	// WritePackets writes the packets data[i] with the capture info ci[i],
+	// and returns the number of packets written.  ci and data must have the
+	// same length.  Backends supporting it write the packets with fewer
+	// syscalls than calling WritePacket for each packet.
+	WritePackets(ci []CaptureInfo, data [][]byte) (int, error)
+	// Close flushes buffered packets, and closes the destination.
+	io.Closer
+}
+
+// CaptureInfoWriter is implemented by writers storing the capture info of the
+// packets, like pcapgo.Writer, pcapgo.NgWriter and pcapgo.RotatingWriter.
+type CaptureInfoWriter interface {
+	WritePacket(ci CaptureInfo, data []byte) error
+}
+
+// RawPacketDataWriter is implemented by handles injecting packets into live
+// interfaces, like pcap.Handle, afpacket.TPacket, afxdp.Socket and
+// pcapgo.EthernetHandle.
+type RawPacketDataWriter interface {
+	WritePacketData(data []byte) error
+}
+
+// errBatchLength is returned by WritePackets if ci and data don't match.
+func errBatchLength(ci []CaptureInfo, data [][]byte) error {
+	return fmt.Errorf("batch has %d capture infos for %d packets", len(ci), len(data))
+}
+
+// closeOrFlush closes w if it has a Close method, or else flushes it if it
+// has a Flush method.
+func closeOrFlush(w interface{}) error {
+	switch w := w.(type) {
+	case interface{ Close() error }:
+		return w.Close()
+	case interface{ Close() }:
+		w.Close()
+	case interface{ Flush() error }:
+		return w.Flush()
+	}
+	return nil
+}
+
+// NewPacketDataWriter returns a PacketDataWriter writing to w.  Close closes w
+// if it has a Close method, or else flushes it if it has a Flush method, like
+// pcapgo.NgWriter.  The io.Writer below a pcapgo writer is not closed.
+func NewPacketDataWriter(w CaptureInfoWriter) PacketDataWriter {
+	if pw, ok := w.(PacketDataWriter); ok {
+		return pw
+	}
+	return captureInfoWriter{w}
+}
+
+type captureInfoWriter struct {
+	w CaptureInfoWriter
+}
+
+func (w captureInfoWriter) WritePacket(ci CaptureInfo, data []byte) error {
+	return w.w.WritePacket(ci, data)
+}
+
+func (w captureInfoWriter) WritePackets(ci []CaptureInfo, data [][]byte) (int, error) {
+	if len(ci) != len(data) {
+		return 0, errBatchLength(ci, data)
+	}
+	for i := range data {
+		if err := w.w.WritePacket(ci[i], data[i]); err != nil {
+			return i, err
+		}
+	}
+	return len(data), nil
+}
+
+func (w captureInfoWriter) Close() error {
+	return closeOrFlush(w.w)
+}
+
+// NewRawPacketDataWriter returns a PacketDataWriter injecting packets with w.
+// The capture info of the packets is ignored.  If w has a
+// WritePacketDataBatch([][]byte) (int, error) method, like afpacket.TPacket
+// and afxdp.Socket, it is used for WritePackets.  Close closes w.
+func NewRawPacketDataWriter(w RawPacketDataWriter) PacketDataWriter {
+	return rawPacketDataWriter{w}
+}
+
+type rawPacketDataWriter struct {
+	w RawPacketDataWriter
+}
+
+func (w rawPacketDataWriter) WritePacket(ci CaptureInfo, data []byte) error {
+	return w.w.WritePacketData(data)
+}
+
+func (w rawPacketDataWriter) WritePackets(ci []CaptureInfo, data [][]byte) (int, error) {
+	if len(ci) != len(data) {
+		return 0, errBatchLength(ci, data)
+	}
+	if b, ok := w.w.(interface {
+		WritePacketDataBatch([][]byte) (int, error)
+	}); ok {
+		return b.WritePacketDataBatch(data)
+	}
+	for i := range data {
+		if err := w.w.WritePacketData(data[i]); err != nil {
+			return i, err
+		}
+	}
+	return len(data), nil
+}
+
+func (w rawPacketDataWriter) Close() error {
+	return closeOrFlush(w.w)
+}
+
+// MultiWriter returns a PacketDataWriter duplicating its writes to all the
+// given writers, similar to io.MultiWriter.  A write stops at the first
+// writer returning an error.  Close closes all writers, and returns the first
+// error.
+func MultiWriter(writers ...PacketDataWriter) PacketDataWriter {
+	return multiWriter(append([]PacketDataWriter(nil), writers...))
+}
+
+type multiWriter []PacketDataWriter
+
+func (m multiWriter) WritePacket(ci CaptureInfo, data []byte) error {
+	for _, w := range m {
+		if err := w.WritePacket(ci, data); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (m multiWriter) WritePackets(ci []CaptureInfo, data [][]byte) (int, error) {
+	if len(ci) != len(data) {
+		return 0, errBatchLength(ci, data)
+	}
+	for _, w := range m {
+		if n, err := w.WritePackets(ci, data); err != nil {
+			return n, err
+		}
+	}
+	return len(data), nil
+}
+
+func (m multiWriter) Close() error {
+	var first error
+	for _, w := range m {
+		if err := w.Close(); err != nil && first == nil {
+			first = err
+		}
+	}
+	return first
+}
+
+// Tee returns a PacketDataSource writing every packet it reads from src to w,
+// similar to io.TeeReader.  Read errors of src are returned unchanged.  If
+// writing a packet fails, ReadPacketData returns a *TeeError, and the packet
+// is lost.
+//
+// Tee allows to record a capture while processing it:
+//
+//	src := gopacket.Tee(handle, gopacket.NewPacketDataWriter(fileWriter))
+//	for packet := range gopacket.NewPacketSource(src, layers.LinkTypeEthernet).Packets() {
+//	  ...
+//	}
+func Tee(src PacketDataSource, w PacketDataWriter) PacketDataSource {
+	return &tee{src, w}
+}
+
+// TeeError is returned by the PacketDataSource of Tee if writing a packet
+// failed, to tell write errors from the errors of the source.
+type TeeError struct {
+	Err error
+}
+
+func (e *TeeError) Error() string {
+	return "tee write failed: " + e.Err.Error()
+}
+
+type tee struct {
+	src PacketDataSource
+	w   PacketDataWriter
+}
+
+func (t *tee) ReadPacketData() ([]byte, CaptureInfo, error) {
+	data, ci, err := t.src.ReadPacketData()
+	if err != nil {
+		return data, ci, err
+	}
+	if err := t.w.WritePacket(ci, data); err != nil {
+		return nil, CaptureInfo{}, &TeeError{err}
+	}
+	return data, ci, nil
+}
@@ -0,0 +1,159 @@
+// Copyright 2012 Google, Inc. All rights reserved.
+//
+// Use of this source code is governed by a BSD-style license
+// that can be found in the LICENSE file in the root of the source
+// tree.
+
+package gopacket
+
+import (
+	"errors"
+	"io"
+	"testing"
+)
+
+// recorder stores the packets written to it.
+type recorder struct {
+	ci      []CaptureInfo
+	data    [][]byte
+	batches int
+	closed  int
+	flushed int
+	err     error
+}
+
+func (r *recorder) WritePacket(ci CaptureInfo, data []byte) error {
+	if r.err != nil {
+		return r.err
+	}
+	r.ci = append(r.ci, ci)
+	r.data = append(r.data, data)
+	return nil
+}
+
+func (r *recorder) WritePacketData(data []byte) error {
+	return r.WritePacket(CaptureInfo{}, data)
+}
+
+// flusher is flushed, like pcapgo.NgWriter.
+type flusher struct{ *recorder }
+
+func (f flusher) Flush() error { f.flushed++; return nil }
+
+// handle is closed without an error, like pcap.Handle.
+type handle struct{ *recorder }
+
+func (h handle) WritePacketData(data []byte) error { return h.recorder.WritePacketData(data) }
+func (h handle) Close()                            { h.closed++ }
+
+// batchHandle has a batch write method, like afpacket.TPacket.
+type batchHandle struct{ handle }
+
+func (h batchHandle) WritePacketDataBatch(data [][]byte) (int, error) {
+	h.batches++
+	for _, d := range data {
+		h.WritePacketData(d)
+	}
+	return len(data), nil
+}
+
+func testBatch() ([]CaptureInfo, [][]byte) {
+	return []CaptureInfo{{CaptureLength: 1, Length: 1}, {CaptureLength: 2, Length: 2}},
+		[][]byte{{1}, {2, 2}}
+}
+
+func TestPacketDataWriter(t *testing.T) {
+	ci, data := testBatch()
+
+	r := &recorder{}
+	w := NewPacketDataWriter(flusher{r})
+	if n, err := w.WritePackets(ci, data); n != 2 || err != nil {
+		t.Fatalf("got %d, %v", n, err)
+	}
+	if err := w.Close(); err != nil || r.flushed != 1 || len(r.ci) != 2 || r.ci[1].Length != 2 {
+		t.Errorf("bad writes %+v", r)
+	}
+	if _, err := w.WritePackets(ci[:1], data); err == nil {
+		t.Error("mismatched batch accepted")
+	}
+
+	r = &recorder{}
+	w = NewRawPacketDataWriter(handle{r})
+	w.WritePacket(ci[0], data[0])
+	w.WritePackets(ci, data)
+	if w.Close(); r.closed != 1 || len(r.data) != 3 || r.batches != 0 {
+		t.Errorf("bad writes %+v", r)
+	}
+
+	r = &recorder{}
+	w = NewRawPacketDataWriter(batchHandle{handle{r}})
+	if n, err := w.WritePackets(ci, data); n != 2 || err != nil || r.batches != 1 || len(r.data) != 2 {
+		t.Errorf("got %d, %v, %+v", n, err, r)
+	}
+
+	werr := errors.New("write failed")
+	r = &recorder{err: werr}
+	if n, err := NewRawPacketDataWriter(r).WritePackets(ci, data); n != 0 || err != werr {
+		t.Errorf("got %d, %v", n, err)
+	}
+}
+
+func TestMultiWriter(t *testing.T) {
+	ci, data := testBatch()
+	a, b := &recorder{}, &recorder{}
+	w := MultiWriter(NewPacketDataWriter(flusher{a}), NewRawPacketDataWriter(handle{b}))
+	w.WritePacket(ci[0], data[0])
+	if n, err := w.WritePackets(ci, data); n != 2 || err != nil {
+		t.Fatalf("got %d, %v", n, err)
+	}
+	if err := w.Close(); err != nil || len(a.data) != 3 || len(b.data) != 3 || a.flushed != 1 || b.closed != 1 {
+		t.Errorf("bad writes %+v %+v", a, b)
+	}
+
+	werr := errors.New("write failed")
+	a, b = &recorder{err: werr}, &recorder{}
+	w = MultiWriter(NewPacketDataWriter(a), NewPacketDataWriter(b))
+	if err := w.WritePacket(ci[0], data[0]); err != werr || len(b.data) != 0 {
+		t.Errorf("got %v, %+v", err, b)
+	}
+}
+
+type source struct {
+	data [][]byte
+}
+
+func (s *source) ReadPacketData() ([]byte, CaptureInfo, error) {
+	if len(s.data) == 0 {
+		return nil, CaptureInfo{}, io.EOF
+	}
+	d := s.data[0]
+	s.data = s.data[1:]
+	return d, CaptureInfo{CaptureLength: len(d), Length: len(d)}, nil
+}
+
+func TestTee(t *testing.T) {
+	_, data := testBatch()
+	r := &recorder{}
+	src := Tee(&source{data}, NewPacketDataWriter(r))
+	for i := 0; ; i++ {
+		d, ci, err := src.ReadPacketData()
+		if err == io.EOF {
+			if i != 2 {
+				t.Errorf("read %d packets", i)
+			}
+			break
+		}
+		if err != nil || ci.Length != len(d) {
+			t.Fatalf("got %v, %+v", err, ci)
+		}
+	}
+	if len(r.data) != 2 || r.ci[1].Length != 2 {
+		t.Errorf("bad writes %+v", r)
+	}
+
+	werr := errors.New("write failed")
+	src = Tee(&source{data}, NewPacketDataWriter(&recorder{err: werr}))
+	if _, _, err := src.ReadPacketData(); err == nil || err.(*TeeError).Err != werr {
+		t.Errorf("got %v", err)
+	}
+}
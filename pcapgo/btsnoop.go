@@ -0,0 +1,165 @@
+// Copyright 2018 The GoPacket Authors. All rights reserved.
+//
+// Use of this source code is governed by a BSD-style license
+// that can be found in the LICENSE file in the root of the source
+// tree.
+
+package pcapgo
+
+import (
+	"bytes"
+	"encoding/binary"
+	"fmt"
+	"io"
+	"time"
+
+	"github.com/davidsonff/gopacket"
+	"github.com/davidsonff/gopacket/layers"
+)
+
+var btsnoopMagic = []byte("btsnoop\x00")
+
+const btsnoopVersion = 1
+
+// btsnoop datalink types
+const (
+	btsnoopDatalinkH1   = 1001
+	btsnoopDatalinkUART = 1002
+)
+
+// btsnoopEpochOffset is the number of microseconds between 0 AD, the btsnoop epoch, and the unix epoch
+const btsnoopEpochOffset = 0x00dcddb30f2f8000
+
+// btsnoopMaxCaptureLength is the maximum capture length accepted, so that a corrupted record doesn't allocate gigabytes
+const btsnoopMaxCaptureLength = 256 * 1024
+
+// btsnoop packet flags
+const (
+	btsnoopFlagReceived = 1 << 0
+	btsnoopFlagCommand  = 1 << 1
+)
+
+// HCI packet types, prepended to H1 packets
+const (
+	hciPacketCommand = 0x01
+	hciPacketACL     = 0x02
+	hciPacketEvent   = 0x04
+)
+
+// BtsnoopReader reads Bluetooth HCI packets from btsnoop files, as written by Android (btsnoop_hci.log) and BlueZ. The format is derived
+// from snoop (see https://tools.ietf.org/html/rfc1761), with a 64 bit timestamp in microseconds since 0 AD.
+//
+// Packets are returned with LinkTypeBluetoothHCIH4WithPhdr: the direction of the packet (0 sent by the host, 1 received by the host) as
+// 4 byte big endian integer followed by the H4 packet. The packet type of H1 (non-UART) files is reconstructed from the packet flags.
+// Only H1 and H4 (UART) files are supported.
+type BtsnoopReader struct {
+	r        io.Reader
+	datalink uint32
+	// reusable
+	buf       [24]byte
+	packetBuf []byte
+}
+
+// NewBtsnoopReader returns a new BtsnoopReader reading from r. The file header is read at this point.
+func NewBtsnoopReader(r io.Reader) (*BtsnoopReader, error) {
+	ret := &BtsnoopReader{r: r}
+	var buf [16]byte
+	if _, err := io.ReadFull(r, buf[:]); err != nil {
+		return nil, err
+	}
+	if !bytes.Equal(buf[:8], btsnoopMagic) {
+		return nil, fmt.Errorf("Unknown btsnoop magic %x", buf[:8])
+	}
+	if version := binary.BigEndian.Uint32(buf[8:12]); version != btsnoopVersion {
+		return nil, fmt.Errorf("Unknown btsnoop version %d", version)
+	}
+	ret.datalink = binary.BigEndian.Uint32(buf[12:16])
+	if ret.datalink != btsnoopDatalinkH1 && ret.datalink != btsnoopDatalinkUART {
+		return nil, fmt.Errorf("Unsupported btsnoop datalink %d", ret.datalink)
+	}
+	return ret, nil
+}
+
+// readPacketHeader reads the next record header and returns the capture info and the number of bytes prepended to the packet
+func (r *BtsnoopReader) readPacketHeader() (ci gopacket.CaptureInfo, prefix int, err error) {
+	if _, err = io.ReadFull(r.r, r.buf[:]); err != nil {
+		return
+	}
+	// original length, included length, flags, cumulative drops, timestamp
+	// the lengths are checked before converting them to int, which has 32 bits on some platforms
+	length := binary.BigEndian.Uint32(r.buf[0:4])
+	captureLength := binary.BigEndian.Uint32(r.buf[4:8])
+	flags := binary.BigEndian.Uint32(r.buf[8:12])
+	micros := int64(binary.BigEndian.Uint64(r.buf[16:24])) - btsnoopEpochOffset
+	ci.Timestamp = time.Unix(micros/1000000, (micros%1000000)*1000).UTC()
+	if captureLength > length {
+		err = fmt.Errorf("capture length exceeds original packet length: %d > %d", captureLength, length)
+		return
+	}
+	if captureLength > btsnoopMaxCaptureLength {
+		err = fmt.Errorf("capture length %d exceeds maximum of %d", captureLength, btsnoopMaxCaptureLength)
+		return
+	}
+	ci.Length = int(length)
+	ci.CaptureLength = int(captureLength)
+
+	// pseudo header
+	binary.BigEndian.PutUint32(r.buf[0:4], flags&btsnoopFlagReceived)
+	prefix = 4
+	if r.datalink == btsnoopDatalinkH1 {
+		switch {
+		case flags&btsnoopFlagCommand == 0:
+			r.buf[4] = hciPacketACL
+		case flags&btsnoopFlagReceived != 0:
+			r.buf[4] = hciPacketEvent
+		default:
+			r.buf[4] = hciPacketCommand
+		}
+		prefix = 5
+	}
+	ci.CaptureLength += prefix
+	ci.Length += prefix
+	return
+}
+
+// ReadPacketData reads the next packet.
+func (r *BtsnoopReader) ReadPacketData() (data []byte, ci gopacket.CaptureInfo, err error) {
+	var prefix int
+	if ci, prefix, err = r.readPacketHeader(); err != nil {
+		return
+	}
+	data = make([]byte, ci.CaptureLength)
+	copy(data, r.buf[:prefix])
+	if _, err = io.ReadFull(r.r, data[prefix:]); err == io.EOF {
+		err = io.ErrUnexpectedEOF
+	}
+	return
+}
+
+// ZeroCopyReadPacketData reads the next packet. The data buffer is owned by the BtsnoopReader,
+// and each call to ZeroCopyReadPacketData invalidates data returned by the previous one.
+func (r *BtsnoopReader) ZeroCopyReadPacketData() (data []byte, ci gopacket.CaptureInfo, err error) {
+	var prefix int
+	if ci, prefix, err = r.readPacketHeader(); err != nil {
+		return
+	}
+	if cap(r.packetBuf) < ci.CaptureLength {
+		r.packetBuf = make([]byte, ci.CaptureLength)
+	}
+	data = r.packetBuf[:ci.CaptureLength]
+	copy(data, r.buf[:prefix])
+	if _, err = io.ReadFull(r.r, data[prefix:]); err == io.EOF {
+		err = io.ErrUnexpectedEOF
+	}
+	return
+}
+
+// LinkType returns LinkTypeBluetoothHCIH4WithPhdr.
+func (r *BtsnoopReader) LinkType() layers.LinkType {
+	return layers.LinkTypeBluetoothHCIH4WithPhdr
+}
+
+// Resolution returns the timestamp resolution of btsnoop files, which is microseconds.
+func (r *BtsnoopReader) Resolution() gopacket.TimestampResolution {
+	return gopacket.TimestampResolutionMicrosecond
+}
@@ -0,0 +1,101 @@
+// Copyright 2018 The GoPacket Authors. All rights reserved.
+//
+// Use of this source code is governed by a BSD-style license
+// that can be found in the LICENSE file in the root of the source
+// tree.
+
+package pcapgo
+
+import (
+	"bytes"
+	"encoding/binary"
+	"io"
+	"testing"
+	"time"
+
+	"github.com/davidsonff/gopacket/layers"
+)
+
+// btsnoopTestFile returns a btsnoop file with the given datalink, and a packet per given flags
+func btsnoopTestFile(datalink uint32, flags ...uint32) []byte {
+	var buf bytes.Buffer
+	buf.Write(btsnoopMagic)
+	binary.Write(&buf, binary.BigEndian, []uint32{btsnoopVersion, datalink})
+	ts := time.Date(2018, 3, 4, 5, 6, 7, 8000, time.UTC)
+	for i, f := range flags {
+		data := []byte{byte(i), 0xaa, 0xbb}
+		binary.Write(&buf, binary.BigEndian, []uint32{uint32(len(data)), uint32(len(data)), f, 0})
+		binary.Write(&buf, binary.BigEndian, ts.UnixNano()/1000+btsnoopEpochOffset)
+		buf.Write(data)
+	}
+	return buf.Bytes()
+}
+
+func TestBtsnoopReader(t *testing.T) {
+	for _, test := range []struct {
+		name     string
+		datalink uint32
+		want     [][]byte
+	}{
+		{"H4", btsnoopDatalinkUART, [][]byte{
+			{0, 0, 0, 0, 0, 0xaa, 0xbb},
+			{0, 0, 0, 1, 1, 0xaa, 0xbb},
+			{0, 0, 0, 0, 2, 0xaa, 0xbb},
+			{0, 0, 0, 1, 3, 0xaa, 0xbb},
+		}},
+		{"H1", btsnoopDatalinkH1, [][]byte{
+			{0, 0, 0, 0, hciPacketACL, 0, 0xaa, 0xbb},
+			{0, 0, 0, 1, hciPacketACL, 1, 0xaa, 0xbb},
+			{0, 0, 0, 0, hciPacketCommand, 2, 0xaa, 0xbb},
+			{0, 0, 0, 1, hciPacketEvent, 3, 0xaa, 0xbb},
+		}},
+	} {
+		r, err := NewBtsnoopReader(bytes.NewReader(btsnoopTestFile(test.datalink, 0, 1, 2, 3)))
+		if err != nil {
+			t.Fatalf("[%s] %s", test.name, err)
+		}
+		if r.LinkType() != layers.LinkTypeBluetoothHCIH4WithPhdr {
+			t.Errorf("[%s] unexpected link type %d", test.name, r.LinkType())
+		}
+		for i, want := range test.want {
+			data, ci, err := r.ReadPacketData()
+			if err != nil {
+				t.Fatalf("[%s] packet %d: %s", test.name, i, err)
+			}
+			if !bytes.Equal(data, want) || ci.CaptureLength != len(want) || ci.Length != len(want) {
+				t.Errorf("[%s] packet %d: expected %x, got %x (%+v)", test.name, i, want, data, ci)
+			}
+			if !ci.Timestamp.Equal(time.Date(2018, 3, 4, 5, 6, 7, 8000, time.UTC)) {
+				t.Errorf("[%s] packet %d: unexpected timestamp %s", test.name, i, ci.Timestamp)
+			}
+		}
+		if _, _, err := r.ZeroCopyReadPacketData(); err != io.EOF {
+			t.Errorf("[%s] expected EOF, got %v", test.name, err)
+		}
+	}
+
+	if _, err := NewBtsnoopReader(bytes.NewReader(btsnoopTestFile(1004))); err == nil {
+		t.Error("expected an error for an unsupported datalink")
+	}
+}
+
+func TestBtsnoopCorruptLength(t *testing.T) {
+	file := btsnoopTestFile(btsnoopDatalinkUART, 0)
+	// original and included length of the first record
+	binary.BigEndian.PutUint32(file[16:20], 0xfffffff0)
+	binary.BigEndian.PutUint32(file[20:24], 0xfffffff0)
+	for _, zeroCopy := range []bool{false, true} {
+		r, err := NewBtsnoopReader(bytes.NewReader(file))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if zeroCopy {
+			_, _, err = r.ZeroCopyReadPacketData()
+		} else {
+			_, _, err = r.ReadPacketData()
+		}
+		if err == nil {
+			t.Errorf("zero copy %v: expected an error for a huge capture length", zeroCopy)
+		}
+	}
+}
@@ -38,6 +38,9 @@ type EthernetHandle struct {
 	mu     sync.Mutex
 	intf   int
 	addr   net.HardwareAddr
+	// ring is the TPACKET_V3 ring, if the handle was created with NewEthernetHandleWithRing
+	ring    *ring
+	snaplen int
 }
 
 // readOne reads a packet from the handle and returns a capture info + vlan info
@@ -123,6 +126,20 @@ func (h *EthernetHandle) readOne() (ci gopacket.CaptureInfo, vlan int, haveVlan
 // ReadPacketData implements gopacket.PacketDataSource. If this was captured on a vlan, the vlan id will be in the AncillaryData[0]
 func (h *EthernetHandle) ReadPacketData() ([]byte, gopacket.CaptureInfo, error) {
 	h.mu.Lock()
+	if h.ring != nil {
+		data, ci, vlan, haveVlan, err := h.readRing()
+		if err != nil {
+			h.mu.Unlock()
+			return nil, gopacket.CaptureInfo{}, err
+		}
+		b := make([]byte, len(data))
+		copy(b, data)
+		h.mu.Unlock()
+		if haveVlan {
+			ci.AncillaryData = []interface{}{vlan}
+		}
+		return b, ci, nil
+	}
 	ci, vlan, haveVlan, err := h.readOne()
 	if err != nil {
 		h.mu.Unlock()
@@ -145,6 +162,19 @@ func (h *EthernetHandle) ReadPacketData() ([]byte, gopacket.CaptureInfo, error)
 // This function does not allocate memory. Beware that the next call to ZeroCopyReadPacketData will overwrite existing slices (returned data AND AncillaryData)!
 // Due to shared buffers this must not be called concurrently
 func (h *EthernetHandle) ZeroCopyReadPacketData() ([]byte, gopacket.CaptureInfo, error) {
+	if h.ring != nil {
+		h.mu.Lock()
+		data, ci, vlan, haveVlan, err := h.readRing()
+		h.mu.Unlock()
+		if err != nil {
+			return nil, gopacket.CaptureInfo{}, err
+		}
+		if haveVlan {
+			h.ancil[0] = vlan
+			ci.AncillaryData = h.ancil
+		}
+		return data, ci, nil
+	}
 	ci, vlan, haveVlan, err := h.readOne()
 	if err != nil {
 		return nil, gopacket.CaptureInfo{}, fmt.Errorf("couldn't read packet data: %s", err)
@@ -158,9 +188,19 @@ func (h *EthernetHandle) ZeroCopyReadPacketData() ([]byte, gopacket.CaptureInfo,
 	return h.buffer[:ci.CaptureLength], ci, nil
 }
 
+// WritePacketData transmits a raw packet on the interface of the handle.
+func (h *EthernetHandle) WritePacketData(data []byte) error {
+	_, err := unix.Write(h.fd, data)
+	return err
+}
+
 // Close closes the underlying socket
 func (h *EthernetHandle) Close() {
 	if h.fd != -1 {
+		if h.ring != nil {
+			unix.Munmap(h.ring.data)
+			h.ring = nil
+		}
 		unix.Close(h.fd)
 		h.fd = -1
 		runtime.SetFinalizer(h, nil)
@@ -172,12 +212,20 @@ func (h *EthernetHandle) SetCaptureLength(len int) error {
 	if len < 0 {
 		return fmt.Errorf("illegal capture length %d. Must be at least 0", len)
 	}
+	if h.ring != nil {
+		// the ring always gets the full packet, which is truncated when read
+		h.snaplen = len
+		return nil
+	}
 	h.buffer = make([]byte, len)
 	return nil
 }
 
 // GetCaptureLength returns the maximum capture length
 func (h *EthernetHandle) GetCaptureLength() int {
+	if h.ring != nil {
+		return h.snaplen
+	}
 	return len(h.buffer)
 }
 
@@ -226,13 +274,33 @@ func (h *EthernetHandle) SetPromiscuous(b bool) error {
 	return unix.SetsockoptPacketMreq(h.fd, unix.SOL_PACKET, opt, &mreq)
 }
 
+// FanoutType is the type of fanout used by SetFanout. See afpacket.FanoutType.
+type FanoutType int
+
+// FanoutType values.
+const (
+	FanoutHash           FanoutType = unix.PACKET_FANOUT_HASH
+	FanoutHashWithDefrag FanoutType = unix.PACKET_FANOUT_FLAG_DEFRAG
+	FanoutLoadBalance    FanoutType = unix.PACKET_FANOUT_LB
+	FanoutCPU            FanoutType = unix.PACKET_FANOUT_CPU
+	FanoutRollover       FanoutType = unix.PACKET_FANOUT_ROLLOVER
+	FanoutRandom         FanoutType = unix.PACKET_FANOUT_RND
+	FanoutQueueMapping   FanoutType = unix.PACKET_FANOUT_QM
+)
+
+// SetFanout adds the handle to the fanout group id, which spreads the packets among all the sockets of the group according to the
+// fanout type. All members of the group, which can be in different processes, must use the same type.
+func (h *EthernetHandle) SetFanout(t FanoutType, id uint16) error {
+	return unix.SetsockoptInt(h.fd, unix.SOL_PACKET, unix.PACKET_FANOUT, int(t)<<16|int(id))
+}
+
 // Stats returns number of packets and dropped packets. This will be the number of packets/dropped packets since the last call to stats (not the cummulative sum!).
 func (h *EthernetHandle) Stats() (*unix.TpacketStats, error) {
 	return unix.GetsockoptTpacketStats(h.fd, unix.SOL_PACKET, unix.PACKET_STATISTICS)
 }
 
 // NewEthernetHandle implements pcap.OpenLive for network devices.
-// If you want better performance have a look at github.com/davidsonff/gopacket/afpacket.
+// If you want better performance have a look at NewEthernetHandleWithRing, or github.com/davidsonff/gopacket/afpacket.
 // SetCaptureLength can be used to limit the maximum capture length.
 func NewEthernetHandle(ifname string) (*EthernetHandle, error) {
 	intf, err := net.InterfaceByName(ifname)
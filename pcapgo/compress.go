@@ -0,0 +1,191 @@
+// Copyright 2018 The GoPacket Authors. All rights reserved.
+//
+// Use of this source code is governed by a BSD-style license
+// that can be found in the LICENSE file in the root of the source
+// tree.
+
+package pcapgo
+
+import (
+	"bufio"
+	"bytes"
+	"compress/gzip"
+	"fmt"
+	"io"
+	"path/filepath"
+	"strings"
+	"sync"
+)
+
+// Compression is a compression format of capture files.
+type Compression int
+
+const (
+	// CompressionNone is used for uncompressed files
+	CompressionNone Compression = iota
+	// CompressionGzip is gzip (.gz). It is always available.
+	CompressionGzip
+	// CompressionZstd is Zstandard (.zst). Reading is built in, unless pcapgo is built with the tag pcapgo_nozstd; writing needs a compressor
+	// registered with RegisterCompression.
+	CompressionZstd
+	// CompressionXz is xz (.xz) with the LZMA2 filter. Reading is built in, unless pcapgo is built with the tag pcapgo_noxz; writing needs a
+	// compressor registered with RegisterCompression.
+	CompressionXz
+	// CompressionLz4 is the lz4 frame format (.lz4). Reading is built in, unless pcapgo is built with the tag pcapgo_nolz4; writing needs a
+	// compressor registered with RegisterCompression.
+	CompressionLz4
+)
+
+var compressionNames = map[Compression]string{
+	CompressionNone: "none",
+	CompressionGzip: "gzip",
+	CompressionZstd: "zstd",
+	CompressionXz:   "xz",
+	CompressionLz4:  "lz4",
+}
+
+func (c Compression) String() string {
+	if name, ok := compressionNames[c]; ok {
+		return name
+	}
+	return fmt.Sprintf("Compression(%d)", int(c))
+}
+
+// compressionFormats lists the magic bytes and file extension of every compression format
+var compressionFormats = []struct {
+	compression Compression
+	magic       []byte
+	extension   string
+}{
+	{CompressionGzip, []byte{magicGzip1, magicGzip2}, ".gz"},
+	{CompressionZstd, []byte{0x28, 0xb5, 0x2f, 0xfd}, ".zst"},
+	{CompressionXz, []byte{0xfd, '7', 'z', 'X', 'Z', 0x00}, ".xz"},
+	{CompressionLz4, []byte{0x04, 0x22, 0x4d, 0x18}, ".lz4"},
+}
+
+// compressionMagicLength is the number of bytes needed to detect every compression format
+const compressionMagicLength = 6
+
+type compressionCodec struct {
+	newReader func(io.Reader) (io.Reader, error)
+	newWriter func(io.Writer) (io.WriteCloser, error)
+}
+
+var (
+	compressionMu     sync.RWMutex
+	compressionCodecs = map[Compression]compressionCodec{
+		CompressionGzip: {
+			newReader: func(r io.Reader) (io.Reader, error) { return gzip.NewReader(r) },
+			newWriter: func(w io.Writer) (io.WriteCloser, error) { return gzip.NewWriter(w), nil },
+		},
+	}
+)
+
+// RegisterCompression registers the decompressor and compressor used for the given compression format, replacing the built-in ones. This
+// keeps pcapgo free of dependencies on third party compression packages: pcapgo has pure Go decompressors for zstd, xz and lz4, and a
+// program that wants to write zstd compressed captures registers an encoder, e.g. in an init function. Either function may be nil, if only
+// reading or writing is needed.
+//
+//	pcapgo.RegisterCompression(pcapgo.CompressionZstd, func(r io.Reader) (io.Reader, error) {
+//		return zstd.NewReader(r)
+//	}, func(w io.Writer) (io.WriteCloser, error) {
+//		return zstd.NewWriter(w)
+//	})
+func RegisterCompression(c Compression, newReader func(io.Reader) (io.Reader, error), newWriter func(io.Writer) (io.WriteCloser, error)) {
+	compressionMu.Lock()
+	defer compressionMu.Unlock()
+	compressionCodecs[c] = compressionCodec{newReader: newReader, newWriter: newWriter}
+}
+
+func lookupCompression(c Compression) compressionCodec {
+	compressionMu.RLock()
+	defer compressionMu.RUnlock()
+	return compressionCodecs[c]
+}
+
+// DetectCompression returns the compression format of data starting with the given bytes. At least 6 bytes are needed to detect every format.
+func DetectCompression(magic []byte) Compression {
+	for _, format := range compressionFormats {
+		if bytes.HasPrefix(magic, format.magic) {
+			return format.compression
+		}
+	}
+	return CompressionNone
+}
+
+// CompressionFromName returns the compression format matching the extension of the given file name, e.g. CompressionGzip for capture.pcap.gz.
+func CompressionFromName(name string) Compression {
+	ext := strings.ToLower(filepath.Ext(name))
+	for _, format := range compressionFormats {
+		if ext == format.extension {
+			return format.compression
+		}
+	}
+	return CompressionNone
+}
+
+// NewDecompressor detects the compression format of r, and returns a reader returning the uncompressed data. Uncompressed data is returned as is.
+// An error is returned if the data is compressed with a format which has no registered decompressor.
+func NewDecompressor(r io.Reader) (io.Reader, Compression, error) {
+	br, ok := r.(*bufio.Reader)
+	if !ok {
+		br = bufio.NewReader(r)
+	}
+	// short files are detected as uncompressed, and fail while reading the header
+	magic, err := br.Peek(compressionMagicLength)
+	if err != nil && err != io.EOF {
+		return nil, CompressionNone, err
+	}
+	c := DetectCompression(magic)
+	if c == CompressionNone {
+		return br, c, nil
+	}
+	codec := lookupCompression(c)
+	if codec.newReader == nil {
+		return nil, c, fmt.Errorf("No decompressor registered for %s compressed captures", c)
+	}
+	dr, err := codec.newReader(br)
+	return dr, c, err
+}
+
+type nopWriteCloser struct {
+	io.Writer
+}
+
+func (nopWriteCloser) Close() error { return nil }
+
+// NewCompressor returns a writer compressing the data written to w with the given compression format. Close must be called to write out the
+// remaining data; it does not close w. CompressionNone returns a writer writing directly to w.
+func NewCompressor(w io.Writer, c Compression) (io.WriteCloser, error) {
+	if c == CompressionNone {
+		return nopWriteCloser{w}, nil
+	}
+	codec := lookupCompression(c)
+	if codec.newWriter == nil {
+		return nil, fmt.Errorf("No compressor registered for %s", c)
+	}
+	return codec.newWriter(w)
+}
+
+// unexpectedEOF turns io.EOF into io.ErrUnexpectedEOF, for data ending before a complete compressed stream.
+func unexpectedEOF(err error) error {
+	if err == io.EOF {
+		return io.ErrUnexpectedEOF
+	}
+	return err
+}
+
+// lzCopy appends length bytes starting offset bytes before the end of dst to dst, as needed by LZ77 style decompressors. The source may
+// overlap the copied bytes, repeating them. The caller must ensure that dst has room for length bytes.
+func lzCopy(dst []byte, offset, length int) []byte {
+	start := len(dst)
+	dst = dst[:start+length]
+	src := start - offset
+	if offset >= length {
+		copy(dst[start:], dst[src:src+length])
+		return dst
+	}
+	for i := start; i < start+length; i += copy(dst[i:start+length], dst[src:i]) {
+	}
+	return dst
+}
@@ -0,0 +1,379 @@
+// Copyright 2018 The GoPacket Authors. All rights reserved.
+//
+// Use of this source code is governed by a BSD-style license
+// that can be found in the LICENSE file in the root of the source
+// tree.
+
+// +build !pcapgo_nolz4
+
+package pcapgo
+
+import (
+	"bufio"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"math/bits"
+)
+
+// The lz4 frame format is documented at https://github.com/lz4/lz4/blob/dev/doc/lz4_Frame_format.md and the block format at
+// https://github.com/lz4/lz4/blob/dev/doc/lz4_Block_format.md.
+
+func init() {
+	RegisterCompression(CompressionLz4, newLz4Reader, nil)
+}
+
+const (
+	lz4Magic          = 0x184d2204
+	lz4SkippableMagic = 0x184d2a50 // the low 4 bits are user defined
+	lz4SkippableMask  = 0xfffffff0
+	lz4Window         = 64 * 1024 // the maximum match offset
+)
+
+// lz4 frame descriptor flags
+const (
+	lz4FlagDictID          = 1 << 0
+	lz4FlagContentChecksum = 1 << 2
+	lz4FlagContentSize     = 1 << 3
+	lz4FlagBlockChecksum   = 1 << 4
+	lz4FlagBlockIndep      = 1 << 5
+	lz4FlagVersionMask     = 3 << 6
+	lz4FlagVersion         = 1 << 6
+)
+
+var errLz4Corrupt = errors.New("Corrupt lz4 data")
+
+// lz4Reader decompresses a sequence of lz4 frames.
+type lz4Reader struct {
+	r   *bufio.Reader
+	err error
+	// the current frame
+	inFrame       bool
+	flags         byte
+	blockMax      int
+	contentHash   xxh32
+	contentSize   uint64 // from the header, if lz4FlagContentSize is set
+	contentLength uint64
+	// hist holds the last decompressed data, which is referenced by linked blocks, followed by the decompressed data not read yet: out
+	hist []byte
+	out  []byte
+	// reusable
+	block []byte
+}
+
+func newLz4Reader(r io.Reader) (io.Reader, error) {
+	br, ok := r.(*bufio.Reader)
+	if !ok {
+		br = bufio.NewReader(r)
+	}
+	ret := &lz4Reader{r: br}
+	// read the first frame header, so that the data is checked right away
+	if err := ret.readFrameHeader(true); err != nil {
+		return nil, err
+	}
+	return ret, nil
+}
+
+func (z *lz4Reader) Read(p []byte) (int, error) {
+	for len(z.out) == 0 {
+		if z.err != nil {
+			return 0, z.err
+		}
+		if z.inFrame {
+			z.err = z.readBlock()
+		} else {
+			z.err = z.readFrameHeader(false)
+		}
+	}
+	n := copy(p, z.out)
+	z.out = z.out[n:]
+	return n, nil
+}
+
+// readFrameHeader reads the header of the next frame, skipping skippable frames. At the end of the data io.EOF is returned, unless first is set.
+func (z *lz4Reader) readFrameHeader(first bool) error {
+	var buf [8]byte
+	for {
+		if _, err := io.ReadFull(z.r, buf[:4]); err != nil {
+			if err == io.EOF && first {
+				err = io.ErrUnexpectedEOF
+			}
+			return err
+		}
+		magic := binary.LittleEndian.Uint32(buf[:4])
+		if magic == lz4Magic {
+			break
+		}
+		if magic&lz4SkippableMask != lz4SkippableMagic {
+			return fmt.Errorf("Unknown lz4 magic %x", buf[:4])
+		}
+		if _, err := io.ReadFull(z.r, buf[:4]); err != nil {
+			return unexpectedEOF(err)
+		}
+		if _, err := z.r.Discard(int(binary.LittleEndian.Uint32(buf[:4]))); err != nil {
+			return unexpectedEOF(err)
+		}
+	}
+
+	// frame descriptor: flags, block descriptor, optional content size and dictionary id, header checksum
+	var descriptor [14]byte
+	if _, err := io.ReadFull(z.r, descriptor[:2]); err != nil {
+		return unexpectedEOF(err)
+	}
+	flags := descriptor[0]
+	if flags&lz4FlagVersionMask != lz4FlagVersion {
+		return fmt.Errorf("Unsupported lz4 version %d", flags>>6)
+	}
+	if flags&lz4FlagDictID != 0 {
+		return errors.New("lz4 frames with a dictionary are not supported")
+	}
+	blockSize := (descriptor[1] >> 4) & 7
+	if blockSize < 4 || flags&0x02 != 0 || descriptor[1]&0x8f != 0 {
+		return errLz4Corrupt
+	}
+	length := 2
+	if flags&lz4FlagContentSize != 0 {
+		length += 8
+	}
+	if _, err := io.ReadFull(z.r, descriptor[2:length+1]); err != nil {
+		return unexpectedEOF(err)
+	}
+	if byte(xxh32Sum(descriptor[:length])>>8) != descriptor[length] {
+		return errors.New("lz4 frame header checksum mismatch")
+	}
+
+	z.inFrame = true
+	z.flags = flags
+	z.blockMax = 1 << (8 + 2*blockSize)
+	if flags&lz4FlagContentSize != 0 {
+		z.contentSize = binary.LittleEndian.Uint64(descriptor[2:])
+	}
+	z.contentHash.reset()
+	z.contentLength = 0
+	z.hist = z.hist[:0]
+	return nil
+}
+
+// readBlock reads and decompresses the next block of the current frame, or the end of the frame.
+func (z *lz4Reader) readBlock() error {
+	var buf [4]byte
+	if _, err := io.ReadFull(z.r, buf[:]); err != nil {
+		return unexpectedEOF(err)
+	}
+	size := binary.LittleEndian.Uint32(buf[:])
+	if size == 0 {
+		return z.readFrameEnd()
+	}
+	uncompressed := size&(1<<31) != 0
+	size &^= 1 << 31
+	if int(size) > z.blockMax {
+		return errLz4Corrupt
+	}
+	if cap(z.block) < int(size) {
+		z.block = make([]byte, size)
+	}
+	block := z.block[:size]
+	if _, err := io.ReadFull(z.r, block); err != nil {
+		return unexpectedEOF(err)
+	}
+	if z.flags&lz4FlagBlockChecksum != 0 {
+		if _, err := io.ReadFull(z.r, buf[:]); err != nil {
+			return unexpectedEOF(err)
+		}
+		if xxh32Sum(block) != binary.LittleEndian.Uint32(buf[:]) {
+			return errors.New("lz4 block checksum mismatch")
+		}
+	}
+
+	// keep the window referenced by linked blocks, and make room for the block
+	keep := 0
+	if z.flags&lz4FlagBlockIndep == 0 {
+		keep = len(z.hist)
+		if keep > lz4Window {
+			keep = lz4Window
+		}
+	}
+	if cap(z.hist) < lz4Window+z.blockMax {
+		hist := make([]byte, keep, lz4Window+z.blockMax)
+		copy(hist, z.hist[len(z.hist)-keep:])
+		z.hist = hist
+	} else {
+		z.hist = z.hist[:copy(z.hist, z.hist[len(z.hist)-keep:])]
+	}
+
+	start := len(z.hist)
+	if uncompressed {
+		z.hist = append(z.hist, block...)
+	} else {
+		var err error
+		if z.hist, err = lz4DecodeBlock(z.hist, block, start+z.blockMax); err != nil {
+			return err
+		}
+	}
+	z.out = z.hist[start:]
+	z.contentLength += uint64(len(z.out))
+	if z.flags&lz4FlagContentChecksum != 0 {
+		z.contentHash.write(z.out)
+	}
+	return nil
+}
+
+// readFrameEnd reads the content checksum following the end mark.
+func (z *lz4Reader) readFrameEnd() error {
+	z.inFrame = false
+	if z.flags&lz4FlagContentSize != 0 && z.contentLength != z.contentSize {
+		return fmt.Errorf("lz4 frame has %d bytes instead of %d", z.contentLength, z.contentSize)
+	}
+	if z.flags&lz4FlagContentChecksum == 0 {
+		return nil
+	}
+	var buf [4]byte
+	if _, err := io.ReadFull(z.r, buf[:]); err != nil {
+		return unexpectedEOF(err)
+	}
+	if z.contentHash.sum(z.contentLength) != binary.LittleEndian.Uint32(buf[:]) {
+		return errors.New("lz4 content checksum mismatch")
+	}
+	return nil
+}
+
+// lz4DecodeBlock appends the decompressed block to dst, which holds the data referenced by matches, and returns the result. The result may
+// not exceed limit bytes.
+func lz4DecodeBlock(dst, block []byte, limit int) ([]byte, error) {
+	for i := 0; ; {
+		if i >= len(block) {
+			return nil, errLz4Corrupt
+		}
+		token := block[i]
+		i++
+		literals := int(token >> 4)
+		if literals == 15 {
+			n, ok := lz4Length(block, &i)
+			if !ok {
+				return nil, errLz4Corrupt
+			}
+			literals += n
+		}
+		if literals > len(block)-i || literals > limit-len(dst) {
+			return nil, errLz4Corrupt
+		}
+		dst = append(dst, block[i:i+literals]...)
+		i += literals
+		if i == len(block) {
+			// the last sequence has no match
+			return dst, nil
+		}
+
+		if len(block)-i < 2 {
+			return nil, errLz4Corrupt
+		}
+		offset := int(binary.LittleEndian.Uint16(block[i:]))
+		i += 2
+		length := int(token&15) + 4
+		if length == 19 {
+			n, ok := lz4Length(block, &i)
+			if !ok {
+				return nil, errLz4Corrupt
+			}
+			length += n
+		}
+		if offset == 0 || offset > len(dst) || length > limit-len(dst) {
+			return nil, errLz4Corrupt
+		}
+		dst = lzCopy(dst, offset, length)
+	}
+}
+
+// lz4Length reads the additional bytes of a literal or match length.
+func lz4Length(block []byte, i *int) (int, bool) {
+	n := 0
+	for *i < len(block) {
+		b := block[*i]
+		*i++
+		n += int(b)
+		if b != 255 {
+			return n, true
+		}
+	}
+	return 0, false
+}
+
+// xxh32 is the 32 bit xxHash (https://github.com/Cyan4973/xxHash/blob/dev/doc/xxhash_spec.md) with seed 0, as used by the lz4 checksums.
+type xxh32 struct {
+	v   [4]uint32
+	buf [16]byte
+	n   int
+}
+
+const (
+	xxh32Prime1 uint32 = 2654435761
+	xxh32Prime2 uint32 = 2246822519
+	xxh32Prime3 uint32 = 3266489917
+	xxh32Prime4 uint32 = 668265263
+	xxh32Prime5 uint32 = 374761393
+)
+
+func (h *xxh32) reset() {
+	// xxh32Prime1 + xxh32Prime2, xxh32Prime2, 0, -xxh32Prime1 modulo 2^32
+	h.v = [4]uint32{606290984, xxh32Prime2, 0, 1640531535}
+	h.n = 0
+}
+
+func xxh32Round(v, input uint32) uint32 {
+	return bits.RotateLeft32(v+input*xxh32Prime2, 13) * xxh32Prime1
+}
+
+func (h *xxh32) write(p []byte) {
+	if h.n > 0 {
+		n := copy(h.buf[h.n:], p)
+		h.n += n
+		p = p[n:]
+		if h.n < 16 {
+			return
+		}
+		h.stripe(h.buf[:])
+		h.n = 0
+	}
+	for ; len(p) >= 16; p = p[16:] {
+		h.stripe(p)
+	}
+	h.n = copy(h.buf[:], p)
+}
+
+func (h *xxh32) stripe(p []byte) {
+	for i := range h.v {
+		h.v[i] = xxh32Round(h.v[i], binary.LittleEndian.Uint32(p[4*i:]))
+	}
+}
+
+// sum returns the hash of the length bytes written.
+func (h *xxh32) sum(length uint64) uint32 {
+	var acc uint32
+	if length >= 16 {
+		acc = bits.RotateLeft32(h.v[0], 1) + bits.RotateLeft32(h.v[1], 7) + bits.RotateLeft32(h.v[2], 12) + bits.RotateLeft32(h.v[3], 18)
+	} else {
+		acc = h.v[2] + xxh32Prime5
+	}
+	acc += uint32(length)
+	p := h.buf[:h.n]
+	for ; len(p) >= 4; p = p[4:] {
+		acc = bits.RotateLeft32(acc+binary.LittleEndian.Uint32(p)*xxh32Prime3, 17) * xxh32Prime4
+	}
+	for _, b := range p {
+		acc = bits.RotateLeft32(acc+uint32(b)*xxh32Prime5, 11) * xxh32Prime1
+	}
+	acc ^= acc >> 15
+	acc *= xxh32Prime2
+	acc ^= acc >> 13
+	acc *= xxh32Prime3
+	acc ^= acc >> 16
+	return acc
+}
+
+func xxh32Sum(p []byte) uint32 {
+	var h xxh32
+	h.reset()
+	h.write(p)
+	return h.sum(uint64(len(p)))
+}
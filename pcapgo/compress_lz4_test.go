@@ -0,0 +1,92 @@
+// Copyright 2018 The GoPacket Authors. All rights reserved.
+//
+// Use of this source code is governed by a BSD-style license
+// that can be found in the LICENSE file in the root of the source
+// tree.
+
+// +build !pcapgo_nolz4
+
+package pcapgo
+
+import (
+	"bytes"
+	"testing"
+)
+
+func TestLz4Reader(t *testing.T) {
+	// linked blocks with block checksums, content size and content checksum
+	compressed, want := testDecompressFile(t, "capture.pcap.lz4", CompressionLz4, compressedTestCapture)
+	testDecompressDamaged(t, compressed, want)
+}
+
+// lz4TestFrame returns an lz4 frame with independent blocks
+func lz4TestFrame(blocks ...[]byte) []byte {
+	descriptor := []byte{0x60, 0x40}
+	frame := []byte{0x04, 0x22, 0x4d, 0x18}
+	frame = append(frame, descriptor...)
+	frame = append(frame, byte(xxh32Sum(descriptor)>>8))
+	for _, block := range blocks {
+		frame = append(frame, block...)
+	}
+	return append(frame, 0, 0, 0, 0)
+}
+
+func TestLz4Frames(t *testing.T) {
+	uncompressed := []byte{3, 0, 0, 0x80, 'a', 'b', 'c'}
+	// literals xy, a match of 5 bytes at offset 2, and the last literal z
+	compressed := []byte{7, 0, 0, 0, 0x21, 'x', 'y', 2, 0, 0x10, 'z'}
+	skippable := []byte{0x50, 0x2a, 0x4d, 0x18, 3, 0, 0, 0, 'f', 'o', 'o'}
+
+	for _, test := range []struct {
+		name string
+		data []byte
+		want string
+	}{
+		{"blocks", lz4TestFrame(uncompressed, compressed), "abcxyxyxyxz"},
+		{"frames", append(append(lz4TestFrame(compressed), skippable...), lz4TestFrame(uncompressed)...), "xyxyxyxzabc"},
+	} {
+		got, err := decompressAll(test.data)
+		if err != nil || string(got) != test.want {
+			t.Errorf("%s: got %q, %v", test.name, got, err)
+		}
+	}
+
+	for _, test := range []struct {
+		name string
+		data []byte
+	}{
+		// the blocks are independent, so the match can't reach the first block
+		{"offset", lz4TestFrame(uncompressed, []byte{4, 0, 0, 0, 0x00, 3, 0, 0x00})},
+		{"match at the end", lz4TestFrame([]byte{4, 0, 0, 0, 0x10, 'a', 1, 0})},
+		{"literals", lz4TestFrame([]byte{2, 0, 0, 0, 0x20, 'a'})},
+		{"header checksum", append(lz4TestFrame(uncompressed)[:6], 0)},
+		{"missing end mark", lz4TestFrame(uncompressed)[:14]},
+	} {
+		if got, err := decompressAll(test.data); err == nil {
+			t.Errorf("%s: no error, got %q", test.name, got)
+		}
+	}
+}
+
+func TestXxh32(t *testing.T) {
+	// the content checksums of lz4 frames
+	for data, want := range map[string]uint32{"": 0x02cc5d05, "abc": 0x32d153ff} {
+		if got := xxh32Sum([]byte(data)); got != want {
+			t.Errorf("xxh32(%q) = %08x, expected %08x", data, got, want)
+		}
+	}
+	// hashing in pieces gives the same result
+	data := bytes.Repeat([]byte("0123456789"), 10)
+	var h xxh32
+	h.reset()
+	for i := 0; i < len(data); i += 7 {
+		end := i + 7
+		if end > len(data) {
+			end = len(data)
+		}
+		h.write(data[i:end])
+	}
+	if got, want := h.sum(uint64(len(data))), xxh32Sum(data); got != want {
+		t.Errorf("xxh32 in pieces = %08x, expected %08x", got, want)
+	}
+}
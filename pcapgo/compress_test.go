@@ -0,0 +1,234 @@
+// Copyright 2018 The GoPacket Authors. All rights reserved.
+//
+// Use of this source code is governed by a BSD-style license
+// that can be found in the LICENSE file in the root of the source
+// tree.
+
+package pcapgo
+
+import (
+	"bytes"
+	"compress/gzip"
+	"crypto/sha256"
+	"encoding/hex"
+	"io"
+	"io/ioutil"
+	"math/rand"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+// compressedTestFile is the uncompressed content of files in tests/compressed (see tests/README.md)
+type compressedTestFile struct {
+	sha256  string
+	length  int
+	packets int // the number of packets, if it is a pcap file
+}
+
+var (
+	compressedTestCapture = compressedTestFile{"4cdaf673f0875714b2cbf35128439a451e237fc208f7415248763be623bd7e66", 178745, 74}
+	compressedTestDNS     = compressedTestFile{"d95c5693004758207d371c89bb1c939075ede6686d4973b83be568fe5ae52d28", 1001, 10}
+	compressedTestRandom  = compressedTestFile{"3afbe35f09106ec32f24e088e17fdb2ab393585f1bc946f734e996d604b0746e", 4096, 0}
+)
+
+func decompressAll(data []byte) ([]byte, error) {
+	r, _, err := NewDecompressor(bytes.NewReader(data))
+	if err != nil {
+		return nil, err
+	}
+	return ioutil.ReadAll(r)
+}
+
+// testDecompressFile decompresses the named file in tests/compressed, checks the content, and returns the compressed and the
+// uncompressed data.
+func testDecompressFile(t *testing.T, name string, c Compression, want compressedTestFile) ([]byte, []byte) {
+	t.Helper()
+	path := filepath.Join("tests", "compressed", name)
+	compressed, err := ioutil.ReadFile(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	r, got, err := NewDecompressor(bytes.NewReader(compressed))
+	if err != nil || got != c {
+		t.Fatalf("%s: detected %s, %v", name, got, err)
+	}
+	data, err := ioutil.ReadAll(r)
+	if err != nil {
+		t.Fatalf("%s: %s", name, err)
+	}
+	if sum := sha256.Sum256(data); len(data) != want.length || hex.EncodeToString(sum[:]) != want.sha256 {
+		t.Fatalf("%s: uncompressed %d bytes with sha256 %x, expected %d bytes with sha256 %s", name, len(data), sum, want.length, want.sha256)
+	}
+
+	if want.packets > 0 {
+		r, format, err := OpenCaptureFile(path, DefaultCaptureReaderOptions)
+		if err != nil || format != CaptureFormatPcap {
+			t.Fatalf("%s: opened as %s, %v", name, format, err)
+		}
+		defer r.Close()
+		if packets, err := readAllPackets(r); err != nil || len(packets) != want.packets {
+			t.Errorf("%s: read %d packets, %v", name, len(packets), err)
+		}
+	}
+	return compressed, data
+}
+
+// testDecompressDamaged checks that truncated compressed data fails to decompress, and that modified data fails to decompress or is
+// uncompressed correctly, which holds if the compressed data has a checksum of the content.
+func testDecompressDamaged(t *testing.T, compressed, want []byte) {
+	t.Helper()
+	rng := rand.New(rand.NewSource(1))
+	for i := 0; i < 100; i++ {
+		// keep the magic, so that the compression is detected
+		n := compressionMagicLength + rng.Intn(len(compressed)-compressionMagicLength)
+		if _, err := decompressAll(compressed[:n]); err == nil {
+			t.Errorf("No error for data truncated to %d bytes", n)
+		}
+		damaged := append([]byte(nil), compressed...)
+		damaged[n] ^= 1 << uint(rng.Intn(8))
+		if got, err := decompressAll(damaged); err == nil && !bytes.Equal(got, want) {
+			t.Errorf("Damaged byte %d not detected", n)
+		}
+	}
+}
+
+func TestDetectCompression(t *testing.T) {
+	for _, test := range []struct {
+		magic []byte
+		name  string
+		want  Compression
+	}{
+		{[]byte{0x1f, 0x8b, 0x08, 0, 0, 0}, "a.pcap.gz", CompressionGzip},
+		{[]byte{0x28, 0xb5, 0x2f, 0xfd, 0, 0}, "a.pcapng.zst", CompressionZstd},
+		{[]byte{0xfd, '7', 'z', 'X', 'Z', 0}, "a.pcap.XZ", CompressionXz},
+		{[]byte{0x04, 0x22, 0x4d, 0x18, 0, 0}, "a.pcap.lz4", CompressionLz4},
+		{[]byte{0x0a, 0x0d, 0x0d, 0x0a, 0, 0}, "a.pcapng", CompressionNone},
+		{[]byte{0x1f}, "a.gz.pcap", CompressionNone},
+	} {
+		if got := DetectCompression(test.magic); got != test.want {
+			t.Errorf("DetectCompression(%x): expected %s, got %s", test.magic, test.want, got)
+		}
+		if got := CompressionFromName(test.name); got != test.want {
+			t.Errorf("CompressionFromName(%s): expected %s, got %s", test.name, test.want, got)
+		}
+	}
+}
+
+// xorCodec is a trivial registered compression format
+type xorCodec struct {
+	r io.Reader
+	w io.Writer
+}
+
+func (x xorCodec) Read(p []byte) (int, error) {
+	n, err := x.r.Read(p)
+	for i := range p[:n] {
+		p[i] ^= 0xff
+	}
+	return n, err
+}
+
+func (x xorCodec) Write(p []byte) (int, error) {
+	b := make([]byte, len(p))
+	for i := range p {
+		b[i] = p[i] ^ 0xff
+	}
+	return x.w.Write(b)
+}
+
+func (x xorCodec) Close() error { return nil }
+
+func TestCompressedReaders(t *testing.T) {
+	lz4 := lookupCompression(CompressionLz4)
+	defer RegisterCompression(CompressionLz4, lz4.newReader, lz4.newWriter)
+	RegisterCompression(CompressionLz4, func(r io.Reader) (io.Reader, error) {
+		// skip the magic
+		if _, err := io.CopyN(ioutil.Discard, r, 4); err != nil {
+			return nil, err
+		}
+		return xorCodec{r: r}, nil
+	}, func(w io.Writer) (io.WriteCloser, error) {
+		_, err := w.Write([]byte{0x04, 0x22, 0x4d, 0x18})
+		return xorCodec{w: w}, err
+	})
+
+	compress := func(c Compression, data []byte) []byte {
+		var buf bytes.Buffer
+		w, err := NewCompressor(&buf, c)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if _, err := w.Write(data); err != nil {
+			t.Fatal(err)
+		}
+		if err := w.Close(); err != nil {
+			t.Fatal(err)
+		}
+		return buf.Bytes()
+	}
+	pcap := editTestPcap(t, 0, 1, 2)
+	pcapng := editTestPcapng(t, 0, 1, 2)
+	for _, c := range []Compression{CompressionNone, CompressionGzip, CompressionLz4} {
+		r, err := NewReader(bytes.NewReader(compress(c, pcap)))
+		if err != nil {
+			t.Fatalf("[%s] %s", c, err)
+		}
+		if packets, err := readAllPackets(r); err != nil || len(packets) != 3 {
+			t.Errorf("[%s] pcap: read %d packets, %v", c, len(packets), err)
+		}
+		ng, err := NewNgReader(bytes.NewReader(compress(c, pcapng)), NgReaderOptions{WantMixedLinkType: true})
+		if err != nil {
+			t.Fatalf("[%s] %s", c, err)
+		}
+		if packets, err := readAllPackets(ng); err != nil || len(packets) != 3 {
+			t.Errorf("[%s] pcapng: read %d packets, %v", c, len(packets), err)
+		}
+		var buf bytes.Buffer
+		if n, err := Edit(&buf, bytes.NewReader(compress(c, pcapng)), EditOptions{}); err != nil || n != 3 {
+			t.Errorf("[%s] edit: wrote %d packets, %v", c, n, err)
+		}
+	}
+
+	zstd := lookupCompression(CompressionZstd)
+	RegisterCompression(CompressionZstd, nil, nil)
+	_, err := NewReader(bytes.NewReader([]byte{0x28, 0xb5, 0x2f, 0xfd, 0, 0, 0, 0}))
+	RegisterCompression(CompressionZstd, zstd.newReader, zstd.newWriter)
+	if err == nil {
+		t.Error("Expected an error for an unregistered compression format")
+	}
+	if _, err := NewIndexedReader(bytes.NewReader(compress(CompressionGzip, pcap)), 100, DefaultIndexedReaderOptions); err == nil {
+		t.Error("Expected an error indexing a compressed file")
+	}
+}
+
+func TestRotatingWriterCompression(t *testing.T) {
+	dir, err := ioutil.TempDir("", "rotate")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	options := DefaultRotatingWriterOptions
+	options.Template = filepath.Join(dir, "capture.pcap.gz")
+	options.Compression = CompressionGzip
+	options.MaxBytes = 24 + 2*(16+84)
+	w, err := NewRotatingWriter(options)
+	if err != nil {
+		t.Fatal(err)
+	}
+	rotateTestPackets(t, w, 0, 1, 2)
+	for name, n := range map[string]int{"capture.pcap.gz": 2, "capture-1.pcap.gz": 1} {
+		f, err := os.Open(filepath.Join(dir, name))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if _, err := gzip.NewReader(f); err != nil {
+			t.Errorf("%s is not gzip compressed: %s", name, err)
+		}
+		f.Close()
+		if got := countPackets(t, filepath.Join(dir, name)); got != n {
+			t.Errorf("expected %d packets in %s, got %d", n, name, got)
+		}
+	}
+}
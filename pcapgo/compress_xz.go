@@ -0,0 +1,830 @@
+// Copyright 2018 The GoPacket Authors. All rights reserved.
+//
+// Use of this source code is governed by a BSD-style license
+// that can be found in the LICENSE file in the root of the source
+// tree.
+
+// +build !pcapgo_noxz
+
+package pcapgo
+
+import (
+	"bufio"
+	"bytes"
+	"crypto/sha256"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"hash"
+	"hash/crc32"
+	"hash/crc64"
+	"io"
+)
+
+// The xz format is documented at https://tukaani.org/xz/xz-file-format.txt. Only the LZMA2 filter is supported, which is the only filter
+// used by xz without additional options. The LZMA2 decoder follows the one of XZ Embedded.
+
+func init() {
+	RegisterCompression(CompressionXz, newXzReader, nil)
+}
+
+const (
+	xzHeaderMagic  = "\xfd7zXZ\x00"
+	xzFooterMagic  = "YZ"
+	xzFilterLZMA2  = 0x21
+	xzCheckNone    = 0
+	xzCheckCRC32   = 1
+	xzCheckCRC64   = 4
+	xzCheckSHA256  = 10
+	xzMaxDict      = 1 << 28 // the largest dictionary accepted; the presets of xz use up to 64 MiB
+	lzma2MaxChunk  = 2 << 20 // the maximum uncompressed size of an LZMA2 chunk
+	lzma2MaxPacked = 64 << 10
+)
+
+var (
+	errXzCorrupt = errors.New("Corrupt xz data")
+	crc64Table   = crc64.MakeTable(crc64.ECMA)
+)
+
+type xzRecord struct {
+	unpadded, uncompressed uint64
+}
+
+// xzReader decompresses a sequence of xz streams.
+type xzReader struct {
+	r      *bufio.Reader
+	err    error
+	offset uint64 // the number of bytes read from r
+	// the current stream
+	inStream bool
+	flags    [2]byte
+	records  []xzRecord
+	// the current block
+	inBlock        bool
+	blockStart     uint64 // offset of the block header
+	dataStart      uint64 // offset of the compressed data
+	headerSize     uint64
+	compressedSize uint64 // 0 if unknown
+	uncompressed   uint64
+	expectedSize   uint64 // the uncompressed size from the header, or ^0 if unknown
+	check          hash.Hash
+	lzma2          lzma2Decoder
+	out            []byte
+}
+
+func newXzReader(r io.Reader) (io.Reader, error) {
+	br, ok := r.(*bufio.Reader)
+	if !ok {
+		br = bufio.NewReader(r)
+	}
+	ret := &xzReader{r: br}
+	// read the first stream header, so that the data is checked right away
+	if err := ret.readStreamHeader(true); err != nil {
+		return nil, err
+	}
+	return ret, nil
+}
+
+func (z *xzReader) Read(p []byte) (int, error) {
+	for len(z.out) == 0 {
+		if z.err != nil {
+			return 0, z.err
+		}
+		switch {
+		case z.inBlock:
+			z.err = z.readChunk()
+		case z.inStream:
+			z.err = z.readBlockHeader()
+		default:
+			z.err = z.readStreamHeader(false)
+		}
+	}
+	n := copy(p, z.out)
+	z.out = z.out[n:]
+	return n, nil
+}
+
+func (z *xzReader) readFull(b []byte) error {
+	n, err := io.ReadFull(z.r, b)
+	z.offset += uint64(n)
+	return unexpectedEOF(err)
+}
+
+func (z *xzReader) readByte() (byte, error) {
+	b, err := z.r.ReadByte()
+	if err != nil {
+		return 0, unexpectedEOF(err)
+	}
+	z.offset++
+	return b, nil
+}
+
+// readStreamHeader reads the header of the next stream, skipping stream padding. At the end of the data io.EOF is returned, unless first
+// is set.
+func (z *xzReader) readStreamHeader(first bool) error {
+	var header [12]byte
+	for {
+		n, err := io.ReadFull(z.r, header[:4])
+		z.offset += uint64(n)
+		if err == io.EOF && !first {
+			return io.EOF
+		}
+		if err != nil {
+			return unexpectedEOF(err)
+		}
+		// stream padding is a multiple of 4 null bytes
+		if first || binary.LittleEndian.Uint32(header[:4]) != 0 {
+			break
+		}
+	}
+	if err := z.readFull(header[4:]); err != nil {
+		return err
+	}
+	if string(header[:6]) != xzHeaderMagic {
+		return fmt.Errorf("Unknown xz magic %x", header[:6])
+	}
+	if crc32.ChecksumIEEE(header[6:8]) != binary.LittleEndian.Uint32(header[8:]) {
+		return errors.New("xz stream header checksum mismatch")
+	}
+	if header[6] != 0 || header[7]&0xf0 != 0 {
+		return errXzCorrupt
+	}
+	z.inStream = true
+	copy(z.flags[:], header[6:8])
+	z.records = z.records[:0]
+	return nil
+}
+
+// xzCheckSize returns the length of the check of the given type
+func xzCheckSize(checkType byte) int {
+	if checkType == xzCheckNone {
+		return 0
+	}
+	return 4 << ((checkType - 1) / 3)
+}
+
+// readBlockHeader reads the header of the next block, or the index and the footer of the stream.
+func (z *xzReader) readBlockHeader() error {
+	z.blockStart = z.offset
+	size, err := z.readByte()
+	if err != nil {
+		return err
+	}
+	if size == 0 {
+		return z.readIndex()
+	}
+	header := make([]byte, 4*(int(size)+1))
+	header[0] = size
+	if err := z.readFull(header[1:]); err != nil {
+		return err
+	}
+	crc := binary.LittleEndian.Uint32(header[len(header)-4:])
+	header = header[:len(header)-4]
+	if crc32.ChecksumIEEE(header) != crc {
+		return errors.New("xz block header checksum mismatch")
+	}
+	flags := header[1]
+	if flags&0x3c != 0 {
+		return errXzCorrupt
+	}
+	fields := bytes.NewReader(header[2:])
+	z.compressedSize, z.expectedSize = 0, ^uint64(0)
+	if flags&0x40 != 0 {
+		if z.compressedSize, err = xzReadVarint(fields); err != nil || z.compressedSize == 0 {
+			return errXzCorrupt
+		}
+	}
+	if flags&0x80 != 0 {
+		if z.expectedSize, err = xzReadVarint(fields); err != nil {
+			return errXzCorrupt
+		}
+	}
+	var dictSize uint32
+	for i := 0; i <= int(flags&3); i++ {
+		id, err := xzReadVarint(fields)
+		if err != nil {
+			return errXzCorrupt
+		}
+		propsSize, err := xzReadVarint(fields)
+		if err != nil || propsSize > uint64(fields.Len()) {
+			return errXzCorrupt
+		}
+		props := make([]byte, propsSize)
+		fields.Read(props)
+		if id != xzFilterLZMA2 || flags&3 != 0 {
+			return fmt.Errorf("Unsupported xz filter %#x", id)
+		}
+		if len(props) != 1 || props[0] > 40 {
+			return errXzCorrupt
+		}
+		if props[0] == 40 {
+			dictSize = 1<<32 - 1
+		} else {
+			dictSize = (2 | uint32(props[0]&1)) << (props[0]/2 + 11)
+		}
+	}
+	if dictSize > xzMaxDict {
+		return fmt.Errorf("xz dictionary size %d exceeds maximum of %d", dictSize, xzMaxDict)
+	}
+	// the rest of the header is padding
+	for fields.Len() > 0 {
+		if b, _ := fields.ReadByte(); b != 0 {
+			return errXzCorrupt
+		}
+	}
+
+	switch checkType := z.flags[1]; checkType {
+	case xzCheckCRC32:
+		z.check = crc32.NewIEEE()
+	case xzCheckCRC64:
+		z.check = crc64.New(crc64Table)
+	case xzCheckSHA256:
+		z.check = sha256.New()
+	default:
+		// other checks are not verified
+		z.check = nil
+	}
+	z.inBlock = true
+	z.headerSize = uint64(len(header) + 4)
+	z.dataStart = z.offset
+	z.uncompressed = 0
+	z.lzma2.reset(int(dictSize))
+	return nil
+}
+
+// xzReadVarint reads a multibyte integer of up to 9 bytes, 7 bits per byte
+func xzReadVarint(r io.ByteReader) (uint64, error) {
+	var v uint64
+	for i := uint(0); i < 9; i++ {
+		b, err := r.ReadByte()
+		if err != nil {
+			return 0, errXzCorrupt
+		}
+		if i > 0 && b == 0 {
+			return 0, errXzCorrupt
+		}
+		v |= uint64(b&0x7f) << (7 * i)
+		if b&0x80 == 0 {
+			return v, nil
+		}
+	}
+	return 0, errXzCorrupt
+}
+
+// readChunk decompresses the next LZMA2 chunk of the current block, or reads the end of the block.
+func (z *xzReader) readChunk() error {
+	control, err := z.readByte()
+	if err != nil {
+		return err
+	}
+	if control == 0 {
+		return z.readBlockEnd()
+	}
+	var buf [5]byte
+	var size, packed int
+	if control >= 0x80 {
+		if err := z.readFull(buf[:4]); err != nil {
+			return err
+		}
+		size = int(control&0x1f)<<16 + int(binary.BigEndian.Uint16(buf[0:2])) + 1
+		packed = int(binary.BigEndian.Uint16(buf[2:4])) + 1
+		if control >= 0xc0 {
+			if buf[4], err = z.readByte(); err != nil {
+				return err
+			}
+		}
+	} else {
+		if err := z.readFull(buf[:2]); err != nil {
+			return err
+		}
+		size = int(binary.BigEndian.Uint16(buf[0:2])) + 1
+		packed = size
+	}
+	if cap(z.lzma2.chunk) < packed {
+		z.lzma2.chunk = make([]byte, packed, lzma2MaxPacked)
+	}
+	chunk := z.lzma2.chunk[:packed]
+	if err := z.readFull(chunk); err != nil {
+		return err
+	}
+	if z.out, err = z.lzma2.decodeChunk(control, buf[4], chunk, size); err != nil {
+		return err
+	}
+	z.uncompressed += uint64(len(z.out))
+	if z.uncompressed > z.expectedSize || (z.compressedSize != 0 && z.offset-z.dataStart > z.compressedSize) {
+		return errXzCorrupt
+	}
+	if z.check != nil {
+		z.check.Write(z.out)
+	}
+	return nil
+}
+
+// readBlockEnd reads the block padding and check, and verifies the sizes from the block header.
+func (z *xzReader) readBlockEnd() error {
+	z.inBlock = false
+	compressed := z.offset - z.dataStart
+	if (z.compressedSize != 0 && compressed != z.compressedSize) || (z.expectedSize != ^uint64(0) && z.uncompressed != z.expectedSize) {
+		return errXzCorrupt
+	}
+	var buf [64]byte
+	padding := int(-compressed & 3)
+	if err := z.readFull(buf[:padding]); err != nil {
+		return err
+	}
+	for _, b := range buf[:padding] {
+		if b != 0 {
+			return errXzCorrupt
+		}
+	}
+	checkSize := xzCheckSize(z.flags[1])
+	if err := z.readFull(buf[:checkSize]); err != nil {
+		return err
+	}
+	if z.check != nil {
+		var sum []byte
+		switch h := z.check.(type) {
+		case hash.Hash32:
+			sum = make([]byte, 4)
+			binary.LittleEndian.PutUint32(sum, h.Sum32())
+		case hash.Hash64:
+			sum = make([]byte, 8)
+			binary.LittleEndian.PutUint64(sum, h.Sum64())
+		default:
+			sum = h.Sum(nil)
+		}
+		if !bytes.Equal(sum, buf[:checkSize]) {
+			return errors.New("xz block check mismatch")
+		}
+	}
+	z.records = append(z.records, xzRecord{z.headerSize + compressed + uint64(checkSize), z.uncompressed})
+	return nil
+}
+
+// readIndex reads the index and the footer of the stream, after the index indicator has been read, and checks them against the blocks read.
+func (z *xzReader) readIndex() error {
+	z.inStream = false
+	crc := crc32.NewIEEE()
+	crc.Write([]byte{0})
+	index := &xzIndexReader{z, crc}
+	count, err := xzReadVarint(index)
+	if err != nil {
+		return err
+	}
+	if count != uint64(len(z.records)) {
+		return errXzCorrupt
+	}
+	for _, record := range z.records {
+		var r xzRecord
+		if r.unpadded, err = xzReadVarint(index); err != nil {
+			return err
+		}
+		if r.uncompressed, err = xzReadVarint(index); err != nil {
+			return err
+		}
+		if r != record {
+			return errXzCorrupt
+		}
+	}
+	for (z.offset-z.blockStart)&3 != 0 {
+		if b, err := index.ReadByte(); err != nil || b != 0 {
+			return errXzCorrupt
+		}
+	}
+	indexSize := z.offset - z.blockStart
+	// the index checksum, followed by the stream footer: checksum, backward size, flags, magic
+	var footer [16]byte
+	if err := z.readFull(footer[:]); err != nil {
+		return err
+	}
+	if crc.Sum32() != binary.LittleEndian.Uint32(footer[0:4]) {
+		return errors.New("xz index checksum mismatch")
+	}
+	if crc32.ChecksumIEEE(footer[8:14]) != binary.LittleEndian.Uint32(footer[4:8]) {
+		return errors.New("xz stream footer checksum mismatch")
+	}
+	if string(footer[14:]) != xzFooterMagic || footer[12] != z.flags[0] || footer[13] != z.flags[1] ||
+		(uint64(binary.LittleEndian.Uint32(footer[8:12]))+1)*4 != indexSize+4 {
+		return errXzCorrupt
+	}
+	return nil
+}
+
+// xzIndexReader reads the bytes of the index, and adds them to its checksum.
+type xzIndexReader struct {
+	z   *xzReader
+	crc hash.Hash32
+}
+
+func (r *xzIndexReader) ReadByte() (byte, error) {
+	b, err := r.z.readByte()
+	if err != nil {
+		return 0, err
+	}
+	r.crc.Write([]byte{b})
+	return b, nil
+}
+
+// lzma2Decoder decodes LZMA2 chunks.
+type lzma2Decoder struct {
+	dictSize      int
+	needDictReset bool
+	needProps     bool
+	lc, lp, pb    uint
+	pos           int // the number of bytes since the last dictionary reset
+	state         int
+	rep           [4]int // the distances of the last matches, minus 1
+	isMatch       [lzmaStates << lzmaMaxPosBits]uint16
+	isRep         [lzmaStates]uint16
+	isRep0        [lzmaStates]uint16
+	isRep1        [lzmaStates]uint16
+	isRep2        [lzmaStates]uint16
+	isRep0Long    [lzmaStates << lzmaMaxPosBits]uint16
+	distSlot      [lzmaDistStates][1 << lzmaDistSlotBits]uint16
+	distSpecial   [lzmaFullDistances - lzmaDistModelEnd]uint16
+	distAlign     [1 << lzmaAlignBits]uint16
+	matchLen      lzmaLenDecoder
+	repLen        lzmaLenDecoder
+	literal       []uint16
+	rc            lzmaRangeDecoder
+	// hist holds the dictionary followed by the data of the current chunk
+	hist  []byte
+	chunk []byte
+}
+
+const (
+	lzmaStates         = 12
+	lzmaLiteralStates  = 7
+	lzmaMaxPosBits     = 4
+	lzmaDistStates     = 4
+	lzmaDistSlotBits   = 6
+	lzmaDistModelStart = 4
+	lzmaDistModelEnd   = 14
+	lzmaFullDistances  = 1 << (lzmaDistModelEnd / 2)
+	lzmaAlignBits      = 4
+	lzmaMatchLenMin    = 2
+	lzmaProbInit       = 1 << 10
+)
+
+type lzmaLenDecoder struct {
+	choice  uint16
+	choice2 uint16
+	low     [1 << lzmaMaxPosBits][8]uint16
+	mid     [1 << lzmaMaxPosBits][8]uint16
+	high    [256]uint16
+}
+
+func (l *lzmaLenDecoder) reset() {
+	l.choice, l.choice2 = lzmaProbInit, lzmaProbInit
+	for i := range l.low {
+		lzmaResetProbs(l.low[i][:])
+		lzmaResetProbs(l.mid[i][:])
+	}
+	lzmaResetProbs(l.high[:])
+}
+
+func (l *lzmaLenDecoder) decode(rc *lzmaRangeDecoder, posState int) int {
+	if !rc.bit(&l.choice) {
+		return lzmaMatchLenMin + rc.bitTree(l.low[posState][:], 3)
+	}
+	if !rc.bit(&l.choice2) {
+		return lzmaMatchLenMin + 8 + rc.bitTree(l.mid[posState][:], 3)
+	}
+	return lzmaMatchLenMin + 16 + rc.bitTree(l.high[:], 8)
+}
+
+func lzmaResetProbs(probs []uint16) {
+	for i := range probs {
+		probs[i] = lzmaProbInit
+	}
+}
+
+// reset prepares d for a new block
+func (d *lzma2Decoder) reset(dictSize int) {
+	d.dictSize = dictSize
+	d.needDictReset = true
+	d.needProps = true
+}
+
+// resetState resets the state and the probabilities of the LZMA decoder
+func (d *lzma2Decoder) resetState() {
+	d.state = 0
+	d.rep = [4]int{}
+	lzmaResetProbs(d.isMatch[:])
+	lzmaResetProbs(d.isRep[:])
+	lzmaResetProbs(d.isRep0[:])
+	lzmaResetProbs(d.isRep1[:])
+	lzmaResetProbs(d.isRep2[:])
+	lzmaResetProbs(d.isRep0Long[:])
+	for i := range d.distSlot {
+		lzmaResetProbs(d.distSlot[i][:])
+	}
+	lzmaResetProbs(d.distSpecial[:])
+	lzmaResetProbs(d.distAlign[:])
+	d.matchLen.reset()
+	d.repLen.reset()
+	n := 0x300 << (d.lc + d.lp)
+	if cap(d.literal) < n {
+		d.literal = make([]uint16, n)
+	}
+	d.literal = d.literal[:n]
+	lzmaResetProbs(d.literal)
+}
+
+// decodeChunk decodes an LZMA2 chunk with the given control and properties byte, which decompresses to size bytes, and returns the
+// decompressed data.
+func (d *lzma2Decoder) decodeChunk(control, props byte, chunk []byte, size int) ([]byte, error) {
+	if control >= 0xe0 || control == 1 {
+		d.needProps = true
+		d.needDictReset = false
+		d.hist = d.hist[:0]
+		d.pos = 0
+	} else if d.needDictReset {
+		return nil, errXzCorrupt
+	}
+	if control >= 0x80 {
+		if control >= 0xc0 {
+			d.needProps = false
+			if props >= 9*5*5 {
+				return nil, errXzCorrupt
+			}
+			d.lc, d.lp, d.pb = uint(props%9), uint(props/9%5), uint(props/45)
+			if d.lc+d.lp > 4 {
+				return nil, errXzCorrupt
+			}
+		} else if d.needProps {
+			return nil, errXzCorrupt
+		}
+		if control >= 0xa0 {
+			d.resetState()
+		}
+	} else if control > 2 {
+		return nil, errXzCorrupt
+	}
+
+	// drop the data which can't be referenced anymore, and make room for the chunk
+	if len(d.hist) > 2*d.dictSize {
+		d.hist = d.hist[:copy(d.hist, d.hist[len(d.hist)-d.dictSize:])]
+	}
+	if cap(d.hist)-len(d.hist) < size {
+		hist := make([]byte, len(d.hist), 2*len(d.hist)+lzma2MaxChunk)
+		copy(hist, d.hist)
+		d.hist = hist
+	}
+	start := len(d.hist)
+	if control < 0x80 {
+		d.hist = append(d.hist, chunk...)
+		d.pos += size
+		return d.hist[start:], nil
+	}
+	if err := d.decodeLZMA(chunk, start+size); err != nil {
+		return nil, err
+	}
+	return d.hist[start:], nil
+}
+
+// decodeLZMA decodes LZMA data until d.hist has limit bytes. The chunk must be consumed exactly.
+func (d *lzma2Decoder) decodeLZMA(chunk []byte, limit int) error {
+	rc := &d.rc
+	if !rc.init(chunk) {
+		return errXzCorrupt
+	}
+	hist := d.hist
+	posMask := 1<<d.pb - 1
+	for len(hist) < limit {
+		posState := d.pos & posMask
+		if !rc.bit(&d.isMatch[d.state<<lzmaMaxPosBits|posState]) {
+			hist = d.decodeLiteral(hist)
+			d.pos++
+			continue
+		}
+		var length int
+		if rc.bit(&d.isRep[d.state]) {
+			if d.pos == 0 {
+				return errXzCorrupt
+			}
+			length = d.decodeRepMatch(posState)
+		} else {
+			length = d.decodeMatch(posState)
+		}
+		dist := d.rep[0] + 1
+		if dist > d.pos || dist > d.dictSize || length > limit-len(hist) {
+			return errXzCorrupt
+		}
+		hist = lzCopy(hist, dist, length)
+		d.pos += length
+	}
+	d.hist = hist
+	if !rc.finished() {
+		return errXzCorrupt
+	}
+	return nil
+}
+
+func (d *lzma2Decoder) decodeLiteral(hist []byte) []byte {
+	rc := &d.rc
+	prev := 0
+	if d.pos > 0 {
+		prev = int(hist[len(hist)-1])
+	}
+	base := 0x300 * ((d.pos&(1<<d.lp-1))<<d.lc + prev>>(8-d.lc))
+	probs := d.literal[base : base+0x300]
+	symbol := 1
+	if d.state < lzmaLiteralStates {
+		for symbol < 0x100 {
+			symbol <<= 1
+			if rc.bit(&probs[symbol>>1]) {
+				symbol |= 1
+			}
+		}
+	} else {
+		// the byte at the distance of the last match selects the probabilities, until a bit differs
+		matchByte := int(hist[len(hist)-d.rep[0]-1]) << 1
+		offset := 0x100
+		for symbol < 0x100 {
+			matchBit := matchByte & offset
+			matchByte <<= 1
+			if rc.bit(&probs[offset+matchBit+symbol]) {
+				symbol = symbol<<1 | 1
+				offset = matchBit
+			} else {
+				symbol <<= 1
+				offset &^= matchBit
+			}
+		}
+	}
+	switch {
+	case d.state < 4:
+		d.state = 0
+	case d.state < 10:
+		d.state -= 3
+	default:
+		d.state -= 6
+	}
+	return append(hist, byte(symbol))
+}
+
+func (d *lzma2Decoder) decodeMatch(posState int) int {
+	rc := &d.rc
+	if d.state < lzmaLiteralStates {
+		d.state = 7
+	} else {
+		d.state = 10
+	}
+	d.rep[3], d.rep[2], d.rep[1] = d.rep[2], d.rep[1], d.rep[0]
+	length := d.matchLen.decode(rc, posState)
+
+	distState := length - lzmaMatchLenMin
+	if distState >= lzmaDistStates {
+		distState = lzmaDistStates - 1
+	}
+	slot := rc.bitTree(d.distSlot[distState][:], lzmaDistSlotBits)
+	if slot < lzmaDistModelStart {
+		d.rep[0] = slot
+		return length
+	}
+	// distances have up to 32 bits, which don't fit an int on 32-bit platforms
+	limit := uint(slot>>1 - 1)
+	dist := uint32(2|slot&1) << limit
+	if slot < lzmaDistModelEnd {
+		dist += uint32(rc.bitTreeReverse(d.distSpecial[int(dist)-slot:], limit))
+	} else {
+		dist += uint32(rc.direct(limit-lzmaAlignBits)) << lzmaAlignBits
+		dist += uint32(rc.bitTreeReverse(d.distAlign[:], lzmaAlignBits))
+	}
+	// the end marker (all bits set) isn't allowed in LZMA2, and fails the distance check like any too large distance
+	if dist >= xzMaxDict {
+		dist = xzMaxDict
+	}
+	d.rep[0] = int(dist)
+	return length
+}
+
+func (d *lzma2Decoder) decodeRepMatch(posState int) int {
+	rc := &d.rc
+	if !rc.bit(&d.isRep0[d.state]) {
+		if !rc.bit(&d.isRep0Long[d.state<<lzmaMaxPosBits|posState]) {
+			// a single byte at the last distance
+			if d.state < lzmaLiteralStates {
+				d.state = 9
+			} else {
+				d.state = 11
+			}
+			return 1
+		}
+	} else {
+		var dist int
+		if !rc.bit(&d.isRep1[d.state]) {
+			dist = d.rep[1]
+		} else {
+			if !rc.bit(&d.isRep2[d.state]) {
+				dist = d.rep[2]
+			} else {
+				dist = d.rep[3]
+				d.rep[3] = d.rep[2]
+			}
+			d.rep[2] = d.rep[1]
+		}
+		d.rep[1] = d.rep[0]
+		d.rep[0] = dist
+	}
+	if d.state < lzmaLiteralStates {
+		d.state = 8
+	} else {
+		d.state = 11
+	}
+	return d.repLen.decode(rc, posState)
+}
+
+// lzmaRangeDecoder is the range decoder of an LZMA2 chunk. Reading past the end of the chunk returns zeros, and fails finished.
+type lzmaRangeDecoder struct {
+	in   []byte
+	pos  int
+	rng  uint32
+	code uint32
+}
+
+func (rc *lzmaRangeDecoder) init(in []byte) bool {
+	if len(in) < 5 || in[0] != 0 {
+		return false
+	}
+	rc.in = in
+	rc.pos = 5
+	rc.rng = 0xffffffff
+	rc.code = binary.BigEndian.Uint32(in[1:5])
+	return true
+}
+
+func (rc *lzmaRangeDecoder) normalize() {
+	if rc.rng < 1<<24 {
+		rc.rng <<= 8
+		rc.code <<= 8
+		if rc.pos < len(rc.in) {
+			rc.code |= uint32(rc.in[rc.pos])
+		}
+		rc.pos++
+	}
+}
+
+// finished returns whether the whole input was used, and the encoder's final flush is reached. Since the decoder normalizes before each bit,
+// the last byte may still be pending.
+func (rc *lzmaRangeDecoder) finished() bool {
+	rc.normalize()
+	return rc.pos == len(rc.in) && rc.code == 0
+}
+
+// bit decodes a bit with the probability *p of being 0, and updates *p
+func (rc *lzmaRangeDecoder) bit(p *uint16) bool {
+	rc.normalize()
+	bound := (rc.rng >> 11) * uint32(*p)
+	if rc.code < bound {
+		rc.rng = bound
+		*p += (1<<11 - *p) >> 5
+		return false
+	}
+	rc.rng -= bound
+	rc.code -= bound
+	*p -= *p >> 5
+	return true
+}
+
+// bitTree decodes n bits, most significant bit first, with the probabilities probs[1:1<<n]
+func (rc *lzmaRangeDecoder) bitTree(probs []uint16, n uint) int {
+	symbol := 1
+	for symbol < 1<<n {
+		symbol <<= 1
+		if rc.bit(&probs[symbol>>1]) {
+			symbol |= 1
+		}
+	}
+	return symbol - 1<<n
+}
+
+// bitTreeReverse decodes n bits, least significant bit first, with the probabilities probs[:1<<n-1]
+func (rc *lzmaRangeDecoder) bitTreeReverse(probs []uint16, n uint) int {
+	symbol := 1
+	result := 0
+	for i := uint(0); i < n; i++ {
+		if rc.bit(&probs[symbol-1]) {
+			symbol = symbol<<1 | 1
+			result |= 1 << i
+		} else {
+			symbol <<= 1
+		}
+	}
+	return result
+}
+
+// direct decodes n bits with a fixed probability of 1/2
+func (rc *lzmaRangeDecoder) direct(n uint) int {
+	result := 0
+	for ; n > 0; n-- {
+		rc.normalize()
+		rc.rng >>= 1
+		rc.code -= rc.rng
+		mask := 0 - (rc.code >> 31)
+		rc.code += rc.rng & mask
+		result = result<<1 + int(mask+1)
+	}
+	return result
+}
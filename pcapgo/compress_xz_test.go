@@ -0,0 +1,38 @@
+// Copyright 2018 The GoPacket Authors. All rights reserved.
+//
+// Use of this source code is governed by a BSD-style license
+// that can be found in the LICENSE file in the root of the source
+// tree.
+
+// +build !pcapgo_noxz
+
+package pcapgo
+
+import (
+	"bytes"
+	"testing"
+)
+
+func TestXzReader(t *testing.T) {
+	// CRC64 check, the default of xz
+	compressed, want := testDecompressFile(t, "capture.pcap.xz", CompressionXz, compressedTestCapture)
+	testDecompressDamaged(t, compressed, want)
+	// CRC32 check, blocks of 1 KiB with uncompressed LZMA2 chunks
+	random, randomData := testDecompressFile(t, "random.xz", CompressionXz, compressedTestRandom)
+	testDecompressDamaged(t, random, randomData)
+	// SHA-256 check, 64 MiB dictionary
+	dns, dnsData := testDecompressFile(t, "dns.pcap.xz", CompressionXz, compressedTestDNS)
+
+	// concatenated streams with stream padding
+	var streams []byte
+	streams = append(streams, dns...)
+	streams = append(streams, 0, 0, 0, 0)
+	streams = append(streams, random...)
+	if got, err := decompressAll(streams); err != nil || !bytes.Equal(got, append(dnsData, randomData...)) {
+		t.Errorf("Concatenated streams: uncompressed %d bytes, %v", len(got), err)
+	}
+	// stream padding must be a multiple of 4 bytes
+	if _, err := decompressAll(append(dns, 0, 0)); err == nil {
+		t.Error("No error for bad stream padding")
+	}
+}
@@ -0,0 +1,993 @@
+// Copyright 2018 The GoPacket Authors. All rights reserved.
+//
+// Use of this source code is governed by a BSD-style license
+// that can be found in the LICENSE file in the root of the source
+// tree.
+
+// +build !pcapgo_nozstd
+
+package pcapgo
+
+import (
+	"bufio"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"math/bits"
+)
+
+// The Zstandard format is documented in RFC 8878. Dictionaries are not supported, since capture files are not compressed with one.
+
+func init() {
+	RegisterCompression(CompressionZstd, newZstdReader, nil)
+}
+
+const (
+	zstdMagic          = 0xfd2fb528
+	zstdSkippableMagic = 0x184d2a50 // the low 4 bits are user defined
+	zstdSkippableMask  = 0xfffffff0
+	// zstdMaxWindow is the largest window accepted, which is also the default limit of the zstd tool
+	zstdMaxWindow = 1 << 27
+	zstdMaxBlock  = 128 * 1024
+)
+
+// zstd block types
+const (
+	zstdBlockRaw        = 0
+	zstdBlockRLE        = 1
+	zstdBlockCompressed = 2
+)
+
+// zstd literals section types
+const (
+	zstdLiteralsRaw        = 0
+	zstdLiteralsRLE        = 1
+	zstdLiteralsCompressed = 2
+	zstdLiteralsTreeless   = 3
+)
+
+// zstd sequence table modes
+const (
+	zstdModePredefined = 0
+	zstdModeRLE        = 1
+	zstdModeCompressed = 2
+	zstdModeRepeat     = 3
+)
+
+var errZstdCorrupt = errors.New("Corrupt zstd data")
+
+// zstdReader decompresses a sequence of zstd frames.
+type zstdReader struct {
+	r   *bufio.Reader
+	err error
+	// the current frame
+	inFrame        bool
+	window         int
+	blockMax       int
+	checksum       bool
+	hasContentSize bool
+	contentSize    uint64
+	contentLength  uint64
+	contentHash    xxh64
+	// the tables and offsets which may be repeated by the next block. The sequence tables point to the predefined tables, or to the
+	// tables built for the frame, or are nil.
+	reps                      [3]int
+	huffman                   zstdHuffman
+	llTable, ofTable, mlTable *zstdTable
+	llBuilt, ofBuilt, mlBuilt zstdTable
+	// hist holds the window of decompressed data, followed by the decompressed data not read yet: out
+	hist []byte
+	out  []byte
+	// reusable
+	block    []byte
+	literals []byte
+}
+
+func newZstdReader(r io.Reader) (io.Reader, error) {
+	br, ok := r.(*bufio.Reader)
+	if !ok {
+		br = bufio.NewReader(r)
+	}
+	ret := &zstdReader{r: br}
+	// read the first frame header, so that the data is checked right away
+	if err := ret.readFrameHeader(true); err != nil {
+		return nil, err
+	}
+	return ret, nil
+}
+
+func (z *zstdReader) Read(p []byte) (int, error) {
+	for len(z.out) == 0 {
+		if z.err != nil {
+			return 0, z.err
+		}
+		if z.inFrame {
+			z.err = z.readBlock()
+		} else {
+			z.err = z.readFrameHeader(false)
+		}
+	}
+	n := copy(p, z.out)
+	z.out = z.out[n:]
+	return n, nil
+}
+
+// readFrameHeader reads the header of the next frame, skipping skippable frames. At the end of the data io.EOF is returned, unless first is set.
+func (z *zstdReader) readFrameHeader(first bool) error {
+	var buf [8]byte
+	for {
+		if _, err := io.ReadFull(z.r, buf[:4]); err != nil {
+			if err == io.EOF && first {
+				err = io.ErrUnexpectedEOF
+			}
+			return err
+		}
+		magic := binary.LittleEndian.Uint32(buf[:4])
+		if magic == zstdMagic {
+			break
+		}
+		if magic&zstdSkippableMask != zstdSkippableMagic {
+			return fmt.Errorf("Unknown zstd magic %x", buf[:4])
+		}
+		if _, err := io.ReadFull(z.r, buf[:4]); err != nil {
+			return unexpectedEOF(err)
+		}
+		if _, err := z.r.Discard(int(binary.LittleEndian.Uint32(buf[:4]))); err != nil {
+			return unexpectedEOF(err)
+		}
+	}
+
+	descriptor, err := z.r.ReadByte()
+	if err != nil {
+		return unexpectedEOF(err)
+	}
+	singleSegment := descriptor&0x20 != 0
+	if descriptor&0x08 != 0 {
+		return errZstdCorrupt
+	}
+	var window uint64
+	if !singleSegment {
+		b, err := z.r.ReadByte()
+		if err != nil {
+			return unexpectedEOF(err)
+		}
+		window = 1 << (10 + b>>3)
+		window += window / 8 * uint64(b&7)
+	}
+	if n := [4]int{0, 1, 2, 4}[descriptor&3]; n > 0 {
+		if _, err := io.ReadFull(z.r, buf[:n]); err != nil {
+			return unexpectedEOF(err)
+		}
+		if le64(buf[:n]) != 0 {
+			return errors.New("zstd frames with a dictionary are not supported")
+		}
+	}
+	n := [4]int{0, 2, 4, 8}[descriptor>>6]
+	if n == 0 && singleSegment {
+		n = 1
+	}
+	z.hasContentSize = n > 0
+	if n > 0 {
+		if _, err := io.ReadFull(z.r, buf[:n]); err != nil {
+			return unexpectedEOF(err)
+		}
+		z.contentSize = le64(buf[:n])
+		if n == 2 {
+			z.contentSize += 256
+		}
+	}
+	if singleSegment {
+		window = z.contentSize
+	}
+	if window > zstdMaxWindow {
+		return fmt.Errorf("zstd window size %d exceeds maximum of %d", window, zstdMaxWindow)
+	}
+
+	z.inFrame = true
+	z.window = int(window)
+	z.blockMax = zstdMaxBlock
+	if z.window < z.blockMax {
+		z.blockMax = z.window
+	}
+	z.checksum = descriptor&0x04 != 0
+	z.contentLength = 0
+	z.contentHash.reset()
+	z.reps = [3]int{1, 4, 8}
+	z.huffman.valid = false
+	z.llTable, z.ofTable, z.mlTable = nil, nil, nil
+	z.hist = z.hist[:0]
+	return nil
+}
+
+// le64 returns the little endian integer stored in up to 8 bytes
+func le64(b []byte) uint64 {
+	var v uint64
+	for i := len(b) - 1; i >= 0; i-- {
+		v = v<<8 | uint64(b[i])
+	}
+	return v
+}
+
+// readBlock reads and decompresses the next block of the current frame.
+func (z *zstdReader) readBlock() error {
+	var buf [4]byte
+	if _, err := io.ReadFull(z.r, buf[:3]); err != nil {
+		return unexpectedEOF(err)
+	}
+	header := le64(buf[:3])
+	last := header&1 != 0
+	blockType := (header >> 1) & 3
+	size := int(header >> 3)
+	if size > z.blockMax {
+		return errZstdCorrupt
+	}
+
+	// drop the data which can't be referenced anymore, and make room for the block
+	if len(z.hist) > 2*z.window {
+		z.hist = z.hist[:copy(z.hist, z.hist[len(z.hist)-z.window:])]
+	}
+	if cap(z.hist)-len(z.hist) < z.blockMax {
+		hist := make([]byte, len(z.hist), 2*len(z.hist)+z.blockMax)
+		copy(hist, z.hist)
+		z.hist = hist
+	}
+	start := len(z.hist)
+	switch blockType {
+	case zstdBlockRaw:
+		z.hist = z.hist[:start+size]
+		if _, err := io.ReadFull(z.r, z.hist[start:]); err != nil {
+			return unexpectedEOF(err)
+		}
+	case zstdBlockRLE:
+		b, err := z.r.ReadByte()
+		if err != nil {
+			return unexpectedEOF(err)
+		}
+		for i := 0; i < size; i++ {
+			z.hist = append(z.hist, b)
+		}
+	case zstdBlockCompressed:
+		if cap(z.block) < size {
+			z.block = make([]byte, size)
+		}
+		block := z.block[:size]
+		if _, err := io.ReadFull(z.r, block); err != nil {
+			return unexpectedEOF(err)
+		}
+		if err := z.decodeBlock(block, start+z.blockMax); err != nil {
+			return err
+		}
+	default:
+		return errZstdCorrupt
+	}
+	z.out = z.hist[start:]
+	z.contentLength += uint64(len(z.out))
+	if z.checksum {
+		z.contentHash.write(z.out)
+	}
+	if last {
+		return z.readFrameEnd()
+	}
+	return nil
+}
+
+// readFrameEnd checks the content size and reads the checksum following the last block.
+func (z *zstdReader) readFrameEnd() error {
+	z.inFrame = false
+	if z.hasContentSize && z.contentLength != z.contentSize {
+		return fmt.Errorf("zstd frame has %d bytes instead of %d", z.contentLength, z.contentSize)
+	}
+	if !z.checksum {
+		return nil
+	}
+	var buf [4]byte
+	if _, err := io.ReadFull(z.r, buf[:]); err != nil {
+		return unexpectedEOF(err)
+	}
+	if uint32(z.contentHash.sum()) != binary.LittleEndian.Uint32(buf[:]) {
+		return errors.New("zstd content checksum mismatch")
+	}
+	return nil
+}
+
+// decodeBlock appends the decompressed block to z.hist, which may not exceed limit bytes.
+func (z *zstdReader) decodeBlock(block []byte, limit int) error {
+	literals, n, err := z.decodeLiterals(block)
+	if err != nil {
+		return err
+	}
+	block = block[n:]
+
+	// sequences section header: number of sequences, table modes, table descriptions
+	if len(block) == 0 {
+		return errZstdCorrupt
+	}
+	var sequences int
+	switch b := int(block[0]); {
+	case b < 128:
+		sequences, n = b, 1
+	case b < 255 && len(block) >= 2:
+		sequences, n = (b-128)<<8|int(block[1]), 2
+	case b == 255 && len(block) >= 3:
+		sequences, n = int(block[1])|int(block[2])<<8+0x7f00, 3
+	default:
+		return errZstdCorrupt
+	}
+	block = block[n:]
+	if sequences == 0 {
+		if len(block) != 0 || len(literals) > limit-len(z.hist) {
+			return errZstdCorrupt
+		}
+		z.hist = append(z.hist, literals...)
+		return nil
+	}
+	if len(block) == 0 || block[0]&3 != 0 {
+		return errZstdCorrupt
+	}
+	modes := block[0]
+	block = block[1:]
+	for _, t := range []struct {
+		table      **zstdTable
+		built      *zstdTable
+		mode       byte
+		predefined *zstdTable
+		maxSymbol  int
+		maxLog     uint
+	}{
+		{&z.llTable, &z.llBuilt, modes >> 6, &zstdPredefinedLL, 35, 9},
+		{&z.ofTable, &z.ofBuilt, (modes >> 4) & 3, &zstdPredefinedOF, 31, 8},
+		{&z.mlTable, &z.mlBuilt, (modes >> 2) & 3, &zstdPredefinedML, 52, 9},
+	} {
+		switch t.mode {
+		case zstdModePredefined:
+			*t.table = t.predefined
+		case zstdModeRLE:
+			if len(block) == 0 || int(block[0]) > t.maxSymbol {
+				return errZstdCorrupt
+			}
+			t.built.setRLE(block[0])
+			*t.table = t.built
+			block = block[1:]
+		case zstdModeCompressed:
+			n, err := t.built.read(block, t.maxSymbol, t.maxLog)
+			if err != nil {
+				return err
+			}
+			*t.table = t.built
+			block = block[n:]
+		case zstdModeRepeat:
+			if *t.table == nil {
+				return errZstdCorrupt
+			}
+		}
+	}
+
+	return z.executeSequences(block, sequences, literals, limit)
+}
+
+// executeSequences decodes the sequences bitstream, and appends the literals and matches to z.hist.
+func (z *zstdReader) executeSequences(in []byte, sequences int, literals []byte, limit int) error {
+	br, err := newZstdBits(in)
+	if err != nil {
+		return err
+	}
+	ll, of, ml := z.llTable, z.ofTable, z.mlTable
+	llState := int(br.read(ll.log))
+	ofState := int(br.read(of.log))
+	mlState := int(br.read(ml.log))
+	hist := z.hist
+	for i := 0; i < sequences; i++ {
+		ofCode := of.table[ofState].symbol
+		mlCode := ml.table[mlState].symbol
+		llCode := ll.table[llState].symbol
+		offsetValue := 1<<ofCode + int(br.read(uint(ofCode)))
+		matchLength := zstdMLBase[mlCode] + int(br.read(uint(zstdMLBits[mlCode])))
+		literalLength := zstdLLBase[llCode] + int(br.read(uint(zstdLLBits[llCode])))
+
+		var offset int
+		if offsetValue > 3 {
+			offset = offsetValue - 3
+			z.reps = [3]int{offset, z.reps[0], z.reps[1]}
+		} else {
+			rep := offsetValue - 1
+			if literalLength == 0 {
+				rep++
+			}
+			switch rep {
+			case 0:
+				offset = z.reps[0]
+			case 3:
+				offset = z.reps[0] - 1
+			default:
+				offset = z.reps[rep]
+			}
+			if rep > 0 {
+				if rep != 1 {
+					z.reps[2] = z.reps[1]
+				}
+				z.reps[1] = z.reps[0]
+				z.reps[0] = offset
+			}
+		}
+
+		if i+1 < sequences {
+			llState = int(ll.table[llState].base) + int(br.read(uint(ll.table[llState].bits)))
+			mlState = int(ml.table[mlState].base) + int(br.read(uint(ml.table[mlState].bits)))
+			ofState = int(of.table[ofState].base) + int(br.read(uint(of.table[ofState].bits)))
+		}
+
+		if literalLength > len(literals) || literalLength+matchLength > limit-len(hist) {
+			return errZstdCorrupt
+		}
+		hist = append(hist, literals[:literalLength]...)
+		literals = literals[literalLength:]
+		if offset <= 0 || offset > len(hist) {
+			return errZstdCorrupt
+		}
+		hist = lzCopy(hist, offset, matchLength)
+	}
+	if br.pos != 0 || len(literals) > limit-len(hist) {
+		return errZstdCorrupt
+	}
+	z.hist = append(hist, literals...)
+	return nil
+}
+
+// decodeLiterals decodes the literals section at the start of the block, and returns the literals and the length of the section.
+func (z *zstdReader) decodeLiterals(in []byte) ([]byte, int, error) {
+	if len(in) == 0 {
+		return nil, 0, errZstdCorrupt
+	}
+	literalsType := in[0] & 3
+	sizeFormat := (in[0] >> 2) & 3
+
+	if literalsType == zstdLiteralsRaw || literalsType == zstdLiteralsRLE {
+		var size, n int
+		switch {
+		case sizeFormat&1 == 0:
+			size, n = int(in[0]>>3), 1
+		case sizeFormat == 1 && len(in) >= 2:
+			size, n = int(le64(in[:2])>>4), 2
+		case sizeFormat == 3 && len(in) >= 3:
+			size, n = int(le64(in[:3])>>4), 3
+		default:
+			return nil, 0, errZstdCorrupt
+		}
+		if size > z.blockMax {
+			return nil, 0, errZstdCorrupt
+		}
+		if literalsType == zstdLiteralsRaw {
+			if len(in)-n < size {
+				return nil, 0, errZstdCorrupt
+			}
+			return in[n : n+size], n + size, nil
+		}
+		if len(in) <= n {
+			return nil, 0, errZstdCorrupt
+		}
+		literals := z.literalsBuffer(size)
+		for i := range literals {
+			literals[i] = in[n]
+		}
+		return literals, n + 1, nil
+	}
+
+	// Huffman coded literals: the header has the regenerated and compressed sizes, and the number of streams
+	var size, compressed, n int
+	streams := 4
+	switch sizeFormat {
+	case 0, 1:
+		if sizeFormat == 0 {
+			streams = 1
+		}
+		if len(in) < 3 {
+			return nil, 0, errZstdCorrupt
+		}
+		v := le64(in[:3])
+		size, compressed, n = int(v>>4)&0x3ff, int(v>>14)&0x3ff, 3
+	case 2:
+		if len(in) < 4 {
+			return nil, 0, errZstdCorrupt
+		}
+		v := le64(in[:4])
+		size, compressed, n = int(v>>4)&0x3fff, int(v>>18)&0x3fff, 4
+	case 3:
+		if len(in) < 5 {
+			return nil, 0, errZstdCorrupt
+		}
+		v := le64(in[:5])
+		size, compressed, n = int(v>>4)&0x3ffff, int(v>>22)&0x3ffff, 5
+	}
+	if size > z.blockMax || compressed > len(in)-n {
+		return nil, 0, errZstdCorrupt
+	}
+	data := in[n : n+compressed]
+	if literalsType == zstdLiteralsCompressed {
+		tableLength, err := z.huffman.read(data)
+		if err != nil {
+			return nil, 0, err
+		}
+		data = data[tableLength:]
+	} else if !z.huffman.valid {
+		return nil, 0, errZstdCorrupt
+	}
+
+	literals := z.literalsBuffer(size)
+	if streams == 1 {
+		if err := z.huffman.decode(literals, data); err != nil {
+			return nil, 0, err
+		}
+		return literals, n + compressed, nil
+	}
+	// 4 streams, preceded by the sizes of the first 3
+	if len(data) < 6 {
+		return nil, 0, errZstdCorrupt
+	}
+	var sizes [4]int
+	for i := 0; i < 3; i++ {
+		sizes[i] = int(binary.LittleEndian.Uint16(data[2*i:]))
+	}
+	data = data[6:]
+	sizes[3] = len(data) - sizes[0] - sizes[1] - sizes[2]
+	segment := (size + 3) / 4
+	if sizes[3] < 0 || 3*segment > size {
+		return nil, 0, errZstdCorrupt
+	}
+	out := literals
+	for i, length := range sizes {
+		end := segment
+		if i == 3 {
+			end = len(out)
+		}
+		if err := z.huffman.decode(out[:end], data[:length]); err != nil {
+			return nil, 0, err
+		}
+		out = out[end:]
+		data = data[length:]
+	}
+	return literals, n + compressed, nil
+}
+
+func (z *zstdReader) literalsBuffer(size int) []byte {
+	if cap(z.literals) < size {
+		z.literals = make([]byte, size, zstdMaxBlock)
+	}
+	return z.literals[:size]
+}
+
+// zstdBits reads a bitstream backwards, as used for Huffman and FSE coded data. Bits before the start of the data read as 0.
+type zstdBits struct {
+	in  []byte
+	pos int // the number of bits left
+}
+
+func newZstdBits(in []byte) (*zstdBits, error) {
+	// the highest bit set in the last byte marks the end of the data
+	if len(in) == 0 || in[len(in)-1] == 0 {
+		return nil, errZstdCorrupt
+	}
+	return &zstdBits{in: in, pos: 8*len(in) - 9 + bits.Len8(in[len(in)-1])}, nil
+}
+
+// peek returns the next n bits, n <= 56
+func (b *zstdBits) peek(n uint) uint64 {
+	start := b.pos - int(n)
+	end := b.pos
+	if n == 0 || end <= 0 {
+		return 0
+	}
+	low := start
+	if low < 0 {
+		low = 0
+	}
+	v := le64(b.in[low>>3 : (end+7)>>3])
+	v >>= uint(low & 7)
+	v <<= uint(low - start)
+	return v & (1<<n - 1)
+}
+
+// read returns and consumes the next n bits, n <= 56
+func (b *zstdBits) read(n uint) uint64 {
+	v := b.peek(n)
+	b.pos -= int(n)
+	return v
+}
+
+// zstdHuffman is a Huffman decoding table for literals. Every entry of the table is the symbol, and the number of bits in the high byte.
+type zstdHuffman struct {
+	table   [1 << zstdMaxHuffmanBits]uint16
+	maxBits uint
+	valid   bool
+}
+
+const zstdMaxHuffmanBits = 11
+
+// read reads the Huffman tree description at the start of in, and returns its length
+func (h *zstdHuffman) read(in []byte) (int, error) {
+	h.valid = false
+	if len(in) == 0 {
+		return 0, errZstdCorrupt
+	}
+	var weights [256]byte
+	var n, length int
+	if header := int(in[0]); header < 128 {
+		// FSE compressed weights, decoded with 2 interleaved states
+		length = 1 + header
+		if len(in) < length {
+			return 0, errZstdCorrupt
+		}
+		var t zstdTable
+		tableLength, err := t.read(in[1:length], 255, 6)
+		if err != nil {
+			return 0, err
+		}
+		br, err := newZstdBits(in[1+tableLength : length])
+		if err != nil {
+			return 0, err
+		}
+		// the last weight is implied, so at most 255 are stored
+		state := [2]int{int(br.read(t.log)), int(br.read(t.log))}
+		for i := 0; ; i ^= 1 {
+			if n >= len(weights)-2 {
+				return 0, errZstdCorrupt
+			}
+			e := t.table[state[i]]
+			weights[n] = e.symbol
+			n++
+			state[i] = int(e.base) + int(br.read(uint(e.bits)))
+			if br.pos < 0 {
+				// the stream ends with the symbol of the other state
+				weights[n] = t.table[state[i^1]].symbol
+				n++
+				break
+			}
+		}
+	} else {
+		// 4 bit weights
+		n = header - 127
+		length = 1 + (n+1)/2
+		if len(in) < length {
+			return 0, errZstdCorrupt
+		}
+		for i := 0; i < n; i++ {
+			weights[i] = in[1+i/2] >> (4 * uint(1-i&1)) & 15
+		}
+	}
+
+	// the weight of the last symbol is implied by the others
+	total := 0
+	for _, w := range weights[:n] {
+		if w > zstdMaxHuffmanBits {
+			return 0, errZstdCorrupt
+		}
+		if w > 0 {
+			total += 1 << (w - 1)
+		}
+	}
+	if total == 0 {
+		return 0, errZstdCorrupt
+	}
+	maxBits := bits.Len(uint(total))
+	rest := 1<<uint(maxBits) - total
+	if maxBits > zstdMaxHuffmanBits || rest&(rest-1) != 0 {
+		return 0, errZstdCorrupt
+	}
+	weights[n] = byte(bits.Len(uint(rest)))
+	n++
+
+	// symbols with a lower weight have longer codes, which come first
+	var rankStart [zstdMaxHuffmanBits + 2]int
+	for _, w := range weights[:n] {
+		if w > 0 {
+			rankStart[w] += 1 << (w - 1)
+		}
+	}
+	position := 0
+	for w := range rankStart {
+		position, rankStart[w] = position+rankStart[w], position
+	}
+	for symbol, w := range weights[:n] {
+		if w == 0 {
+			continue
+		}
+		entry := uint16(symbol) | uint16(maxBits+1-int(w))<<8
+		start := rankStart[w]
+		for i := start; i < start+1<<(w-1); i++ {
+			h.table[i] = entry
+		}
+		rankStart[w] += 1 << (w - 1)
+	}
+	h.maxBits = uint(maxBits)
+	h.valid = true
+	return length, nil
+}
+
+// decode fills out with the symbols of the Huffman coded stream in
+func (h *zstdHuffman) decode(out, in []byte) error {
+	br, err := newZstdBits(in)
+	if err != nil {
+		return err
+	}
+	for i := range out {
+		e := h.table[br.peek(h.maxBits)]
+		out[i] = byte(e)
+		br.pos -= int(e >> 8)
+	}
+	if br.pos != 0 {
+		return errZstdCorrupt
+	}
+	return nil
+}
+
+// zstdTable is an FSE decoding table.
+type zstdTable struct {
+	table []zstdTableEntry
+	log   uint
+}
+
+type zstdTableEntry struct {
+	symbol byte
+	bits   byte
+	base   uint16 // the next state is base plus the next bits
+}
+
+// setRLE makes t always return symbol
+func (t *zstdTable) setRLE(symbol byte) {
+	t.table = append(t.table[:0], zstdTableEntry{symbol: symbol})
+	t.log = 0
+}
+
+// read reads the FSE table description at the start of in, builds the table, and returns the length of the description
+func (t *zstdTable) read(in []byte, maxSymbol int, maxLog uint) (int, error) {
+	if len(in) == 0 {
+		return 0, errZstdCorrupt
+	}
+	log := uint(in[0]&15) + 5
+	if log > maxLog {
+		return 0, errZstdCorrupt
+	}
+	// the description is a little endian bitstream
+	pos := 4
+	peek := func(n int) int {
+		var v uint64
+		for i := (pos + n - 1) >> 3; i >= pos>>3; i-- {
+			v <<= 8
+			if i < len(in) {
+				v |= uint64(in[i])
+			}
+		}
+		return int(v>>uint(pos&7)) & (1<<uint(n) - 1)
+	}
+
+	var counts [256]int16
+	remaining := 1<<log + 1
+	threshold := 1 << log
+	nbBits := int(log) + 1
+	symbol := 0
+	previousZero := false
+	for remaining > 1 && symbol <= maxSymbol {
+		if previousZero {
+			// 2 bit repeat flags for the following zero counts
+			for {
+				repeat := peek(2)
+				pos += 2
+				symbol += repeat
+				if repeat != 3 {
+					break
+				}
+			}
+			if symbol > maxSymbol || pos > 8*len(in) {
+				return 0, errZstdCorrupt
+			}
+		}
+		max := 2*threshold - 1 - remaining
+		v := peek(nbBits)
+		var count int
+		if v&(threshold-1) < max {
+			count = v & (threshold - 1)
+			pos += nbBits - 1
+		} else {
+			count = v & (2*threshold - 1)
+			if count >= threshold {
+				count -= max
+			}
+			pos += nbBits
+		}
+		count--
+		if count < 0 {
+			remaining += count
+		} else {
+			remaining -= count
+		}
+		if remaining < 1 {
+			return 0, errZstdCorrupt
+		}
+		counts[symbol] = int16(count)
+		symbol++
+		previousZero = count == 0
+		for remaining < threshold {
+			nbBits--
+			threshold >>= 1
+		}
+	}
+	if remaining != 1 || pos > 8*len(in) {
+		return 0, errZstdCorrupt
+	}
+	if err := t.build(counts[:symbol], log); err != nil {
+		return 0, err
+	}
+	return (pos + 7) >> 3, nil
+}
+
+// build builds the decoding table for the normalized symbol counts, where -1 stands for a probability below 1.
+func (t *zstdTable) build(counts []int16, log uint) error {
+	size := 1 << log
+	if cap(t.table) < size {
+		t.table = make([]zstdTableEntry, size)
+	}
+	t.table = t.table[:size]
+	for i := range t.table {
+		t.table[i] = zstdTableEntry{}
+	}
+	t.log = log
+	high := size - 1
+	var next [256]int
+	for symbol, count := range counts {
+		if count == -1 {
+			t.table[high].symbol = byte(symbol)
+			high--
+			next[symbol] = 1
+		} else {
+			next[symbol] = int(count)
+		}
+	}
+	step := size>>1 + size>>3 + 3
+	position := 0
+	for symbol, count := range counts {
+		for i := 0; i < int(count); i++ {
+			t.table[position].symbol = byte(symbol)
+			for position = (position + step) & (size - 1); position > high; position = (position + step) & (size - 1) {
+			}
+		}
+	}
+	if position != 0 {
+		return errZstdCorrupt
+	}
+	for i := range t.table {
+		e := &t.table[i]
+		state := next[e.symbol]
+		next[e.symbol]++
+		e.bits = byte(int(log) + 1 - bits.Len(uint(state)))
+		e.base = uint16(state<<e.bits - size)
+	}
+	return nil
+}
+
+// the predefined tables of the sequences section
+var zstdPredefinedLL, zstdPredefinedOF, zstdPredefinedML zstdTable
+
+func init() {
+	zstdPredefinedLL.build([]int16{
+		4, 3, 2, 2, 2, 2, 2, 2, 2, 2, 2, 2, 2, 1, 1, 1,
+		2, 2, 2, 2, 2, 2, 2, 2, 2, 3, 2, 1, 1, 1, 1, 1,
+		-1, -1, -1, -1}, 6)
+	zstdPredefinedOF.build([]int16{
+		1, 1, 1, 1, 1, 1, 2, 2, 2, 1, 1, 1, 1, 1, 1, 1,
+		1, 1, 1, 1, 1, 1, 1, 1, -1, -1, -1, -1, -1}, 5)
+	zstdPredefinedML.build([]int16{
+		1, 4, 3, 2, 2, 2, 2, 2, 2, 1, 1, 1, 1, 1, 1, 1,
+		1, 1, 1, 1, 1, 1, 1, 1, 1, 1, 1, 1, 1, 1, 1, 1,
+		1, 1, 1, 1, 1, 1, 1, 1, 1, 1, 1, 1, 1, 1, -1, -1,
+		-1, -1, -1, -1, -1}, 6)
+}
+
+// base values and number of additional bits of the literal length and match length codes
+var (
+	zstdLLBase = [36]int{
+		0, 1, 2, 3, 4, 5, 6, 7, 8, 9, 10, 11, 12, 13, 14, 15,
+		16, 18, 20, 22, 24, 28, 32, 40, 48, 64, 128, 256, 512, 1024, 2048, 4096,
+		8192, 16384, 32768, 65536}
+	zstdLLBits = [36]byte{
+		0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0,
+		1, 1, 1, 1, 2, 2, 3, 3, 4, 6, 7, 8, 9, 10, 11, 12,
+		13, 14, 15, 16}
+	zstdMLBase = [53]int{
+		3, 4, 5, 6, 7, 8, 9, 10, 11, 12, 13, 14, 15, 16, 17, 18,
+		19, 20, 21, 22, 23, 24, 25, 26, 27, 28, 29, 30, 31, 32, 33, 34,
+		35, 37, 39, 41, 43, 47, 51, 59, 67, 83, 99, 131, 259, 515, 1027, 2051,
+		4099, 8195, 16387, 32771, 65539}
+	zstdMLBits = [53]byte{
+		0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0,
+		0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0,
+		1, 1, 1, 1, 2, 2, 3, 3, 4, 4, 5, 7, 8, 9, 10, 11,
+		12, 13, 14, 15, 16}
+)
+
+// xxh64 is the 64 bit xxHash (https://github.com/Cyan4973/xxHash/blob/dev/doc/xxhash_spec.md) with seed 0, as used by the zstd checksum.
+type xxh64 struct {
+	v      [4]uint64
+	buf    [32]byte
+	n      int
+	length uint64
+}
+
+const (
+	xxh64Prime1 uint64 = 11400714785074694791
+	xxh64Prime2 uint64 = 14029467366897019727
+	xxh64Prime3 uint64 = 1609587929392839161
+	xxh64Prime4 uint64 = 9650029242287828579
+	xxh64Prime5 uint64 = 2870177450012600261
+)
+
+func (h *xxh64) reset() {
+	// xxh64Prime1 + xxh64Prime2, xxh64Prime2, 0, -xxh64Prime1 modulo 2^64
+	h.v = [4]uint64{6983438078262162902, xxh64Prime2, 0, 7046029288634856825}
+	h.n = 0
+	h.length = 0
+}
+
+func xxh64Round(v, input uint64) uint64 {
+	return bits.RotateLeft64(v+input*xxh64Prime2, 31) * xxh64Prime1
+}
+
+func xxh64Merge(acc, v uint64) uint64 {
+	return (acc^xxh64Round(0, v))*xxh64Prime1 + xxh64Prime4
+}
+
+func (h *xxh64) write(p []byte) {
+	h.length += uint64(len(p))
+	if h.n > 0 {
+		n := copy(h.buf[h.n:], p)
+		h.n += n
+		p = p[n:]
+		if h.n < 32 {
+			return
+		}
+		h.stripe(h.buf[:])
+		h.n = 0
+	}
+	for ; len(p) >= 32; p = p[32:] {
+		h.stripe(p)
+	}
+	h.n = copy(h.buf[:], p)
+}
+
+func (h *xxh64) stripe(p []byte) {
+	for i := range h.v {
+		h.v[i] = xxh64Round(h.v[i], binary.LittleEndian.Uint64(p[8*i:]))
+	}
+}
+
+func (h *xxh64) sum() uint64 {
+	var acc uint64
+	if h.length >= 32 {
+		acc = bits.RotateLeft64(h.v[0], 1) + bits.RotateLeft64(h.v[1], 7) + bits.RotateLeft64(h.v[2], 12) + bits.RotateLeft64(h.v[3], 18)
+		for _, v := range h.v {
+			acc = xxh64Merge(acc, v)
+		}
+	} else {
+		acc = h.v[2] + xxh64Prime5
+	}
+	acc += h.length
+	p := h.buf[:h.n]
+	for ; len(p) >= 8; p = p[8:] {
+		acc ^= xxh64Round(0, binary.LittleEndian.Uint64(p))
+		acc = bits.RotateLeft64(acc, 27)*xxh64Prime1 + xxh64Prime4
+	}
+	if len(p) >= 4 {
+		acc ^= uint64(binary.LittleEndian.Uint32(p)) * xxh64Prime1
+		acc = bits.RotateLeft64(acc, 23)*xxh64Prime2 + xxh64Prime3
+		p = p[4:]
+	}
+	for _, b := range p {
+		acc ^= uint64(b) * xxh64Prime5
+		acc = bits.RotateLeft64(acc, 11) * xxh64Prime1
+	}
+	acc ^= acc >> 33
+	acc *= xxh64Prime2
+	acc ^= acc >> 29
+	acc *= xxh64Prime3
+	acc ^= acc >> 32
+	return acc
+}
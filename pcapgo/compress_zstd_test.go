@@ -0,0 +1,78 @@
+// Copyright 2018 The GoPacket Authors. All rights reserved.
+//
+// Use of this source code is governed by a BSD-style license
+// that can be found in the LICENSE file in the root of the source
+// tree.
+
+// +build !pcapgo_nozstd
+
+package pcapgo
+
+import (
+	"bytes"
+	"testing"
+)
+
+func TestZstdReader(t *testing.T) {
+	// level 1 has a checksum, level 19 uses compressed sequence tables and repeats them
+	compressed, want := testDecompressFile(t, "capture.pcap.zst", CompressionZstd, compressedTestCapture)
+	testDecompressFile(t, "capture-19.pcap.zst", CompressionZstd, compressedTestCapture)
+	testDecompressDamaged(t, compressed, want)
+
+	// concatenated frames
+	twice := append(append([]byte(nil), compressed...), compressed...)
+	if got, err := decompressAll(twice); err != nil || !bytes.Equal(got, append(want, want...)) {
+		t.Errorf("Concatenated frames: uncompressed %d bytes, %v", len(got), err)
+	}
+}
+
+func TestZstdFrames(t *testing.T) {
+	// single segment frame with a content size of 8 bytes: raw block, RLE block
+	frame := []byte{0x28, 0xb5, 0x2f, 0xfd, 0x20, 8, 0x18, 0, 0, 'a', 'b', 'c', 0x2b, 0, 0, 'x'}
+	skippable := []byte{0x5f, 0x2a, 0x4d, 0x18, 3, 0, 0, 0, 'f', 'o', 'o'}
+	// frame with a 1 KiB window and a compressed block of raw literals without sequences
+	literals := []byte{0x28, 0xb5, 0x2f, 0xfd, 0x00, 0x00, 0x2d, 0, 0, 0x18, 'a', 'b', 'c', 0}
+
+	for _, test := range []struct {
+		name string
+		data []byte
+		want string
+	}{
+		{"frame", frame, "abcxxxxx"},
+		{"skippable", append(append(append([]byte(nil), frame...), skippable...), literals...), "abcxxxxxabc"},
+	} {
+		got, err := decompressAll(test.data)
+		if err != nil || string(got) != test.want {
+			t.Errorf("%s: got %q, %v", test.name, got, err)
+		}
+	}
+
+	for _, test := range []struct {
+		name  string
+		patch func([]byte)
+	}{
+		{"content size", func(b []byte) { b[5] = 9 }},
+		{"dictionary", func(b []byte) { b[4] |= 1 }},
+		{"reserved block type", func(b []byte) { b[6] |= 6 }},
+		{"block size", func(b []byte) { b[6] = 0x48 }},
+		{"trailing data", func(b []byte) { b[12] = 0x2a }},
+	} {
+		damaged := append([]byte(nil), frame...)
+		test.patch(damaged)
+		if got, err := decompressAll(damaged); err == nil {
+			t.Errorf("%s: no error, got %q", test.name, got)
+		}
+	}
+}
+
+func TestXxh64(t *testing.T) {
+	// the zstd checksum is the low 32 bits
+	for data, want := range map[string]uint64{"": 0xef46db3751d8e999, "abc": 0x44bc2cf5ad770999} {
+		var h xxh64
+		h.reset()
+		h.write([]byte(data))
+		if got := h.sum(); got != want {
+			t.Errorf("xxh64(%q) = %016x, expected %016x", data, got, want)
+		}
+	}
+}
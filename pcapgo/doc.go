@@ -11,17 +11,27 @@ Overview
 
 This package contains implementations for native PCAP support. Currently supported are
 
- * pcap-files read/write: Reader, Writer
+ * pcap-files read/write: Reader (including modified pcap), Writer
  * pcapng-files read/write: NgReader, NgWriter
- * raw socket capture (linux only): EthernetHandle
+ * snoop-files read/write: SnoopReader, SnoopWriter
+ * ERF, Network Monitor and btsnoop files read: ErfReader, NetmonReader, BtsnoopReader
+ * format detection for all of the above: OpenCapture
+ * random access to pcap and pcapng files: IndexedReader
+ * merging, splitting and editing pcap and pcapng files: Merge, Split, Edit
+ * rotating pcap and pcapng files: RotatingWriter
+ * transparently compressed files: NewDecompressor, NewCompressor, RegisterCompression, with built-in gzip, zstd, xz and lz4 decompression
+ * raw socket capture (linux only): EthernetHandle, with a TPACKET_V3 ring: NewEthernetHandleWithRing
 
 Basic Usage pcapng
 
 Pcapng files can be read and written. Reading supports both big and little endian files, packet blocks,
-simple packet blocks, enhanced packets blocks, interface blocks, and interface statistics blocks. All
-the options also by Wireshark are supported. The default reader options match libpcap behaviour. Have
+simple packet blocks, enhanced packets blocks, interface blocks, interface statistics blocks, name
+resolution blocks, decryption secrets blocks, and custom blocks. All the options also by Wireshark are
+supported. The default reader options match libpcap behaviour. Have
 a look at NgReaderOptions for more advanced usage. Both ReadPacketData and ZeroCopyReadPacketData is
-supported (which means PacketDataSource and ZeroCopyPacketDataSource is supported).
+supported (which means PacketDataSource and ZeroCopyPacketDataSource is supported). The options of
+enhanced packet blocks (comments, flags, hashes, ...) can be read with ReadPacketDataWithOptions, and
+written with WritePacketWithOptions.
 
 		f, err := os.Open("somefile.pcapng")
 		if err != nil {
@@ -37,10 +47,11 @@ supported (which means PacketDataSource and ZeroCopyPacketDataSource is supporte
 		data, ci, err := r.ReadPacketData()
 		...
 
-Write supports only little endian, enhanced packets blocks, interface blocks, and interface statistics
-blocks. The same options as with writing are supported. Interface timestamp resolution is fixed to
+Write supports little and big endian sections, enhanced and simple packets blocks, interface blocks, interface statistics
+blocks, name resolution blocks, decryption secrets blocks, and custom blocks. The same options as with writing are supported. Interface timestamp resolution is fixed to
 10^-9s to match time.Time. Any other values are ignored. Upon creating a writer, a section, and an
-interface block is automatically written. Additional interfaces can be added at any time. Since
+interface block is automatically written. Additional interfaces can be added at any time, and new sections can be
+started with StartSection. Since
 the writer uses a bufio.Writer internally, Flush must be called before closing the file! Have a look
 at NewNgWriterInterface for more advanced usage.
 
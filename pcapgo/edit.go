@@ -0,0 +1,468 @@
+// Copyright 2018 The GoPacket Authors. All rights reserved.
+//
+// Use of this source code is governed by a BSD-style license
+// that can be found in the LICENSE file in the root of the source
+// tree.
+
+package pcapgo
+
+import (
+	"bufio"
+	"container/heap"
+	"crypto/md5"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"time"
+
+	"github.com/davidsonff/gopacket"
+)
+
+// This file implements mergecap/editcap-like operations on pcap and pcapng files. Inputs are detected as pcap or pcapng files,
+// possibly compressed. Outputs have the format of the input, except for Merge, which always writes pcapng files. Timestamps are preserved exactly, and
+// the interfaces of pcapng files are added to the output as needed.
+
+// editInterfaceKey identifies an interface of an input
+type editInterfaceKey struct {
+	input, section, intf int
+}
+
+// editPacket is a packet read from an input, with the interface it was captured on
+type editPacket struct {
+	data    []byte
+	ci      gopacket.CaptureInfo
+	options NgPacketOptions
+	intf    *NgInterface
+	key     editInterfaceKey
+}
+
+// editInput reads packets from a pcap or pcapng file
+type editInput struct {
+	pcap *Reader
+	ng   *NgReader
+	id   int
+	// interface of pcap files
+	intf NgInterface
+}
+
+func newEditInput(r io.Reader, id int) (*editInput, error) {
+	dr, _, err := NewDecompressor(r)
+	if err != nil {
+		return nil, err
+	}
+	br, ok := dr.(*bufio.Reader)
+	if !ok {
+		br = bufio.NewReader(dr)
+	}
+	magic, err := br.Peek(4)
+	if err != nil {
+		return nil, err
+	}
+	in := &editInput{id: id}
+	if binary.LittleEndian.Uint32(magic) == uint32(ngBlockTypeSectionHeader) {
+		// all the interfaces are needed
+		in.ng, err = NewNgReader(br, NgReaderOptions{WantMixedLinkType: true})
+		return in, err
+	}
+	if in.pcap, err = NewReader(br); err != nil {
+		return nil, err
+	}
+	in.intf = NgInterface{
+		LinkType:            in.pcap.LinkType(),
+		SnapLength:          in.pcap.Snaplen(),
+		TimestampResolution: 6,
+	}
+	if in.pcap.nanoSecsFactor == 1 {
+		in.intf.TimestampResolution = 9
+	}
+	return in, nil
+}
+
+// next reads the next packet into p. The options of pcapng packets are kept, so that they are written to the output.
+func (in *editInput) next(p *editPacket) (err error) {
+	p.key = editInterfaceKey{input: in.id}
+	if in.pcap != nil {
+		p.data, p.ci, err = in.pcap.ReadPacketData()
+		p.intf = &in.intf
+		return err
+	}
+	if p.data, p.ci, p.options, err = in.ng.ReadPacketDataWithOptions(); err != nil {
+		return err
+	}
+	// the link type is available through the interface
+	p.ci.AncillaryData = nil
+	p.key.section = in.ng.section
+	p.key.intf = p.ci.InterfaceIndex
+	p.intf = &in.ng.ifaces[p.ci.InterfaceIndex]
+	return nil
+}
+
+// editOutput writes packets to a pcap or pcapng file, adding the interfaces of pcapng files as needed
+type editOutput struct {
+	pcap    *Writer
+	ng      *NgWriter
+	ifaces  map[editInterfaceKey]int
+	snaplen uint32
+	packets int
+	bytes   int64
+}
+
+// newEditOutput starts a new file in the format of the given input. If snaplen is not 0, it replaces the snapshot length of the interfaces.
+func newEditOutput(w io.Writer, in *editInput, snaplen uint32) (*editOutput, error) {
+	out := &editOutput{snaplen: snaplen}
+	if in.pcap != nil {
+		if in.pcap.nanoSecsFactor == 1 {
+			out.pcap = NewWriterNanos(w)
+		} else {
+			out.pcap = NewWriter(w)
+		}
+		if snaplen == 0 {
+			snaplen = in.pcap.Snaplen()
+		}
+		return out, out.pcap.WriteFileHeader(snaplen, in.pcap.LinkType())
+	}
+	return newNgEditOutput(w, in.ng.SectionInfo(), snaplen)
+}
+
+// newNgEditOutput starts a new pcapng file with the given section information.
+func newNgEditOutput(w io.Writer, info NgSectionInfo, snaplen uint32) (*editOutput, error) {
+	ng, err := newNgWriter(w, NgWriterOptions{SectionInfo: info})
+	if err != nil {
+		return nil, err
+	}
+	return &editOutput{
+		ng:      ng,
+		ifaces:  make(map[editInterfaceKey]int),
+		snaplen: snaplen,
+	}, nil
+}
+
+// size returns the number of bytes needed to write a packet, including its options
+func (out *editOutput) size(p *editPacket) int64 {
+	if out.pcap != nil {
+		return int64(16 + len(p.data))
+	}
+	size := int64(32 + len(p.data) + (4-len(p.data)&3)&3)
+	if opts, err := ngPacketOptions(p.options); err == nil {
+		size += int64(prepareNgOptions(opts))
+	}
+	return size
+}
+
+// write writes a packet, with its options if the output is a pcapng file
+func (out *editOutput) write(p *editPacket) error {
+	out.packets++
+	out.bytes += out.size(p)
+	if out.pcap != nil {
+		return out.pcap.WritePacket(p.ci, p.data)
+	}
+	id, ok := out.ifaces[p.key]
+	if !ok {
+		i := *p.intf
+		// timestamps are already absolute
+		i.TimestampOffset = 0
+		if out.snaplen != 0 && (i.SnapLength == 0 || i.SnapLength > out.snaplen) {
+			i.SnapLength = out.snaplen
+		}
+		var err error
+		if id, err = out.ng.AddInterface(i); err != nil {
+			return err
+		}
+		out.ifaces[p.key] = id
+	}
+	ci := p.ci
+	ci.InterfaceIndex = id
+	return out.ng.WritePacketWithOptions(ci, p.data, p.options)
+}
+
+func (out *editOutput) flush() error {
+	if out.ng != nil {
+		return out.ng.Flush()
+	}
+	return nil
+}
+
+// MergeOptions holds options for Merge.
+type MergeOptions struct {
+	// Append concatenates the inputs instead of merging their packets chronologically.
+	Append bool
+	// SectionInfo is written to the section header of the output.
+	SectionInfo NgSectionInfo
+}
+
+// DefaultMergeOptions provides sane defaults for Merge.
+var DefaultMergeOptions = MergeOptions{
+	SectionInfo: DefaultNgWriterOptions.SectionInfo,
+}
+
+// mergeHead is the next packet of an input
+type mergeHead struct {
+	in *editInput
+	editPacket
+}
+
+// mergeHeap orders inputs by the timestamp of their next packet, then by input order
+type mergeHeap []*mergeHead
+
+func (h mergeHeap) Len() int { return len(h) }
+func (h mergeHeap) Less(i, j int) bool {
+	if h[i].ci.Timestamp.Equal(h[j].ci.Timestamp) {
+		return h[i].in.id < h[j].in.id
+	}
+	return h[i].ci.Timestamp.Before(h[j].ci.Timestamp)
+}
+func (h mergeHeap) Swap(i, j int)       { h[i], h[j] = h[j], h[i] }
+func (h *mergeHeap) Push(x interface{}) { *h = append(*h, x.(*mergeHead)) }
+func (h *mergeHeap) Pop() interface{} {
+	old := *h
+	x := old[len(old)-1]
+	*h = old[:len(old)-1]
+	return x
+}
+
+// Merge writes the packets of the given pcap or pcapng inputs as a single pcapng file to w, in chronological order (or in input order, see
+// MergeOptions.Append). Every interface of every input is added to the output. Inputs with packets out of order are not sorted. It returns the
+// number of packets written.
+func Merge(w io.Writer, inputs []io.Reader, options MergeOptions) (int, error) {
+	out, err := newNgEditOutput(w, options.SectionInfo, 0)
+	if err != nil {
+		return 0, err
+	}
+	h := make(mergeHeap, 0, len(inputs))
+	for i, r := range inputs {
+		in, err := newEditInput(r, i)
+		if err != nil {
+			return 0, fmt.Errorf("input %d: %v", i, err)
+		}
+		head := &mergeHead{in: in}
+		if options.Append {
+			// the timestamp of the first packet doesn't matter
+			h = append(h, head)
+			continue
+		}
+		if err = in.next(&head.editPacket); err == nil {
+			h = append(h, head)
+		} else if err != io.EOF {
+			return 0, fmt.Errorf("input %d: %v", i, err)
+		}
+	}
+	if options.Append {
+		for _, head := range h {
+			for {
+				err := head.in.next(&head.editPacket)
+				if err == io.EOF {
+					break
+				}
+				if err != nil {
+					return out.packets, fmt.Errorf("input %d: %v", head.in.id, err)
+				}
+				if err := out.write(&head.editPacket); err != nil {
+					return out.packets, err
+				}
+			}
+		}
+		return out.packets, out.flush()
+	}
+	heap.Init(&h)
+	for len(h) > 0 {
+		head := h[0]
+		if err := out.write(&head.editPacket); err != nil {
+			return out.packets, err
+		}
+		if err = head.in.next(&head.editPacket); err == io.EOF {
+			heap.Pop(&h)
+		} else if err != nil {
+			return out.packets, fmt.Errorf("input %d: %v", head.in.id, err)
+		} else {
+			heap.Fix(&h, 0)
+		}
+	}
+	return out.packets, out.flush()
+}
+
+// EditOptions selects and modifies the packets copied by Edit and Split. Zero values disable the corresponding operation.
+type EditOptions struct {
+	// StartTime and EndTime select the packets with timestamps in [StartTime, EndTime).
+	StartTime, EndTime time.Time
+	// FirstPacket and LastPacket select the packets with numbers in [FirstPacket, LastPacket]. The first packet of the input is packet 1.
+	FirstPacket, LastPacket int
+	// DedupWindow drops the packets with the same data as a packet seen less than DedupWindow before.
+	DedupWindow time.Duration
+	// Snaplen truncates the packets to Snaplen bytes, and sets the snapshot length of the output.
+	Snaplen uint32
+}
+
+type dedupEntry struct {
+	ts  time.Time
+	sum [md5.Size]byte
+}
+
+// editFilter applies EditOptions to packets
+type editFilter struct {
+	options EditOptions
+	n       int
+	seen    map[[md5.Size]byte]int
+	window  []dedupEntry
+}
+
+// keep returns if the packet is kept, and truncates it if needed. done is true if no more packets can be kept.
+func (f *editFilter) keep(p *editPacket) (ok, done bool) {
+	o := &f.options
+	f.n++
+	if o.LastPacket != 0 && f.n > o.LastPacket {
+		return false, true
+	}
+	if f.n < o.FirstPacket ||
+		(!o.StartTime.IsZero() && p.ci.Timestamp.Before(o.StartTime)) ||
+		(!o.EndTime.IsZero() && !p.ci.Timestamp.Before(o.EndTime)) {
+		return false, false
+	}
+	if o.DedupWindow > 0 {
+		if f.seen == nil {
+			f.seen = make(map[[md5.Size]byte]int)
+		}
+		// forget the packets outside of the window
+		expired := 0
+		for _, e := range f.window {
+			if p.ci.Timestamp.Sub(e.ts) < o.DedupWindow {
+				break
+			}
+			if f.seen[e.sum]--; f.seen[e.sum] == 0 {
+				delete(f.seen, e.sum)
+			}
+			expired++
+		}
+		f.window = f.window[expired:]
+		sum := md5.Sum(p.data)
+		if f.seen[sum] > 0 {
+			return false, false
+		}
+		f.seen[sum]++
+		f.window = append(f.window, dedupEntry{ts: p.ci.Timestamp, sum: sum})
+	}
+	if o.Snaplen != 0 && len(p.data) > int(o.Snaplen) {
+		p.data = p.data[:o.Snaplen]
+		p.ci.CaptureLength = len(p.data)
+	}
+	return true, false
+}
+
+// Edit copies the packets of the given pcap or pcapng input selected by options to w, in the format of the input. It returns the number of packets
+// written.
+func Edit(w io.Writer, r io.Reader, options EditOptions) (int, error) {
+	in, err := newEditInput(r, 0)
+	if err != nil {
+		return 0, err
+	}
+	out, err := newEditOutput(w, in, options.Snaplen)
+	if err != nil {
+		return 0, err
+	}
+	f := editFilter{options: options}
+	for {
+		var p editPacket
+		err := in.next(&p)
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return out.packets, err
+		}
+		ok, done := f.keep(&p)
+		if done {
+			break
+		}
+		if !ok {
+			continue
+		}
+		if err := out.write(&p); err != nil {
+			return out.packets, err
+		}
+	}
+	return out.packets, out.flush()
+}
+
+// SplitOptions holds the limits of the files written by Split. A new file is started when the next packet would exceed one of the limits. Zero
+// values disable the corresponding limit.
+type SplitOptions struct {
+	// Packets is the maximum number of packets per file.
+	Packets int
+	// Duration is the maximum time between the first and the last packet of a file.
+	Duration time.Duration
+	// Bytes is the maximum size of the packets of a file, including their headers, but not the file headers.
+	Bytes int64
+	// EditOptions selects and modifies the packets written.
+	EditOptions EditOptions
+}
+
+// Split copies the packets of the given pcap or pcapng input to several files, in the format of the input, according to the limits of options. The
+// files are created by calling create with their number, starting at 0, and closed after the last packet. Every file has all the headers needed,
+// e.g. the interfaces of pcapng files. It returns the number of files written.
+func Split(r io.Reader, create func(n int) (io.WriteCloser, error), options SplitOptions) (int, error) {
+	if options.Packets <= 0 && options.Duration <= 0 && options.Bytes <= 0 {
+		return 0, errors.New("Split needs a limit")
+	}
+	in, err := newEditInput(r, 0)
+	if err != nil {
+		return 0, err
+	}
+	var out *editOutput
+	var file io.WriteCloser
+	var first time.Time
+	files := 0
+	finish := func() error {
+		if out == nil {
+			return nil
+		}
+		err := out.flush()
+		if cerr := file.Close(); err == nil {
+			err = cerr
+		}
+		out = nil
+		return err
+	}
+	f := editFilter{options: options.EditOptions}
+	for {
+		var p editPacket
+		err := in.next(&p)
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			finish()
+			return files, err
+		}
+		ok, done := f.keep(&p)
+		if done {
+			break
+		}
+		if !ok {
+			continue
+		}
+		if out != nil && ((options.Packets > 0 && out.packets >= options.Packets) ||
+			(options.Duration > 0 && p.ci.Timestamp.Sub(first) >= options.Duration) ||
+			(options.Bytes > 0 && out.bytes+out.size(&p) > options.Bytes)) {
+			if err := finish(); err != nil {
+				return files, err
+			}
+		}
+		if out == nil {
+			if file, err = create(files); err != nil {
+				return files, err
+			}
+			files++
+			if out, err = newEditOutput(file, in, options.EditOptions.Snaplen); err != nil {
+				file.Close()
+				out = nil
+				return files, err
+			}
+			first = p.ci.Timestamp
+		}
+		if err := out.write(&p); err != nil {
+			finish()
+			return files, err
+		}
+	}
+	return files, finish()
+}
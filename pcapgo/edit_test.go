@@ -0,0 +1,360 @@
+// Copyright 2018 The GoPacket Authors. All rights reserved.
+//
+// Use of this source code is governed by a BSD-style license
+// that can be found in the LICENSE file in the root of the source
+// tree.
+
+package pcapgo
+
+import (
+	"bytes"
+	"io"
+	"reflect"
+	"testing"
+	"time"
+
+	"github.com/davidsonff/gopacket"
+	"github.com/davidsonff/gopacket/layers"
+)
+
+var editBase = time.Unix(1500000000, 0).UTC()
+
+// editTestPcap returns a pcap file with a packet per given second
+func editTestPcap(t *testing.T, seconds ...int) []byte {
+	var buf bytes.Buffer
+	w := NewWriterNanos(&buf)
+	if err := w.WriteFileHeader(65536, layers.LinkTypeEthernet); err != nil {
+		t.Fatal(err)
+	}
+	for _, s := range seconds {
+		data := bytes.Repeat([]byte{byte(s)}, 20+s)
+		ci := gopacket.CaptureInfo{
+			Timestamp:     editBase.Add(time.Duration(s)*time.Second + 1),
+			CaptureLength: len(data),
+			Length:        len(data),
+		}
+		if err := w.WritePacket(ci, data); err != nil {
+			t.Fatal(err)
+		}
+	}
+	return buf.Bytes()
+}
+
+// editTestPcapng returns a pcapng file with two interfaces, and a packet per given second, alternating between the interfaces
+func editTestPcapng(t *testing.T, seconds ...int) []byte {
+	var buf bytes.Buffer
+	w, err := NewNgWriterInterface(&buf, NgInterface{Name: "eth0", LinkType: layers.LinkTypeEthernet}, DefaultNgWriterOptions)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := w.AddInterface(NgInterface{Name: "raw0", LinkType: layers.LinkTypeRaw, SnapLength: 100}); err != nil {
+		t.Fatal(err)
+	}
+	for i, s := range seconds {
+		data := bytes.Repeat([]byte{byte(s)}, 20+s)
+		ci := gopacket.CaptureInfo{
+			Timestamp:      editBase.Add(time.Duration(s)*time.Second + 1),
+			CaptureLength:  len(data),
+			Length:         len(data),
+			InterfaceIndex: i % 2,
+		}
+		if err := w.WritePacket(ci, data); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := w.Flush(); err != nil {
+		t.Fatal(err)
+	}
+	return buf.Bytes()
+}
+
+type editTestPacket struct {
+	second   int
+	length   int
+	linkType layers.LinkType
+}
+
+func checkEditOutput(t *testing.T, name string, file []byte, want []editTestPacket) {
+	var packets []editTestPacket
+	if bytes.HasPrefix(file, []byte{0x0a, 0x0d, 0x0d, 0x0a}) {
+		r, err := NewNgReader(bytes.NewReader(file), NgReaderOptions{WantMixedLinkType: true})
+		if err != nil {
+			t.Fatalf("[%s] %s", name, err)
+		}
+		for {
+			data, ci, err := r.ReadPacketData()
+			if err == io.EOF {
+				break
+			}
+			if err != nil {
+				t.Fatalf("[%s] %s", name, err)
+			}
+			s := int(ci.Timestamp.Sub(editBase) / time.Second)
+			if !ci.Timestamp.Equal(editBase.Add(time.Duration(s)*time.Second + 1)) {
+				t.Errorf("[%s] timestamp not preserved: %s", name, ci.Timestamp)
+			}
+			packets = append(packets, editTestPacket{s, len(data), ci.AncillaryData[0].(layers.LinkType)})
+		}
+	} else {
+		r, err := NewReader(bytes.NewReader(file))
+		if err != nil {
+			t.Fatalf("[%s] %s", name, err)
+		}
+		for {
+			data, ci, err := r.ReadPacketData()
+			if err == io.EOF {
+				break
+			}
+			if err != nil {
+				t.Fatalf("[%s] %s", name, err)
+			}
+			s := int(ci.Timestamp.Sub(editBase) / time.Second)
+			if !ci.Timestamp.Equal(editBase.Add(time.Duration(s)*time.Second + 1)) {
+				t.Errorf("[%s] timestamp not preserved: %s", name, ci.Timestamp)
+			}
+			packets = append(packets, editTestPacket{s, len(data), r.LinkType()})
+		}
+	}
+	if len(packets) != len(want) {
+		t.Fatalf("[%s] expected %d packets, got %d: %v", name, len(want), len(packets), packets)
+	}
+	for i := range want {
+		if packets[i] != want[i] {
+			t.Errorf("[%s] packet %d: expected %v, got %v", name, i, want[i], packets[i])
+		}
+	}
+}
+
+func TestMerge(t *testing.T) {
+	inputs := func() []io.Reader {
+		return []io.Reader{
+			bytes.NewReader(editTestPcap(t, 0, 3, 5)),
+			bytes.NewReader(editTestPcapng(t, 1, 2, 6)),
+			bytes.NewReader(editTestPcap(t)),
+		}
+	}
+	var buf bytes.Buffer
+	n, err := Merge(&buf, inputs(), DefaultMergeOptions)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if n != 6 {
+		t.Errorf("expected 6 packets written, got %d", n)
+	}
+	eth, raw := layers.LinkTypeEthernet, layers.LinkTypeRaw
+	checkEditOutput(t, "merge", buf.Bytes(), []editTestPacket{
+		{0, 20, eth}, {1, 21, eth}, {2, 22, raw}, {3, 23, eth}, {5, 25, eth}, {6, 26, eth},
+	})
+	r, err := NewNgReader(bytes.NewReader(buf.Bytes()), NgReaderOptions{WantMixedLinkType: true})
+	if err != nil {
+		t.Fatal(err)
+	}
+	for {
+		if _, _, err := r.ReadPacketData(); err != nil {
+			break
+		}
+	}
+	if r.NInterfaces() != 3 {
+		t.Errorf("expected 3 interfaces, got %d", r.NInterfaces())
+	}
+	if intf, _ := r.Interface(2); intf.Name != "raw0" || intf.SnapLength != 100 {
+		t.Errorf("interface not preserved: %+v", intf)
+	}
+
+	buf.Reset()
+	if _, err := Merge(&buf, inputs(), MergeOptions{Append: true}); err != nil {
+		t.Fatal(err)
+	}
+	checkEditOutput(t, "append", buf.Bytes(), []editTestPacket{
+		{0, 20, eth}, {3, 23, eth}, {5, 25, eth}, {1, 21, eth}, {2, 22, raw}, {6, 26, eth},
+	})
+}
+
+func TestEdit(t *testing.T) {
+	in := editTestPcap(t, 0, 1, 1, 2, 3, 4, 4, 5, 6, 7)
+	var buf bytes.Buffer
+	n, err := Edit(&buf, bytes.NewReader(in), EditOptions{
+		FirstPacket: 2,
+		LastPacket:  9,
+		StartTime:   editBase.Add(time.Second),
+		EndTime:     editBase.Add(6 * time.Second),
+		DedupWindow: time.Second,
+		Snaplen:     23,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if n != 5 {
+		t.Errorf("expected 5 packets written, got %d", n)
+	}
+	eth := layers.LinkTypeEthernet
+	checkEditOutput(t, "edit", buf.Bytes(), []editTestPacket{
+		{1, 21, eth}, {2, 22, eth}, {3, 23, eth}, {4, 23, eth}, {5, 23, eth},
+	})
+	r, err := NewReader(bytes.NewReader(buf.Bytes()))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if r.Snaplen() != 23 {
+		t.Errorf("expected snaplen 23, got %d", r.Snaplen())
+	}
+
+	buf.Reset()
+	if _, err := Edit(&buf, bytes.NewReader(editTestPcapng(t, 0, 1, 2, 3)), EditOptions{FirstPacket: 2}); err != nil {
+		t.Fatal(err)
+	}
+	checkEditOutput(t, "edit pcapng", buf.Bytes(), []editTestPacket{
+		{1, 21, layers.LinkTypeRaw}, {2, 22, eth}, {3, 23, layers.LinkTypeRaw},
+	})
+}
+
+type editTestFile struct {
+	bytes.Buffer
+	closed bool
+}
+
+func (f *editTestFile) Close() error {
+	f.closed = true
+	return nil
+}
+
+func TestSplit(t *testing.T) {
+	for _, test := range []struct {
+		name    string
+		in      []byte
+		options SplitOptions
+		want    [][]editTestPacket
+	}{
+		{
+			name:    "packets",
+			in:      editTestPcap(t, 0, 1, 2, 3, 4),
+			options: SplitOptions{Packets: 2},
+			want: [][]editTestPacket{
+				{{0, 20, layers.LinkTypeEthernet}, {1, 21, layers.LinkTypeEthernet}},
+				{{2, 22, layers.LinkTypeEthernet}, {3, 23, layers.LinkTypeEthernet}},
+				{{4, 24, layers.LinkTypeEthernet}},
+			},
+		},
+		{
+			name:    "duration",
+			in:      editTestPcapng(t, 0, 1, 2, 3, 10),
+			options: SplitOptions{Duration: 3 * time.Second},
+			want: [][]editTestPacket{
+				{{0, 20, layers.LinkTypeEthernet}, {1, 21, layers.LinkTypeRaw}, {2, 22, layers.LinkTypeEthernet}},
+				{{3, 23, layers.LinkTypeRaw}},
+				{{10, 30, layers.LinkTypeEthernet}},
+			},
+		},
+		{
+			name:    "bytes",
+			in:      editTestPcap(t, 0, 1, 2),
+			options: SplitOptions{Bytes: 16 + 20 + 16 + 21},
+			want: [][]editTestPacket{
+				{{0, 20, layers.LinkTypeEthernet}, {1, 21, layers.LinkTypeEthernet}},
+				{{2, 22, layers.LinkTypeEthernet}},
+			},
+		},
+	} {
+		var files []*editTestFile
+		n, err := Split(bytes.NewReader(test.in), func(n int) (io.WriteCloser, error) {
+			if n != len(files) {
+				t.Errorf("[%s] unexpected file number %d", test.name, n)
+			}
+			f := &editTestFile{}
+			files = append(files, f)
+			return f, nil
+		}, test.options)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if n != len(test.want) || len(files) != len(test.want) {
+			t.Fatalf("[%s] expected %d files, got %d", test.name, len(test.want), n)
+		}
+		for i, f := range files {
+			if !f.closed {
+				t.Errorf("[%s] file %d not closed", test.name, i)
+			}
+			checkEditOutput(t, test.name, f.Bytes(), test.want[i])
+		}
+	}
+}
+
+func TestEditPacketOptions(t *testing.T) {
+	options := []NgPacketOptions{
+		{Comments: []string{"first", "packet"}, Flags: NewNgPacketFlags(NgPacketDirectionInbound, 0, 4)},
+		{},
+		{DropCount: 3, Hashes: []NgPacketHash{{Algorithm: NgHashAlgorithmCRC32, Value: []byte{1, 2, 3, 4}}}},
+		{PacketID: 42, Queue: 1},
+	}
+	var buf bytes.Buffer
+	w, err := NewNgWriterInterface(&buf, NgInterface{Name: "eth0", LinkType: layers.LinkTypeEthernet}, DefaultNgWriterOptions)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for s, o := range options {
+		data := bytes.Repeat([]byte{byte(s)}, 20+s)
+		ci := gopacket.CaptureInfo{
+			Timestamp:     editBase.Add(time.Duration(s)*time.Second + 1),
+			CaptureLength: len(data),
+			Length:        len(data),
+		}
+		if err := w.WritePacketWithOptions(ci, data, o); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := w.Flush(); err != nil {
+		t.Fatal(err)
+	}
+	in := buf.Bytes()
+
+	check := func(name string, file []byte, want []NgPacketOptions) {
+		r, err := NewNgReader(bytes.NewReader(file), DefaultNgReaderOptions)
+		if err != nil {
+			t.Fatalf("[%s] %s", name, err)
+		}
+		for i := 0; ; i++ {
+			_, _, got, err := r.ReadPacketDataWithOptions()
+			if err == io.EOF {
+				if i != len(want) {
+					t.Errorf("[%s] expected %d packets, got %d", name, len(want), i)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("[%s] %s", name, err)
+			}
+			if i >= len(want) {
+				t.Fatalf("[%s] expected %d packets, got more", name, len(want))
+			}
+			if !reflect.DeepEqual(got, want[i]) {
+				t.Errorf("[%s] packet %d: expected options %+v, got %+v", name, i, want[i], got)
+			}
+		}
+	}
+
+	var out bytes.Buffer
+	if _, err := Merge(&out, []io.Reader{bytes.NewReader(in), bytes.NewReader(editTestPcap(t, 10))}, DefaultMergeOptions); err != nil {
+		t.Fatal(err)
+	}
+	check("merge", out.Bytes(), append(options[:len(options):len(options)], NgPacketOptions{}))
+
+	out.Reset()
+	if _, err := Edit(&out, bytes.NewReader(in), EditOptions{FirstPacket: 2, Snaplen: 21}); err != nil {
+		t.Fatal(err)
+	}
+	check("edit", out.Bytes(), options[1:])
+
+	var files []*editTestFile
+	if _, err := Split(bytes.NewReader(in), func(n int) (io.WriteCloser, error) {
+		f := &editTestFile{}
+		files = append(files, f)
+		return f, nil
+	}, SplitOptions{Packets: 3}); err != nil {
+		t.Fatal(err)
+	}
+	if len(files) != 2 {
+		t.Fatalf("[split] expected 2 files, got %d", len(files))
+	}
+	check("split 0", files[0].Bytes(), options[:3])
+	check("split 1", files[1].Bytes(), options[3:])
+}
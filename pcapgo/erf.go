@@ -0,0 +1,246 @@
+// Copyright 2018 The GoPacket Authors. All rights reserved.
+//
+// Use of this source code is governed by a BSD-style license
+// that can be found in the LICENSE file in the root of the source
+// tree.
+
+package pcapgo
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"time"
+
+	"github.com/davidsonff/gopacket"
+	"github.com/davidsonff/gopacket/layers"
+)
+
+// ERF record types. The types not listed here (ATM, AAL5, ...) are not supported.
+const (
+	erfTypeHDLCPOS         = 1
+	erfTypeEth             = 2
+	erfTypeMCHDLC          = 5
+	erfTypeColorHDLCPOS    = 10
+	erfTypeColorEth        = 11
+	erfTypeDSMColorHDLCPOS = 15
+	erfTypeDSMColorEth     = 16
+	erfTypeColorMCHDLCPOS  = 17
+	erfTypeColorHashPOS    = 19
+	erfTypeColorHashEth    = 20
+	erfTypeIPv4            = 22
+	erfTypeIPv6            = 23
+	erfTypeMeta            = 27
+	erfTypePad             = 48
+
+	// erfTypeMax is the highest record type known to DetectCaptureFormat
+	erfTypeMax = 48
+)
+
+const (
+	erfHeaderLength          = 16
+	erfExtensionHeaderLength = 8
+	erfTypeExtension         = 0x80 // extension headers follow
+	erfFlagsInterface        = 0x03
+)
+
+// erfLinkTypes maps ERF record types to link types, and gives the length of the type specific header
+var erfLinkTypes = map[uint8]struct {
+	linkType     layers.LinkType
+	headerLength int
+}{
+	erfTypeHDLCPOS:         {layers.LinkTypeC_HDLC, 0},
+	erfTypeColorHDLCPOS:    {layers.LinkTypeC_HDLC, 0},
+	erfTypeDSMColorHDLCPOS: {layers.LinkTypeC_HDLC, 0},
+	erfTypeColorHashPOS:    {layers.LinkTypeC_HDLC, 0},
+	erfTypeMCHDLC:          {layers.LinkTypeC_HDLC, 4},
+	erfTypeColorMCHDLCPOS:  {layers.LinkTypeC_HDLC, 4},
+	erfTypeEth:             {layers.LinkTypeEthernet, 2},
+	erfTypeColorEth:        {layers.LinkTypeEthernet, 2},
+	erfTypeDSMColorEth:     {layers.LinkTypeEthernet, 2},
+	erfTypeColorHashEth:    {layers.LinkTypeEthernet, 2},
+	erfTypeIPv4:            {layers.LinkTypeRaw, 0},
+	erfTypeIPv6:            {layers.LinkTypeRaw, 0},
+}
+
+// ErfExtensionHeader is an extension header of an ERF record.
+type ErfExtensionHeader struct {
+	// Type is the extension header type, without the "more headers" bit
+	Type uint8
+	// Data is the remaining 56 bits of the extension header
+	Data uint64
+}
+
+// ErfRecordHeader holds the ERF specific fields of a record.
+type ErfRecordHeader struct {
+	// Type is the record type, without the extension header bit
+	Type uint8
+	// Flags contains the capture interface, and the truncation and error flags
+	Flags uint8
+	// LossCounter is the loss counter, or the color of colored record types
+	LossCounter uint16
+	// Extensions are the extension headers of the record
+	Extensions []ErfExtensionHeader
+}
+
+// ErfReader reads Endace Extensible Record Format (ERF) files, as written by DAG cards. See
+// https://wiki.wireshark.org/ERF for information on the file format.
+//
+// ERF files have no file header; the link type is taken from the first Ethernet, HDLC/POS or IP record. Records of other types, and
+// records with a different link type, are skipped, like NgReader does without WantMixedLinkType. The capture interface of the record is
+// returned in CaptureInfo.InterfaceIndex. Ethernet frames include the FCS if it was captured.
+type ErfReader struct {
+	r        io.Reader
+	linkType layers.LinkType
+	// the first packet, read to determine the link type
+	pending       bool
+	pendingCI     gopacket.CaptureInfo
+	pendingHeader ErfRecordHeader
+	pendingOffset int
+	// reusable
+	buf       [erfHeaderLength]byte
+	packetBuf []byte
+}
+
+// NewErfReader returns a new ErfReader reading from r. The first data record is read at this point to determine the link type.
+func NewErfReader(r io.Reader) (*ErfReader, error) {
+	ret := &ErfReader{r: r}
+	ci, header, offset, err := ret.readRecord()
+	if err != nil {
+		return nil, err
+	}
+	ret.linkType = erfLinkTypes[header.Type].linkType
+	ret.pending = true
+	ret.pendingCI = ci
+	ret.pendingHeader = header
+	ret.pendingOffset = offset
+	return ret, nil
+}
+
+// readRecord reads the next supported record into packetBuf, and returns the offset of the packet data
+func (r *ErfReader) readRecord() (ci gopacket.CaptureInfo, header ErfRecordHeader, offset int, err error) {
+	for {
+		if _, err = io.ReadFull(r.r, r.buf[:]); err != nil {
+			return
+		}
+		ts := binary.LittleEndian.Uint64(r.buf[0:8])
+		typ := r.buf[8]
+		header = ErfRecordHeader{
+			Type:        typ &^ erfTypeExtension,
+			Flags:       r.buf[9],
+			LossCounter: binary.BigEndian.Uint16(r.buf[12:14]),
+		}
+		rlen := int(binary.BigEndian.Uint16(r.buf[10:12]))
+		wlen := int(binary.BigEndian.Uint16(r.buf[14:16]))
+		if rlen < erfHeaderLength {
+			err = fmt.Errorf("ERF record length too short: %d", rlen)
+			return
+		}
+		length := rlen - erfHeaderLength
+		if cap(r.packetBuf) < length {
+			r.packetBuf = make([]byte, length)
+		}
+		r.packetBuf = r.packetBuf[:length]
+		if _, err = io.ReadFull(r.r, r.packetBuf); err != nil {
+			if err == io.EOF {
+				err = io.ErrUnexpectedEOF
+			}
+			return
+		}
+
+		offset = 0
+		more := typ&erfTypeExtension != 0
+		for more {
+			if offset+erfExtensionHeaderLength > length {
+				err = errors.New("ERF extension headers exceed the record")
+				return
+			}
+			ext := binary.BigEndian.Uint64(r.packetBuf[offset:])
+			header.Extensions = append(header.Extensions, ErfExtensionHeader{
+				Type: uint8(ext>>56) &^ erfTypeExtension,
+				Data: ext & (1<<56 - 1),
+			})
+			more = ext&(erfTypeExtension<<56) != 0
+			offset += erfExtensionHeaderLength
+		}
+
+		info, ok := erfLinkTypes[header.Type]
+		if !ok || (r.linkType != 0 && info.linkType != r.linkType) {
+			continue
+		}
+		offset += info.headerLength
+		if offset > length {
+			err = errors.New("ERF record too short for its type")
+			return
+		}
+		ci.CaptureLength = length - offset
+		if ci.CaptureLength > wlen {
+			// padding
+			ci.CaptureLength = wlen
+		}
+		ci.Length = wlen
+		ci.InterfaceIndex = int(header.Flags & erfFlagsInterface)
+		frac := ts & 0xffffffff
+		ci.Timestamp = time.Unix(int64(ts>>32), int64((frac*1000000000+1<<31)>>32)).UTC()
+		return
+	}
+}
+
+func (r *ErfReader) next() (data []byte, ci gopacket.CaptureInfo, header ErfRecordHeader, err error) {
+	var offset int
+	if r.pending {
+		r.pending = false
+		ci, header, offset = r.pendingCI, r.pendingHeader, r.pendingOffset
+	} else if ci, header, offset, err = r.readRecord(); err != nil {
+		return
+	}
+	return r.packetBuf[offset : offset+ci.CaptureLength], ci, header, nil
+}
+
+// ReadPacketDataWithHeader reads the next packet, and returns the ERF specific fields of its record as well.
+func (r *ErfReader) ReadPacketDataWithHeader() (data []byte, ci gopacket.CaptureInfo, header ErfRecordHeader, err error) {
+	data, ci, header, err = r.next()
+	if err != nil {
+		return
+	}
+	return append([]byte(nil), data...), ci, header, nil
+}
+
+// ReadPacketData reads the next packet.
+func (r *ErfReader) ReadPacketData() (data []byte, ci gopacket.CaptureInfo, err error) {
+	data, ci, _, err = r.ReadPacketDataWithHeader()
+	return
+}
+
+// ZeroCopyReadPacketData reads the next packet. The data buffer is owned by the ErfReader,
+// and each call to ZeroCopyReadPacketData invalidates data returned by the previous one.
+func (r *ErfReader) ZeroCopyReadPacketData() (data []byte, ci gopacket.CaptureInfo, err error) {
+	data, ci, _, err = r.next()
+	return
+}
+
+// LinkType returns the link type of the packets.
+func (r *ErfReader) LinkType() layers.LinkType {
+	return r.linkType
+}
+
+// Resolution returns the timestamp resolution of ERF files, which is 2^-32s.
+func (r *ErfReader) Resolution() gopacket.TimestampResolution {
+	return gopacket.TimestampResolutionNTP
+}
+
+// isErfHeader checks if b looks like the header of an ERF record, as ERF files have no magic number
+func isErfHeader(b []byte) bool {
+	if len(b) < erfHeaderLength {
+		return false
+	}
+	typ := b[8] &^ erfTypeExtension
+	rlen := binary.BigEndian.Uint16(b[10:12])
+	wlen := binary.BigEndian.Uint16(b[14:16])
+	seconds := binary.LittleEndian.Uint32(b[4:8])
+	if typ == 0 || typ > erfTypeMax || rlen < erfHeaderLength || seconds == 0 {
+		return false
+	}
+	return typ == erfTypePad || typ == erfTypeMeta || wlen > 0
+}
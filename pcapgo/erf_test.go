@@ -0,0 +1,97 @@
+// Copyright 2018 The GoPacket Authors. All rights reserved.
+//
+// Use of this source code is governed by a BSD-style license
+// that can be found in the LICENSE file in the root of the source
+// tree.
+
+package pcapgo
+
+import (
+	"bytes"
+	"encoding/binary"
+	"io"
+	"reflect"
+	"testing"
+	"time"
+
+	"github.com/davidsonff/gopacket/layers"
+)
+
+// erfTestRecord returns an ERF record of the given type, padded to 8 bytes
+func erfTestRecord(seconds uint32, typ, flags uint8, extensions []uint64, payload []byte, wlen int) []byte {
+	body := new(bytes.Buffer)
+	for _, ext := range extensions {
+		binary.Write(body, binary.BigEndian, ext)
+	}
+	body.Write(payload)
+	for body.Len()%8 != 0 {
+		body.WriteByte(0)
+	}
+	var header [erfHeaderLength]byte
+	// half a second
+	binary.LittleEndian.PutUint64(header[0:8], uint64(seconds)<<32|1<<31)
+	header[8] = typ
+	header[9] = flags
+	binary.BigEndian.PutUint16(header[10:12], uint16(erfHeaderLength+body.Len()))
+	binary.BigEndian.PutUint16(header[12:14], 7)
+	binary.BigEndian.PutUint16(header[14:16], uint16(wlen))
+	return append(header[:], body.Bytes()...)
+}
+
+func TestErfReader(t *testing.T) {
+	frame := bytes.Repeat([]byte{0xee}, 60)
+	var file []byte
+	// a metadata record, which is skipped
+	file = append(file, erfTestRecord(1500000000, erfTypeMeta, 0, nil, make([]byte, 20), 0)...)
+	// ethernet with two extension headers, padded
+	file = append(file, erfTestRecord(1500000001, erfTypeEth|erfTypeExtension, 2, []uint64{
+		(0x80|0x01)<<56 | 0x1234,
+		0x04<<56 | 0x5678,
+	}, append([]byte{0, 0}, frame...), 60)...)
+	// IPv4, which doesn't match the link type
+	file = append(file, erfTestRecord(1500000002, erfTypeIPv4, 0, nil, frame[:20], 20)...)
+	// colored ethernet, truncated
+	file = append(file, erfTestRecord(1500000003, erfTypeColorEth, 1, nil, append([]byte{0, 0}, frame[:30]...), 64)...)
+
+	if format := DetectCaptureFormat(file); format != CaptureFormatERF {
+		t.Errorf("expected format erf, got %s", format)
+	}
+	r, err := NewErfReader(bytes.NewReader(file))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if r.LinkType() != layers.LinkTypeEthernet {
+		t.Errorf("expected link type ethernet, got %s", r.LinkType())
+	}
+
+	data, ci, header, err := r.ReadPacketDataWithHeader()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(data, frame) || ci.CaptureLength != 60 || ci.Length != 60 || ci.InterfaceIndex != 2 {
+		t.Errorf("unexpected packet %x %+v", data, ci)
+	}
+	if !ci.Timestamp.Equal(time.Unix(1500000001, 500000000)) {
+		t.Errorf("unexpected timestamp %s", ci.Timestamp)
+	}
+	wantHeader := ErfRecordHeader{
+		Type:        erfTypeEth,
+		Flags:       2,
+		LossCounter: 7,
+		Extensions:  []ErfExtensionHeader{{Type: 1, Data: 0x1234}, {Type: 4, Data: 0x5678}},
+	}
+	if !reflect.DeepEqual(header, wantHeader) {
+		t.Errorf("expected header %+v, got %+v", wantHeader, header)
+	}
+
+	data, ci, err = r.ZeroCopyReadPacketData()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(data, frame[:30]) || ci.CaptureLength != 30 || ci.Length != 64 || ci.InterfaceIndex != 1 {
+		t.Errorf("unexpected packet %x %+v", data, ci)
+	}
+	if _, _, err := r.ReadPacketData(); err != io.EOF {
+		t.Errorf("expected EOF, got %v", err)
+	}
+}
@@ -0,0 +1,376 @@
+// Copyright 2018 The GoPacket Authors. All rights reserved.
+//
+// Use of this source code is governed by a BSD-style license
+// that can be found in the LICENSE file in the root of the source
+// tree.
+
+package pcapgo
+
+import (
+	"bufio"
+	"encoding/binary"
+	"encoding/gob"
+	"errors"
+	"fmt"
+	"io"
+	"sort"
+	"time"
+
+	"github.com/davidsonff/gopacket"
+	"github.com/davidsonff/gopacket/layers"
+)
+
+// IndexedReaderOptions holds options for an IndexedReader.
+type IndexedReaderOptions struct {
+	// NgReaderOptions are used for pcapng files. The callbacks are only called while the index is built by NewIndexedReader.
+	NgReaderOptions NgReaderOptions
+}
+
+// DefaultIndexedReaderOptions provides sane defaults for an IndexedReader.
+var DefaultIndexedReaderOptions = IndexedReaderOptions{
+	NgReaderOptions: DefaultNgReaderOptions,
+}
+
+// ErrIndexMismatch gets returned by LoadIndexedReader if the index was not built for the given capture file.
+var ErrIndexMismatch = errors.New("Index does not match the capture file")
+
+const indexVersion = 1
+
+// indexEntry is the position of a single packet in the capture file
+type indexEntry struct {
+	Offset    int64
+	Timestamp int64
+}
+
+// indexSection holds what is needed to decode the packets of a pcapng section
+type indexSection struct {
+	FirstPacket int
+	BigEndian   bool
+	Interfaces  []NgInterface
+}
+
+// index is the persisted part of an IndexedReader
+type index struct {
+	Version  int
+	Size     int64
+	Pcapng   bool
+	Sorted   bool
+	Packets  []indexEntry
+	Sections []indexSection
+}
+
+// countingReader counts the bytes read from the underlying reader
+type countingReader struct {
+	r io.Reader
+	n int64
+}
+
+func (c *countingReader) Read(p []byte) (int, error) {
+	n, err := c.r.Read(p)
+	c.n += int64(n)
+	return n, err
+}
+
+// IndexedReader provides random access to the packets of an uncompressed pcap or pcapng file. It is built on an index of the offsets and timestamps
+// of the packets, which is created by a full scan of the file with NewIndexedReader, and can be persisted with WriteIndex and loaded with
+// LoadIndexedReader, so that opening the file again doesn't need a scan.
+//
+// IndexedReader implements gopacket.PacketDataSource, reading the packets in file order from the current position, see Seek and SeekTime.
+// It is not safe for concurrent use.
+type IndexedReader struct {
+	r          io.ReaderAt
+	index      index
+	pcap       *Reader
+	ng         *NgReader
+	next       int
+	start, end time.Time
+}
+
+// NewIndexedReader scans the whole capture file of the given size available through r, and returns an IndexedReader for it. A truncated
+// packet at the end of the file, e.g. one being written, ends the index.
+func NewIndexedReader(r io.ReaderAt, size int64, options IndexedReaderOptions) (*IndexedReader, error) {
+	ret, err := newIndexedReader(r, size, options)
+	if err != nil {
+		return nil, err
+	}
+	if ret.index.Pcapng {
+		err = ret.indexNg(options)
+	} else {
+		err = ret.indexPcap()
+	}
+	if err != nil {
+		return nil, err
+	}
+	ret.bounds()
+	return ret, nil
+}
+
+// LoadIndexedReader returns an IndexedReader for the capture file of the given size available through r, using an index written by WriteIndex
+// instead of scanning the file. ErrIndexMismatch is returned if the index was built for a file of a different size or format, and
+// another error if the index is inconsistent, like a corrupted one.
+func LoadIndexedReader(r io.ReaderAt, size int64, idx io.Reader, options IndexedReaderOptions) (*IndexedReader, error) {
+	ret, err := newIndexedReader(r, size, options)
+	if err != nil {
+		return nil, err
+	}
+	pcapng := ret.index.Pcapng
+	if err := gob.NewDecoder(idx).Decode(&ret.index); err != nil {
+		return nil, err
+	}
+	if ret.index.Version != indexVersion || ret.index.Size != size || ret.index.Pcapng != pcapng {
+		return nil, ErrIndexMismatch
+	}
+	if err := ret.index.check(); err != nil {
+		return nil, err
+	}
+	for _, section := range ret.index.Sections {
+		for i := range section.Interfaces {
+			section.Interfaces[i].prepareTimestamps()
+		}
+	}
+	ret.bounds()
+	return ret, nil
+}
+
+// check checks that a loaded index can be used to read the packets, as it might have been corrupted
+func (x *index) check() error {
+	for _, p := range x.Packets {
+		if p.Offset < 0 || p.Offset >= x.Size {
+			return fmt.Errorf("Invalid index: packet offset %d outside of the capture file", p.Offset)
+		}
+	}
+	if !x.Pcapng || len(x.Packets) == 0 {
+		return nil
+	}
+	if len(x.Sections) == 0 || x.Sections[0].FirstPacket != 0 {
+		return errors.New("Invalid index: no section for the first packet")
+	}
+	for i := 1; i < len(x.Sections); i++ {
+		if x.Sections[i].FirstPacket <= x.Sections[i-1].FirstPacket {
+			return fmt.Errorf("Invalid index: section %d doesn't start after section %d", i, i-1)
+		}
+	}
+	return nil
+}
+
+// newIndexedReader reads the file header and prepares the reader used to decode the packets
+func newIndexedReader(r io.ReaderAt, size int64, options IndexedReaderOptions) (*IndexedReader, error) {
+	var magic [compressionMagicLength]byte
+	if n, err := r.ReadAt(magic[:], 0); n < 4 {
+		return nil, err
+	}
+	if DetectCompression(magic[:]) != CompressionNone {
+		return nil, errors.New("Compressed capture files can't be indexed")
+	}
+	ret := &IndexedReader{
+		r: r,
+		index: index{
+			Version: indexVersion,
+			Size:    size,
+		},
+	}
+	if ngBlockType(binary.LittleEndian.Uint32(magic[:4])) == ngBlockTypeSectionHeader {
+		// the callbacks are only called while indexing
+		options := options.NgReaderOptions
+		options.SectionEndCallback = nil
+		options.StatisticsCallback = nil
+		options.NameResolutionCallback = nil
+		options.DecryptionSecretsCallback = nil
+		options.CustomBlockCallback = nil
+		ng, err := NewNgReader(io.NewSectionReader(r, 0, size), options)
+		if err != nil {
+			return nil, err
+		}
+		ret.ng = ng
+		ret.index.Pcapng = true
+		return ret, nil
+	}
+	pcap, err := NewReader(io.NewSectionReader(r, 0, size))
+	if err != nil {
+		return nil, err
+	}
+	ret.pcap = pcap
+	return ret, nil
+}
+
+func (r *IndexedReader) add(offset int64, ts time.Time) {
+	t := ts.UnixNano()
+	if n := len(r.index.Packets); n == 0 {
+		r.index.Sorted = true
+	} else if t < r.index.Packets[n-1].Timestamp {
+		r.index.Sorted = false
+	}
+	r.index.Packets = append(r.index.Packets, indexEntry{Offset: offset, Timestamp: t})
+}
+
+// indexPcap builds the index of a pcap file
+func (r *IndexedReader) indexPcap() error {
+	const headerLength = 24
+	counter := &countingReader{
+		r: bufio.NewReader(io.NewSectionReader(r.r, headerLength, r.index.Size-headerLength)),
+		n: headerLength,
+	}
+	pcap := *r.pcap
+	pcap.r = counter
+	for {
+		offset := counter.n
+		_, ci, err := pcap.ZeroCopyReadPacketData()
+		if err == io.EOF || err == io.ErrUnexpectedEOF {
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+		r.add(offset, ci.Timestamp)
+	}
+}
+
+// indexNg builds the index of a pcapng file
+func (r *IndexedReader) indexNg(options IndexedReaderOptions) error {
+	counter := &countingReader{r: io.NewSectionReader(r.r, 0, r.index.Size)}
+	ng, err := NewNgReader(counter, options.NgReaderOptions)
+	if err != nil {
+		return err
+	}
+	ng.counter = counter
+	section := 0
+	for {
+		_, ci, err := ng.ZeroCopyReadPacketData()
+		if err == io.EOF || err == io.ErrUnexpectedEOF {
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+		// interfaces can only be added to a section, so the interfaces known at the last packet of a section are enough to decode all of them
+		if ng.section != section {
+			section = ng.section
+			r.index.Sections = append(r.index.Sections, indexSection{
+				FirstPacket: len(r.index.Packets),
+				BigEndian:   ng.bigEndian,
+				Interfaces:  append([]NgInterface(nil), ng.ifaces...),
+			})
+		} else if last := &r.index.Sections[len(r.index.Sections)-1]; len(last.Interfaces) != len(ng.ifaces) {
+			last.Interfaces = append([]NgInterface(nil), ng.ifaces...)
+		}
+		r.add(ng.blockOffset, ci.Timestamp)
+	}
+}
+
+// bounds computes the time bounds of the capture
+func (r *IndexedReader) bounds() {
+	packets := r.index.Packets
+	if len(packets) == 0 {
+		return
+	}
+	start, end := packets[0].Timestamp, packets[len(packets)-1].Timestamp
+	if !r.index.Sorted {
+		for _, p := range packets {
+			if p.Timestamp < start {
+				start = p.Timestamp
+			}
+			if p.Timestamp > end {
+				end = p.Timestamp
+			}
+		}
+	}
+	r.start = time.Unix(0, start).UTC()
+	r.end = time.Unix(0, end).UTC()
+}
+
+// WriteIndex writes the index of the capture file to w, to be loaded with LoadIndexedReader.
+func (r *IndexedReader) WriteIndex(w io.Writer) error {
+	return gob.NewEncoder(w).Encode(&r.index)
+}
+
+// Len returns the number of packets in the capture file.
+func (r *IndexedReader) Len() int {
+	return len(r.index.Packets)
+}
+
+// StartTime returns the timestamp of the oldest packet of the capture file. It is zero if there are no packets.
+func (r *IndexedReader) StartTime() time.Time {
+	return r.start
+}
+
+// EndTime returns the timestamp of the newest packet of the capture file. It is zero if there are no packets.
+func (r *IndexedReader) EndTime() time.Time {
+	return r.end
+}
+
+// LinkType returns the link type of the capture file, as a layers.LinkType. For pcapng files, see NgReader.LinkType.
+func (r *IndexedReader) LinkType() layers.LinkType {
+	if r.ng != nil {
+		return r.ng.LinkType()
+	}
+	return r.pcap.LinkType()
+}
+
+// Timestamp returns the timestamp of packet n, without reading it.
+func (r *IndexedReader) Timestamp(n int) (time.Time, error) {
+	if n < 0 || n >= len(r.index.Packets) {
+		return time.Time{}, fmt.Errorf("Packet %d out of range; have only %d packets", n, len(r.index.Packets))
+	}
+	return time.Unix(0, r.index.Packets[n].Timestamp).UTC(), nil
+}
+
+// ReadPacketAt reads packet n, counting from 0 in file order. It doesn't change the current position.
+func (r *IndexedReader) ReadPacketAt(n int) (data []byte, ci gopacket.CaptureInfo, err error) {
+	if n < 0 || n >= len(r.index.Packets) {
+		err = fmt.Errorf("Packet %d out of range; have only %d packets", n, len(r.index.Packets))
+		return
+	}
+	offset := r.index.Packets[n].Offset
+	block := io.NewSectionReader(r.r, offset, r.index.Size-offset)
+	if r.pcap != nil {
+		r.pcap.r = block
+		return r.pcap.ReadPacketData()
+	}
+	sections := r.index.Sections
+	i := sort.Search(len(sections), func(i int) bool { return sections[i].FirstPacket > n }) - 1
+	r.ng.r.Reset(block)
+	r.ng.ifaces = sections[i].Interfaces
+	r.ng.bigEndian = sections[i].BigEndian
+	return r.ng.ReadPacketData()
+}
+
+// Seek sets the current position to packet n. Seeking to Len() is allowed, and makes ReadPacketData return io.EOF.
+func (r *IndexedReader) Seek(n int) error {
+	if n < 0 || n > len(r.index.Packets) {
+		return fmt.Errorf("Packet %d out of range; have only %d packets", n, len(r.index.Packets))
+	}
+	r.next = n
+	return nil
+}
+
+// SeekTime sets the current position to the first packet, in file order, with a timestamp not before t, and returns its number. If there is no
+// such packet, the position is set to, and SeekTime returns, Len(). Files with packets in chronological order are searched without a scan.
+func (r *IndexedReader) SeekTime(t time.Time) int {
+	ts := t.UnixNano()
+	packets := r.index.Packets
+	if r.index.Sorted {
+		r.next = sort.Search(len(packets), func(i int) bool { return packets[i].Timestamp >= ts })
+		return r.next
+	}
+	r.next = len(packets)
+	for i, p := range packets {
+		if p.Timestamp >= ts {
+			r.next = i
+			break
+		}
+	}
+	return r.next
+}
+
+// ReadPacketData reads the packet at the current position, and moves to the next one. It returns io.EOF after the last packet.
+func (r *IndexedReader) ReadPacketData() (data []byte, ci gopacket.CaptureInfo, err error) {
+	if r.next >= len(r.index.Packets) {
+		err = io.EOF
+		return
+	}
+	data, ci, err = r.ReadPacketAt(r.next)
+	if err == nil {
+		r.next++
+	}
+	return
+}
@@ -0,0 +1,198 @@
+// Copyright 2018 The GoPacket Authors. All rights reserved.
+//
+// Use of this source code is governed by a BSD-style license
+// that can be found in the LICENSE file in the root of the source
+// tree.
+
+package pcapgo
+
+import (
+	"bytes"
+	"io"
+	"io/ioutil"
+	"path/filepath"
+	"reflect"
+	"testing"
+	"time"
+
+	"github.com/davidsonff/gopacket"
+	"github.com/davidsonff/gopacket/layers"
+)
+
+type indexTestPacket struct {
+	data []byte
+	ci   gopacket.CaptureInfo
+}
+
+func readAllPackets(src gopacket.PacketDataSource) (packets []indexTestPacket, err error) {
+	for {
+		data, ci, err := src.ReadPacketData()
+		if err == io.EOF {
+			return packets, nil
+		}
+		if err != nil {
+			return packets, err
+		}
+		packets = append(packets, indexTestPacket{data, ci})
+	}
+}
+
+func checkIndexedReader(t *testing.T, name string, file []byte, want []indexTestPacket, options IndexedReaderOptions) {
+	r, err := NewIndexedReader(bytes.NewReader(file), int64(len(file)), options)
+	if err != nil {
+		t.Fatalf("[%s] Couldn't index: %s", name, err)
+	}
+	var idx bytes.Buffer
+	if err := r.WriteIndex(&idx); err != nil {
+		t.Fatalf("[%s] Couldn't write index: %s", name, err)
+	}
+	loaded, err := LoadIndexedReader(bytes.NewReader(file), int64(len(file)), bytes.NewReader(idx.Bytes()), options)
+	if err != nil {
+		t.Fatalf("[%s] Couldn't load index: %s", name, err)
+	}
+	for _, r := range []*IndexedReader{r, loaded} {
+		if r.Len() != len(want) {
+			t.Fatalf("[%s] Expected %d packets, got %d", name, len(want), r.Len())
+		}
+		// backwards, to make sure every packet is read independently
+		for i := len(want) - 1; i >= 0; i-- {
+			data, ci, err := r.ReadPacketAt(i)
+			if err != nil {
+				t.Fatalf("[%s] [packet %d] Unexpected error: %s", name, i, err)
+			}
+			if !bytes.Equal(data, want[i].data) || !reflect.DeepEqual(ci, want[i].ci) {
+				t.Fatalf("[%s] [packet %d] mismatch:\ngot:\n%#v\nwant:\n%#v\n\n", name, i, ci, want[i].ci)
+			}
+		}
+		got, err := readAllPackets(r)
+		if err != nil || len(got) != len(want) {
+			t.Fatalf("[%s] Sequential read returned %d packets, %v", name, len(got), err)
+		}
+	}
+}
+
+func TestIndexedReaderNg(t *testing.T) {
+	for _, be := range []string{"be", "le"} {
+		files, err := filepath.Glob(filepath.Join("tests", be, "*.pcapng"))
+		if err != nil {
+			t.Fatal(err)
+		}
+		for _, name := range files {
+			file, err := ioutil.ReadFile(name)
+			if err != nil {
+				t.Fatal(err)
+			}
+			for _, mixed := range []bool{false, true} {
+				options := DefaultIndexedReaderOptions
+				options.NgReaderOptions.WantMixedLinkType = mixed
+				r, err := NewNgReader(bytes.NewReader(file), options.NgReaderOptions)
+				if err != nil {
+					continue
+				}
+				want, err := readAllPackets(r)
+				if err != nil {
+					// not a valid file for the sequential reader
+					continue
+				}
+				checkIndexedReader(t, name, file, want, options)
+			}
+		}
+	}
+}
+
+func TestIndexedReaderPcap(t *testing.T) {
+	var buf bytes.Buffer
+	w := NewWriterNanos(&buf)
+	w.WriteFileHeader(65536, layers.LinkTypeEthernet)
+	var want []indexTestPacket
+	base := time.Unix(1500000000, 0).UTC()
+	for i := 0; i < 100; i++ {
+		data := bytes.Repeat([]byte{byte(i)}, i+1)
+		ci := gopacket.CaptureInfo{
+			Timestamp:     base.Add(time.Duration(i) * time.Second),
+			CaptureLength: len(data),
+			Length:        len(data) + 10,
+		}
+		if err := w.WritePacket(ci, data); err != nil {
+			t.Fatal(err)
+		}
+		want = append(want, indexTestPacket{data, ci})
+	}
+	file := buf.Bytes()
+	checkIndexedReader(t, "pcap", file, want, DefaultIndexedReaderOptions)
+
+	r, err := NewIndexedReader(bytes.NewReader(file), int64(len(file)), DefaultIndexedReaderOptions)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !r.StartTime().Equal(base) || !r.EndTime().Equal(base.Add(99*time.Second)) {
+		t.Errorf("Unexpected time bounds %s - %s", r.StartTime(), r.EndTime())
+	}
+	if n := r.SeekTime(base.Add(41500 * time.Millisecond)); n != 42 {
+		t.Errorf("SeekTime: expected packet 42, got %d", n)
+	}
+	if data, _, err := r.ReadPacketData(); err != nil || !bytes.Equal(data, want[42].data) {
+		t.Errorf("ReadPacketData after SeekTime returned %v, %v", data, err)
+	}
+	if n := r.SeekTime(base.Add(time.Hour)); n != r.Len() {
+		t.Errorf("SeekTime after the end: expected %d, got %d", r.Len(), n)
+	}
+	if _, _, err := r.ReadPacketData(); err != io.EOF {
+		t.Errorf("Expected EOF, got %v", err)
+	}
+	if _, _, err := r.ReadPacketAt(100); err == nil {
+		t.Error("Expected error reading packet out of range")
+	}
+
+	// a truncated last packet ends the index
+	truncated := file[:len(file)-10]
+	r, err = NewIndexedReader(bytes.NewReader(truncated), int64(len(truncated)), DefaultIndexedReaderOptions)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if r.Len() != 99 {
+		t.Errorf("Expected 99 packets in truncated file, got %d", r.Len())
+	}
+
+	var idx bytes.Buffer
+	if err := r.WriteIndex(&idx); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := LoadIndexedReader(bytes.NewReader(file), int64(len(file)), &idx, DefaultIndexedReaderOptions); err != ErrIndexMismatch {
+		t.Errorf("Expected ErrIndexMismatch, got %v", err)
+	}
+}
+
+func TestLoadIndexedReaderInvalid(t *testing.T) {
+	file, err := ioutil.ReadFile(filepath.Join("tests", "le", "test202.pcapng"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	size := int64(len(file))
+	for _, test := range []struct {
+		name   string
+		tamper func(x *index)
+	}{
+		{"no sections", func(x *index) { x.Sections = nil }},
+		{"late first section", func(x *index) { x.Sections[0].FirstPacket = 1 }},
+		{"sections out of order", func(x *index) { x.Sections[1].FirstPacket = 0 }},
+		{"offset past the end", func(x *index) { x.Packets[2].Offset = size }},
+		{"negative offset", func(x *index) { x.Packets[0].Offset = -1 }},
+	} {
+		r, err := NewIndexedReader(bytes.NewReader(file), size, DefaultIndexedReaderOptions)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if len(r.index.Sections) != 2 {
+			t.Fatalf("Expected 2 sections, got %d", len(r.index.Sections))
+		}
+		test.tamper(&r.index)
+		var idx bytes.Buffer
+		if err := r.WriteIndex(&idx); err != nil {
+			t.Fatal(err)
+		}
+		if _, err := LoadIndexedReader(bytes.NewReader(file), size, &idx, DefaultIndexedReaderOptions); err == nil {
+			t.Errorf("[%s] Expected error loading the index", test.name)
+		}
+	}
+}
@@ -0,0 +1,271 @@
+// Copyright 2018 The GoPacket Authors. All rights reserved.
+//
+// Use of this source code is governed by a BSD-style license
+// that can be found in the LICENSE file in the root of the source
+// tree.
+
+package pcapgo
+
+import (
+	"encoding/binary"
+	"fmt"
+	"io"
+	"time"
+
+	"github.com/davidsonff/gopacket"
+	"github.com/davidsonff/gopacket/layers"
+)
+
+var (
+	netmonMagic1 = []byte("RTSS")
+	netmonMagic2 = []byte("GMBU")
+)
+
+const (
+	netmonHeaderLength  = 32 // the part of the header needed to read the frames
+	netmonFrameHeader1  = 8
+	netmonFrameHeader2  = 16
+	netmonNetworkPcap   = 0xE000 // 0xE000 | pcap link type
+	netmonNetworkMask   = 0xF000
+	netmonMaxFrameTable = 1 << 28
+	// netmonMaxCaptureLength is the maximum capture length accepted, so that a corrupted frame doesn't allocate gigabytes
+	netmonMaxCaptureLength = 256 * 1024
+)
+
+// netmonLinkTypes maps Network Monitor media types to link types. Media types not listed here are metadata, or not supported.
+var netmonLinkTypes = map[uint16]layers.LinkType{
+	1: layers.LinkTypeEthernet,
+	2: layers.LinkTypeTokenRing,
+	7: layers.LinkTypeRaw, // tunneling interfaces
+	8: layers.LinkTypeRaw, // wireless WAN
+	9: layers.LinkTypeRaw, // RAS
+}
+
+func netmonLinkType(network uint16) (layers.LinkType, bool) {
+	if network&netmonNetworkMask == netmonNetworkPcap {
+		linkType := network &^ netmonNetworkMask
+		return layers.LinkType(linkType), linkType <= 0xff
+	}
+	linkType, ok := netmonLinkTypes[network]
+	return linkType, ok
+}
+
+// NetmonReader reads Microsoft Network Monitor 1.x and 2.x capture files (.cap). See https://wiki.wireshark.org/NetMon for information on
+// the file format.
+//
+// Network Monitor files have a frame table at the end of the file, which is used to locate the frames, so the file must be available as an
+// io.ReaderAt. The capture start time is stored in local time without time zone, and is interpreted as UTC; files of version 2.3 and later
+// have UTC timestamps for every frame, which are used instead. Files of version 2.1 and later have a media type per frame: metadata frames
+// (process information, network information, ...) and frames of another link type than the first supported one are skipped, like NgReader
+// does without WantMixedLinkType.
+type NetmonReader struct {
+	r            io.ReaderAt
+	versionMajor uint8
+	versionMinor uint8
+	network      uint16
+	linkType     layers.LinkType
+	start        time.Time
+	frames       []uint32
+	next         int
+	// reusable
+	packetBuf []byte
+}
+
+// NewNetmonReader returns a new NetmonReader reading from r. The file header and the frame table are read at this point.
+func NewNetmonReader(r io.ReaderAt) (*NetmonReader, error) {
+	var buf [netmonHeaderLength]byte
+	if err := readFullAt(r, buf[:], 0); err != nil {
+		return nil, err
+	}
+	ret := &NetmonReader{
+		r:            r,
+		versionMinor: buf[4],
+		versionMajor: buf[5],
+		network:      binary.LittleEndian.Uint16(buf[6:8]),
+	}
+	switch {
+	case string(buf[0:4]) == string(netmonMagic1) && ret.versionMajor == 1:
+	case string(buf[0:4]) == string(netmonMagic2) && ret.versionMajor == 2:
+	default:
+		return nil, fmt.Errorf("Unknown Network Monitor magic %x version %d.%d", buf[0:4], ret.versionMajor, ret.versionMinor)
+	}
+	// SYSTEMTIME: year, month, day of week, day, hour, minute, second, millisecond
+	st := func(i int) int { return int(binary.LittleEndian.Uint16(buf[8+2*i:])) }
+	ret.start = time.Date(st(0), time.Month(st(1)), st(3), st(4), st(5), st(6), st(7)*int(time.Millisecond), time.UTC)
+
+	offset := binary.LittleEndian.Uint32(buf[24:28])
+	length := binary.LittleEndian.Uint32(buf[28:32])
+	if length%4 != 0 || length > netmonMaxFrameTable {
+		return nil, fmt.Errorf("Invalid Network Monitor frame table length %d", length)
+	}
+	table := make([]byte, length)
+	if err := readFullAt(r, table, int64(offset)); err != nil {
+		return nil, err
+	}
+	ret.frames = make([]uint32, length/4)
+	for i := range ret.frames {
+		ret.frames[i] = binary.LittleEndian.Uint32(table[4*i:])
+	}
+
+	if linkType, ok := netmonLinkType(ret.network); ok {
+		ret.linkType = linkType
+	} else if ret.trailerLength() == 0 {
+		return nil, fmt.Errorf("Unsupported Network Monitor media type %d", ret.network)
+	}
+	return ret, nil
+}
+
+// readFullAt reads len(b) bytes at offset, and returns io.ErrUnexpectedEOF if the data ends before
+func readFullAt(r io.ReaderAt, b []byte, offset int64) error {
+	n, err := r.ReadAt(b, offset)
+	if n == len(b) {
+		return nil
+	}
+	if err == io.EOF {
+		err = io.ErrUnexpectedEOF
+	}
+	return err
+}
+
+// trailerLength returns the length of the trailer following every frame
+func (r *NetmonReader) trailerLength() int {
+	if r.versionMajor < 2 {
+		return 0
+	}
+	switch r.versionMinor {
+	case 0:
+		return 0
+	case 1:
+		// media type
+		return 2
+	case 2:
+		// media type, process info index
+		return 6
+	default:
+		// media type, process info index, UTC timestamp, time zone index
+		return 15
+	}
+}
+
+// readFrame reads frame i, and returns whether it should be returned
+func (r *NetmonReader) readFrame(i int) (data []byte, ci gopacket.CaptureInfo, ok bool, err error) {
+	offset := int64(r.frames[i])
+	headerLength := netmonFrameHeader1
+	if r.versionMajor == 2 {
+		headerLength = netmonFrameHeader2
+	}
+	var header [netmonFrameHeader2]byte
+	if err = readFullAt(r.r, header[:headerLength], offset); err != nil {
+		return
+	}
+	// the lengths are checked before converting them to int, which has 32 bits on some platforms
+	var frameLength, captureLength uint32
+	if r.versionMajor == 1 {
+		ci.Timestamp = r.start.Add(time.Duration(binary.LittleEndian.Uint32(header[0:4])) * time.Millisecond)
+		frameLength = uint32(binary.LittleEndian.Uint16(header[4:6]))
+		captureLength = uint32(binary.LittleEndian.Uint16(header[6:8]))
+	} else {
+		ci.Timestamp = r.start.Add(time.Duration(binary.LittleEndian.Uint64(header[0:8])) * time.Microsecond)
+		frameLength = binary.LittleEndian.Uint32(header[8:12])
+		captureLength = binary.LittleEndian.Uint32(header[12:16])
+	}
+	if captureLength > frameLength {
+		err = fmt.Errorf("capture length exceeds original packet length: %d > %d", captureLength, frameLength)
+		return
+	}
+	if captureLength > netmonMaxCaptureLength {
+		err = fmt.Errorf("capture length %d exceeds maximum of %d", captureLength, netmonMaxCaptureLength)
+		return
+	}
+	ci.Length = int(frameLength)
+	ci.CaptureLength = int(captureLength)
+
+	trailerLength := r.trailerLength()
+	length := ci.CaptureLength + trailerLength
+	if cap(r.packetBuf) < length {
+		r.packetBuf = make([]byte, length)
+	}
+	r.packetBuf = r.packetBuf[:length]
+	if err = readFullAt(r.r, r.packetBuf, offset+int64(headerLength)); err != nil {
+		return
+	}
+	data = r.packetBuf[:ci.CaptureLength]
+	if trailerLength == 0 {
+		return data, ci, true, nil
+	}
+	trailer := r.packetBuf[ci.CaptureLength:]
+	linkType, supported := netmonLinkType(binary.LittleEndian.Uint16(trailer[0:2]))
+	if !supported {
+		return data, ci, false, nil
+	}
+	if r.linkType == 0 {
+		r.linkType = linkType
+	} else if linkType != r.linkType {
+		return data, ci, false, nil
+	}
+	if trailerLength >= 14 {
+		// FILETIME: 100ns intervals since 1601
+		if ft := binary.LittleEndian.Uint64(trailer[6:14]); ft != 0 {
+			const unixEpoch = 116444736000000000
+			ft -= unixEpoch
+			ci.Timestamp = time.Unix(int64(ft/10000000), int64(ft%10000000)*100).UTC()
+		}
+	}
+	return data, ci, true, nil
+}
+
+func (r *NetmonReader) readNext() (data []byte, ci gopacket.CaptureInfo, err error) {
+	for r.next < len(r.frames) {
+		var ok bool
+		data, ci, ok, err = r.readFrame(r.next)
+		r.next++
+		if err != nil || ok {
+			return
+		}
+	}
+	return nil, ci, io.EOF
+}
+
+// ReadPacketData reads the next packet.
+func (r *NetmonReader) ReadPacketData() (data []byte, ci gopacket.CaptureInfo, err error) {
+	if data, ci, err = r.readNext(); err != nil {
+		return
+	}
+	return append([]byte(nil), data...), ci, nil
+}
+
+// ZeroCopyReadPacketData reads the next packet. The data buffer is owned by the NetmonReader,
+// and each call to ZeroCopyReadPacketData invalidates data returned by the previous one.
+func (r *NetmonReader) ZeroCopyReadPacketData() (data []byte, ci gopacket.CaptureInfo, err error) {
+	return r.readNext()
+}
+
+// LinkType returns the link type of the packets. If the file header has no supported media type, the link type of the first supported
+// frame is used, which needs to read the frames up to that one.
+func (r *NetmonReader) LinkType() layers.LinkType {
+	if r.linkType == 0 {
+		for i := r.next; i < len(r.frames) && r.linkType == 0; i++ {
+			if _, _, _, err := r.readFrame(i); err != nil {
+				break
+			}
+		}
+	}
+	return r.linkType
+}
+
+// Resolution returns the timestamp resolution of the packets.
+func (r *NetmonReader) Resolution() gopacket.TimestampResolution {
+	switch {
+	case r.versionMajor == 1:
+		return gopacket.TimestampResolutionMillisecond
+	case r.versionMinor >= 3:
+		return gopacket.TimestampResolution{Base: 10, Exponent: -7}
+	default:
+		return gopacket.TimestampResolutionMicrosecond
+	}
+}
+
+// Len returns the number of frames of the file, including metadata frames.
+func (r *NetmonReader) Len() int {
+	return len(r.frames)
+}
@@ -0,0 +1,164 @@
+// Copyright 2018 The GoPacket Authors. All rights reserved.
+//
+// Use of this source code is governed by a BSD-style license
+// that can be found in the LICENSE file in the root of the source
+// tree.
+
+package pcapgo
+
+import (
+	"bytes"
+	"encoding/binary"
+	"io"
+	"testing"
+	"time"
+
+	"github.com/davidsonff/gopacket"
+	"github.com/davidsonff/gopacket/layers"
+)
+
+type netmonTestFrame struct {
+	delta   uint64 // ms for version 1, µs for version 2
+	network uint16
+	data    []byte
+}
+
+// netmonTestFile returns a Network Monitor file with the given version and frames, and the frame table at the end
+func netmonTestFile(major, minor uint8, network uint16, frames ...netmonTestFrame) []byte {
+	le := binary.LittleEndian
+	var buf bytes.Buffer
+	if major == 1 {
+		buf.Write(netmonMagic1)
+	} else {
+		buf.Write(netmonMagic2)
+	}
+	buf.Write([]byte{minor, major})
+	binary.Write(&buf, le, network)
+	// 2018-03-04 05:06:07.089
+	binary.Write(&buf, le, []uint16{2018, 3, 0, 4, 5, 6, 7, 89})
+	// frame table offset and length, filled in later
+	buf.Write(make([]byte, 8))
+	// the rest of the header
+	buf.Write(make([]byte, 48))
+	var table []uint32
+	for _, f := range frames {
+		table = append(table, uint32(buf.Len()))
+		if major == 1 {
+			binary.Write(&buf, le, []uint32{uint32(f.delta)})
+			binary.Write(&buf, le, []uint16{uint16(len(f.data)) + 4, uint16(len(f.data))})
+		} else {
+			binary.Write(&buf, le, f.delta)
+			binary.Write(&buf, le, []uint32{uint32(len(f.data)) + 4, uint32(len(f.data))})
+		}
+		buf.Write(f.data)
+		if major == 2 && minor >= 1 {
+			binary.Write(&buf, le, f.network)
+		}
+		if major == 2 && minor >= 2 {
+			binary.Write(&buf, le, uint32(0))
+		}
+		if major == 2 && minor >= 3 {
+			binary.Write(&buf, le, uint64(0))
+			buf.WriteByte(0)
+		}
+	}
+	file := buf.Bytes()
+	le.PutUint32(file[24:28], uint32(len(file)))
+	le.PutUint32(file[28:32], uint32(4*len(table)))
+	for _, offset := range table {
+		file = append(file, 0, 0, 0, 0)
+		le.PutUint32(file[len(file)-4:], offset)
+	}
+	return file
+}
+
+func TestNetmonReader(t *testing.T) {
+	start := time.Date(2018, 3, 4, 5, 6, 7, 89000000, time.UTC)
+	eth := bytes.Repeat([]byte{0xee}, 20)
+	ip := bytes.Repeat([]byte{0x45}, 20)
+
+	for _, test := range []struct {
+		name       string
+		file       []byte
+		linkType   layers.LinkType
+		resolution gopacket.TimestampResolution
+		want       []time.Time
+	}{
+		{
+			name:       "1.1",
+			file:       netmonTestFile(1, 1, 1, netmonTestFrame{0, 0, eth}, netmonTestFrame{1500, 0, eth}),
+			linkType:   layers.LinkTypeEthernet,
+			resolution: gopacket.TimestampResolutionMillisecond,
+			want:       []time.Time{start, start.Add(1500 * time.Millisecond)},
+		},
+		{
+			name:       "2.0",
+			file:       netmonTestFile(2, 0, 1, netmonTestFrame{0, 0, eth}, netmonTestFrame{1500, 0, eth}),
+			linkType:   layers.LinkTypeEthernet,
+			resolution: gopacket.TimestampResolutionMicrosecond,
+			want:       []time.Time{start, start.Add(1500 * time.Microsecond)},
+		},
+		{
+			// the file media type isn't set, and metadata frames and frames of other link types are skipped
+			name: "2.3",
+			file: netmonTestFile(2, 3, 0,
+				netmonTestFrame{0, 0xFFFD, eth},
+				netmonTestFrame{10, netmonNetworkPcap | uint16(layers.LinkTypeRaw), ip},
+				netmonTestFrame{20, 1, eth},
+				netmonTestFrame{30, netmonNetworkPcap | uint16(layers.LinkTypeRaw), ip},
+			),
+			linkType:   layers.LinkTypeRaw,
+			resolution: gopacket.TimestampResolution{Base: 10, Exponent: -7},
+			want:       []time.Time{start.Add(10 * time.Microsecond), start.Add(30 * time.Microsecond)},
+		},
+	} {
+		r, err := NewNetmonReader(bytes.NewReader(test.file))
+		if err != nil {
+			t.Fatalf("[%s] %s", test.name, err)
+		}
+		if r.LinkType() != test.linkType {
+			t.Errorf("[%s] expected link type %s, got %s", test.name, test.linkType, r.LinkType())
+		}
+		if r.Resolution() != test.resolution {
+			t.Errorf("[%s] expected resolution %s, got %s", test.name, test.resolution, r.Resolution())
+		}
+		for i, want := range test.want {
+			data, ci, err := r.ReadPacketData()
+			if err != nil {
+				t.Fatalf("[%s] packet %d: %s", test.name, i, err)
+			}
+			if len(data) != 20 || ci.CaptureLength != 20 || ci.Length != 24 || !ci.Timestamp.Equal(want) {
+				t.Errorf("[%s] packet %d: unexpected packet %x %+v", test.name, i, data, ci)
+			}
+			if test.linkType == layers.LinkTypeRaw && data[0] != 0x45 {
+				t.Errorf("[%s] packet %d: frame of another link type returned", test.name, i)
+			}
+		}
+		if _, _, err := r.ZeroCopyReadPacketData(); err != io.EOF {
+			t.Errorf("[%s] expected EOF, got %v", test.name, err)
+		}
+
+		// through OpenCapture, without random access
+		c, format, err := OpenCapture(io.MultiReader(bytes.NewReader(test.file)), DefaultCaptureReaderOptions)
+		if err != nil || format != CaptureFormatNetmon {
+			t.Fatalf("[%s] OpenCapture returned %s, %v", test.name, format, err)
+		}
+		if packets, err := readAllPackets(c); err != nil || len(packets) != len(test.want) {
+			t.Errorf("[%s] OpenCapture: read %d packets, %v", test.name, len(packets), err)
+		}
+	}
+}
+
+func TestNetmonCorruptLength(t *testing.T) {
+	file := netmonTestFile(2, 0, 1, netmonTestFrame{0, 0, bytes.Repeat([]byte{0xee}, 20)})
+	// original and captured length of the frame after the 80 byte file header
+	binary.LittleEndian.PutUint32(file[88:92], 0xfffffff0)
+	binary.LittleEndian.PutUint32(file[92:96], 0xfffffff0)
+	r, err := NewNetmonReader(bytes.NewReader(file))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, _, err := r.ReadPacketData(); err == nil || err == io.EOF {
+		t.Errorf("expected an error for a huge capture length, got %v", err)
+	}
+}
@@ -8,10 +8,12 @@ package pcapgo
 
 import (
 	"bufio"
+	"bytes"
 	"encoding/binary"
 	"errors"
 	"fmt"
 	"io"
+	"net"
 	"time"
 
 	"github.com/davidsonff/gopacket"
@@ -33,6 +35,12 @@ type NgReaderOptions struct {
 	SectionEndCallback func([]NgInterface, NgSectionInfo)
 	// StatisticsCallback is called when a interface statistics block is read. The interface id and the read statistics are provided.
 	StatisticsCallback func(int, NgInterfaceStatistics)
+	// NameResolutionCallback is called when a name resolution block is read.
+	NameResolutionCallback func(NgNameResolution)
+	// DecryptionSecretsCallback is called when a decryption secrets block is read.
+	DecryptionSecretsCallback func(NgDecryptionSecrets)
+	// CustomBlockCallback is called when a custom block is read.
+	CustomBlockCallback func(NgCustomBlock)
 }
 
 // DefaultNgReaderOptions provides sane defaults for a pcapng reader.
@@ -45,6 +53,10 @@ type NgReader struct {
 	sectionInfo       NgSectionInfo
 	linkType          layers.LinkType
 	ifaces            []NgInterface
+	nameResolution    []NgNameResolution
+	names             map[string][]string
+	secrets           []NgDecryptionSecrets
+	customBlocks      []NgCustomBlock
 	currentBlock      ngBlock
 	currentOption     ngOption
 	buf               [24]byte
@@ -55,12 +67,25 @@ type NgReader struct {
 	firstSectionFound bool
 	activeSection     bool
 	bigEndian         bool
+	// used by IndexedReader to find the offsets of the blocks
+	counter     *countingReader
+	blockOffset int64
+	section     int
 }
 
 // NewNgReader initializes a new writer, reads the first section header, and if necessary according to the options the first interface.
+// Compressed files are transparently uncompressed (see NewDecompressor).
 func NewNgReader(r io.Reader, options NgReaderOptions) (*NgReader, error) {
+	dr, _, err := NewDecompressor(r)
+	if err != nil {
+		return nil, err
+	}
+	br, ok := dr.(*bufio.Reader)
+	if !ok {
+		br = bufio.NewReader(dr)
+	}
 	ret := &NgReader{
-		r: bufio.NewReader(r),
+		r: br,
 		currentOption: ngOption{
 			value: make([]byte, 1024),
 		},
@@ -125,6 +150,9 @@ func (r *NgReader) getUint64(buffer []byte) uint64 {
 
 // readBlock reads a the blocktype and length from the file. If the type is a section header, endianess is also read.
 func (r *NgReader) readBlock() error {
+	if r.counter != nil {
+		r.blockOffset = r.counter.n - int64(r.r.Buffered())
+	}
 	if err := r.readBytes(r.buf[0:8]); err != nil {
 		return err
 	}
@@ -170,6 +198,7 @@ func (r *NgReader) readOption() error {
 		}
 		return nil
 	}
+	r.currentOption.value = r.currentOption.value[:0]
 	if length != 0 {
 		if length < uint16(cap(r.currentOption.value)) {
 			r.currentOption.value = r.currentOption.value[:length]
@@ -202,8 +231,12 @@ func (r *NgReader) readSectionHeader() error {
 		}
 		r.options.SectionEndCallback(interfaces, r.sectionInfo)
 	}
-	// clear the interfaces
+	// clear the interfaces and the other per section information
 	r.ifaces = r.ifaces[:0]
+	r.nameResolution = nil
+	r.names = nil
+	r.secrets = nil
+	r.customBlocks = nil
 	r.activeSection = false
 
 RESTART:
@@ -256,6 +289,7 @@ OPTIONS:
 	}
 	r.activeSection = true
 	r.sectionInfo = section
+	r.section++
 
 	if !r.options.WantMixedLinkType {
 		// If we don't want mixed link type, we need the first interface to fill Reader.LinkType()
@@ -314,6 +348,11 @@ func (r *NgReader) firstInterface() error {
 			return nil
 		case ngBlockTypePacket, ngBlockTypeEnhancedPacket, ngBlockTypeSimplePacket, ngBlockTypeInterfaceStatistics:
 			return errors.New("A section must have an interface before a packet block")
+		case ngBlockTypeNameResolution, ngBlockTypeDecryptionSecrets, ngBlockTypeCustomCopy, ngBlockTypeCustomNoCopy:
+			if err := r.readAuxiliaryBlock(); err != nil {
+				return err
+			}
+			continue
 		}
 		if _, err := r.r.Discard(int(r.currentBlock.length)); err != nil {
 			return err
@@ -362,8 +401,13 @@ OPTIONS:
 	if intf.TimestampResolution == 0 {
 		intf.TimestampResolution = 6
 	}
+	intf.prepareTimestamps()
+	r.ifaces = append(r.ifaces, intf)
+	return nil
+}
 
-	//parse options
+// prepareTimestamps prepares the timestamp calculation of the interface according to its resolution
+func (intf *NgInterface) prepareTimestamps() {
 	if intf.TimestampResolution.Binary() {
 		//negative power of 2
 		intf.secondMask = 1 << intf.TimestampResolution.Exponent()
@@ -381,8 +425,6 @@ OPTIONS:
 	} else {
 		intf.scaleDown = intf.secondMask / 1e9
 	}
-	r.ifaces = append(r.ifaces, intf)
-	return nil
 }
 
 // convertTime adds offset + shifts the given time value according to the given interface
@@ -437,6 +479,175 @@ OPTIONS:
 	return nil
 }
 
+// readBlockBody reads the rest of the current block, except for the trailing length, into a new buffer
+func (r *NgReader) readBlockBody() ([]byte, error) {
+	if r.currentBlock.length < 4 || r.currentBlock.length > ngMaxBlockLength {
+		return nil, fmt.Errorf("Invalid length %d for block type %x", r.currentBlock.length, r.currentBlock.typ)
+	}
+	body := make([]byte, r.currentBlock.length-4)
+	if err := r.readBytes(body); err != nil {
+		return nil, err
+	}
+	if _, err := r.r.Discard(4); err != nil {
+		return nil, err
+	}
+	r.currentBlock.length = 0
+	return body, nil
+}
+
+// parseOptions calls fn for every option in the given buffer, until end of options or the end of the buffer
+func (r *NgReader) parseOptions(b []byte, fn func(code ngOptionCode, value []byte)) {
+	for len(b) >= 4 {
+		code := ngOptionCode(r.getUint16(b[:2]))
+		length := int(r.getUint16(b[2:4]))
+		b = b[4:]
+		if code == ngOptionCodeEndOfOptions || length > len(b) {
+			return
+		}
+		fn(code, b[:length])
+		length += (4 - length&3) & 3
+		if length > len(b) {
+			return
+		}
+		b = b[length:]
+	}
+}
+
+// readAuxiliaryBlock reads a name resolution, decryption secrets or custom block, stores it in the section information and calls the corresponding callback
+func (r *NgReader) readAuxiliaryBlock() error {
+	body, err := r.readBlockBody()
+	if err != nil {
+		return err
+	}
+	switch r.currentBlock.typ {
+	case ngBlockTypeNameResolution:
+		nrb, err := r.parseNameResolution(body)
+		if err != nil {
+			return err
+		}
+		if r.names == nil {
+			r.names = make(map[string][]string)
+		}
+		for _, record := range nrb.Records {
+			key := string(record.Addr.To16())
+			r.names[key] = append(r.names[key], record.Names...)
+		}
+		r.nameResolution = append(r.nameResolution, nrb)
+		if r.options.NameResolutionCallback != nil {
+			r.options.NameResolutionCallback(nrb)
+		}
+	case ngBlockTypeDecryptionSecrets:
+		if len(body) < 8 {
+			return errors.New("Decryption secrets block too short")
+		}
+		dsb := NgDecryptionSecrets{
+			Type: NgSecretsType(r.getUint32(body[:4])),
+		}
+		length := int(r.getUint32(body[4:8]))
+		body = body[8:]
+		if length > len(body) {
+			return fmt.Errorf("Decryption secrets length %d exceeds block length", length)
+		}
+		dsb.Data = body[:length]
+		length += (4 - length&3) & 3
+		if length <= len(body) {
+			r.parseOptions(body[length:], func(code ngOptionCode, value []byte) {
+				if code == ngOptionCodeComment {
+					dsb.Comment = string(value)
+				}
+			})
+		}
+		r.secrets = append(r.secrets, dsb)
+		if r.options.DecryptionSecretsCallback != nil {
+			r.options.DecryptionSecretsCallback(dsb)
+		}
+	case ngBlockTypeCustomCopy, ngBlockTypeCustomNoCopy:
+		if len(body) < 4 {
+			return errors.New("Custom block too short")
+		}
+		cb := NgCustomBlock{
+			PEN:      r.getUint32(body[:4]),
+			Data:     body[4:],
+			Copyable: r.currentBlock.typ == ngBlockTypeCustomCopy,
+		}
+		r.customBlocks = append(r.customBlocks, cb)
+		if r.options.CustomBlockCallback != nil {
+			r.options.CustomBlockCallback(cb)
+		}
+	}
+	return nil
+}
+
+// parseNameResolution parses the records and options of a name resolution block
+func (r *NgReader) parseNameResolution(b []byte) (nrb NgNameResolution, err error) {
+RECORDS:
+	for {
+		if len(b) < 4 {
+			return nrb, errors.New("Name resolution block without end of records")
+		}
+		typ := ngNameResolutionRecordType(r.getUint16(b[:2]))
+		length := int(r.getUint16(b[2:4]))
+		b = b[4:]
+		if length > len(b) {
+			return nrb, fmt.Errorf("Name resolution record length %d exceeds block length", length)
+		}
+		value := b[:length]
+		length += (4 - length&3) & 3
+		if length > len(b) {
+			length = len(b)
+		}
+		b = b[length:]
+
+		var addrLen int
+		switch typ {
+		case ngNameResolutionRecordEnd:
+			break RECORDS
+		case ngNameResolutionRecordIPv4:
+			addrLen = net.IPv4len
+		case ngNameResolutionRecordIPv6:
+			addrLen = net.IPv6len
+		default:
+			// unknown record type
+			continue
+		}
+		if len(value) < addrLen {
+			return nrb, fmt.Errorf("Name resolution record too short for its address (%d bytes)", len(value))
+		}
+		record := NgNameResolutionRecord{
+			Addr: net.IP(append([]byte(nil), value[:addrLen]...)),
+		}
+		for names := value[addrLen:]; len(names) > 0; {
+			end := bytes.IndexByte(names, 0)
+			if end < 0 {
+				end = len(names)
+			}
+			record.Names = append(record.Names, string(names[:end]))
+			if end == len(names) {
+				break
+			}
+			names = names[end+1:]
+		}
+		nrb.Records = append(nrb.Records, record)
+	}
+	r.parseOptions(b, func(code ngOptionCode, value []byte) {
+		switch code {
+		case ngOptionCodeComment:
+			nrb.Comment = string(value)
+		case ngOptionCodeNameResolutionDNSName:
+			nrb.DNSName = string(value)
+		case ngOptionCodeNameResolutionDNSIP4Addr:
+			if len(value) >= net.IPv4len {
+				nrb.DNSAddr = net.IP(append([]byte(nil), value[:net.IPv4len]...))
+			}
+		case ngOptionCodeNameResolutionDNSIP6Addr:
+			if len(value) >= net.IPv6len {
+				nrb.DNSAddr = net.IP(append([]byte(nil), value[:net.IPv6len]...))
+			}
+		}
+	})
+	return nrb, nil
+}
+
 // readPacketHeader looks for a packet (enhanced, simple, or packet) and parses the header.
 // If an interface descriptor, an interface statistics block, or a section header is encountered, those are handled accordingly.
 // All other block types are skipped. New block types must be added here.
@@ -489,6 +700,10 @@ FIND_PACKET:
 			if err := r.readSectionHeader(); err != nil {
 				return err
 			}
+		case ngBlockTypeNameResolution, ngBlockTypeDecryptionSecrets, ngBlockTypeCustomCopy, ngBlockTypeCustomNoCopy:
+			if err := r.readAuxiliaryBlock(); err != nil {
+				return err
+			}
 		case ngBlockTypePacket:
 			if err := r.readBytes(r.buf[:20]); err != nil {
 				return err
@@ -539,11 +754,89 @@ func (r *NgReader) ReadPacketData() (data []byte, ci gopacket.CaptureInfo, err e
 	if err = r.readBytes(data); err != nil {
 		return
 	}
-	// handle options somehow - this would be expensive
+	// options are handled by ReadPacketDataWithOptions
 	_, err = r.r.Discard(int(r.currentBlock.length) - r.ci.CaptureLength)
 	return
 }
 
+// ReadPacketDataWithOptions returns the next packet available from this data source, like ReadPacketData, together with its options.
+// Only enhanced packet blocks and packet blocks have options; the options of other packets are empty.
+func (r *NgReader) ReadPacketDataWithOptions() (data []byte, ci gopacket.CaptureInfo, options NgPacketOptions, err error) {
+	if err = r.readPacketHeader(); err != nil {
+		return
+	}
+	ci = r.ci
+	if r.options.WantMixedLinkType {
+		ci.AncillaryData = make([]interface{}, 1)
+		ci.AncillaryData[0] = r.ancil[0]
+	}
+	data = make([]byte, r.ci.CaptureLength)
+	if err = r.readBytes(data); err != nil {
+		return
+	}
+	length := uint32(r.ci.CaptureLength)
+	padding := (4 - length&3) & 3
+	if (r.currentBlock.typ == ngBlockTypeEnhancedPacket || r.currentBlock.typ == ngBlockTypePacket) && length+padding+4 <= r.currentBlock.length {
+		if _, err = r.r.Discard(int(padding)); err != nil {
+			return
+		}
+		r.currentBlock.length -= length + padding
+		if err = r.readPacketOptions(&options); err != nil {
+			return
+		}
+		_, err = r.r.Discard(int(r.currentBlock.length))
+		return
+	}
+	_, err = r.r.Discard(int(r.currentBlock.length) - r.ci.CaptureLength)
+	return
+}
+
+// readPacketOptions parses the options of an enhanced packet block or a packet block
+func (r *NgReader) readPacketOptions(options *NgPacketOptions) error {
+	for {
+		if err := r.readOption(); err != nil {
+			return err
+		}
+		value := r.currentOption.value
+		switch r.currentOption.code {
+		case ngOptionCodeEndOfOptions:
+			return nil
+		case ngOptionCodeComment:
+			options.Comments = append(options.Comments, string(value))
+		case ngOptionCodePacketFlags:
+			if len(value) >= 4 {
+				options.Flags = NgPacketFlags(r.getUint32(value[:4]))
+			}
+		case ngOptionCodePacketHash:
+			if len(value) >= 1 {
+				options.Hashes = append(options.Hashes, NgPacketHash{
+					Algorithm: NgHashAlgorithm(value[0]),
+					Value:     append([]byte(nil), value[1:]...),
+				})
+			}
+		case ngOptionCodePacketDropCount:
+			if len(value) >= 8 {
+				options.DropCount = r.getUint64(value[:8])
+			}
+		case ngOptionCodePacketID:
+			if len(value) >= 8 {
+				options.PacketID = r.getUint64(value[:8])
+			}
+		case ngOptionCodePacketQueue:
+			if len(value) >= 4 {
+				options.Queue = r.getUint32(value[:4])
+			}
+		case ngOptionCodePacketVerdict:
+			if len(value) >= 1 {
+				options.Verdicts = append(options.Verdicts, NgPacketVerdict{
+					Type: NgVerdictType(value[0]),
+					Data: append([]byte(nil), value[1:]...),
+				})
+			}
+		}
+	}
+}
+
 // ZeroCopyReadPacketData returns the next packet available from this data source.
 // If WantMixedLinkType is true, ci.AncillaryData[0] contains the link type.
 // Warning: Like data, ci.AncillaryData is also reused and overwritten on the next call to ZeroCopyReadPacketData.
@@ -604,3 +897,23 @@ func (r *NgReader) Resolution() gopacket.TimestampResolution {
 	}
 	return r.ifaces[0].Resolution()
 }
+
+// NameResolution returns the name resolution blocks read so far in the current section.
+func (r *NgReader) NameResolution() []NgNameResolution {
+	return r.nameResolution
+}
+
+// LookupAddr returns the names of the given address, according to the name resolution blocks read so far in the current section.
+func (r *NgReader) LookupAddr(ip net.IP) []string {
+	return r.names[string(ip.To16())]
+}
+
+// DecryptionSecrets returns the decryption secrets blocks read so far in the current section.
+func (r *NgReader) DecryptionSecrets() []NgDecryptionSecrets {
+	return r.secrets
+}
+
+// CustomBlocks returns the custom blocks read so far in the current section.
+func (r *NgReader) CustomBlocks() []NgCustomBlock {
+	return r.customBlocks
+}
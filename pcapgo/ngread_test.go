@@ -12,6 +12,7 @@ import (
 	"encoding/hex"
 	"io"
 	"log"
+	"net"
 	"os"
 	"path/filepath"
 	"reflect"
@@ -1920,3 +1921,129 @@ func BenchmarkNgZeroCopyReadPacketData(b *testing.B) {
 		_, _, _ = r.ZeroCopyReadPacketData()
 	}
 }
+
+func TestNgReadNameResolution(t *testing.T) {
+	for _, be := range []string{"be", "le"} {
+		f, err := os.Open(filepath.Join("tests", be, "test202.pcapng"))
+		if err != nil {
+			t.Fatal("Couldn't open file:", err)
+		}
+		defer f.Close()
+		var blocks []NgNameResolution
+		options := DefaultNgReaderOptions
+		options.NameResolutionCallback = func(nrb NgNameResolution) {
+			blocks = append(blocks, nrb)
+		}
+		r, err := NewNgReader(f, options)
+		if err != nil {
+			t.Fatal("Couldn't read start of file:", err)
+		}
+		// the first packet follows the name resolution blocks of the first section
+		if _, _, err = r.ReadPacketData(); err != nil {
+			t.Fatalf("[%s] Unexpected error: %s", be, err)
+		}
+		if len(blocks) != 2 || !reflect.DeepEqual(blocks, r.NameResolution()) {
+			t.Fatalf("[%s] Expected 2 name resolution blocks, got %#v and %#v", be, blocks, r.NameResolution())
+		}
+		if blocks[0].Comment != "test202 empty NRB" || len(blocks[0].Records) != 0 {
+			t.Errorf("[%s] Unexpected first block %#v", be, blocks[0])
+		}
+		if blocks[1].Comment != "test202 NRB" || len(blocks[1].Records) != 6 {
+			t.Errorf("[%s] Unexpected second block %#v", be, blocks[1])
+		}
+		if names := r.LookupAddr(net.ParseIP("192.168.1.2")); !reflect.DeepEqual(names, []string{"a", "example.com", "example.net"}) {
+			t.Errorf("[%s] Unexpected names for 192.168.1.2: %q", be, names)
+		}
+		if names := r.LookupAddr(net.ParseIP("fc01:dead::beef")); !reflect.DeepEqual(names, []string{"example.com"}) {
+			t.Errorf("[%s] Unexpected names for fc01:dead::beef: %q", be, names)
+		}
+		if names := r.LookupAddr(net.ParseIP("10.9.9.9")); names != nil {
+			t.Errorf("[%s] Unexpected names for 10.9.9.9: %q", be, names)
+		}
+		for err == nil {
+			_, _, err = r.ReadPacketData()
+		}
+		if err != io.EOF {
+			t.Fatalf("[%s] Unexpected error: %s", be, err)
+		}
+		if len(blocks) != 5 {
+			t.Errorf("[%s] Expected 5 name resolution blocks in the file, got %d", be, len(blocks))
+		}
+		if len(r.NameResolution()) != 1 || r.LookupAddr(net.ParseIP("192.168.1.2"))[0] != "qux.example.com" {
+			t.Errorf("[%s] Name resolution not reset by the last section: %#v", be, r.NameResolution())
+		}
+	}
+}
+
+func TestNgReadCustomBlocks(t *testing.T) {
+	for _, be := range []string{"be", "le"} {
+		f, err := os.Open(filepath.Join("tests", be, "test017.pcapng"))
+		if err != nil {
+			t.Fatal("Couldn't open file:", err)
+		}
+		defer f.Close()
+		var blocks []NgCustomBlock
+		options := DefaultNgReaderOptions
+		// this file has no interface
+		options.WantMixedLinkType = true
+		options.CustomBlockCallback = func(cb NgCustomBlock) {
+			blocks = append(blocks, cb)
+		}
+		r, err := NewNgReader(f, options)
+		if err != nil {
+			t.Fatal("Couldn't read start of file:", err)
+		}
+		for err == nil {
+			_, _, err = r.ReadPacketData()
+		}
+		if err != io.EOF {
+			t.Fatalf("[%s] Unexpected error: %s", be, err)
+		}
+		if len(blocks) != 4 || !reflect.DeepEqual(blocks, r.CustomBlocks()) {
+			t.Fatalf("[%s] Expected 4 custom blocks, got %#v", be, blocks)
+		}
+		for i, want := range []NgCustomBlock{
+			{PEN: 32473, Copyable: true, Data: []byte("an example Custom Block")},
+			{PEN: 32473, Copyable: false, Data: []byte("an example Custom Block not to be copied")},
+			{PEN: 36724, Copyable: true, Data: []byte("my Custom Block")},
+			{PEN: 36724, Copyable: false, Data: []byte("all your block are belong to us")},
+		} {
+			got := blocks[i]
+			if got.PEN != want.PEN || got.Copyable != want.Copyable || !bytes.HasPrefix(got.Data, want.Data) {
+				t.Errorf("[%s] custom block %d mismatch:\ngot:\n%#v\nwant:\n%#v\n\n", be, i, got, want)
+			}
+		}
+	}
+}
+
+func TestNgReadPacketOptions(t *testing.T) {
+	for _, be := range []string{"be", "le"} {
+		f, err := os.Open(filepath.Join("tests", be, "test009.pcapng"))
+		if err != nil {
+			t.Fatal("Couldn't open file:", err)
+		}
+		defer f.Close()
+		r, err := NewNgReader(f, DefaultNgReaderOptions)
+		if err != nil {
+			t.Fatal("Couldn't read start of file:", err)
+		}
+		for i, want := range []NgPacketOptions{
+			{Comments: []string{"test009-1"}},
+			{Comments: []string{"test009-2"}, Flags: 0x48000000, DropCount: 12345},
+		} {
+			data, _, options, err := r.ReadPacketDataWithOptions()
+			if err != nil {
+				t.Fatalf("[%s] [packet %d] Unexpected error: %s", be, i, err)
+			}
+			if !bytes.Equal(data, ngPacketSource[i]) {
+				t.Fatalf("[%s] [packet %d] data mismatch", be, i)
+			}
+			if !reflect.DeepEqual(options, want) {
+				t.Errorf("[%s] [packet %d] options mismatch:\ngot:\n%#v\nwant:\n%#v\n\n", be, i, options, want)
+			}
+		}
+		if _, _, _, err = r.ReadPacketDataWithOptions(); err != io.EOF {
+			t.Fatalf("[%s] Expected EOF, got %v", be, err)
+		}
+	}
+}
@@ -9,6 +9,7 @@ package pcapgo
 import (
 	"bufio"
 	"encoding/binary"
+	"errors"
 	"fmt"
 	"io"
 	"runtime"
@@ -22,6 +23,11 @@ import (
 type NgWriterOptions struct {
 	// SectionInfo will be written to the section header
 	SectionInfo NgSectionInfo
+	// ByteOrder is the byte order of the section. Defaults to little endian if nil.
+	ByteOrder binary.ByteOrder
+	// SimplePackets writes packets of interface 0 as simple packet blocks, which have no timestamp, for minimal files. Packets with options,
+	// of other interfaces, or which are truncated are still written as enhanced packet blocks.
+	SimplePackets bool
 }
 
 // DefaultNgWriterOptions contain defaults for a pcapng writer used by NewWriter
@@ -43,10 +49,11 @@ var DefaultNgInterface = NgInterface{
 
 // NgWriter holds the internal state of a pcapng file writer. Internally a bufio.NgWriter is used, therefore Flush must be called before closing the underlying file.
 type NgWriter struct {
-	w       *bufio.Writer
-	options NgWriterOptions
-	intf    uint32
-	buf     [28]byte
+	w         *bufio.Writer
+	options   NgWriterOptions
+	byteOrder binary.ByteOrder
+	intf      uint32
+	buf       [28]byte
 }
 
 // NewNgWriter initializes and returns a new writer. Additionally, one section and one interface (without statistics) is written to the file. Interface and section options are used from DefaultNgInterface and DefaultNgWriterOptions.
@@ -62,13 +69,10 @@ func NewNgWriter(w io.Writer, linkType layers.LinkType) (*NgWriter, error) {
 // NewNgWriterInterface initializes and returns a new writer. Additionally, one section and one interface (without statistics) is written to the file.
 // Flush must be called before the file is closed, or if eventual unwritten information should be written out to the storage device.
 //
-// Written files are in little endian format. Interface timestamp resolution is fixed to 9 (to match time.Time).
+// Written files are in the byte order given by the options, little endian by default. Interface timestamp resolution is fixed to 9 (to match time.Time).
 func NewNgWriterInterface(w io.Writer, intf NgInterface, options NgWriterOptions) (*NgWriter, error) {
-	ret := &NgWriter{
-		w:       bufio.NewWriter(w),
-		options: options,
-	}
-	if err := ret.writeSectionHeader(); err != nil {
+	ret, err := newNgWriter(w, options)
+	if err != nil {
 		return nil, err
 	}
 
@@ -78,6 +82,29 @@ func NewNgWriterInterface(w io.Writer, intf NgInterface, options NgWriterOptions
 	return ret, nil
 }
 
+// newNgWriter initializes and returns a new writer, and writes the section header. Interfaces must be added before writing packets.
+func newNgWriter(w io.Writer, options NgWriterOptions) (*NgWriter, error) {
+	ret := &NgWriter{
+		w: bufio.NewWriter(w),
+	}
+	if err := ret.StartSection(options); err != nil {
+		return nil, err
+	}
+	return ret, nil
+}
+
+// StartSection starts a new section with the given options, e.g. with another byte order or user application. Interfaces are local to
+// a section, so the interfaces needed by the packets of the new section must be added again, starting with id 0.
+func (w *NgWriter) StartSection(options NgWriterOptions) error {
+	w.options = options
+	w.byteOrder = options.ByteOrder
+	if w.byteOrder == nil {
+		w.byteOrder = binary.LittleEndian
+	}
+	w.intf = 0
+	return w.writeSectionHeader()
+}
+
 // ngOptionLength returns the needed length for one option value (without padding)
 func ngOptionLength(option ngOption) int {
 	switch val := option.raw.(type) {
@@ -122,8 +149,8 @@ func (w *NgWriter) writeOptions(options []ngOption) error {
 
 	var zero [4]byte
 	for _, option := range options {
-		binary.LittleEndian.PutUint16(w.buf[0:2], uint16(option.code))
-		binary.LittleEndian.PutUint16(w.buf[2:4], option.length)
+		w.byteOrder.PutUint16(w.buf[0:2], uint16(option.code))
+		w.byteOrder.PutUint16(w.buf[2:4], option.length)
 		if _, err := w.w.Write(w.buf[:4]); err != nil {
 			return err
 		}
@@ -150,23 +177,23 @@ func (w *NgWriter) writeOptions(options []ngOption) error {
 			}
 		case time.Time:
 			ts := val.UnixNano()
-			binary.LittleEndian.PutUint32(w.buf[:4], uint32(ts>>32))
-			binary.LittleEndian.PutUint32(w.buf[4:8], uint32(ts))
+			w.byteOrder.PutUint32(w.buf[:4], uint32(ts>>32))
+			w.byteOrder.PutUint32(w.buf[4:8], uint32(ts))
 			if _, err := w.w.Write(w.buf[:8]); err != nil {
 				return err
 			}
 		case uint64:
-			binary.LittleEndian.PutUint64(w.buf[:8], val)
+			w.byteOrder.PutUint64(w.buf[:8], val)
 			if _, err := w.w.Write(w.buf[:8]); err != nil {
 				return err
 			}
 		case uint32:
-			binary.LittleEndian.PutUint32(w.buf[:4], val)
+			w.byteOrder.PutUint32(w.buf[:4], val)
 			if _, err := w.w.Write(w.buf[:4]); err != nil {
 				return err
 			}
 		case uint8:
-			binary.LittleEndian.PutUint32(w.buf[:4], 0) // padding
+			w.byteOrder.PutUint32(w.buf[:4], 0) // padding
 			w.buf[0] = val
 			if _, err := w.w.Write(w.buf[:4]); err != nil {
 				return err
@@ -177,8 +204,8 @@ func (w *NgWriter) writeOptions(options []ngOption) error {
 	}
 
 	// options must be folled by an end of options option
-	binary.LittleEndian.PutUint16(w.buf[0:2], uint16(ngOptionCodeEndOfOptions))
-	binary.LittleEndian.PutUint16(w.buf[2:4], 0)
+	w.byteOrder.PutUint16(w.buf[0:2], uint16(ngOptionCodeEndOfOptions))
+	w.byteOrder.PutUint16(w.buf[2:4], 0)
 	_, err := w.w.Write(w.buf[:4])
 	return err
 }
@@ -214,12 +241,12 @@ func (w *NgWriter) writeSectionHeader() error {
 		24 + // header
 		4 // trailer
 
-	binary.LittleEndian.PutUint32(w.buf[:4], uint32(ngBlockTypeSectionHeader))
-	binary.LittleEndian.PutUint32(w.buf[4:8], length)
-	binary.LittleEndian.PutUint32(w.buf[8:12], ngByteOrderMagic)
-	binary.LittleEndian.PutUint16(w.buf[12:14], ngVersionMajor)
-	binary.LittleEndian.PutUint16(w.buf[14:16], ngVersionMinor)
-	binary.LittleEndian.PutUint64(w.buf[16:24], 0xFFFFFFFFFFFFFFFF) // unspecified
+	w.byteOrder.PutUint32(w.buf[:4], uint32(ngBlockTypeSectionHeader))
+	w.byteOrder.PutUint32(w.buf[4:8], length)
+	w.byteOrder.PutUint32(w.buf[8:12], ngByteOrderMagic)
+	w.byteOrder.PutUint16(w.buf[12:14], ngVersionMajor)
+	w.byteOrder.PutUint16(w.buf[14:16], ngVersionMinor)
+	w.byteOrder.PutUint64(w.buf[16:24], 0xFFFFFFFFFFFFFFFF) // unspecified
 	if _, err := w.w.Write(w.buf[:24]); err != nil {
 		return err
 	}
@@ -228,7 +255,7 @@ func (w *NgWriter) writeSectionHeader() error {
 		return err
 	}
 
-	binary.LittleEndian.PutUint32(w.buf[0:4], length)
+	w.byteOrder.PutUint32(w.buf[0:4], length)
 	_, err := w.w.Write(w.buf[:4])
 	return err
 }
@@ -279,11 +306,11 @@ func (w *NgWriter) AddInterface(intf NgInterface) (id int, err error) {
 		16 + // header
 		4 // trailer
 
-	binary.LittleEndian.PutUint32(w.buf[:4], uint32(ngBlockTypeInterfaceDescriptor))
-	binary.LittleEndian.PutUint32(w.buf[4:8], length)
-	binary.LittleEndian.PutUint16(w.buf[8:10], uint16(intf.LinkType))
-	binary.LittleEndian.PutUint16(w.buf[10:12], 0) // reserved value
-	binary.LittleEndian.PutUint32(w.buf[12:16], intf.SnapLength)
+	w.byteOrder.PutUint32(w.buf[:4], uint32(ngBlockTypeInterfaceDescriptor))
+	w.byteOrder.PutUint32(w.buf[4:8], length)
+	w.byteOrder.PutUint16(w.buf[8:10], uint16(intf.LinkType))
+	w.byteOrder.PutUint16(w.buf[10:12], 0) // reserved value
+	w.byteOrder.PutUint32(w.buf[12:16], intf.SnapLength)
 	if _, err := w.w.Write(w.buf[:16]); err != nil {
 		return 0, err
 	}
@@ -292,7 +319,7 @@ func (w *NgWriter) AddInterface(intf NgInterface) (id int, err error) {
 		return 0, err
 	}
 
-	binary.LittleEndian.PutUint32(w.buf[0:4], length)
+	w.byteOrder.PutUint32(w.buf[0:4], length)
 	_, err = w.w.Write(w.buf[:4])
 	return id, err
 }
@@ -334,11 +361,11 @@ func (w *NgWriter) WriteInterfaceStats(intf int, stats NgInterfaceStatistics) er
 		ts = 0
 	}
 
-	binary.LittleEndian.PutUint32(w.buf[:4], uint32(ngBlockTypeInterfaceStatistics))
-	binary.LittleEndian.PutUint32(w.buf[4:8], length)
-	binary.LittleEndian.PutUint32(w.buf[8:12], uint32(intf))
-	binary.LittleEndian.PutUint32(w.buf[12:16], uint32(ts>>32))
-	binary.LittleEndian.PutUint32(w.buf[16:20], uint32(ts))
+	w.byteOrder.PutUint32(w.buf[:4], uint32(ngBlockTypeInterfaceStatistics))
+	w.byteOrder.PutUint32(w.buf[4:8], length)
+	w.byteOrder.PutUint32(w.buf[8:12], uint32(intf))
+	w.byteOrder.PutUint32(w.buf[12:16], uint32(ts>>32))
+	w.byteOrder.PutUint32(w.buf[16:20], uint32(ts))
 	if _, err := w.w.Write(w.buf[:20]); err != nil {
 		return err
 	}
@@ -347,13 +374,59 @@ func (w *NgWriter) WriteInterfaceStats(intf int, stats NgInterfaceStatistics) er
 		return err
 	}
 
-	binary.LittleEndian.PutUint32(w.buf[0:4], length)
+	w.byteOrder.PutUint32(w.buf[0:4], length)
 	_, err := w.w.Write(w.buf[:4])
 	return err
 }
 
 // WritePacket writes out packet with the given data and capture info. The given InterfaceIndex must already be added to the file. InterfaceIndex 0 is automatically added by the NewWriter* methods.
 func (w *NgWriter) WritePacket(ci gopacket.CaptureInfo, data []byte) error {
+	return w.writePacket(ci, data, nil)
+}
+
+// WritePacketWithOptions writes out packet with the given data, capture info and options, like WritePacket. Empty options are not written.
+func (w *NgWriter) WritePacketWithOptions(ci gopacket.CaptureInfo, data []byte, options NgPacketOptions) error {
+	opts, err := ngPacketOptions(options)
+	if err != nil {
+		return err
+	}
+	return w.writePacket(ci, data, opts)
+}
+
+// ngPacketOptions returns the options of an enhanced packet block.
+func ngPacketOptions(options NgPacketOptions) ([]ngOption, error) {
+	opts := make([]ngOption, 0, len(options.Comments)+len(options.Hashes)+len(options.Verdicts)+4)
+	for _, comment := range options.Comments {
+		opts = append(opts, ngOption{code: ngOptionCodeComment, raw: comment})
+	}
+	if options.Flags != 0 {
+		opts = append(opts, ngOption{code: ngOptionCodePacketFlags, raw: uint32(options.Flags)})
+	}
+	for _, hash := range options.Hashes {
+		opts = append(opts, ngOption{code: ngOptionCodePacketHash, raw: append([]byte{uint8(hash.Algorithm)}, hash.Value...)})
+	}
+	if options.DropCount != 0 {
+		opts = append(opts, ngOption{code: ngOptionCodePacketDropCount, raw: options.DropCount})
+	}
+	if options.PacketID != 0 {
+		opts = append(opts, ngOption{code: ngOptionCodePacketID, raw: options.PacketID})
+	}
+	if options.Queue != 0 {
+		opts = append(opts, ngOption{code: ngOptionCodePacketQueue, raw: options.Queue})
+	}
+	for _, verdict := range options.Verdicts {
+		opts = append(opts, ngOption{code: ngOptionCodePacketVerdict, raw: append([]byte{uint8(verdict.Type)}, verdict.Data...)})
+	}
+	for _, option := range opts {
+		if ngOptionLength(option) > 0xFFFF {
+			return nil, fmt.Errorf("packet option %d too long", option.code)
+		}
+	}
+	return opts, nil
+}
+
+// writePacket writes out an enhanced packet block with the given options.
+func (w *NgWriter) writePacket(ci gopacket.CaptureInfo, data []byte, options []ngOption) error {
 	if ci.InterfaceIndex >= int(w.intf) || ci.InterfaceIndex < 0 {
 		return fmt.Errorf("Can't send statistics for non existent interface %d; have only %d interfaces", ci.InterfaceIndex, w.intf)
 	}
@@ -363,20 +436,23 @@ func (w *NgWriter) WritePacket(ci gopacket.CaptureInfo, data []byte) error {
 	if ci.CaptureLength > ci.Length {
 		return fmt.Errorf("invalid capture info %+v:  capture length > length", ci)
 	}
+	if w.options.SimplePackets && len(options) == 0 && ci.InterfaceIndex == 0 && ci.CaptureLength == ci.Length {
+		return w.writeSimplePacket(data)
+	}
 
 	length := uint32(len(data)) + 32
 	padding := (4 - length&3) & 3
-	length += padding
+	length += padding + prepareNgOptions(options)
 
 	ts := ci.Timestamp.UnixNano()
 
-	binary.LittleEndian.PutUint32(w.buf[:4], uint32(ngBlockTypeEnhancedPacket))
-	binary.LittleEndian.PutUint32(w.buf[4:8], length)
-	binary.LittleEndian.PutUint32(w.buf[8:12], uint32(ci.InterfaceIndex))
-	binary.LittleEndian.PutUint32(w.buf[12:16], uint32(ts>>32))
-	binary.LittleEndian.PutUint32(w.buf[16:20], uint32(ts))
-	binary.LittleEndian.PutUint32(w.buf[20:24], uint32(ci.CaptureLength))
-	binary.LittleEndian.PutUint32(w.buf[24:28], uint32(ci.Length))
+	w.byteOrder.PutUint32(w.buf[:4], uint32(ngBlockTypeEnhancedPacket))
+	w.byteOrder.PutUint32(w.buf[4:8], length)
+	w.byteOrder.PutUint32(w.buf[8:12], uint32(ci.InterfaceIndex))
+	w.byteOrder.PutUint32(w.buf[12:16], uint32(ts>>32))
+	w.byteOrder.PutUint32(w.buf[16:20], uint32(ts))
+	w.byteOrder.PutUint32(w.buf[20:24], uint32(ci.CaptureLength))
+	w.byteOrder.PutUint32(w.buf[24:28], uint32(ci.Length))
 
 	if _, err := w.w.Write(w.buf[:28]); err != nil {
 		return err
@@ -386,11 +462,172 @@ func (w *NgWriter) WritePacket(ci gopacket.CaptureInfo, data []byte) error {
 		return err
 	}
 
-	binary.LittleEndian.PutUint32(w.buf[:4], 0)
+	if len(options) == 0 {
+		w.byteOrder.PutUint32(w.buf[:4], 0)
+		w.byteOrder.PutUint32(w.buf[4:8], length)
+		_, err := w.w.Write(w.buf[4-padding : 8]) // padding + length
+		return err
+	}
+
+	w.byteOrder.PutUint32(w.buf[:4], 0)
+	if _, err := w.w.Write(w.buf[:padding]); err != nil {
+		return err
+	}
+
+	if err := w.writeOptions(options); err != nil {
+		return err
+	}
+
+	w.byteOrder.PutUint32(w.buf[:4], length)
+	_, err := w.w.Write(w.buf[:4])
+	return err
+}
+
+// writeSimplePacket writes out a simple packet block for interface 0
+func (w *NgWriter) writeSimplePacket(data []byte) error {
+	length := uint32(len(data)) + 16
+	padding := (4 - length&3) & 3
+	length += padding
+
+	w.byteOrder.PutUint32(w.buf[:4], uint32(ngBlockTypeSimplePacket))
+	w.byteOrder.PutUint32(w.buf[4:8], length)
+	w.byteOrder.PutUint32(w.buf[8:12], uint32(len(data)))
+	if _, err := w.w.Write(w.buf[:12]); err != nil {
+		return err
+	}
+	if _, err := w.w.Write(data); err != nil {
+		return err
+	}
+	w.byteOrder.PutUint32(w.buf[:4], 0)
+	w.byteOrder.PutUint32(w.buf[4:8], length)
 	_, err := w.w.Write(w.buf[4-padding : 8]) // padding + length
 	return err
 }
 
+// ngAppendPadded appends value and its padding to 32 bits to b
+func ngAppendPadded(b []byte, value []byte) []byte {
+	b = append(b, value...)
+	var zero [4]byte
+	return append(b, zero[:(4-len(value)&3)&3]...)
+}
+
+// writeBlock writes a block with the given body, which must be padded to 32 bits, followed by the given options. The options are prepared by writeBlock.
+func (w *NgWriter) writeBlock(typ ngBlockType, body []byte, options []ngOption) error {
+	length := prepareNgOptions(options) + uint32(len(body)) +
+		8 + // header
+		4 // trailer
+
+	w.byteOrder.PutUint32(w.buf[:4], uint32(typ))
+	w.byteOrder.PutUint32(w.buf[4:8], length)
+	if _, err := w.w.Write(w.buf[:8]); err != nil {
+		return err
+	}
+	if _, err := w.w.Write(body); err != nil {
+		return err
+	}
+
+	if err := w.writeOptions(options); err != nil {
+		return err
+	}
+
+	w.byteOrder.PutUint32(w.buf[0:4], length)
+	_, err := w.w.Write(w.buf[:4])
+	return err
+}
+
+// WriteNameResolution writes a name resolution block with the given records to the file. Every record must have an IPv4 or IPv6 address and at least one name. Empty options are not written.
+func (w *NgWriter) WriteNameResolution(nrb NgNameResolution) error {
+	var body []byte
+	var header [4]byte
+	for _, record := range nrb.Records {
+		typ := ngNameResolutionRecordIPv4
+		addr := record.Addr.To4()
+		if addr == nil {
+			typ = ngNameResolutionRecordIPv6
+			addr = record.Addr.To16()
+		}
+		if addr == nil {
+			return fmt.Errorf("Invalid address %v in name resolution record", record.Addr)
+		}
+		if len(record.Names) == 0 {
+			return fmt.Errorf("Name resolution record for %v has no names", record.Addr)
+		}
+		value := append([]byte(nil), addr...)
+		for _, name := range record.Names {
+			value = append(value, name...)
+			value = append(value, 0)
+		}
+		if len(value) > 0xFFFF {
+			return fmt.Errorf("Names of %v too long for a name resolution record", record.Addr)
+		}
+		w.byteOrder.PutUint16(header[0:2], uint16(typ))
+		w.byteOrder.PutUint16(header[2:4], uint16(len(value)))
+		body = append(body, header[:]...)
+		body = ngAppendPadded(body, value)
+	}
+	// end of records
+	body = append(body, 0, 0, 0, 0)
+
+	var scratch [3]ngOption
+	i := 0
+	if nrb.Comment != "" {
+		scratch[i].code = ngOptionCodeComment
+		scratch[i].raw = nrb.Comment
+		i++
+	}
+	if nrb.DNSName != "" {
+		scratch[i].code = ngOptionCodeNameResolutionDNSName
+		scratch[i].raw = nrb.DNSName
+		i++
+	}
+	if ip4 := nrb.DNSAddr.To4(); ip4 != nil {
+		scratch[i].code = ngOptionCodeNameResolutionDNSIP4Addr
+		scratch[i].raw = []byte(ip4)
+		i++
+	} else if ip6 := nrb.DNSAddr.To16(); ip6 != nil {
+		scratch[i].code = ngOptionCodeNameResolutionDNSIP6Addr
+		scratch[i].raw = []byte(ip6)
+		i++
+	}
+	return w.writeBlock(ngBlockTypeNameResolution, body, scratch[:i])
+}
+
+// WriteDecryptionSecrets writes a decryption secrets block to the file, e.g. to embed the TLS key log of the captured connections. An empty comment is not written.
+func (w *NgWriter) WriteDecryptionSecrets(dsb NgDecryptionSecrets) error {
+	if len(dsb.Data) > ngMaxBlockLength {
+		return errors.New("Decryption secrets too long")
+	}
+	body := make([]byte, 8, 8+len(dsb.Data)+3)
+	w.byteOrder.PutUint32(body[0:4], uint32(dsb.Type))
+	w.byteOrder.PutUint32(body[4:8], uint32(len(dsb.Data)))
+	body = ngAppendPadded(body, dsb.Data)
+
+	var scratch [1]ngOption
+	i := 0
+	if dsb.Comment != "" {
+		scratch[i].code = ngOptionCodeComment
+		scratch[i].raw = dsb.Comment
+		i++
+	}
+	return w.writeBlock(ngBlockTypeDecryptionSecrets, body, scratch[:i])
+}
+
+// WriteCustomBlock writes a custom block to the file. Data is padded to 32 bits, and may contain options.
+func (w *NgWriter) WriteCustomBlock(cb NgCustomBlock) error {
+	if len(cb.Data) > ngMaxBlockLength {
+		return errors.New("Custom block data too long")
+	}
+	body := make([]byte, 4, 4+len(cb.Data)+3)
+	w.byteOrder.PutUint32(body[0:4], cb.PEN)
+	body = ngAppendPadded(body, cb.Data)
+
+	typ := ngBlockTypeCustomNoCopy
+	if cb.Copyable {
+		typ = ngBlockTypeCustomCopy
+	}
+	return w.writeBlock(typ, body, nil)
+}
+
 // Flush writes out buffered data to the storage media. Must be called before closing the underlying file.
 func (w *NgWriter) Flush() error {
 	return w.w.Flush()
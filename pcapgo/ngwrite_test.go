@@ -8,6 +8,10 @@ package pcapgo
 
 import (
 	"bytes"
+	"encoding/binary"
+	"io"
+	"net"
+	"reflect"
 	"testing"
 	"time"
 
@@ -214,6 +218,152 @@ func TestNgWriteComplex(t *testing.T) {
 	ngRunFileReadTest(test, "", false, t)
 }
 
+func TestNgWriteAuxiliaryBlocks(t *testing.T) {
+	nrb := NgNameResolution{
+		Records: []NgNameResolutionRecord{
+			{Addr: net.IP{192, 168, 1, 2}, Names: []string{"example.com", "www.example.com"}},
+			{Addr: net.ParseIP("fc01:dead::beef"), Names: []string{"example.org"}},
+		},
+		Comment: "resolved",
+		DNSName: "ns.example.com",
+		DNSAddr: net.IP{192, 168, 1, 1},
+	}
+	dsb := NgDecryptionSecrets{
+		Type:    NgSecretsTypeTLSKeyLog,
+		Data:    []byte("CLIENT_RANDOM 00 11\n"),
+		Comment: "keys",
+	}
+	cb := NgCustomBlock{
+		PEN:  32473,
+		Data: []byte("abcdefgh"),
+	}
+
+	buffer := &bytes.Buffer{}
+	w, err := NewNgWriter(buffer, layers.LinkTypeEthernet)
+	if err != nil {
+		t.Fatal("Opening file failed with: ", err)
+	}
+	if err := w.WriteNameResolution(nrb); err != nil {
+		t.Fatal("Couldn't write name resolution", err)
+	}
+	if err := w.WriteDecryptionSecrets(dsb); err != nil {
+		t.Fatal("Couldn't write decryption secrets", err)
+	}
+	ci := gopacket.CaptureInfo{
+		Timestamp:     time.Unix(0, 0).UTC(),
+		Length:        len(ngPacketSource[0]),
+		CaptureLength: len(ngPacketSource[0]),
+	}
+	if err := w.WritePacket(ci, ngPacketSource[0]); err != nil {
+		t.Fatal("Couldn't write packet", err)
+	}
+	if err := w.WriteCustomBlock(cb); err != nil {
+		t.Fatal("Couldn't write custom block", err)
+	}
+	if err := w.WriteNameResolution(NgNameResolution{Records: []NgNameResolutionRecord{{Addr: net.IP{1, 2, 3, 4}}}}); err == nil {
+		t.Error("Expected error for record without names")
+	}
+	if err := w.Flush(); err != nil {
+		t.Fatal("Couldn't flush buffer", err)
+	}
+
+	var customBlocks int
+	options := DefaultNgReaderOptions
+	options.CustomBlockCallback = func(NgCustomBlock) { customBlocks++ }
+	r, err := NewNgReader(bytes.NewReader(buffer.Bytes()), options)
+	if err != nil {
+		t.Fatal("Couldn't read start of file:", err)
+	}
+	for err == nil {
+		_, _, err = r.ReadPacketData()
+	}
+	if err != io.EOF {
+		t.Fatal("Unexpected error:", err)
+	}
+	if got := r.NameResolution(); len(got) != 1 || !reflect.DeepEqual(got[0], nrb) {
+		t.Errorf("name resolution mismatch:\ngot:\n%#v\nwant:\n%#v\n\n", got, nrb)
+	}
+	if names := r.LookupAddr(net.ParseIP("192.168.1.2")); !reflect.DeepEqual(names, nrb.Records[0].Names) {
+		t.Errorf("Unexpected names for 192.168.1.2: %q", names)
+	}
+	if got := r.DecryptionSecrets(); len(got) != 1 || !reflect.DeepEqual(got[0], dsb) {
+		t.Errorf("decryption secrets mismatch:\ngot:\n%#v\nwant:\n%#v\n\n", got, dsb)
+	}
+	if got := r.CustomBlocks(); customBlocks != 1 || len(got) != 1 || !reflect.DeepEqual(got[0], cb) {
+		t.Errorf("custom block mismatch:\ngot:\n%#v\nwant:\n%#v\n\n", got, cb)
+	}
+}
+
+func TestNgWritePacketOptions(t *testing.T) {
+	want := []NgPacketOptions{
+		{
+			Comments:  []string{"first", "second comment"},
+			Flags:     NewNgPacketFlags(NgPacketDirectionOutbound, NgReceptionTypeMulticast, 4),
+			Hashes:    []NgPacketHash{{Algorithm: NgHashAlgorithmCRC32, Value: []byte{1, 2, 3, 4}}},
+			DropCount: 7,
+			PacketID:  0x0102030405060708,
+			Queue:     3,
+			Verdicts:  []NgPacketVerdict{{Type: NgVerdictTypeLinuxXDP, Data: []byte{2, 0, 0, 0, 0, 0, 0, 0}}},
+		},
+		{},
+		{Comments: []string{"abc"}},
+	}
+
+	buffer := &bytes.Buffer{}
+	w, err := NewNgWriter(buffer, layers.LinkTypeEthernet)
+	if err != nil {
+		t.Fatal("Opening file failed with: ", err)
+	}
+	for i, options := range want {
+		ci := gopacket.CaptureInfo{
+			Timestamp:     time.Unix(int64(i), 0).UTC(),
+			Length:        len(ngPacketSource[i]),
+			CaptureLength: len(ngPacketSource[i]),
+		}
+		if err := w.WritePacketWithOptions(ci, ngPacketSource[i], options); err != nil {
+			t.Fatal("Couldn't write packet", err)
+		}
+	}
+	if err := w.Flush(); err != nil {
+		t.Fatal("Couldn't flush buffer", err)
+	}
+
+	r, err := NewNgReader(bytes.NewReader(buffer.Bytes()), DefaultNgReaderOptions)
+	if err != nil {
+		t.Fatal("Couldn't read start of file:", err)
+	}
+	for i := range want {
+		data, ci, options, err := r.ReadPacketDataWithOptions()
+		if err != nil {
+			t.Fatalf("[packet %d] Unexpected error: %s", i, err)
+		}
+		if !bytes.Equal(data, ngPacketSource[i]) || ci.Timestamp.Unix() != int64(i) {
+			t.Fatalf("[packet %d] data mismatch", i)
+		}
+		if !reflect.DeepEqual(options, want[i]) {
+			t.Errorf("[packet %d] options mismatch:\ngot:\n%#v\nwant:\n%#v\n\n", i, options, want[i])
+		}
+	}
+	if flags := want[0].Flags; flags.Direction() != NgPacketDirectionOutbound || flags.ReceptionType() != NgReceptionTypeMulticast || flags.FCSLength() != 4 {
+		t.Errorf("flags mismatch: %#x", flags)
+	}
+
+	// options are skipped by ReadPacketData
+	r, err = NewNgReader(bytes.NewReader(buffer.Bytes()), DefaultNgReaderOptions)
+	if err != nil {
+		t.Fatal("Couldn't read start of file:", err)
+	}
+	for i := range want {
+		data, _, err := r.ReadPacketData()
+		if err != nil {
+			t.Fatalf("[packet %d] Unexpected error: %s", i, err)
+		}
+		if !bytes.Equal(data, ngPacketSource[i]) {
+			t.Fatalf("[packet %d] data mismatch", i)
+		}
+	}
+}
+
 type ngDevNull struct{}
 
 func (w *ngDevNull) Write(p []byte) (n int, err error) {
@@ -237,3 +387,94 @@ func BenchmarkNgWritePacket(b *testing.B) {
 		w.WritePacket(ci, data)
 	}
 }
+
+func TestNgWriteSections(t *testing.T) {
+	buffer := &bytes.Buffer{}
+	options := DefaultNgWriterOptions
+	options.SimplePackets = true
+	w, err := NewNgWriterInterface(buffer, NgInterface{Name: "eth0", LinkType: layers.LinkTypeEthernet}, options)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := w.AddInterface(NgInterface{Name: "eth1", LinkType: layers.LinkTypeEthernet}); err != nil {
+		t.Fatal(err)
+	}
+	ts := time.Unix(1500000000, 1).UTC()
+	data := []byte{1, 2, 3, 4, 5}
+	// a simple packet block, and enhanced packet blocks for a truncated packet and another interface
+	for _, ci := range []gopacket.CaptureInfo{
+		{Timestamp: ts, CaptureLength: 5, Length: 5},
+		{Timestamp: ts, CaptureLength: 5, Length: 10},
+		{Timestamp: ts, CaptureLength: 5, Length: 5, InterfaceIndex: 1},
+	} {
+		if err := w.WritePacket(ci, data); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	if err := w.StartSection(NgWriterOptions{
+		SectionInfo: NgSectionInfo{Application: "legacy"},
+		ByteOrder:   binary.BigEndian,
+	}); err != nil {
+		t.Fatal(err)
+	}
+	if err := w.WritePacket(gopacket.CaptureInfo{Timestamp: ts, CaptureLength: 5, Length: 5}, data); err == nil {
+		t.Error("expected an error writing a packet without an interface in the new section")
+	}
+	if _, err := w.AddInterface(NgInterface{Name: "raw0", LinkType: layers.LinkTypeRaw}); err != nil {
+		t.Fatal(err)
+	}
+	if err := w.WriteInterfaceStats(0, NgInterfaceStatistics{StartTime: ts, PacketsReceived: 1}); err != nil {
+		t.Fatal(err)
+	}
+	if err := w.WritePacketWithOptions(gopacket.CaptureInfo{Timestamp: ts, CaptureLength: 5, Length: 5}, data, NgPacketOptions{Comments: []string{"be"}}); err != nil {
+		t.Fatal(err)
+	}
+	if err := w.Flush(); err != nil {
+		t.Fatal(err)
+	}
+
+	// the second section starts with a big endian section header
+	file := buffer.Bytes()
+	second := bytes.LastIndex(file, []byte{0x0a, 0x0d, 0x0d, 0x0a})
+	if second <= 0 || !bytes.Equal(file[second+8:second+12], []byte{0x1a, 0x2b, 0x3c, 0x4d}) {
+		t.Fatalf("no big endian section found")
+	}
+
+	var sections []NgSectionInfo
+	r, err := NewNgReader(bytes.NewReader(file), NgReaderOptions{
+		WantMixedLinkType:  true,
+		SectionEndCallback: func(intfs []NgInterface, info NgSectionInfo) { sections = append(sections, info) },
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := []gopacket.CaptureInfo{
+		{CaptureLength: 5, Length: 5, AncillaryData: []interface{}{layers.LinkTypeEthernet}},
+		{Timestamp: ts, CaptureLength: 5, Length: 10, AncillaryData: []interface{}{layers.LinkTypeEthernet}},
+		{Timestamp: ts, CaptureLength: 5, Length: 5, InterfaceIndex: 1, AncillaryData: []interface{}{layers.LinkTypeEthernet}},
+		{Timestamp: ts, CaptureLength: 5, Length: 5, AncillaryData: []interface{}{layers.LinkTypeRaw}},
+	}
+	for i := range want {
+		got, ci, options, err := r.ReadPacketDataWithOptions()
+		if err != nil {
+			t.Fatalf("packet %d: %s", i, err)
+		}
+		if !bytes.Equal(got, data) || !reflect.DeepEqual(ci, want[i]) {
+			t.Errorf("packet %d: expected %+v, got %+v", i, want[i], ci)
+		}
+		if i == 3 && (len(options.Comments) != 1 || options.Comments[0] != "be") {
+			t.Errorf("packet %d: options not preserved: %+v", i, options)
+		}
+	}
+	if r.SectionInfo().Application != "legacy" {
+		t.Errorf("unexpected section info %+v", r.SectionInfo())
+	}
+	if _, _, err := r.ReadPacketData(); err != io.EOF {
+		t.Errorf("expected EOF, got %v", err)
+	}
+	// the callback isn't called for the last section
+	if len(sections) != 1 || sections[0].Application != "gopacket" {
+		t.Errorf("unexpected sections %+v", sections)
+	}
+}
@@ -0,0 +1,241 @@
+// Copyright 2018 The GoPacket Authors. All rights reserved.
+//
+// Use of this source code is governed by a BSD-style license
+// that can be found in the LICENSE file in the root of the source
+// tree.
+
+package pcapgo
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"math"
+	"os"
+
+	"github.com/davidsonff/gopacket"
+	"github.com/davidsonff/gopacket/layers"
+)
+
+// CaptureReader is implemented by the readers of every capture file format returned by OpenCapture.
+type CaptureReader interface {
+	gopacket.PacketDataSource
+	gopacket.ZeroCopyPacketDataSource
+	// LinkType returns the link type of the packets
+	LinkType() layers.LinkType
+	// Resolution returns the timestamp resolution of the packets
+	Resolution() gopacket.TimestampResolution
+}
+
+// CaptureFormat is a capture file format.
+type CaptureFormat int
+
+const (
+	// CaptureFormatUnknown is returned for data not matching any supported format
+	CaptureFormatUnknown CaptureFormat = iota
+	// CaptureFormatPcap is the libpcap format in any byte order, with microsecond or nanosecond timestamps. It is read by Reader.
+	CaptureFormatPcap
+	// CaptureFormatPcapng is the pcapng format. It is read by NgReader.
+	CaptureFormatPcapng
+	// CaptureFormatSnoop is the Solaris snoop format. It is read by SnoopReader.
+	CaptureFormatSnoop
+	// CaptureFormatModifiedPcap is Kuznetzov's modified pcap format. It is read by Reader.
+	CaptureFormatModifiedPcap
+	// CaptureFormatERF is the Endace Extensible Record Format. It is read by ErfReader.
+	CaptureFormatERF
+	// CaptureFormatNetmon is the Microsoft Network Monitor format. It is read by NetmonReader.
+	CaptureFormatNetmon
+	// CaptureFormatBtsnoop is the btsnoop format of Bluetooth HCI logs. It is read by BtsnoopReader.
+	CaptureFormatBtsnoop
+)
+
+var captureFormatNames = map[CaptureFormat]string{
+	CaptureFormatUnknown:      "unknown",
+	CaptureFormatPcap:         "pcap",
+	CaptureFormatPcapng:       "pcapng",
+	CaptureFormatSnoop:        "snoop",
+	CaptureFormatModifiedPcap: "modified pcap",
+	CaptureFormatERF:          "erf",
+	CaptureFormatNetmon:       "netmon",
+	CaptureFormatBtsnoop:      "btsnoop",
+}
+
+func (f CaptureFormat) String() string {
+	if name, ok := captureFormatNames[f]; ok {
+		return name
+	}
+	return fmt.Sprintf("CaptureFormat(%d)", int(f))
+}
+
+// captureMagicLength is the number of bytes needed to detect every capture format
+const captureMagicLength = erfHeaderLength
+
+// DetectCaptureFormat returns the format of a capture file starting with the given (uncompressed) bytes. At least 16 bytes are needed to
+// detect every format. ERF files have no magic number, so they are detected by checking if the data looks like an ERF record header.
+func DetectCaptureFormat(magic []byte) CaptureFormat {
+	if len(magic) >= 8 && binary.BigEndian.Uint64(magic) == snoopMagic {
+		return CaptureFormatSnoop
+	}
+	if bytes.HasPrefix(magic, btsnoopMagic) {
+		return CaptureFormatBtsnoop
+	}
+	if len(magic) < 4 {
+		return CaptureFormatUnknown
+	}
+	if bytes.HasPrefix(magic, netmonMagic1) || bytes.HasPrefix(magic, netmonMagic2) {
+		return CaptureFormatNetmon
+	}
+	if ngBlockType(binary.LittleEndian.Uint32(magic)) == ngBlockTypeSectionHeader {
+		return CaptureFormatPcapng
+	}
+	switch binary.LittleEndian.Uint32(magic) {
+	case magicMicroseconds, magicNanoseconds, magicMicrosecondsBigendian, magicNanosecondsBigendian:
+		return CaptureFormatPcap
+	case magicModified, magicModifiedBigendian:
+		return CaptureFormatModifiedPcap
+	}
+	if isErfHeader(magic) {
+		return CaptureFormatERF
+	}
+	return CaptureFormatUnknown
+}
+
+// CaptureReaderOptions holds options for OpenCapture.
+type CaptureReaderOptions struct {
+	// NgReaderOptions are used for pcapng files
+	NgReaderOptions NgReaderOptions
+}
+
+// DefaultCaptureReaderOptions provides sane defaults for OpenCapture.
+var DefaultCaptureReaderOptions = CaptureReaderOptions{
+	NgReaderOptions: DefaultNgReaderOptions,
+}
+
+// snoopCaptureReader adapts SnoopReader to CaptureReader
+type snoopCaptureReader struct {
+	*SnoopReader
+	linkType layers.LinkType
+}
+
+func (r snoopCaptureReader) LinkType() layers.LinkType {
+	return r.linkType
+}
+
+// OpenCapture detects the format of the capture file read from r, and returns the matching reader, i.e. a *Reader, an *NgReader, an
+// *ErfReader, a *NetmonReader, a *BtsnoopReader, or a reader wrapping a *SnoopReader. Compressed files are transparently uncompressed (see
+// NewDecompressor).
+//
+// Network Monitor files need random access. If r is an io.ReaderAt and an io.Seeker, like os.File, it is read from the current position;
+// otherwise the whole file is read into memory.
+//
+//	f, _ := os.Open("/tmp/file.pcapng.gz")
+//	defer f.Close()
+//	r, format, err := OpenCapture(f, DefaultCaptureReaderOptions)
+//	source := gopacket.NewPacketSource(r, r.LinkType())
+func OpenCapture(r io.Reader, options CaptureReaderOptions) (CaptureReader, CaptureFormat, error) {
+	// remember where the file starts, in case random access is needed
+	var ra io.ReaderAt
+	if rs, ok := r.(interface {
+		io.ReaderAt
+		io.Seeker
+	}); ok {
+		if base, err := rs.Seek(0, io.SeekCurrent); err == nil {
+			ra = io.NewSectionReader(rs, base, math.MaxInt64-base)
+		}
+	}
+	dr, compression, err := NewDecompressor(r)
+	if err != nil {
+		return nil, CaptureFormatUnknown, err
+	}
+	br, ok := dr.(*bufio.Reader)
+	if !ok {
+		br = bufio.NewReader(dr)
+	}
+	magic, err := br.Peek(captureMagicLength)
+	if err != nil && err != io.EOF {
+		return nil, CaptureFormatUnknown, err
+	}
+	format := DetectCaptureFormat(magic)
+	switch format {
+	case CaptureFormatPcap, CaptureFormatModifiedPcap:
+		pcap, err := NewReader(br)
+		if err != nil {
+			return nil, format, err
+		}
+		return pcap, format, nil
+	case CaptureFormatPcapng:
+		ng, err := NewNgReader(br, options.NgReaderOptions)
+		if err != nil {
+			return nil, format, err
+		}
+		return ng, format, nil
+	case CaptureFormatSnoop:
+		snoop, err := NewSnoopReader(br)
+		if err != nil {
+			return nil, format, err
+		}
+		linkType, err := snoop.LinkType()
+		if err != nil {
+			return nil, format, err
+		}
+		return snoopCaptureReader{snoop, *linkType}, format, nil
+	case CaptureFormatERF:
+		erf, err := NewErfReader(br)
+		if err != nil {
+			return nil, format, err
+		}
+		return erf, format, nil
+	case CaptureFormatNetmon:
+		if ra == nil || compression != CompressionNone {
+			data, err := ioutil.ReadAll(br)
+			if err != nil {
+				return nil, format, err
+			}
+			ra = bytes.NewReader(data)
+		}
+		netmon, err := NewNetmonReader(ra)
+		if err != nil {
+			return nil, format, err
+		}
+		return netmon, format, nil
+	case CaptureFormatBtsnoop:
+		btsnoop, err := NewBtsnoopReader(br)
+		if err != nil {
+			return nil, format, err
+		}
+		return btsnoop, format, nil
+	}
+	if len(magic) == 0 {
+		return nil, format, io.EOF
+	}
+	return nil, format, errors.New("Unknown capture file format")
+}
+
+// CaptureReadCloser is a CaptureReader reading from a file opened by OpenCaptureFile.
+type CaptureReadCloser interface {
+	CaptureReader
+	io.Closer
+}
+
+type captureFile struct {
+	CaptureReader
+	io.Closer
+}
+
+// OpenCaptureFile opens the named capture file with OpenCapture. The returned reader must be closed to close the file.
+func OpenCaptureFile(name string, options CaptureReaderOptions) (CaptureReadCloser, CaptureFormat, error) {
+	f, err := os.Open(name)
+	if err != nil {
+		return nil, CaptureFormatUnknown, err
+	}
+	r, format, err := OpenCapture(f, options)
+	if err != nil {
+		f.Close()
+		return nil, format, err
+	}
+	return captureFile{r, f}, format, nil
+}
@@ -0,0 +1,85 @@
+// Copyright 2018 The GoPacket Authors. All rights reserved.
+//
+// Use of this source code is governed by a BSD-style license
+// that can be found in the LICENSE file in the root of the source
+// tree.
+
+package pcapgo
+
+import (
+	"bytes"
+	"io/ioutil"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/davidsonff/gopacket"
+	"github.com/davidsonff/gopacket/layers"
+)
+
+func TestOpenCapture(t *testing.T) {
+	pcapng, err := ioutil.ReadFile(filepath.Join("tests", "be", "test010.pcapng"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	bigEndianNanos := []byte{
+		0xa1, 0xb2, 0x3c, 0x4d, 0x00, 0x02, 0x00, 0x04, // magic, maj, min
+		0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, // tz, sigfigs
+		0x00, 0x00, 0xff, 0xff, 0x00, 0x00, 0x00, 0x65, // snaplen, linkType
+		0x5a, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x07, // sec, nsec
+		0x00, 0x00, 0x00, 0x02, 0x00, 0x00, 0x00, 0x02, // incl, orig
+		0x45, 0x00, // data
+	}
+	var gz bytes.Buffer
+	w, _ := NewCompressor(&gz, CompressionGzip)
+	w.Write(bigEndianNanos)
+	w.Close()
+
+	for _, test := range []struct {
+		name       string
+		file       []byte
+		format     CaptureFormat
+		linkType   layers.LinkType
+		resolution gopacket.TimestampResolution
+		packets    int
+	}{
+		{"pcap", editTestPcap(t, 0, 1), CaptureFormatPcap, layers.LinkTypeEthernet, gopacket.TimestampResolutionNanosecond, 2},
+		{"pcap big endian", bigEndianNanos, CaptureFormatPcap, layers.LinkTypeRaw, gopacket.TimestampResolutionNanosecond, 1},
+		{"pcap gzip", gz.Bytes(), CaptureFormatPcap, layers.LinkTypeRaw, gopacket.TimestampResolutionNanosecond, 1},
+		{"pcapng", pcapng, CaptureFormatPcapng, layers.LinkTypeEthernet, gopacket.TimestampResolutionMicrosecond, 4},
+		{"snoop", append(append([]byte(nil), spHeader...), pack...), CaptureFormatSnoop, layers.LinkTypeEthernet, gopacket.TimestampResolutionMicrosecond, 1},
+		{"btsnoop", btsnoopTestFile(btsnoopDatalinkUART, 0, 1), CaptureFormatBtsnoop, layers.LinkTypeBluetoothHCIH4WithPhdr, gopacket.TimestampResolutionMicrosecond, 2},
+		{"erf", erfTestRecord(1500000000, erfTypeIPv6, 0, nil, make([]byte, 40), 40), CaptureFormatERF, layers.LinkTypeRaw, gopacket.TimestampResolutionNTP, 1},
+		{"netmon", netmonTestFile(2, 0, 1, netmonTestFrame{0, 0, make([]byte, 20)}), CaptureFormatNetmon, layers.LinkTypeEthernet, gopacket.TimestampResolutionMicrosecond, 1},
+	} {
+		if got := DetectCaptureFormat(test.file); got != test.format && test.name != "pcap gzip" {
+			t.Errorf("[%s] DetectCaptureFormat returned %s", test.name, got)
+		}
+		r, format, err := OpenCapture(bytes.NewReader(test.file), DefaultCaptureReaderOptions)
+		if err != nil {
+			t.Fatalf("[%s] %s", test.name, err)
+		}
+		if format != test.format {
+			t.Errorf("[%s] expected format %s, got %s", test.name, test.format, format)
+		}
+		if r.LinkType() != test.linkType {
+			t.Errorf("[%s] expected link type %s, got %s", test.name, test.linkType, r.LinkType())
+		}
+		if r.Resolution() != test.resolution {
+			t.Errorf("[%s] expected resolution %s, got %s", test.name, test.resolution, r.Resolution())
+		}
+		packets, err := readAllPackets(r)
+		if err != nil || len(packets) != test.packets {
+			t.Errorf("[%s] read %d packets, %v", test.name, len(packets), err)
+		}
+		if test.format == CaptureFormatPcap && test.name != "pcap" {
+			if ts := packets[0].ci.Timestamp; !ts.Equal(time.Unix(0x5a000000, 7)) {
+				t.Errorf("[%s] unexpected timestamp %s", test.name, ts)
+			}
+		}
+	}
+
+	if _, format, err := OpenCapture(bytes.NewReader([]byte("not a capture file")), DefaultCaptureReaderOptions); err == nil || format != CaptureFormatUnknown {
+		t.Errorf("expected an error for an unknown format, got %s, %v", format, err)
+	}
+}
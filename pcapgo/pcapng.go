@@ -9,6 +9,7 @@ package pcapgo
 import (
 	"errors"
 	"math"
+	"net"
 	"time"
 
 	"github.com/davidsonff/gopacket"
@@ -35,11 +36,26 @@ const (
 	ngBlockTypeInterfaceDescriptor ngBlockType = 1          // Interface description block
 	ngBlockTypePacket              ngBlockType = 2          // Packet block (deprecated)
 	ngBlockTypeSimplePacket        ngBlockType = 3          // Simple packet block
+	ngBlockTypeNameResolution      ngBlockType = 4          // Name resolution block
 	ngBlockTypeInterfaceStatistics ngBlockType = 5          // Interface statistics block
 	ngBlockTypeEnhancedPacket      ngBlockType = 6          // Enhanced packet block
+	ngBlockTypeDecryptionSecrets   ngBlockType = 0x0A       // Decryption secrets block
+	ngBlockTypeCustomCopy          ngBlockType = 0x00000BAD // Custom block that can be copied to other files
+	ngBlockTypeCustomNoCopy        ngBlockType = 0x40000BAD // Custom block that must not be copied to other files
 	ngBlockTypeSectionHeader       ngBlockType = 0x0A0D0D0A // Section header block (same in both endians)
 )
 
+// ngMaxBlockLength is the maximum length of the blocks which are read into memory as a whole (name resolution, decryption secrets and custom blocks)
+const ngMaxBlockLength = 16 * 1024 * 1024
+
+type ngNameResolutionRecordType uint16
+
+const (
+	ngNameResolutionRecordEnd  ngNameResolutionRecordType = iota // end of records
+	ngNameResolutionRecordIPv4                                   // IPv4 address and names
+	ngNameResolutionRecordIPv6                                   // IPv6 address and names
+)
+
 type ngOptionCode uint16
 
 const (
@@ -76,6 +92,21 @@ const (
 	ngOptionCodeInterfaceStatisticsDelivered                                 // Packets delivered to user
 )
 
+const (
+	ngOptionCodePacketFlags     ngOptionCode = iota + 2 // link layer information
+	ngOptionCodePacketHash                              // hash of the packet
+	ngOptionCodePacketDropCount                         // packets lost between this packet and the preceding one
+	ngOptionCodePacketID                                // unique identifier of the packet
+	ngOptionCodePacketQueue                             // queue of the interface the packet was received on
+	ngOptionCodePacketVerdict                           // verdict of the packet
+)
+
+const (
+	ngOptionCodeNameResolutionDNSName    ngOptionCode = iota + 2 // name of the DNS server
+	ngOptionCodeNameResolutionDNSIP4Addr                         // IPv4 address of the DNS server
+	ngOptionCodeNameResolutionDNSIP6Addr                         // IPv6 address of the DNS server
+)
+
 // ngOption is a pcapng option
 type ngOption struct {
 	code   ngOptionCode
@@ -185,3 +216,154 @@ type NgSectionInfo struct {
 	// Comment can be an arbitrary comment. This value might be empty if this option is missing.
 	Comment string
 }
+
+// NgNameResolutionRecord maps an IP address to one or more names.
+type NgNameResolutionRecord struct {
+	// Addr is the IPv4 or IPv6 address.
+	Addr net.IP
+	// Names are the names of the address.
+	Names []string
+}
+
+// NgNameResolution holds the contents of a pcapng name resolution block.
+type NgNameResolution struct {
+	// Records are the address to name mappings of the block.
+	Records []NgNameResolutionRecord
+	// Comment can be an arbitrary comment. This value might be empty if this option is missing.
+	Comment string
+	// DNSName is the name of the DNS server used for the resolution. This value might be empty if this option is missing.
+	DNSName string
+	// DNSAddr is the IPv4 or IPv6 address of the DNS server used for the resolution. This value might be nil if this option is missing.
+	DNSAddr net.IP
+}
+
+// NgSecretsType is the type of the secrets held by a pcapng decryption secrets block.
+type NgSecretsType uint32
+
+const (
+	NgSecretsTypeTLSKeyLog   NgSecretsType = 0x544c534b // TLS key log, in the NSS key log format
+	NgSecretsTypeWireGuard   NgSecretsType = 0x57474b4c // WireGuard key log
+	NgSecretsTypeZigBeeNWK   NgSecretsType = 0x5a4e574b // ZigBee network key
+	NgSecretsTypeZigBeeAPS   NgSecretsType = 0x5a415053 // ZigBee application support key
+	NgSecretsTypeSSHKeyLog   NgSecretsType = 0x5353484b // SSH key log
+	NgSecretsTypeOPCUAKeyLog NgSecretsType = 0x55414b4c // OPC UA key log
+)
+
+// NgDecryptionSecrets holds the contents of a pcapng decryption secrets block.
+type NgDecryptionSecrets struct {
+	// Type is the format of Data.
+	Type NgSecretsType
+	// Data holds the secrets, e.g. the lines of a TLS key log file.
+	Data []byte
+	// Comment can be an arbitrary comment. This value might be empty if this option is missing.
+	Comment string
+}
+
+// NgCustomBlock holds the contents of a pcapng custom block.
+type NgCustomBlock struct {
+	// PEN is the IANA Private Enterprise Number of the organization defining the format of Data.
+	PEN uint32
+	// Data holds the custom data. Since its length is not part of the block, data read from a file also holds the options following it, if any, and the padding to 32 bits.
+	Data []byte
+	// Copyable is true if the block can be copied to other files by tools which don't know its format.
+	Copyable bool
+}
+
+// NgPacketDirection is the direction of a packet, as stored in NgPacketFlags.
+type NgPacketDirection uint8
+
+const (
+	NgPacketDirectionUnknown  NgPacketDirection = 0
+	NgPacketDirectionInbound  NgPacketDirection = 1
+	NgPacketDirectionOutbound NgPacketDirection = 2
+)
+
+// NgReceptionType is the reception type of a packet, as stored in NgPacketFlags.
+type NgReceptionType uint8
+
+const (
+	NgReceptionTypeUnspecified NgReceptionType = 0
+	NgReceptionTypeUnicast     NgReceptionType = 1
+	NgReceptionTypeMulticast   NgReceptionType = 2
+	NgReceptionTypeBroadcast   NgReceptionType = 3
+	NgReceptionTypePromiscuous NgReceptionType = 4
+)
+
+// NgPacketFlags holds the link layer information of a packet (the epb_flags option).
+type NgPacketFlags uint32
+
+// NewNgPacketFlags returns the flags for the given direction, reception type and FCS length in octets (0-15, 0 if unknown).
+func NewNgPacketFlags(dir NgPacketDirection, rt NgReceptionType, fcsLength uint8) NgPacketFlags {
+	return NgPacketFlags(dir&0x3) | NgPacketFlags(rt&0x7)<<2 | NgPacketFlags(fcsLength&0xf)<<5
+}
+
+// Direction returns the direction of the packet.
+func (f NgPacketFlags) Direction() NgPacketDirection {
+	return NgPacketDirection(f & 0x3)
+}
+
+// ReceptionType returns the reception type of the packet.
+func (f NgPacketFlags) ReceptionType() NgReceptionType {
+	return NgReceptionType(f >> 2 & 0x7)
+}
+
+// FCSLength returns the length of the Frame Check Sequence of the packet in octets, or 0 if it is unknown.
+func (f NgPacketFlags) FCSLength() uint8 {
+	return uint8(f >> 5 & 0xf)
+}
+
+// LinkLayerErrors returns the link layer dependent error bits of the packet (CRC error, packet too long, ...).
+func (f NgPacketFlags) LinkLayerErrors() uint16 {
+	return uint16(f >> 16)
+}
+
+// NgHashAlgorithm is the algorithm of an NgPacketHash.
+type NgHashAlgorithm uint8
+
+const (
+	NgHashAlgorithm2sComplement NgHashAlgorithm = 0
+	NgHashAlgorithmXOR          NgHashAlgorithm = 1
+	NgHashAlgorithmCRC32        NgHashAlgorithm = 2
+	NgHashAlgorithmMD5          NgHashAlgorithm = 3
+	NgHashAlgorithmSHA1         NgHashAlgorithm = 4
+	NgHashAlgorithmToeplitz     NgHashAlgorithm = 5
+)
+
+// NgPacketHash is a hash of a packet (the epb_hash option).
+type NgPacketHash struct {
+	Algorithm NgHashAlgorithm
+	Value     []byte
+}
+
+// NgVerdictType is the type of an NgPacketVerdict.
+type NgVerdictType uint8
+
+const (
+	NgVerdictTypeHardware NgVerdictType = 0
+	NgVerdictTypeLinuxTC  NgVerdictType = 1 // Linux eBPF TC
+	NgVerdictTypeLinuxXDP NgVerdictType = 2 // Linux eBPF XDP
+)
+
+// NgPacketVerdict is the verdict of a packet, e.g. the return value of an eBPF program (the epb_verdict option).
+type NgPacketVerdict struct {
+	Type NgVerdictType
+	Data []byte
+}
+
+// NgPacketOptions holds the options of an enhanced packet block. Zero values are not written, and missing options are read as zero values.
+type NgPacketOptions struct {
+	// Comments are arbitrary comments, e.g. the packet comments of Wireshark.
+	Comments []string
+	// Flags holds the direction, reception type and FCS length of the packet.
+	Flags NgPacketFlags
+	// Hashes are hashes of the packet.
+	Hashes []NgPacketHash
+	// DropCount is the number of packets lost between this packet and the preceding one.
+	DropCount uint64
+	// PacketID uniquely identifies the packet, e.g. if it has been captured on several interfaces.
+	PacketID uint64
+	// Queue is the queue of the interface the packet was received on.
+	Queue uint32
+	// Verdicts are the verdicts of the packet.
+	Verdicts []NgPacketVerdict
+}
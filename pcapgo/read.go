@@ -13,9 +13,6 @@ import (
 	"io"
 	"time"
 
-	"bufio"
-	"compress/gzip"
-
 	"github.com/davidsonff/gopacket"
 	"github.com/davidsonff/gopacket/layers"
 )
@@ -27,8 +24,13 @@ import (
 // We currenty read v2.4 file format with nanosecond and microsecdond
 // timestamp resolution in little-endian and big-endian encoding.
 //
-// If the PCAP data is gzip compressed it is transparently uncompressed
-// by wrapping the given io.Reader with a gzip.Reader.
+// Kuznetzov's "modified pcap" files, as written by patched libpcap versions
+// of old Red Hat distributions, are read as well. The additional fields of
+// their packet headers are ignored, except for the interface index, which
+// is returned in CaptureInfo.InterfaceIndex.
+//
+// If the PCAP data is compressed it is transparently uncompressed
+// by wrapping the given io.Reader with a decompressor (see NewDecompressor).
 type Reader struct {
 	r              io.Reader
 	byteOrder      binary.ByteOrder
@@ -39,8 +41,10 @@ type Reader struct {
 	// sigfigs
 	snaplen  uint32
 	linkType layers.LinkType
+	// length of the packet headers; 16, or 24 for modified pcap
+	headerLength int
 	// reusable buffer
-	buf [16]byte
+	buf [24]byte
 	// buffer for ZeroCopyReadPacketData
 	packetBuf []byte
 }
@@ -49,6 +53,12 @@ const magicNanoseconds = 0xA1B23C4D
 const magicMicrosecondsBigendian = 0xD4C3B2A1
 const magicNanosecondsBigendian = 0x4D3CB2A1
 
+// Kuznetzov's modified pcap format
+const magicModified = 0xA1B2CD34
+const magicModifiedBigendian = 0x34CDB2A1
+
+const headerLengthModified = 24
+
 const magicGzip1 = 0x1f
 const magicGzip2 = 0x8b
 
@@ -71,26 +81,18 @@ func NewReader(r io.Reader) (*Reader, error) {
 }
 
 func (r *Reader) readHeader() error {
-	br := bufio.NewReader(r.r)
-	gzipMagic, err := br.Peek(2)
-	if err != nil {
+	var err error
+	if r.r, _, err = NewDecompressor(r.r); err != nil {
 		return err
 	}
 
-	if gzipMagic[0] == magicGzip1 && gzipMagic[1] == magicGzip2 {
-		if r.r, err = gzip.NewReader(br); err != nil {
-			return err
-		}
-	} else {
-		r.r = br
-	}
-
 	buf := make([]byte, 24)
 	if n, err := io.ReadFull(r.r, buf); err != nil {
 		return err
 	} else if n < 24 {
 		return errors.New("Not enough data for read")
 	}
+	r.headerLength = 16
 	if magic := binary.LittleEndian.Uint32(buf[0:4]); magic == magicNanoseconds {
 		r.byteOrder = binary.LittleEndian
 		r.nanoSecsFactor = 1
@@ -103,6 +105,14 @@ func (r *Reader) readHeader() error {
 	} else if magic == magicMicrosecondsBigendian {
 		r.byteOrder = binary.BigEndian
 		r.nanoSecsFactor = 1000
+	} else if magic == magicModified {
+		r.byteOrder = binary.LittleEndian
+		r.nanoSecsFactor = 1000
+		r.headerLength = headerLengthModified
+	} else if magic == magicModifiedBigendian {
+		r.byteOrder = binary.BigEndian
+		r.nanoSecsFactor = 1000
+		r.headerLength = headerLengthModified
 	} else {
 		return fmt.Errorf("Unknown magic %x", magic)
 	}
@@ -167,12 +177,16 @@ func (r *Reader) ZeroCopyReadPacketData() (data []byte, ci gopacket.CaptureInfo,
 }
 
 func (r *Reader) readPacketHeader() (ci gopacket.CaptureInfo, err error) {
-	if _, err = io.ReadFull(r.r, r.buf[:]); err != nil {
+	if _, err = io.ReadFull(r.r, r.buf[:r.headerLength]); err != nil {
 		return
 	}
 	ci.Timestamp = time.Unix(int64(r.byteOrder.Uint32(r.buf[0:4])), int64(r.byteOrder.Uint32(r.buf[4:8])*r.nanoSecsFactor)).UTC()
 	ci.CaptureLength = int(r.byteOrder.Uint32(r.buf[8:12]))
 	ci.Length = int(r.byteOrder.Uint32(r.buf[12:16]))
+	if r.headerLength == headerLengthModified {
+		// interface index, protocol, packet type, padding
+		ci.InterfaceIndex = int(r.byteOrder.Uint32(r.buf[16:20]))
+	}
 	return
 }
 
@@ -225,7 +239,7 @@ func (r *Reader) String() string {
 // Resolution returns the timestamp resolution of acquired timestamps before scaling to NanosecondTimestampResolution.
 func (r *Reader) Resolution() gopacket.TimestampResolution {
 	if r.nanoSecsFactor == 1 {
-		return gopacket.TimestampResolutionMicrosecond
+		return gopacket.TimestampResolutionNanosecond
 	}
-	return gopacket.TimestampResolutionNanosecond
+	return gopacket.TimestampResolutionMicrosecond
 }
@@ -90,6 +90,42 @@ func TestPacket(t *testing.T) {
 	}
 }
 
+func TestPacketModified(t *testing.T) {
+	test := []byte{
+		0x34, 0xcd, 0xb2, 0xa1, 0x02, 0x00, 0x04, 0x00, // magic, maj, min
+		0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, // tz, sigfigs
+		0xff, 0xff, 0x00, 0x00, 0x01, 0x00, 0x00, 0x00, // snaplen, linkType
+		0x5A, 0xCC, 0x1A, 0x54, 0x01, 0x00, 0x00, 0x00, // sec, usec
+		0x04, 0x00, 0x00, 0x00, 0x08, 0x00, 0x00, 0x00, // cap len, full len
+		0x03, 0x00, 0x00, 0x00, 0x00, 0x08, 0x00, 0x00, // ifindex, protocol, pkt_type, pad
+		0x01, 0x02, 0x03, 0x04, // data
+		0x5A, 0xCC, 0x1A, 0x54, 0x02, 0x00, 0x00, 0x00, // sec, usec
+		0x01, 0x00, 0x00, 0x00, 0x01, 0x00, 0x00, 0x00, // cap len, full len
+		0x03, 0x00, 0x00, 0x00, 0x00, 0x08, 0x00, 0x00, // ifindex, protocol, pkt_type, pad
+		0x05, // data
+	}
+
+	r, err := NewReader(bytes.NewBuffer(test))
+	if err != nil {
+		t.Fatalf("Failed to get new reader object: %v", err)
+	}
+	for i, want := range [][]byte{{1, 2, 3, 4}, {5}} {
+		data, ci, err := r.ReadPacketData()
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !ci.Timestamp.Equal(time.Date(2014, 9, 18, 12, 13, 14, (i+1)*1000, time.UTC)) {
+			t.Errorf("Invalid time read: %s", ci.Timestamp)
+		}
+		if ci.InterfaceIndex != 3 {
+			t.Errorf("Invalid interface index %d", ci.InterfaceIndex)
+		}
+		if !bytes.Equal(data, want) {
+			t.Errorf("buf mismatch:\nwant: %+v\ngot:  %+v", want, data)
+		}
+	}
+}
+
 func TestPacketNano(t *testing.T) {
 	test := []byte{
 		0x4d, 0x3c, 0xb2, 0xa1, 0x02, 0x00, 0x04, 0x00, // magic, maj, min
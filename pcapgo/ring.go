@@ -0,0 +1,291 @@
+// Copyright 2012 Google, Inc. All rights reserved.
+//
+// Use of this source code is governed by a BSD-style license
+// that can be found in the LICENSE file in the root of the source
+// tree.
+// +build linux,go1.9
+
+package pcapgo
+
+import (
+	"errors"
+	"fmt"
+	"sync/atomic"
+	"time"
+	"unsafe"
+
+	"golang.org/x/sys/unix"
+
+	"github.com/davidsonff/gopacket"
+)
+
+// ErrPollTimeout is returned by an EthernetHandle with a ring if no packet arrived within EthernetRingOptions.PollTimeout.
+var ErrPollTimeout = errors.New("packet poll timeout expired")
+
+// EthernetRingOptions configures the TPACKET_V3 ring of an EthernetHandle. The defaults match the ones of afpacket.
+type EthernetRingOptions struct {
+	// FrameSize is the tp_frame_size of the ring. With TPACKET_V3 packets are packed into the blocks, so this only limits the size of a
+	// packet.
+	FrameSize int
+	// BlockSize is the size of a block, which must be a multiple of the page size and of FrameSize.
+	BlockSize int
+	// NumBlocks is the number of blocks of the ring.
+	NumBlocks int
+	// BlockTimeout is the time after which the kernel hands a block that isn't full over to user space. It has millisecond granularity.
+	BlockTimeout time.Duration
+	// PollTimeout is the time to wait for a block, after which ErrPollTimeout is returned. A negative value waits forever.
+	PollTimeout time.Duration
+}
+
+// DefaultEthernetRingOptions is the default ring configuration: 128 blocks of 512KiB.
+var DefaultEthernetRingOptions = EthernetRingOptions{
+	FrameSize:    4096,
+	BlockSize:    4096 * 128,
+	NumBlocks:    128,
+	BlockTimeout: 64 * time.Millisecond,
+	PollTimeout:  -1 * time.Millisecond,
+}
+
+func (o EthernetRingOptions) check() error {
+	pageSize := unix.Getpagesize()
+	switch {
+	case o.FrameSize < unix.TPACKET_ALIGNMENT || o.FrameSize%unix.TPACKET_ALIGNMENT != 0:
+		return fmt.Errorf("frame size %d must be a multiple of %d", o.FrameSize, unix.TPACKET_ALIGNMENT)
+	case o.BlockSize < pageSize || o.BlockSize%pageSize != 0:
+		return fmt.Errorf("block size %d must be divisible by page size %d", o.BlockSize, pageSize)
+	case o.BlockSize%o.FrameSize != 0:
+		return fmt.Errorf("block size %d must be divisible by frame size %d", o.BlockSize, o.FrameSize)
+	case o.NumBlocks < 1:
+		return fmt.Errorf("num blocks %d must be >= 1", o.NumBlocks)
+	case o.BlockTimeout < time.Millisecond:
+		return fmt.Errorf("block timeout %v must be >= %v", o.BlockTimeout, time.Millisecond)
+	}
+	return nil
+}
+
+const (
+	// offset of struct tpacket_hdr_v1 in struct tpacket_block_desc
+	ringBlockHeaderOffset = 8
+	// offset of struct sockaddr_ll after struct tpacket3_hdr, aligned to TPACKET_ALIGNMENT
+	ringSockaddrOffset = (unix.SizeofTpacket3Hdr + unix.TPACKET_ALIGNMENT - 1) &^ (unix.TPACKET_ALIGNMENT - 1)
+)
+
+// ring is a TPACKET_V3 receive ring
+type ring struct {
+	data         []byte
+	blockSize    int
+	numBlocks    int
+	pollTimeout  int
+	block        int  // index of the current block
+	owned        bool // the current block belongs to user space
+	packetsLeft  int
+	packetOffset int // offset of the next packet in the ring
+	// reusable
+	current RingBlock
+}
+
+func (r *ring) blockHeader(i int) *unix.TpacketHdrV1 {
+	return (*unix.TpacketHdrV1)(unsafe.Pointer(&r.data[i*r.blockSize+ringBlockHeaderOffset]))
+}
+
+// release hands the current block back to the kernel and moves to the next one
+func (r *ring) release() {
+	if !r.owned {
+		return
+	}
+	atomic.StoreUint32(&r.blockHeader(r.block).Block_status, unix.TP_STATUS_KERNEL)
+	r.owned = false
+	r.packetsLeft = 0
+	r.block = (r.block + 1) % r.numBlocks
+}
+
+// wait waits until the current block belongs to user space
+func (r *ring) wait(fd int) error {
+	hdr := r.blockHeader(r.block)
+	for atomic.LoadUint32(&hdr.Block_status)&unix.TP_STATUS_USER == 0 {
+		pollset := [1]unix.PollFd{{Fd: int32(fd), Events: unix.POLLIN}}
+		n, err := unix.Poll(pollset[:], r.pollTimeout)
+		if err == unix.EINTR {
+			continue
+		}
+		if err != nil {
+			return err
+		}
+		if n == 0 {
+			return ErrPollTimeout
+		}
+		if pollset[0].Revents&unix.POLLERR != 0 {
+			return errors.New("packet poll failed")
+		}
+	}
+	r.owned = true
+	r.packetsLeft = int(hdr.Num_pkts)
+	r.packetOffset = r.block*r.blockSize + int(hdr.Offset_to_first_pkt)
+	return nil
+}
+
+// next returns the next packet of the current block, or false if there is none
+func (r *ring) next(snaplen int) (data []byte, ci gopacket.CaptureInfo, vlan int, haveVlan bool, ok bool) {
+	if !r.owned || r.packetsLeft == 0 {
+		return
+	}
+	hdr := (*unix.Tpacket3Hdr)(unsafe.Pointer(&r.data[r.packetOffset]))
+	start := r.packetOffset + int(hdr.Mac)
+	data = r.data[start : start+int(hdr.Snaplen)]
+	if len(data) > snaplen {
+		data = data[:snaplen]
+	}
+	ci.Timestamp = time.Unix(int64(hdr.Sec), int64(hdr.Nsec))
+	ci.CaptureLength = len(data)
+	ci.Length = int(hdr.Len)
+	// sockaddr_ll: family, protocol, ifindex
+	ci.InterfaceIndex = int(*(*int32)(unsafe.Pointer(&r.data[r.packetOffset+ringSockaddrOffset+4])))
+	if hdr.Status&unix.TP_STATUS_VLAN_VALID != 0 {
+		vlan = int(hdr.Hv1.Vlan_tci)
+		haveVlan = true
+	}
+
+	r.packetsLeft--
+	if hdr.Next_offset != 0 {
+		r.packetOffset += int(hdr.Next_offset)
+	} else {
+		r.packetOffset += (int(hdr.Mac) + int(hdr.Snaplen) + unix.TPACKET_ALIGNMENT - 1) &^ (unix.TPACKET_ALIGNMENT - 1)
+	}
+	return data, ci, vlan, haveVlan, true
+}
+
+// RingBlock is a block of packets of the ring of an EthernetHandle. It is only valid until it is released, either by Release or by the
+// next read from the EthernetHandle.
+type RingBlock struct {
+	h *EthernetHandle
+	// SequenceNumber is the sequence number of the block assigned by the kernel.
+	SequenceNumber uint64
+	// Packets is the number of packets of the block.
+	Packets int
+}
+
+// Next returns the next packet of the block, or false if all packets have been returned. The data points into the ring, like with
+// ZeroCopyReadPacketData. VLAN information is handled like with ZeroCopyReadPacketData.
+func (b *RingBlock) Next() ([]byte, gopacket.CaptureInfo, bool) {
+	h := b.h
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	if !b.valid() {
+		return nil, gopacket.CaptureInfo{}, false
+	}
+	data, ci, vlan, haveVlan, ok := h.ring.next(h.snaplen)
+	if haveVlan {
+		h.ancil[0] = vlan
+		ci.AncillaryData = h.ancil
+	}
+	return data, ci, ok
+}
+
+// Release hands the block back to the kernel. The data returned by Next must not be used afterwards.
+func (b *RingBlock) Release() {
+	h := b.h
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	if b.valid() {
+		h.ring.release()
+	}
+}
+
+// valid returns whether the block still belongs to user space. h.mu must be held.
+func (b *RingBlock) valid() bool {
+	r := b.h.ring
+	return r != nil && r.owned && r.blockHeader(r.block).Seq_num == b.SequenceNumber
+}
+
+// ReadBlock waits for the next block of packets of the ring, and returns it. The packets not yet read from the previous block are
+// dropped. The returned RingBlock is reused by the next call to ReadBlock.
+func (h *EthernetHandle) ReadBlock() (*RingBlock, error) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	if h.ring == nil {
+		return nil, errors.New("handle has no ring")
+	}
+	h.ring.release()
+	if err := h.ring.wait(h.fd); err != nil {
+		return nil, err
+	}
+	hdr := h.ring.blockHeader(h.ring.block)
+	h.ring.current = RingBlock{
+		h:              h,
+		SequenceNumber: hdr.Seq_num,
+		Packets:        int(hdr.Num_pkts),
+	}
+	return &h.ring.current, nil
+}
+
+// readRing returns the next packet of the ring. h.mu must be held.
+func (h *EthernetHandle) readRing() (data []byte, ci gopacket.CaptureInfo, vlan int, haveVlan bool, err error) {
+	for {
+		var ok bool
+		if data, ci, vlan, haveVlan, ok = h.ring.next(h.snaplen); ok {
+			return
+		}
+		h.ring.release()
+		if err = h.ring.wait(h.fd); err != nil {
+			return
+		}
+	}
+}
+
+// NewEthernetHandleWithRing is like NewEthernetHandle, but reads the packets from a TPACKET_V3 ring buffer shared with the kernel,
+// like afpacket.TPacket, instead of one syscall per packet. This gives much better performance without needing cgo.
+// ZeroCopyReadPacketData returns data pointing into the ring, and the packets can also be read block by block with ReadBlock.
+func NewEthernetHandleWithRing(ifname string, options EthernetRingOptions) (*EthernetHandle, error) {
+	if err := options.check(); err != nil {
+		return nil, err
+	}
+	h, err := NewEthernetHandle(ifname)
+	if err != nil {
+		return nil, err
+	}
+	if err := h.setUpRing(options); err != nil {
+		h.Close()
+		return nil, err
+	}
+	return h, nil
+}
+
+func (h *EthernetHandle) setUpRing(options EthernetRingOptions) error {
+	if err := unix.SetsockoptInt(h.fd, unix.SOL_PACKET, unix.PACKET_VERSION, unix.TPACKET_V3); err != nil {
+		return fmt.Errorf("couldn't set TPACKET_V3: %s", err)
+	}
+	req := unix.TpacketReq3{
+		Block_size:       uint32(options.BlockSize),
+		Block_nr:         uint32(options.NumBlocks),
+		Frame_size:       uint32(options.FrameSize),
+		Frame_nr:         uint32(options.BlockSize / options.FrameSize * options.NumBlocks),
+		Retire_blk_tov:   uint32(options.BlockTimeout / time.Millisecond),
+		Feature_req_word: 0,
+	}
+	if err := unix.SetsockoptTpacketReq3(h.fd, unix.SOL_PACKET, unix.PACKET_RX_RING, &req); err != nil {
+		return fmt.Errorf("couldn't set up ring: %s", err)
+	}
+	data, err := unix.Mmap(h.fd, 0, options.BlockSize*options.NumBlocks, unix.PROT_READ|unix.PROT_WRITE, unix.MAP_SHARED)
+	if err != nil {
+		return fmt.Errorf("couldn't map ring: %s", err)
+	}
+	h.ring = &ring{
+		data:        data,
+		blockSize:   options.BlockSize,
+		numBlocks:   options.NumBlocks,
+		pollTimeout: int(options.PollTimeout / time.Millisecond),
+	}
+	if options.PollTimeout < 0 {
+		h.ring.pollTimeout = -1
+	}
+	// The ring returns the full packets; the buffer is not used.
+	h.buffer = nil
+	h.snaplen = options.BlockSize
+	return nil
+}
+
+// StatsV3 returns the number of packets, dropped packets and queue freezes of a handle with a ring. Like Stats, the counters are reset
+// by every call.
+func (h *EthernetHandle) StatsV3() (*unix.TpacketStatsV3, error) {
+	return unix.GetsockoptTpacketStatsV3(h.fd, unix.SOL_PACKET, unix.PACKET_STATISTICS)
+}
@@ -0,0 +1,197 @@
+// Copyright 2012 Google, Inc. All rights reserved.
+//
+// Use of this source code is governed by a BSD-style license
+// that can be found in the LICENSE file in the root of the source
+// tree.
+// +build linux,go1.9
+
+package pcapgo
+
+import (
+	"net"
+	"testing"
+	"time"
+
+	"golang.org/x/sys/unix"
+
+	"github.com/davidsonff/gopacket/internal/testveth"
+)
+
+// testVeth creates a veth pair in a new network namespace with testveth.Pair, and returns a raw socket to send on the first interface.
+// The calling goroutine stays in the namespace until the returned function is called.
+func testVeth(t *testing.T) (fd int, rxIface string, cleanup func()) {
+	txIface, rxIface, vethCleanup := testveth.Pair(t, "ring")
+	fd = -1
+	cleanup = func() {
+		if fd != -1 {
+			unix.Close(fd)
+		}
+		vethCleanup()
+	}
+	var err error
+	if fd, err = unix.Socket(unix.AF_PACKET, unix.SOCK_RAW, 0); err != nil {
+		cleanup()
+		t.Fatal(err)
+	}
+	intf, err := net.InterfaceByName(txIface)
+	if err != nil {
+		cleanup()
+		t.Fatal(err)
+	}
+	if err := unix.Bind(fd, &unix.SockaddrLinklayer{Ifindex: intf.Index}); err != nil {
+		cleanup()
+		t.Fatal(err)
+	}
+	return fd, rxIface, cleanup
+}
+
+// testRingFrame returns an ethernet frame with the local experimental ethertype, optionally with an 802.1Q tag
+func testRingFrame(i byte, vlan bool) []byte {
+	frame := []byte{0xff, 0xff, 0xff, 0xff, 0xff, 0xff, 0x02, 0, 0, 0, 0, 1}
+	if vlan {
+		frame = append(frame, 0x81, 0x00, 0x00, 0x2a)
+	}
+	frame = append(frame, 0x88, 0xb5, i)
+	return append(frame, make([]byte, 60-len(frame))...)
+}
+
+func testRingOptions() EthernetRingOptions {
+	options := DefaultEthernetRingOptions
+	options.BlockSize = 1 << 16
+	options.NumBlocks = 4
+	options.BlockTimeout = time.Millisecond
+	options.PollTimeout = 100 * time.Millisecond
+	return options
+}
+
+func TestEthernetHandleRing(t *testing.T) {
+	fd, rxIface, cleanup := testVeth(t)
+	defer cleanup()
+
+	h, err := NewEthernetHandleWithRing(rxIface, testRingOptions())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer h.Close()
+
+	for i := 0; i < 10; i++ {
+		if _, err := unix.Write(fd, testRingFrame(byte(i), i == 3)); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	// the first packets block by block, the rest packet by packet
+	var got []byte
+	block, err := h.ReadBlock()
+	if err != nil {
+		t.Fatal(err)
+	}
+	for {
+		data, ci, ok := block.Next()
+		if !ok {
+			break
+		}
+		if ci.CaptureLength != len(data) || ci.Length < len(data) {
+			t.Errorf("capture info %+v doesn't match data length %d", ci, len(data))
+		}
+		if data[12] == 0x88 && data[13] == 0xb5 {
+			got = append(got, data[14])
+		}
+	}
+	block.Release()
+	if _, _, ok := block.Next(); ok {
+		t.Error("released block returned a packet")
+	}
+	for len(got) < 10 {
+		data, ci, err := h.ZeroCopyReadPacketData()
+		if err == ErrPollTimeout {
+			break
+		}
+		if err != nil {
+			t.Fatal(err)
+		}
+		if data[12] != 0x88 || data[13] != 0xb5 {
+			continue
+		}
+		got = append(got, data[14])
+		if data[14] == 3 {
+			// the kernel moves the tag out of band
+			if len(ci.AncillaryData) != 1 || ci.AncillaryData[0] != 0x2a {
+				t.Errorf("vlan packet: got ancillary data %v, want [42]", ci.AncillaryData)
+			}
+		} else if len(ci.AncillaryData) != 0 {
+			t.Errorf("packet %d: got ancillary data %v, want none", data[14], ci.AncillaryData)
+		}
+	}
+	for i := range got {
+		if got[i] != byte(i) {
+			t.Fatalf("got packets %v, want 0 to 9", got)
+		}
+	}
+	if len(got) != 10 {
+		t.Fatalf("got packets %v, want 0 to 9", got)
+	}
+
+	if err := h.SetCaptureLength(20); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := unix.Write(fd, testRingFrame(10, false)); err != nil {
+		t.Fatal(err)
+	}
+	for {
+		data, ci, err := h.ReadPacketData()
+		if err != nil {
+			t.Fatal(err)
+		}
+		if data[12] == 0x88 && data[13] == 0xb5 {
+			if len(data) != 20 || ci.CaptureLength != 20 || ci.Length != 60 {
+				t.Errorf("truncated packet: got %d bytes, capture info %+v", len(data), ci)
+			}
+			break
+		}
+	}
+	if _, err := h.StatsV3(); err != nil {
+		t.Error(err)
+	}
+}
+
+func TestEthernetHandleFanout(t *testing.T) {
+	fd, rxIface, cleanup := testVeth(t)
+	defer cleanup()
+
+	var handles []*EthernetHandle
+	for i := 0; i < 2; i++ {
+		h, err := NewEthernetHandleWithRing(rxIface, testRingOptions())
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer h.Close()
+		if err := h.SetFanout(FanoutLoadBalance, 7); err != nil {
+			t.Fatal(err)
+		}
+		handles = append(handles, h)
+	}
+	for i := 0; i < 10; i++ {
+		if _, err := unix.Write(fd, testRingFrame(byte(i), false)); err != nil {
+			t.Fatal(err)
+		}
+	}
+	counts := make([]int, len(handles))
+	for i, h := range handles {
+		for {
+			data, _, err := h.ZeroCopyReadPacketData()
+			if err == ErrPollTimeout {
+				break
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+			if data[12] == 0x88 && data[13] == 0xb5 {
+				counts[i]++
+			}
+		}
+	}
+	if counts[0]+counts[1] != 10 || counts[0] == 0 || counts[1] == 0 {
+		t.Errorf("packets per member: got %v, want 10 balanced", counts)
+	}
+}
@@ -0,0 +1,311 @@
+// Copyright 2018 The GoPacket Authors. All rights reserved.
+//
+// Use of this source code is governed by a BSD-style license
+// that can be found in the LICENSE file in the root of the source
+// tree.
+
+package pcapgo
+
+import (
+	"bufio"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/davidsonff/gopacket"
+	"github.com/davidsonff/gopacket/layers"
+)
+
+// RotatingWriterOptions holds options for a RotatingWriter.
+type RotatingWriterOptions struct {
+	// Template is the name of the files. It is formatted with the timestamp of the first packet of the file using strftime conversions
+	// (%Y, %m, %d, %H, %M, %S, %y, %j, %s, %z and %%). If two consecutive files would get the same name, the number of the file is inserted
+	// before the extension, e.g. capture-1.pcap.
+	Template string
+	// MaxBytes starts a new file when the next packet would make the file larger than MaxBytes. The uncompressed size is used for compressed
+	// files. 0 disables rotation by size.
+	MaxBytes int64
+	// Interval starts a new file when the next packet is Interval or more after the first packet of the file. 0 disables rotation by time.
+	Interval time.Duration
+	// MaxFiles is the maximum number of files kept, including the current one. The oldest files are removed when a new one is started. 0 keeps
+	// all the files.
+	MaxFiles int
+	// FileDone is called when a file has been synced and closed, e.g. to ship it off. It is called before the file is removed because of MaxFiles.
+	FileDone func(name string)
+
+	// Pcapng writes pcapng files instead of pcap files.
+	Pcapng bool
+	// Compression compresses the files with the given format. The template should have the matching extension, e.g. capture.pcap.gz.
+	Compression Compression
+	// LinkType, Snaplen and Nanoseconds are written to the header of pcap files.
+	LinkType    layers.LinkType
+	Snaplen     uint32
+	Nanoseconds bool
+	// Interfaces are the interfaces written to every pcapng file. More can be added with AddInterface.
+	Interfaces []NgInterface
+	// SectionInfo is written to the section header of pcapng files.
+	SectionInfo NgSectionInfo
+}
+
+// DefaultRotatingWriterOptions provides sane defaults for a RotatingWriter. Template must be set.
+var DefaultRotatingWriterOptions = RotatingWriterOptions{
+	LinkType:    layers.LinkTypeEthernet,
+	Snaplen:     65536,
+	Nanoseconds: true,
+	Interfaces:  []NgInterface{{Name: DefaultNgInterface.Name, OS: DefaultNgInterface.OS, LinkType: layers.LinkTypeEthernet}},
+	SectionInfo: DefaultNgWriterOptions.SectionInfo,
+}
+
+// countingWriter counts the bytes written to the underlying writer
+type countingWriter struct {
+	w io.Writer
+	n int64
+}
+
+func (c *countingWriter) Write(p []byte) (int, error) {
+	n, err := c.w.Write(p)
+	c.n += int64(n)
+	return n, err
+}
+
+// RotatingWriter writes packets to a series of pcap or pcapng files, like tcpdump -C, -G and -W. Every file starts with the headers needed to
+// read it on its own: the link type for pcap files, the interfaces for pcapng files. Files are started on the first packet written to them, and
+// rotation is based on the timestamps of the packets. Close must be called to finish the last file.
+type RotatingWriter struct {
+	options   RotatingWriterOptions
+	file      *os.File
+	compress  io.WriteCloser
+	counter   *countingWriter
+	buffered  *bufio.Writer
+	pcap      *Writer
+	ng        *NgWriter
+	name      string
+	formatted string // name of the file before inserting its number
+	start     time.Time
+	packets   int
+	files     int
+	done      []string
+}
+
+// NewRotatingWriter returns a new RotatingWriter. No file is created before the first packet is written.
+func NewRotatingWriter(options RotatingWriterOptions) (*RotatingWriter, error) {
+	if options.Template == "" {
+		return nil, errors.New("RotatingWriter needs a template")
+	}
+	if options.Pcapng && len(options.Interfaces) == 0 {
+		return nil, errors.New("RotatingWriter needs at least one interface for pcapng files")
+	}
+	options.Interfaces = append([]NgInterface(nil), options.Interfaces...)
+	return &RotatingWriter{options: options}, nil
+}
+
+// strftime formats t according to the strftime conversions supported by RotatingWriterOptions.Template
+func strftime(template string, t time.Time) string {
+	var b strings.Builder
+	for i := 0; i < len(template); i++ {
+		c := template[i]
+		if c != '%' || i+1 == len(template) {
+			b.WriteByte(c)
+			continue
+		}
+		i++
+		switch template[i] {
+		case 'Y':
+			fmt.Fprintf(&b, "%04d", t.Year())
+		case 'y':
+			fmt.Fprintf(&b, "%02d", t.Year()%100)
+		case 'm':
+			fmt.Fprintf(&b, "%02d", int(t.Month()))
+		case 'd':
+			fmt.Fprintf(&b, "%02d", t.Day())
+		case 'H':
+			fmt.Fprintf(&b, "%02d", t.Hour())
+		case 'M':
+			fmt.Fprintf(&b, "%02d", t.Minute())
+		case 'S':
+			fmt.Fprintf(&b, "%02d", t.Second())
+		case 'j':
+			fmt.Fprintf(&b, "%03d", t.YearDay())
+		case 's':
+			b.WriteString(strconv.FormatInt(t.Unix(), 10))
+		case 'z':
+			b.WriteString(t.Format("-0700"))
+		case '%':
+			b.WriteByte('%')
+		default:
+			b.WriteByte('%')
+			b.WriteByte(template[i])
+		}
+	}
+	return b.String()
+}
+
+// size returns the current size of the file
+func (w *RotatingWriter) size() int64 {
+	if w.ng != nil {
+		return w.counter.n + int64(w.ng.w.Buffered())
+	}
+	return w.counter.n + int64(w.buffered.Buffered())
+}
+
+// open starts a new file for a packet with the given timestamp
+func (w *RotatingWriter) open(ts time.Time) error {
+	name := strftime(w.options.Template, ts)
+	formatted := name
+	if formatted == w.formatted {
+		ext := filepath.Ext(name)
+		if CompressionFromName(name) != CompressionNone {
+			// capture-1.pcap.gz
+			ext = filepath.Ext(strings.TrimSuffix(name, ext)) + ext
+		}
+		name = fmt.Sprintf("%s-%d%s", strings.TrimSuffix(name, ext), w.files, ext)
+	}
+	// make room for the new file
+	if w.options.MaxFiles > 0 {
+		for len(w.done) >= w.options.MaxFiles {
+			if err := os.Remove(w.done[0]); err != nil && !os.IsNotExist(err) {
+				return err
+			}
+			w.done = w.done[1:]
+		}
+	}
+	f, err := os.Create(name)
+	if err != nil {
+		return err
+	}
+	w.file = f
+	w.name = name
+	w.formatted = formatted
+	w.start = ts
+	w.packets = 0
+	w.files++
+	if w.compress, err = NewCompressor(f, w.options.Compression); err != nil {
+		w.abort()
+		return err
+	}
+	w.counter = &countingWriter{w: w.compress}
+	if w.options.Pcapng {
+		w.ng, err = newNgWriter(w.counter, NgWriterOptions{SectionInfo: w.options.SectionInfo})
+		for _, intf := range w.options.Interfaces {
+			if err != nil {
+				break
+			}
+			_, err = w.ng.AddInterface(intf)
+		}
+	} else {
+		w.buffered = bufio.NewWriter(w.counter)
+		if w.options.Nanoseconds {
+			w.pcap = NewWriterNanos(w.buffered)
+		} else {
+			w.pcap = NewWriter(w.buffered)
+		}
+		err = w.pcap.WriteFileHeader(w.options.Snaplen, w.options.LinkType)
+	}
+	if err != nil {
+		w.abort()
+	}
+	return err
+}
+
+// abort closes the current file after it failed to start. The file isn't counted or reported as done.
+func (w *RotatingWriter) abort() {
+	if w.compress != nil {
+		w.compress.Close()
+	}
+	w.file.Close()
+	w.file = nil
+	w.compress = nil
+	w.ng = nil
+	w.pcap = nil
+	w.buffered = nil
+}
+
+// finish flushes, syncs and closes the current file
+func (w *RotatingWriter) finish() error {
+	if w.file == nil {
+		return nil
+	}
+	var err error
+	if w.ng != nil {
+		err = w.ng.Flush()
+	} else {
+		err = w.buffered.Flush()
+	}
+	if cerr := w.compress.Close(); err == nil {
+		err = cerr
+	}
+	if serr := w.file.Sync(); err == nil {
+		err = serr
+	}
+	if cerr := w.file.Close(); err == nil {
+		err = cerr
+	}
+	w.file = nil
+	w.compress = nil
+	w.ng = nil
+	w.pcap = nil
+	w.buffered = nil
+	w.done = append(w.done, w.name)
+	if w.options.FileDone != nil {
+		w.options.FileDone(w.name)
+	}
+	return err
+}
+
+// WritePacket writes the given packet, starting a new file before if needed.
+func (w *RotatingWriter) WritePacket(ci gopacket.CaptureInfo, data []byte) error {
+	if w.file != nil && w.packets > 0 {
+		size := int64(16 + len(data))
+		if w.ng != nil {
+			size = int64(32 + len(data) + (4-len(data)&3)&3)
+		}
+		if (w.options.MaxBytes > 0 && w.size()+size > w.options.MaxBytes) ||
+			(w.options.Interval > 0 && ci.Timestamp.Sub(w.start) >= w.options.Interval) {
+			if err := w.finish(); err != nil {
+				return err
+			}
+		}
+	}
+	if w.file == nil {
+		if err := w.open(ci.Timestamp); err != nil {
+			return err
+		}
+	}
+	w.packets++
+	if w.ng != nil {
+		return w.ng.WritePacket(ci, data)
+	}
+	return w.pcap.WritePacket(ci, data)
+}
+
+// AddInterface adds an interface to the current pcapng file, if any, and to the next ones. It returns the id of the interface.
+func (w *RotatingWriter) AddInterface(intf NgInterface) (int, error) {
+	if !w.options.Pcapng {
+		return 0, errors.New("Interfaces can only be added to pcapng files")
+	}
+	w.options.Interfaces = append(w.options.Interfaces, intf)
+	if w.ng != nil {
+		return w.ng.AddInterface(intf)
+	}
+	return len(w.options.Interfaces) - 1, nil
+}
+
+// Rotate finishes the current file, if any. The next packet starts a new file.
+func (w *RotatingWriter) Rotate() error {
+	return w.finish()
+}
+
+// Name returns the name of the current file, or of the last file if none is open.
+func (w *RotatingWriter) Name() string {
+	return w.name
+}
+
+// Close finishes the current file, if any.
+func (w *RotatingWriter) Close() error {
+	return w.finish()
+}
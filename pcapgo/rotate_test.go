@@ -0,0 +1,172 @@
+// Copyright 2018 The GoPacket Authors. All rights reserved.
+//
+// Use of this source code is governed by a BSD-style license
+// that can be found in the LICENSE file in the root of the source
+// tree.
+
+package pcapgo
+
+import (
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+	"time"
+
+	"github.com/davidsonff/gopacket"
+	"github.com/davidsonff/gopacket/layers"
+)
+
+func TestStrftime(t *testing.T) {
+	ts := time.Date(2018, 2, 3, 4, 5, 6, 0, time.UTC)
+	if got := strftime("cap-%Y%m%d-%H%M%S-%j-%s-%%-%q.pcap", ts); got != "cap-20180203-040506-034-1517630706-%-%q.pcap" {
+		t.Errorf("unexpected name %q", got)
+	}
+}
+
+func rotateTestPackets(t *testing.T, w *RotatingWriter, seconds ...int) {
+	data := make([]byte, 84)
+	for _, s := range seconds {
+		ci := gopacket.CaptureInfo{
+			Timestamp:     editBase.Add(time.Duration(s) * time.Second),
+			CaptureLength: len(data),
+			Length:        len(data),
+		}
+		if err := w.WritePacket(ci, data); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := w.Close(); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func countPackets(t *testing.T, name string) (n int) {
+	f, err := os.Open(name)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer f.Close()
+	in, err := newEditInput(f, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for {
+		var p editPacket
+		if err := in.next(&p); err == io.EOF {
+			return
+		} else if err != nil {
+			t.Fatal(err)
+		}
+		n++
+	}
+}
+
+func TestRotatingWriter(t *testing.T) {
+	dir, err := ioutil.TempDir("", "rotate")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	// by size, keeping 2 files
+	var done []string
+	options := DefaultRotatingWriterOptions
+	options.Template = filepath.Join(dir, "size.pcap")
+	options.MaxBytes = 24 + 2*(16+84)
+	options.MaxFiles = 2
+	options.FileDone = func(name string) { done = append(done, filepath.Base(name)) }
+	w, err := NewRotatingWriter(options)
+	if err != nil {
+		t.Fatal(err)
+	}
+	rotateTestPackets(t, w, 0, 1, 2, 3, 4)
+	if want := []string{"size.pcap", "size-1.pcap", "size-2.pcap"}; !reflect.DeepEqual(done, want) {
+		t.Errorf("expected files %v, got %v", want, done)
+	}
+	files, _ := filepath.Glob(filepath.Join(dir, "size*"))
+	if len(files) != 2 {
+		t.Errorf("expected 2 files kept, got %v", files)
+	}
+	if n := countPackets(t, filepath.Join(dir, "size-1.pcap")); n != 2 {
+		t.Errorf("expected 2 packets in size-1.pcap, got %d", n)
+	}
+	if n := countPackets(t, filepath.Join(dir, "size-2.pcap")); n != 1 {
+		t.Errorf("expected 1 packet in size-2.pcap, got %d", n)
+	}
+
+	// by time, pcapng
+	done = nil
+	options = DefaultRotatingWriterOptions
+	options.Template = filepath.Join(dir, "time-%H%M%S.pcapng")
+	options.Interval = time.Minute
+	options.Pcapng = true
+	options.FileDone = func(name string) { done = append(done, filepath.Base(name)) }
+	w, err = NewRotatingWriter(options)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if id, err := w.AddInterface(NgInterface{Name: "raw0", LinkType: layers.LinkTypeRaw}); err != nil || id != 1 {
+		t.Fatalf("AddInterface returned %d, %v", id, err)
+	}
+	rotateTestPackets(t, w, 0, 30, 59, 60, 200)
+	start := editBase.UTC()
+	var want []string
+	for _, s := range []int{0, 60, 200} {
+		want = append(want, strftime("time-%H%M%S.pcapng", start.Add(time.Duration(s)*time.Second)))
+	}
+	if !reflect.DeepEqual(done, want) {
+		t.Fatalf("expected files %v, got %v", want, done)
+	}
+	for i, n := range []int{3, 1, 1} {
+		name := filepath.Join(dir, want[i])
+		if got := countPackets(t, name); got != n {
+			t.Errorf("expected %d packets in %s, got %d", n, want[i], got)
+		}
+		f, err := os.Open(name)
+		if err != nil {
+			t.Fatal(err)
+		}
+		r, err := NewNgReader(f, DefaultNgReaderOptions)
+		if err != nil {
+			t.Fatal(err)
+		}
+		for err == nil {
+			_, _, err = r.ReadPacketData()
+		}
+		f.Close()
+		if r.NInterfaces() != 2 {
+			t.Errorf("expected 2 interfaces in %s, got %d", want[i], r.NInterfaces())
+		}
+	}
+}
+
+func TestRotatingWriterOpenError(t *testing.T) {
+	if _, err := os.Stat("/dev/full"); err != nil {
+		t.Skip("no /dev/full")
+	}
+	var done []string
+	options := DefaultRotatingWriterOptions
+	options.Template = "/dev/full"
+	options.Pcapng = true
+	options.Interfaces = []NgInterface{{LinkType: layers.LinkTypeEthernet}}
+	// The section header doesn't fit into the write buffer, so creating the writer fails.
+	options.SectionInfo.Comment = string(make([]byte, 10000))
+	options.FileDone = func(name string) { done = append(done, name) }
+	w, err := NewRotatingWriter(options)
+	if err != nil {
+		t.Fatal(err)
+	}
+	ci := gopacket.CaptureInfo{Timestamp: time.Unix(1, 0), CaptureLength: 60, Length: 60}
+	if err := w.WritePacket(ci, make([]byte, 60)); err == nil {
+		t.Error("expected an error")
+	}
+	if err := w.Close(); err != nil {
+		t.Error(err)
+	}
+	if len(done) != 0 || len(w.done) != 0 {
+		t.Errorf("failed file reported as done: %v %v", done, w.done)
+	}
+}
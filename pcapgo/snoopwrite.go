@@ -0,0 +1,95 @@
+// Copyright 2018 The GoPacket Authors. All rights reserved.
+//
+// Use of this source code is governed by a BSD-style license
+// that can be found in the LICENSE file in the root of the source
+// tree.
+
+package pcapgo
+
+import (
+	"encoding/binary"
+	"fmt"
+	"io"
+	"time"
+
+	"github.com/davidsonff/gopacket"
+	"github.com/davidsonff/gopacket/layers"
+)
+
+// snoopDatalinks maps link types to snoop datalink types
+var snoopDatalinks = map[layers.LinkType]uint32{
+	layers.LinkTypeEthernet:  4,
+	layers.LinkTypeTokenRing: 2,
+	layers.LinkTypeC_HDLC:    5,
+	layers.LinkTypeFDDI:      8,
+}
+
+// SnoopWriter wraps an underlying io.Writer to write packet data in SNOOP
+// format. See https://tools.ietf.org/html/rfc1761 for information on the
+// file format.
+//
+// Version 2 files are written, in big-endian encoding, with microsecond
+// timestamp resolution. Only Ethernet, Token Ring, HDLC and FDDI packets can
+// be written.
+type SnoopWriter struct {
+	w io.Writer
+	// reusable
+	buf [24]byte
+}
+
+// NewSnoopWriter returns a new writer object, for writing packet data out
+// to the given writer. WriteFileHeader must be called before WritePacket.
+//
+//	f, _ := os.Create("/tmp/file.snoop")
+//	w := pcapgo.NewSnoopWriter(f)
+//	w.WriteFileHeader(layers.LinkTypeEthernet)
+//	w.WritePacket(gopacket.CaptureInfo{...}, data1)
+//	f.Close()
+func NewSnoopWriter(w io.Writer) *SnoopWriter {
+	return &SnoopWriter{w: w}
+}
+
+// WriteFileHeader writes a file header out to the writer.
+// This must be called exactly once per output.
+func (w *SnoopWriter) WriteFileHeader(linkType layers.LinkType) error {
+	datalink, ok := snoopDatalinks[linkType]
+	if !ok {
+		return fmt.Errorf("%s: %s", unkownLinkType, linkType)
+	}
+	var buf [16]byte
+	binary.BigEndian.PutUint64(buf[0:8], snoopMagic)
+	binary.BigEndian.PutUint32(buf[8:12], snoopVersion)
+	binary.BigEndian.PutUint32(buf[12:16], datalink)
+	_, err := w.w.Write(buf[:])
+	return err
+}
+
+// WritePacket writes the given packet data out to the file.
+func (w *SnoopWriter) WritePacket(ci gopacket.CaptureInfo, data []byte) error {
+	if ci.CaptureLength != len(data) {
+		return fmt.Errorf("capture length %d does not match data length %d", ci.CaptureLength, len(data))
+	}
+	if ci.CaptureLength > ci.Length {
+		return fmt.Errorf("invalid capture info %+v:  capture length > length", ci)
+	}
+	t := ci.Timestamp
+	if t.IsZero() {
+		t = time.Now()
+	}
+	padding := (4 - len(data)&3) & 3
+	binary.BigEndian.PutUint32(w.buf[0:4], uint32(ci.Length))
+	binary.BigEndian.PutUint32(w.buf[4:8], uint32(ci.CaptureLength))
+	binary.BigEndian.PutUint32(w.buf[8:12], uint32(24+len(data)+padding))
+	binary.BigEndian.PutUint32(w.buf[12:16], 0) // cumulative drops
+	binary.BigEndian.PutUint32(w.buf[16:20], uint32(t.Unix()))
+	binary.BigEndian.PutUint32(w.buf[20:24], uint32(t.Nanosecond()/1000))
+	if _, err := w.w.Write(w.buf[:]); err != nil {
+		return fmt.Errorf("error writing packet header: %v", err)
+	}
+	if _, err := w.w.Write(data); err != nil {
+		return err
+	}
+	var zero [4]byte
+	_, err := w.w.Write(zero[:padding])
+	return err
+}
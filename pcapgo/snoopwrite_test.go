@@ -0,0 +1,62 @@
+// Copyright 2018 The GoPacket Authors. All rights reserved.
+//
+// Use of this source code is governed by a BSD-style license
+// that can be found in the LICENSE file in the root of the source
+// tree.
+
+package pcapgo
+
+import (
+	"bytes"
+	"io"
+	"testing"
+	"time"
+
+	"github.com/davidsonff/gopacket"
+	"github.com/davidsonff/gopacket/layers"
+)
+
+func TestSnoopWriter(t *testing.T) {
+	var buf bytes.Buffer
+	w := NewSnoopWriter(&buf)
+	if err := w.WriteFileHeader(layers.LinkTypeIPv4); err == nil {
+		t.Error("expected an error for a link type not supported by snoop")
+	}
+	if err := w.WriteFileHeader(layers.LinkTypeEthernet); err != nil {
+		t.Fatal(err)
+	}
+	ts := time.Date(2018, 3, 4, 5, 6, 7, 8000, time.UTC)
+	packets := []struct {
+		data []byte
+		ci   gopacket.CaptureInfo
+	}{
+		{bytes.Repeat([]byte{1}, 42), gopacket.CaptureInfo{Timestamp: ts, CaptureLength: 42, Length: 42}},
+		{bytes.Repeat([]byte{2}, 17), gopacket.CaptureInfo{Timestamp: ts.Add(time.Second), CaptureLength: 17, Length: 100}},
+		{bytes.Repeat([]byte{3}, 64), gopacket.CaptureInfo{Timestamp: ts.Add(2 * time.Second), CaptureLength: 64, Length: 64}},
+	}
+	for _, p := range packets {
+		if err := w.WritePacket(p.ci, p.data); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	r, err := NewSnoopReader(&buf)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if lt, err := r.LinkType(); err != nil || *lt != layers.LinkTypeEthernet {
+		t.Errorf("unexpected link type %v, %v", lt, err)
+	}
+	for i, p := range packets {
+		data, ci, err := r.ReadPacketData()
+		if err != nil {
+			t.Fatalf("packet %d: %s", i, err)
+		}
+		if !bytes.Equal(data, p.data) || ci.CaptureLength != p.ci.CaptureLength || ci.Length != p.ci.Length || !ci.Timestamp.Equal(p.ci.Timestamp) {
+			t.Errorf("packet %d: expected %x %+v, got %x %+v", i, p.data, p.ci, data, ci)
+		}
+	}
+	if _, _, err := r.ReadPacketData(); err != io.EOF {
+		t.Errorf("expected EOF, got %v", err)
+	}
+}
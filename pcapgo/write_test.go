@@ -12,6 +12,7 @@ import (
 	"time"
 
 	"github.com/davidsonff/gopacket"
+	"github.com/davidsonff/gopacket/layers"
 )
 
 func TestWriteHeaderNanos(t *testing.T) {
@@ -101,3 +102,51 @@ func TestCaptureInfoErrors(t *testing.T) {
 		}
 	}
 }
+
+func TestPacketDataWriter(t *testing.T) {
+	var pcapBuf, ngBuf bytes.Buffer
+	pw := NewWriter(&pcapBuf)
+	if err := pw.WriteFileHeader(65536, layers.LinkTypeEthernet); err != nil {
+		t.Fatal(err)
+	}
+	nw, err := NewNgWriter(&ngBuf, layers.LinkTypeEthernet)
+	if err != nil {
+		t.Fatal(err)
+	}
+	w := gopacket.MultiWriter(gopacket.NewPacketDataWriter(pw), gopacket.NewPacketDataWriter(nw))
+
+	var cis []gopacket.CaptureInfo
+	var data [][]byte
+	for i := 0; i < 3; i++ {
+		d := bytes.Repeat([]byte{byte(i)}, 60)
+		cis = append(cis, gopacket.CaptureInfo{Timestamp: time.Unix(int64(i), 0).UTC(), CaptureLength: 60, Length: 60})
+		data = append(data, d)
+	}
+	if n, err := w.WritePackets(cis, data); n != 3 || err != nil {
+		t.Fatalf("wrote %d packets: %v", n, err)
+	}
+	// Close flushes the NgWriter.
+	if err := w.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	pr, err := NewReader(&pcapBuf)
+	if err != nil {
+		t.Fatal(err)
+	}
+	nr, err := NewNgReader(&ngBuf, DefaultNgReaderOptions)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, r := range []gopacket.PacketDataSource{pr, nr} {
+		for i := range data {
+			d, ci, err := r.ReadPacketData()
+			if err != nil {
+				t.Fatalf("%T: packet %d: %v", r, i, err)
+			}
+			if !bytes.Equal(d, data[i]) || !ci.Timestamp.Equal(cis[i].Timestamp) {
+				t.Errorf("%T: packet %d: got %+v %x", r, i, ci, d)
+			}
+		}
+	}
+}
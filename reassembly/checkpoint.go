@@ -0,0 +1,404 @@
+// Copyright 2012 Google, Inc. All rights reserved.
+//
+// Use of this source code is governed by a BSD-style license
+// that can be found in the LICENSE file in the root of the source
+// tree.
+
+package reassembly
+
+import (
+	"bufio"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"time"
+
+	"github.com/davidsonff/gopacket"
+	"github.com/davidsonff/gopacket/layers"
+)
+
+/*
+ * Checkpoint and restore of the reassembly state
+ */
+
+// CheckpointStream is implemented by Streams which have state of their own
+// to persist in snapshots created by Assembler.Checkpoint.
+type CheckpointStream interface {
+	Stream
+	// Checkpoint returns the state of the stream.  It is called with the
+	// connection locked, so the stream isn't used concurrently.
+	Checkpoint() ([]byte, error)
+}
+
+// RestoreStreamFactory is implemented by StreamFactories which can recreate
+// Streams from snapshots.  If the StreamFactory of the StreamPool a snapshot
+// is restored in doesn't implement it, streams are created with New, given a
+// TCP layer holding only the ports of the connection.
+type RestoreStreamFactory interface {
+	StreamFactory
+	// Restore should return a new stream for the given TCP key, with the
+	// state returned by CheckpointStream.Checkpoint (nil if the stream
+	// didn't implement it).
+	Restore(netFlow, tcpFlow gopacket.Flow, state []byte, ac AssemblerContext) (Stream, error)
+}
+
+var checkpointMagic = [4]byte{'G', 'P', 'R', 'A'}
+
+const checkpointVersion = 1
+
+// ErrBadCheckpoint is returned by Restore on invalid snapshots.
+var ErrBadCheckpoint = errors.New("reassembly: invalid checkpoint")
+
+// MaxCheckpointState is the largest state a CheckpointStream may return.  It
+// leaves plenty of room for the states of TCPSimpleFSM and TCPOptionCheck
+// (3 and 24 bytes), and bounds the memory Restore allocates for a stream.
+const MaxCheckpointState = 64 << 10
+
+// page flags in snapshots
+const (
+	checkpointPageStart = 1 << iota
+	checkpointPageEnd
+	checkpointPageContext
+)
+
+// checkpointWriter encodes values, remembering the first error.
+type checkpointWriter struct {
+	w   *bufio.Writer
+	buf [8]byte
+	err error
+}
+
+func (cw *checkpointWriter) write(b []byte) {
+	if cw.err == nil {
+		_, cw.err = cw.w.Write(b)
+	}
+}
+
+func (cw *checkpointWriter) uint8(v uint8) {
+	cw.buf[0] = v
+	cw.write(cw.buf[:1])
+}
+
+func (cw *checkpointWriter) uint32(v uint32) {
+	binary.BigEndian.PutUint32(cw.buf[:4], v)
+	cw.write(cw.buf[:4])
+}
+
+func (cw *checkpointWriter) int64(v int64) {
+	binary.BigEndian.PutUint64(cw.buf[:8], uint64(v))
+	cw.write(cw.buf[:8])
+}
+
+func (cw *checkpointWriter) time(t time.Time) {
+	if t.IsZero() {
+		cw.int64(0)
+	} else {
+		cw.int64(t.UnixNano())
+	}
+}
+
+func (cw *checkpointWriter) bytes(b []byte) {
+	cw.uint32(uint32(len(b)))
+	cw.write(b)
+}
+
+func (cw *checkpointWriter) flow(f gopacket.Flow) {
+	src, dst := f.Endpoints()
+	cw.uint32(uint32(f.EndpointType()))
+	cw.bytes(src.Raw())
+	cw.bytes(dst.Raw())
+}
+
+func (cw *checkpointWriter) pages(first *page) {
+	n := 0
+	for p := first; p != nil; p = p.next {
+		n++
+	}
+	cw.uint32(uint32(n))
+	for p := first; p != nil; p = p.next {
+		var flags uint8
+		if p.start {
+			flags |= checkpointPageStart
+		}
+		if p.end {
+			flags |= checkpointPageEnd
+		}
+		if p.ac != nil {
+			flags |= checkpointPageContext
+		}
+		cw.uint8(flags)
+		cw.uint32(uint32(p.seq))
+		cw.time(p.seen)
+		if p.ac != nil {
+			ci := p.ac.GetCaptureInfo()
+			cw.time(ci.Timestamp)
+			cw.uint32(uint32(ci.CaptureLength))
+			cw.uint32(uint32(ci.Length))
+			cw.uint32(uint32(ci.InterfaceIndex))
+		}
+		cw.bytes(p.bytes)
+	}
+}
+
+func (cw *checkpointWriter) half(half *halfconnection) {
+	cw.int64(int64(half.nextSeq))
+	cw.int64(int64(half.ackSeq))
+	cw.time(half.created)
+	cw.time(half.lastSeen)
+	if half.closed {
+		cw.uint8(1)
+	} else {
+		cw.uint8(0)
+	}
+	cw.pages(half.saved)
+	cw.pages(half.first)
+}
+
+// Checkpoint writes a snapshot of the connections of the Assembler's
+// StreamPool to w: sequence numbers, buffered out-of-order data, and the
+// state of Streams implementing CheckpointStream.  It can be given to Restore
+// on a new Assembler, for example to carry on with the next file of a
+// rotated capture.
+//
+// Checkpoint must not be called concurrently with the Assemblers sharing the
+// StreamPool.
+func (a *Assembler) Checkpoint(w io.Writer) error {
+	cw := &checkpointWriter{w: bufio.NewWriter(w)}
+	cw.write(checkpointMagic[:])
+	cw.uint8(checkpointVersion)
+	conns := a.connPool.connections()
+	cw.uint32(uint32(len(conns)))
+	for _, conn := range conns {
+		conn.mu.Lock()
+		cw.flow(conn.key[0])
+		cw.flow(conn.key[1])
+		var state []byte
+		if cs, ok := conn.c2s.stream.(CheckpointStream); ok {
+			var err error
+			if state, err = cs.Checkpoint(); err != nil && cw.err == nil {
+				cw.err = err
+			}
+			if len(state) > MaxCheckpointState && cw.err == nil {
+				cw.err = fmt.Errorf("reassembly: state of %s is %d bytes, more than MaxCheckpointState", &conn.key, len(state))
+			}
+		}
+		cw.bytes(state)
+		cw.half(&conn.c2s)
+		cw.half(&conn.s2c)
+		conn.mu.Unlock()
+	}
+	if cw.err != nil {
+		return cw.err
+	}
+	return cw.w.Flush()
+}
+
+// checkpointReader decodes values, remembering the first error.
+type checkpointReader struct {
+	r   *bufio.Reader
+	buf [8]byte
+	err error
+}
+
+func (cr *checkpointReader) read(b []byte) {
+	if cr.err == nil {
+		if _, cr.err = io.ReadFull(cr.r, b); cr.err == io.EOF {
+			cr.err = io.ErrUnexpectedEOF
+		}
+	}
+}
+
+func (cr *checkpointReader) uint8() uint8 {
+	cr.read(cr.buf[:1])
+	return cr.buf[0]
+}
+
+func (cr *checkpointReader) uint32() uint32 {
+	cr.read(cr.buf[:4])
+	return binary.BigEndian.Uint32(cr.buf[:4])
+}
+
+func (cr *checkpointReader) int64() int64 {
+	cr.read(cr.buf[:8])
+	return int64(binary.BigEndian.Uint64(cr.buf[:8]))
+}
+
+func (cr *checkpointReader) time() time.Time {
+	v := cr.int64()
+	if v == 0 {
+		return time.Time{}
+	}
+	return time.Unix(0, v).UTC()
+}
+
+func (cr *checkpointReader) bytes(max int) []byte {
+	n := int(cr.uint32())
+	if cr.err != nil {
+		return nil
+	}
+	if n > max {
+		cr.err = ErrBadCheckpoint
+		return nil
+	}
+	if n == 0 {
+		return nil
+	}
+	b := make([]byte, n)
+	cr.read(b)
+	return b
+}
+
+func (cr *checkpointReader) flow() gopacket.Flow {
+	t := gopacket.EndpointType(cr.uint32())
+	src := cr.bytes(gopacket.MaxEndpointSize)
+	dst := cr.bytes(gopacket.MaxEndpointSize)
+	return gopacket.NewFlow(t, src, dst)
+}
+
+// pages reads a list of pages, allocated from pc.  It returns the first and
+// last pages, and the number of pages.
+func (cr *checkpointReader) pages(pc *pageCache) (first, last *page, n int) {
+	count := int(cr.uint32())
+	for i := 0; i < count && cr.err == nil; i++ {
+		flags := cr.uint8()
+		seq := Sequence(cr.uint32())
+		seen := cr.time()
+		var ac AssemblerContext
+		if flags&checkpointPageContext != 0 {
+			ci := gopacket.CaptureInfo{Timestamp: cr.time()}
+			ci.CaptureLength = int(cr.uint32())
+			ci.Length = int(cr.uint32())
+			ci.InterfaceIndex = int(cr.uint32())
+			asc := assemblerSimpleContext(ci)
+			ac = &asc
+		}
+		bytes := cr.bytes(pageBytes)
+		if cr.err != nil {
+			break
+		}
+		p := pc.next(seen)
+		p.bytes = p.buf[:len(bytes)]
+		copy(p.bytes, bytes)
+		p.seq = seq
+		p.ac = ac
+		p.start = flags&checkpointPageStart != 0
+		p.end = flags&checkpointPageEnd != 0
+		if last == nil {
+			first = p
+		} else {
+			last.next = p
+			p.prev = last
+		}
+		last = p
+		n++
+	}
+	return
+}
+
+func (cr *checkpointReader) half(half *halfconnection, pc *pageCache) {
+	half.nextSeq = Sequence(cr.int64())
+	half.ackSeq = Sequence(cr.int64())
+	half.created = cr.time()
+	half.lastSeen = cr.time()
+	half.closed = cr.uint8() != 0
+	var n int
+	half.saved, _, n = cr.pages(pc)
+	half.pages = n
+	half.first, half.last, n = cr.pages(pc)
+	half.pages += n
+}
+
+// Restore reads a snapshot written by Checkpoint, and adds its connections to
+// the Assembler's StreamPool.  Streams are recreated with the StreamPool's
+// StreamFactory, see RestoreStreamFactory.
+//
+// Restore must be called before packets are given to the Assemblers sharing
+// the StreamPool.  If it fails, the connections restored so far are removed
+// again, and the StreamPool is left as it was.
+func (a *Assembler) Restore(r io.Reader) (err error) {
+	cr := &checkpointReader{r: bufio.NewReader(r)}
+	var magic [4]byte
+	cr.read(magic[:])
+	version := cr.uint8()
+	if cr.err != nil {
+		return cr.err
+	}
+	if magic != checkpointMagic || version != checkpointVersion {
+		return ErrBadCheckpoint
+	}
+	pool := a.connPool
+	var restored []*connection
+	defer func() {
+		if err == nil {
+			return
+		}
+		for _, conn := range restored {
+			pool.remove(conn)
+			a.releaseHalf(&conn.c2s)
+			a.releaseHalf(&conn.s2c)
+		}
+	}()
+	count := int(cr.uint32())
+	for i := 0; i < count && cr.err == nil; i++ {
+		k := key{cr.flow(), cr.flow()}
+		state := cr.bytes(MaxCheckpointState)
+		var c2s, s2c halfconnection
+		cr.half(&c2s, a.pc)
+		cr.half(&s2c, a.pc)
+		if cr.err != nil {
+			a.releaseHalf(&c2s)
+			a.releaseHalf(&s2c)
+			break
+		}
+		ac := assemblerSimpleContext(gopacket.CaptureInfo{Timestamp: c2s.lastSeen})
+		s, err := restoreStream(pool.factory, k, state, &ac)
+		if err != nil {
+			a.releaseHalf(&c2s)
+			a.releaseHalf(&s2c)
+			return err
+		}
+		pool.mu.Lock()
+		if conn, _, _ := pool.getHalf(k); conn != nil {
+			pool.mu.Unlock()
+			a.releaseHalf(&c2s)
+			a.releaseHalf(&s2c)
+			return fmt.Errorf("reassembly: connection %s already in pool", &k)
+		}
+		conn, _, _ := pool.newConnection(k, s, c2s.created)
+		restored = append(restored, conn)
+		c2s.dir, s2c.dir = TCPDirClientToServer, TCPDirServerToClient
+		c2s.stream, s2c.stream = s, s
+		conn.c2s, conn.s2c = c2s, s2c
+		pool.conns[k] = conn
+		pool.mu.Unlock()
+	}
+	return cr.err
+}
+
+// releaseHalf returns the pages of a restored half connection to the page
+// cache.
+func (a *Assembler) releaseHalf(half *halfconnection) {
+	for _, first := range []*page{half.saved, half.first} {
+		for p := first; p != nil; {
+			next := p.next
+			a.pc.replace(p)
+			p = next
+		}
+	}
+	half.saved, half.first, half.last = nil, nil, nil
+	half.pages = 0
+}
+
+func restoreStream(factory StreamFactory, k key, state []byte, ac AssemblerContext) (Stream, error) {
+	if rf, ok := factory.(RestoreStreamFactory); ok {
+		return rf.Restore(k[0], k[1], state, ac)
+	}
+	src, dst := k[1].Endpoints()
+	tcp := &layers.TCP{}
+	if len(src.Raw()) == 2 && len(dst.Raw()) == 2 {
+		tcp.SrcPort = layers.TCPPort(binary.BigEndian.Uint16(src.Raw()))
+		tcp.DstPort = layers.TCPPort(binary.BigEndian.Uint16(dst.Raw()))
+	}
+	return factory.New(k[0], k[1], tcp, ac), nil
+}
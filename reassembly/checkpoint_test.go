@@ -0,0 +1,183 @@
+// Copyright 2012 Google, Inc. All rights reserved.
+//
+// Use of this source code is governed by a BSD-style license
+// that can be found in the LICENSE file in the root of the source
+// tree.
+
+package reassembly
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/binary"
+	"testing"
+	"time"
+
+	"github.com/davidsonff/gopacket"
+	"github.com/davidsonff/gopacket/layers"
+)
+
+/* For checkpoint tests: keeps bytes and a state machine */
+type testCheckpointFactory struct {
+	streams []*testCheckpointStream
+}
+
+type testCheckpointStream struct {
+	fsm   *TCPSimpleFSM
+	total uint32 // persisted
+	data  []byte // not persisted
+}
+
+func (f *testCheckpointFactory) New(a, b gopacket.Flow, tcp *layers.TCP, ac AssemblerContext) Stream {
+	s := &testCheckpointStream{fsm: NewTCPSimpleFSM(TCPSimpleFSMOptions{})}
+	f.streams = append(f.streams, s)
+	return s
+}
+
+func (f *testCheckpointFactory) Restore(a, b gopacket.Flow, state []byte, ac AssemblerContext) (Stream, error) {
+	s := &testCheckpointStream{fsm: &TCPSimpleFSM{}}
+	if err := s.fsm.UnmarshalBinary(state[4:]); err != nil {
+		return nil, err
+	}
+	s.total = binary.BigEndian.Uint32(state)
+	f.streams = append(f.streams, s)
+	return s, nil
+}
+
+func (s *testCheckpointStream) Checkpoint() ([]byte, error) {
+	fsm, err := s.fsm.MarshalBinary()
+	if err != nil {
+		return nil, err
+	}
+	state := make([]byte, 4, 4+len(fsm))
+	binary.BigEndian.PutUint32(state, s.total)
+	return append(state, fsm...), nil
+}
+
+func (s *testCheckpointStream) Accept(tcp *layers.TCP, ci gopacket.CaptureInfo, dir TCPFlowDirection, seq Sequence, start *bool, ac AssemblerContext) bool {
+	return s.fsm.CheckState(tcp, dir)
+}
+
+func (s *testCheckpointStream) ReassembledSG(sg ScatterGather, ac AssemblerContext) {
+	l, _ := sg.Lengths()
+	s.total += uint32(l)
+	s.data = append(s.data, sg.Fetch(l)...)
+}
+
+func (s *testCheckpointStream) ReassemblyComplete(ac AssemblerContext) bool {
+	return true
+}
+
+func TestCheckpointRestore(t *testing.T) {
+	assemble := func(a *Assembler, tcp layers.TCP) {
+		flow := netFlow
+		if tcp.SrcPort == 2 {
+			flow = netFlow.Reverse()
+		}
+		tcp.SetInternalPortsForTesting()
+		ctx := assemblerSimpleContext(gopacket.CaptureInfo{Timestamp: time.Unix(1000, 0)})
+		a.AssembleWithContext(flow, &tcp, &ctx)
+	}
+	f1 := &testCheckpointFactory{}
+	a1 := NewAssembler(NewStreamPool(f1))
+	for _, tcp := range []layers.TCP{
+		{SYN: true, SrcPort: 1, DstPort: 2, Seq: 1000},
+		{SYN: true, ACK: true, SrcPort: 2, DstPort: 1, Seq: 5000, Ack: 1001},
+		{ACK: true, SrcPort: 1, DstPort: 2, Seq: 1001, BaseLayer: layers.BaseLayer{Payload: []byte("abc")}},
+		{ACK: true, SrcPort: 1, DstPort: 2, Seq: 1010, BaseLayer: layers.BaseLayer{Payload: []byte("xyz")}},
+	} {
+		assemble(a1, tcp)
+	}
+	if len(f1.streams) != 1 || string(f1.streams[0].data) != "abc" {
+		t.Fatalf("unexpected first assembly")
+	}
+	var snapshot bytes.Buffer
+	if err := a1.Checkpoint(&snapshot); err != nil {
+		t.Fatal(err)
+	}
+
+	f2 := &testCheckpointFactory{}
+	a2 := NewAssembler(NewStreamPool(f2))
+	if err := a2.Restore(bytes.NewReader(snapshot.Bytes())); err != nil {
+		t.Fatal(err)
+	}
+	if len(f2.streams) != 1 {
+		t.Fatalf("want 1 restored stream, got %d", len(f2.streams))
+	}
+	s := f2.streams[0]
+	if s.total != 3 || s.fsm.String() != "Established" {
+		t.Fatalf("stream state not restored: %d, %s", s.total, s.fsm)
+	}
+	assemble(a2, layers.TCP{ACK: true, SrcPort: 1, DstPort: 2, Seq: 1004, BaseLayer: layers.BaseLayer{Payload: []byte("defghi")}})
+	if string(s.data) != "defghixyz" || s.total != 12 {
+		t.Errorf("want defghixyz (12 bytes total), got %q (%d)", s.data, s.total)
+	}
+	if got := a2.FlushAll(); got != 1 {
+		t.Errorf("want 1 connection flushed, got %d", got)
+	}
+}
+
+func TestCheckpointInvalid(t *testing.T) {
+	a := NewAssembler(NewStreamPool(&testCheckpointFactory{}))
+	if err := a.Restore(bytes.NewReader([]byte("nope!"))); err != ErrBadCheckpoint {
+		t.Errorf("want ErrBadCheckpoint, got %v", err)
+	}
+}
+
+func TestTCPOptionCheckMarshal(t *testing.T) {
+	in := TCPOptionCheck{options: [2]tcpStreamOptions{{mss: 1460, scale: 7, receiveWindow: 65535 << 7}, {mss: 0, scale: -1}}}
+	data, err := in.MarshalBinary()
+	if err != nil {
+		t.Fatal(err)
+	}
+	var out TCPOptionCheck
+	if err := out.UnmarshalBinary(data); err != nil {
+		t.Fatal(err)
+	}
+	if in != out {
+		t.Errorf("want %+v, got %+v", in, out)
+	}
+}
+
+func TestRestoreFailure(t *testing.T) {
+	a1 := NewAssembler(NewStreamPool(&testCheckpointFactory{}))
+	for _, tcp := range []layers.TCP{
+		{SYN: true, SrcPort: 1, DstPort: 2, Seq: 1000},
+		{ACK: true, SrcPort: 1, DstPort: 2, Seq: 1010, BaseLayer: layers.BaseLayer{Payload: []byte("xyz")}},
+		{SYN: true, SrcPort: 3, DstPort: 4, Seq: 2000},
+		{ACK: true, SrcPort: 3, DstPort: 4, Seq: 2010, BaseLayer: layers.BaseLayer{Payload: []byte("uvw")}},
+	} {
+		tcp.SetInternalPortsForTesting()
+		ctx := assemblerSimpleContext(gopacket.CaptureInfo{Timestamp: time.Unix(1000, 0)})
+		a1.AssembleWithContext(netFlow, &tcp, &ctx)
+	}
+	var snapshot bytes.Buffer
+	if err := a1.Checkpoint(&snapshot); err != nil {
+		t.Fatal(err)
+	}
+
+	// Every truncated snapshot fails, and leaves no connections nor pages behind.
+	for n := 5; n < snapshot.Len(); n++ {
+		a2 := NewAssembler(NewStreamPool(&testCheckpointFactory{}))
+		if err := a2.Restore(bytes.NewReader(snapshot.Bytes()[:n])); err == nil {
+			t.Fatalf("%d bytes: no error", n)
+		}
+		if len(a2.connPool.conns) != 0 || a2.pc.used != 0 {
+			t.Fatalf("%d bytes: %d connections and %d pages left", n, len(a2.connPool.conns), a2.pc.used)
+		}
+	}
+
+	// A state larger than MaxCheckpointState is rejected without reading it.
+	var huge bytes.Buffer
+	huge.Write(checkpointMagic[:])
+	huge.Write([]byte{checkpointVersion, 0, 0, 0, 1})
+	cw := &checkpointWriter{w: bufio.NewWriter(&huge)}
+	cw.flow(netFlow)
+	cw.flow(netFlow)
+	cw.uint32(MaxCheckpointState + 1)
+	cw.w.Flush()
+	a2 := NewAssembler(NewStreamPool(&testCheckpointFactory{}))
+	if err := a2.Restore(bytes.NewReader(huge.Bytes())); err != ErrBadCheckpoint {
+		t.Errorf("want ErrBadCheckpoint, got %v", err)
+	}
+}
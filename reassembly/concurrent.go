@@ -0,0 +1,247 @@
+// Copyright 2012 Google, Inc. All rights reserved.
+//
+// Use of this source code is governed by a BSD-style license
+// that can be found in the LICENSE file in the root of the source
+// tree.
+
+package reassembly
+
+import (
+	"runtime"
+	"sync"
+	"time"
+
+	"github.com/davidsonff/gopacket"
+	"github.com/davidsonff/gopacket/layers"
+)
+
+/*
+ * ConcurrentAssembler
+ */
+
+// DefaultConcurrentAssemblerOptions provides default options for a
+// ConcurrentAssembler.  Workers is set to runtime.NumCPU() when the
+// ConcurrentAssembler is created, if it's <= 0.
+var DefaultConcurrentAssemblerOptions = ConcurrentAssemblerOptions{
+	Workers:   0,
+	QueueSize: 1024,
+}
+
+// ConcurrentAssemblerOptions controls the behavior of a ConcurrentAssembler.
+type ConcurrentAssemblerOptions struct {
+	// AssemblerOptions are the options of each worker's Assembler.  The
+	// MaxBufferedPagesTotal limit applies per worker.
+	AssemblerOptions
+	// Workers is the number of worker goroutines.  If <= 0,
+	// runtime.NumCPU() is used.
+	Workers int
+	// QueueSize is the number of packets queued per worker before
+	// AssembleWithContext blocks.
+	QueueSize int
+}
+
+// ConcurrentAssemblerStats provides figures aggregated over all the workers
+// of a ConcurrentAssembler.
+type ConcurrentAssemblerStats struct {
+	// Packets is the number of packets assembled.
+	Packets int64
+	// Connections is the number of connections currently in the pools.
+	Connections int
+	// PagesUsed is the number of pages currently used for out-of-order data.
+	PagesUsed int
+	// Flushed and Closed are the total number of connections flushed and
+	// closed by Flush* calls.
+	Flushed int64
+	Closed  int64
+}
+
+// ConcurrentAssembler reassembles TCP streams using several worker
+// goroutines, each with its own Assembler, StreamPool and page cache.
+// Packets are sharded between workers by a symmetric hash of their
+// connection, so both directions of a connection are always handled by the
+// same worker, and no StreamPool is shared.
+//
+// Unlike Assembler, ConcurrentAssembler is safe for concurrent use.  The
+// StreamFactory is used concurrently by all the workers, so its New method
+// must be safe for concurrency.  Each Stream is only used by one worker.
+//
+// Packets are processed asynchronously: the TCP layer given to Assemble and
+// AssembleWithContext, its payload and the AssemblerContext must not be
+// modified or reused by the caller afterwards (so they must not come from a
+// DecodingLayerParser or a ZeroCopyPacketDataSource, unless copied).
+type ConcurrentAssembler struct {
+	workers []*concurrentWorker
+	wg      sync.WaitGroup
+	mu      sync.RWMutex
+	closed  bool
+}
+
+type concurrentRequestKind int
+
+const (
+	concurrentPacket concurrentRequestKind = iota
+	concurrentFlush
+	concurrentFlushAll
+	concurrentStats
+)
+
+type concurrentRequest struct {
+	kind    concurrentRequestKind
+	netFlow gopacket.Flow
+	tcp     *layers.TCP
+	ac      AssemblerContext
+	flush   FlushOptions
+	reply   chan<- ConcurrentAssemblerStats
+}
+
+type concurrentWorker struct {
+	assembler *Assembler
+	pool      *StreamPool
+	requests  chan concurrentRequest
+	stats     ConcurrentAssemblerStats
+}
+
+func (w *concurrentWorker) run(wg *sync.WaitGroup) {
+	defer wg.Done()
+	for r := range w.requests {
+		switch r.kind {
+		case concurrentPacket:
+			w.stats.Packets++
+			w.assembler.AssembleWithContext(r.netFlow, r.tcp, r.ac)
+		case concurrentFlush:
+			flushed, closed := w.assembler.FlushWithOptions(r.flush)
+			w.stats.Flushed += int64(flushed)
+			w.stats.Closed += int64(closed)
+			r.reply <- ConcurrentAssemblerStats{Flushed: int64(flushed), Closed: int64(closed)}
+		case concurrentFlushAll:
+			closed := w.assembler.FlushAll()
+			w.stats.Closed += int64(closed)
+			r.reply <- ConcurrentAssemblerStats{Closed: int64(closed)}
+		case concurrentStats:
+			stats := w.stats
+			stats.PagesUsed = w.assembler.pc.used
+			w.pool.mu.RLock()
+			stats.Connections = len(w.pool.conns)
+			w.pool.mu.RUnlock()
+			r.reply <- stats
+		}
+	}
+}
+
+// NewConcurrentAssembler creates a new ConcurrentAssembler and starts its
+// workers, which create streams using the given factory.  Close must be
+// called to stop them.
+func NewConcurrentAssembler(factory StreamFactory, options ConcurrentAssemblerOptions) *ConcurrentAssembler {
+	if options.Workers <= 0 {
+		options.Workers = runtime.NumCPU()
+	}
+	c := &ConcurrentAssembler{
+		workers: make([]*concurrentWorker, options.Workers),
+	}
+	for i := range c.workers {
+		pool := NewStreamPool(factory)
+		a := NewAssembler(pool)
+		a.AssemblerOptions = options.AssemblerOptions
+		w := &concurrentWorker{
+			assembler: a,
+			pool:      pool,
+			requests:  make(chan concurrentRequest, options.QueueSize),
+		}
+		c.workers[i] = w
+		c.wg.Add(1)
+		go w.run(&c.wg)
+	}
+	return c
+}
+
+// Assemble calls AssembleWithContext with the current timestamp, useful for
+// packets being read directly off the wire.
+func (c *ConcurrentAssembler) Assemble(netFlow gopacket.Flow, t *layers.TCP) {
+	ctx := assemblerSimpleContext(gopacket.CaptureInfo{Timestamp: time.Now()})
+	c.AssembleWithContext(netFlow, t, &ctx)
+}
+
+// AssembleWithContext queues the given TCP packet to the worker handling its
+// connection.  It blocks if that worker's queue is full.  See
+// Assembler.AssembleWithContext.
+func (c *ConcurrentAssembler) AssembleWithContext(netFlow gopacket.Flow, t *layers.TCP, ac AssemblerContext) {
+	h := netFlow.FastHash() ^ t.TransportFlow().FastHash()
+	c.mu.RLock()
+	defer c.mu.RUnlock()
+	if c.closed {
+		panic("reassembly: AssembleWithContext called on closed ConcurrentAssembler")
+	}
+	c.workers[h%uint64(len(c.workers))].requests <- concurrentRequest{
+		kind:    concurrentPacket,
+		netFlow: netFlow,
+		tcp:     t,
+		ac:      ac,
+	}
+}
+
+// broadcast sends a request to all workers once they've handled the
+// packets queued before it, and sums their replies.
+func (c *ConcurrentAssembler) broadcast(r concurrentRequest) (sum ConcurrentAssemblerStats) {
+	reply := make(chan ConcurrentAssemblerStats, len(c.workers))
+	r.reply = reply
+	c.mu.RLock()
+	if c.closed {
+		c.mu.RUnlock()
+		return
+	}
+	for _, w := range c.workers {
+		w.requests <- r
+	}
+	c.mu.RUnlock()
+	for range c.workers {
+		s := <-reply
+		sum.Packets += s.Packets
+		sum.Connections += s.Connections
+		sum.PagesUsed += s.PagesUsed
+		sum.Flushed += s.Flushed
+		sum.Closed += s.Closed
+	}
+	return
+}
+
+// FlushWithOptions calls Assembler.FlushWithOptions on all the workers, once
+// they've assembled the packets queued before the call.  It returns the total
+// number of connections flushed and closed.
+func (c *ConcurrentAssembler) FlushWithOptions(opt FlushOptions) (flushed, closed int) {
+	s := c.broadcast(concurrentRequest{kind: concurrentFlush, flush: opt})
+	return int(s.Flushed), int(s.Closed)
+}
+
+// FlushCloseOlderThan flushes and closes streams older than given time
+func (c *ConcurrentAssembler) FlushCloseOlderThan(t time.Time) (flushed, closed int) {
+	return c.FlushWithOptions(FlushOptions{T: t, TC: t})
+}
+
+// FlushAll flushes all remaining data into all remaining connections and
+// closes those connections, in all workers.  It returns the total number of
+// connections flushed/closed by the call.
+func (c *ConcurrentAssembler) FlushAll() (closed int) {
+	return int(c.broadcast(concurrentRequest{kind: concurrentFlushAll}).Closed)
+}
+
+// Stats returns the statistics of all the workers, once they've assembled
+// the packets queued before the call.
+func (c *ConcurrentAssembler) Stats() ConcurrentAssemblerStats {
+	return c.broadcast(concurrentRequest{kind: concurrentStats})
+}
+
+// Close flushes all connections (see FlushAll), then stops the workers.  The
+// ConcurrentAssembler can't be used afterwards.
+func (c *ConcurrentAssembler) Close() (closed int) {
+	closed = c.FlushAll()
+	c.mu.Lock()
+	if !c.closed {
+		c.closed = true
+		for _, w := range c.workers {
+			close(w.requests)
+		}
+	}
+	c.mu.Unlock()
+	c.wg.Wait()
+	return
+}
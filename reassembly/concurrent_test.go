@@ -0,0 +1,100 @@
+// Copyright 2012 Google, Inc. All rights reserved.
+//
+// Use of this source code is governed by a BSD-style license
+// that can be found in the LICENSE file in the root of the source
+// tree.
+
+package reassembly
+
+import (
+	"net"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/davidsonff/gopacket"
+	"github.com/davidsonff/gopacket/layers"
+)
+
+/* For concurrent tests: counts bytes per connection, safe for concurrency */
+type testConcurrentFactory struct {
+	mu       sync.Mutex
+	bytes    map[string]int
+	complete int
+}
+
+type testConcurrentStream struct {
+	f   *testConcurrentFactory
+	key string
+}
+
+func (f *testConcurrentFactory) New(a, b gopacket.Flow, tcp *layers.TCP, ac AssemblerContext) Stream {
+	return &testConcurrentStream{f: f, key: a.String() + b.String()}
+}
+
+func (s *testConcurrentStream) Accept(tcp *layers.TCP, ci gopacket.CaptureInfo, dir TCPFlowDirection, seq Sequence, start *bool, ac AssemblerContext) bool {
+	return true
+}
+
+func (s *testConcurrentStream) ReassembledSG(sg ScatterGather, ac AssemblerContext) {
+	l, _ := sg.Lengths()
+	s.f.mu.Lock()
+	s.f.bytes[s.key] += l
+	s.f.mu.Unlock()
+}
+
+func (s *testConcurrentStream) ReassemblyComplete(ac AssemblerContext) bool {
+	s.f.mu.Lock()
+	s.f.complete++
+	s.f.mu.Unlock()
+	return true
+}
+
+func TestConcurrentAssembler(t *testing.T) {
+	const conns = 50
+	f := &testConcurrentFactory{bytes: make(map[string]int)}
+	options := DefaultConcurrentAssemblerOptions
+	options.Workers = 4
+	c := NewConcurrentAssembler(f, options)
+	ts := time.Unix(1000, 0)
+	for i := 0; i < conns; i++ {
+		flow, _ := gopacket.FlowFromEndpoints(
+			layers.NewIPEndpoint(net.IP{10, 0, 0, byte(i)}),
+			layers.NewIPEndpoint(net.IP{10, 1, 0, 1}))
+		for _, tcp := range []*layers.TCP{
+			{SYN: true, SrcPort: 1000, DstPort: 80, Seq: 1},
+			{SYN: true, ACK: true, SrcPort: 80, DstPort: 1000, Seq: 100},
+			{SrcPort: 1000, DstPort: 80, Seq: 2, BaseLayer: layers.BaseLayer{Payload: []byte{1, 2, 3}}},
+			{SrcPort: 80, DstPort: 1000, Seq: 101, BaseLayer: layers.BaseLayer{Payload: []byte{1, 2, 3, 4}}},
+			// Out of order, waits for a flush
+			{SrcPort: 1000, DstPort: 80, Seq: 10, BaseLayer: layers.BaseLayer{Payload: []byte{1}}},
+		} {
+			tcp.SetInternalPortsForTesting()
+			nf := flow
+			if tcp.SrcPort == 80 {
+				nf = flow.Reverse()
+			}
+			ctx := assemblerSimpleContext(gopacket.CaptureInfo{Timestamp: ts})
+			c.AssembleWithContext(nf, tcp, &ctx)
+		}
+	}
+	stats := c.Stats()
+	if stats.Packets != conns*5 || stats.Connections != conns || stats.PagesUsed != conns {
+		t.Errorf("unexpected stats %+v", stats)
+	}
+	flushed, closed := c.FlushWithOptions(FlushOptions{T: ts.Add(time.Second)})
+	if flushed != conns || closed != 0 {
+		t.Errorf("want %d flushed and 0 closed, got %d, %d", conns, flushed, closed)
+	}
+	if closed := c.Close(); closed != conns {
+		t.Errorf("want %d connections closed, got %d", conns, closed)
+	}
+	if len(f.bytes) != conns || f.complete != conns {
+		t.Fatalf("want %d connections, got %d (%d complete)", conns, len(f.bytes), f.complete)
+	}
+	for k, v := range f.bytes {
+		if v != 8 {
+			t.Errorf("%s: want 8 bytes, got %d", k, v)
+		}
+	}
+}
@@ -0,0 +1,85 @@
+// Copyright 2012 Google, Inc. All rights reserved.
+//
+// Use of this source code is governed by a BSD-style license
+// that can be found in the LICENSE file in the root of the source
+// tree.
+
+package dispatch
+
+import (
+	"bytes"
+
+	"github.com/davidsonff/gopacket/reassembly"
+)
+
+// matchPrefix returns Match if data starts with one of the prefixes,
+// NeedMore if data is too short to tell, NoMatch otherwise.
+func matchPrefix(data []byte, prefixes ...string) Detection {
+	ret := NoMatch
+	for _, p := range prefixes {
+		if len(data) >= len(p) {
+			if string(data[:len(p)]) == p {
+				return Match
+			}
+		} else if string(data) == p[:len(data)] {
+			ret = NeedMore
+		}
+	}
+	return ret
+}
+
+var httpMethods = []string{
+	"GET ", "POST ", "PUT ", "HEAD ", "DELETE ", "OPTIONS ", "PATCH ",
+	"CONNECT ", "TRACE ",
+}
+
+// DetectHTTP detects HTTP/1.x requests and responses.
+func DetectHTTP(dir reassembly.TCPFlowDirection, data []byte) Detection {
+	if r := matchPrefix(data, httpMethods...); r != NoMatch {
+		return r
+	}
+	return matchPrefix(data, "HTTP/1.")
+}
+
+// DetectTLS detects TLS (and SSLv3) handshake records.
+func DetectTLS(dir reassembly.TCPFlowDirection, data []byte) Detection {
+	if len(data) < 3 {
+		if len(data) > 0 && data[0] != 0x16 || len(data) > 1 && data[1] != 0x03 {
+			return NoMatch
+		}
+		return NeedMore
+	}
+	// ContentType handshake, ProtocolVersion 3.0 to 3.4
+	if data[0] == 0x16 && data[1] == 0x03 && data[2] <= 0x04 {
+		return Match
+	}
+	return NoMatch
+}
+
+// DetectSSH detects the SSH protocol version exchange.
+func DetectSSH(dir reassembly.TCPFlowDirection, data []byte) Detection {
+	return matchPrefix(data, "SSH-")
+}
+
+// DetectSMTP detects SMTP, using the server greeting or the client's HELO or
+// EHLO command.
+func DetectSMTP(dir reassembly.TCPFlowDirection, data []byte) Detection {
+	if dir == reassembly.TCPDirClientToServer {
+		if r := matchPrefix(data, "EHLO ", "HELO "); r != NoMatch {
+			return r
+		}
+	}
+	r := matchPrefix(data, "220")
+	if r != Match {
+		return r
+	}
+	// The greeting is shared with FTP: look for SMTP in its first line.
+	eol := bytes.IndexByte(data, '\n')
+	if eol < 0 {
+		return NeedMore
+	}
+	if bytes.Contains(data[:eol], []byte("SMTP")) {
+		return Match
+	}
+	return NoMatch
+}
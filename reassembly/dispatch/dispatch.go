@@ -0,0 +1,344 @@
+// Copyright 2012 Google, Inc. All rights reserved.
+//
+// Use of this source code is governed by a BSD-style license
+// that can be found in the LICENSE file in the root of the source
+// tree.
+
+// Package dispatch provides a reassembly.StreamFactory which identifies the
+// application protocol of each TCP connection and hands its data to a
+// protocol-specific Handler.
+//
+// Protocols are registered on a Dispatcher with port hints and a content
+// heuristic.  For every new connection, the Dispatcher buffers the first bytes
+// of each direction, asks registered protocols (those whose ports match
+// first) whether they recognize the data, then creates the Handler of the
+// winning protocol and replays the buffered data to it.  Connections which
+// aren't recognized go to the Fallback handler.
+//
+//  d := dispatch.NewDispatcher(dispatch.DefaultDispatcherOptions)
+//  d.Register(&dispatch.Protocol{
+//  	Name:   "http",
+//  	Ports:  []layers.TCPPort{80, 8080},
+//  	Detect: dispatch.DetectHTTP,
+//  	New:    newHTTPHandler,
+//  })
+//  d.Fallback = newRawHandler
+//  assembler := reassembly.NewAssembler(reassembly.NewStreamPool(d))
+//
+// A Handler may hand the connection over to another protocol, for example
+// after a successful STARTTLS or an HTTP Upgrade, by returning the name of
+// that protocol from its Data method.
+package dispatch
+
+import (
+	"github.com/davidsonff/gopacket"
+	"github.com/davidsonff/gopacket/layers"
+	"github.com/davidsonff/gopacket/reassembly"
+)
+
+// Detection is the result of a protocol content heuristic.
+type Detection int
+
+// Detection values.
+const (
+	// NeedMore means the heuristic can't decide with the data available.
+	NeedMore Detection = iota
+	// Match means the data belongs to the protocol.
+	Match
+	// NoMatch means the data does not belong to the protocol.
+	NoMatch
+)
+
+// Redetect can be returned by Handler.Data to run protocol detection again
+// on the following bytes of the connection.
+const Redetect = "*"
+
+// Conn describes the connection a Handler is created for.
+type Conn struct {
+	// Net and Transport are the flows of the client->server direction, as
+	// given to reassembly.StreamFactory.New.
+	Net, Transport gopacket.Flow
+	// Protocol is the name of the protocol chosen for the connection, or
+	// empty for the fallback handler.
+	Protocol string
+}
+
+// Handler processes the application data of a connection, in both
+// directions, in the order it was reassembled.
+type Handler interface {
+	// Data is called with the next bytes of the given direction.  The slice
+	// is only valid during the call.
+	//
+	// To hand the connection over to another registered protocol (or to
+	// Redetect), Data returns the name of that protocol and the number of
+	// bytes of data it consumed; the remaining bytes are given to the new
+	// handler.  Otherwise next must be empty, and consumed is ignored.
+	Data(dir reassembly.TCPFlowDirection, data []byte, ci gopacket.CaptureInfo) (consumed int, next string)
+	// Gap is called when lost bytes have been skipped in a direction.
+	Gap(dir reassembly.TCPFlowDirection, lost int)
+	// Close is called when the connection is complete, or when the
+	// handler is replaced by another one.
+	Close()
+}
+
+// Protocol describes an application protocol known to a Dispatcher.
+type Protocol struct {
+	// Name identifies the protocol, it must be unique within a Dispatcher.
+	Name string
+	// Ports are the TCP ports commonly used by the protocol.  Protocols with
+	// a matching port are tried first.
+	Ports []layers.TCPPort
+	// Detect is the content heuristic, called with the bytes buffered so
+	// far for a direction (possibly none).  If nil, the protocol matches
+	// any connection on one of its Ports, and no other.
+	Detect func(dir reassembly.TCPFlowDirection, data []byte) Detection
+	// New creates a handler for a connection.
+	New func(conn *Conn) Handler
+}
+
+func (p *Protocol) hasPort(transport gopacket.Flow) bool {
+	src, dst := transport.Endpoints()
+	for _, port := range p.Ports {
+		e := layers.NewTCPPortEndpoint(port)
+		if e == src || e == dst {
+			return true
+		}
+	}
+	return false
+}
+
+func (p *Protocol) detect(bufs *[2][]byte, transport gopacket.Flow) Detection {
+	if p.Detect == nil {
+		if p.hasPort(transport) {
+			return Match
+		}
+		return NoMatch
+	}
+	ret := NoMatch
+	for i, dir := range []reassembly.TCPFlowDirection{reassembly.TCPDirClientToServer, reassembly.TCPDirServerToClient} {
+		switch p.Detect(dir, bufs[i]) {
+		case Match:
+			return Match
+		case NeedMore:
+			ret = NeedMore
+		}
+	}
+	return ret
+}
+
+// DefaultDispatcherOptions provides default options for a Dispatcher.
+var DefaultDispatcherOptions = DispatcherOptions{
+	PeekBytes: 1024,
+}
+
+// DispatcherOptions controls the behavior of a Dispatcher.
+type DispatcherOptions struct {
+	// PeekBytes is the number of bytes buffered per direction while the
+	// protocol is undecided.  Once reached, the fallback handler is used
+	// if no protocol matched.
+	PeekBytes int
+	// Accept, if non-nil, is called by the streams' Accept method.
+	Accept func(tcp *layers.TCP, ci gopacket.CaptureInfo, dir reassembly.TCPFlowDirection, nextSeq reassembly.Sequence, start *bool, ac reassembly.AssemblerContext) bool
+}
+
+// Dispatcher implements reassembly.StreamFactory.  Protocols must be
+// registered, and Fallback set, before the Dispatcher is given to a
+// StreamPool.
+type Dispatcher struct {
+	DispatcherOptions
+	// Fallback creates the handler of connections no protocol matched.  If
+	// nil, their data is discarded.
+	Fallback  func(conn *Conn) Handler
+	protocols []*Protocol
+	byName    map[string]*Protocol
+}
+
+// NewDispatcher creates a new Dispatcher with the given options.
+func NewDispatcher(options DispatcherOptions) *Dispatcher {
+	return &Dispatcher{
+		DispatcherOptions: options,
+		byName:            make(map[string]*Protocol),
+	}
+}
+
+// Register adds a protocol to the dispatcher.  Protocols are tried in
+// registration order, after the ones with a matching port.
+func (d *Dispatcher) Register(p *Protocol) {
+	if _, ok := d.byName[p.Name]; ok {
+		panic("dispatch: protocol " + p.Name + " registered twice")
+	}
+	d.protocols = append(d.protocols, p)
+	d.byName[p.Name] = p
+}
+
+// New implements reassembly.StreamFactory.
+func (d *Dispatcher) New(netFlow, tcpFlow gopacket.Flow, tcp *layers.TCP, ac reassembly.AssemblerContext) reassembly.Stream {
+	s := &stream{
+		d:   d,
+		net: netFlow, transport: tcpFlow,
+	}
+	s.candidates = make([]*Protocol, 0, len(d.protocols))
+	for _, p := range d.protocols {
+		if p.hasPort(tcpFlow) {
+			s.candidates = append(s.candidates, p)
+		}
+	}
+	for _, p := range d.protocols {
+		if !p.hasPort(tcpFlow) {
+			s.candidates = append(s.candidates, p)
+		}
+	}
+	return s
+}
+
+// segment is a piece of data buffered while detecting the protocol.
+type segment struct {
+	dir  reassembly.TCPFlowDirection
+	data []byte
+	lost int
+	ci   gopacket.CaptureInfo
+}
+
+// stream implements reassembly.Stream for a Dispatcher.
+type stream struct {
+	d              *Dispatcher
+	net, transport gopacket.Flow
+	candidates     []*Protocol
+	handler        Handler
+	discard        bool
+	pending        []segment
+	bufs           [2][]byte
+}
+
+func dirIndex(dir reassembly.TCPFlowDirection) int {
+	if dir == reassembly.TCPDirClientToServer {
+		return 0
+	}
+	return 1
+}
+
+func (s *stream) Accept(tcp *layers.TCP, ci gopacket.CaptureInfo, dir reassembly.TCPFlowDirection, nextSeq reassembly.Sequence, start *bool, ac reassembly.AssemblerContext) bool {
+	if s.d.Accept != nil {
+		return s.d.Accept(tcp, ci, dir, nextSeq, start, ac)
+	}
+	return true
+}
+
+func (s *stream) ReassembledSG(sg reassembly.ScatterGather, ac reassembly.AssemblerContext) {
+	dir, _, _, skip := sg.Info()
+	length, _ := sg.Lengths()
+	if skip < 0 {
+		skip = 0
+	}
+	if length == 0 && skip == 0 {
+		return
+	}
+	s.input(segment{dir: dir, data: sg.Fetch(length), lost: skip, ci: sg.CaptureInfo(0)}, false)
+}
+
+func (s *stream) ReassemblyComplete(ac reassembly.AssemblerContext) bool {
+	if s.handler == nil && !s.discard && len(s.pending) > 0 {
+		s.choose(true)
+	}
+	s.setHandler(nil, true)
+	s.pending = nil
+	return true
+}
+
+// input gives a segment to the current handler, or buffers it if the
+// protocol is still undecided.  buffered is true when seg.data is already
+// owned by the stream.
+func (s *stream) input(seg segment, buffered bool) {
+	if s.handler == nil && !s.discard {
+		if !buffered {
+			seg.data = append([]byte(nil), seg.data...)
+		}
+		s.pending = append(s.pending, seg)
+		i := dirIndex(seg.dir)
+		s.bufs[i] = append(s.bufs[i], seg.data...)
+		s.choose(len(s.bufs[i]) >= s.d.PeekBytes)
+		return
+	}
+	if s.discard {
+		return
+	}
+	if seg.lost > 0 {
+		s.handler.Gap(seg.dir, seg.lost)
+	}
+	if len(seg.data) == 0 {
+		return
+	}
+	consumed, next := s.handler.Data(seg.dir, seg.data, seg.ci)
+	if next == "" {
+		return
+	}
+	if consumed > len(seg.data) {
+		consumed = len(seg.data)
+	}
+	rest := segment{dir: seg.dir, data: seg.data[consumed:], ci: seg.ci}
+	if next == Redetect {
+		s.setHandler(nil, false)
+	} else if p, ok := s.d.byName[next]; ok {
+		s.setHandler(p.New(s.conn(p.Name)), true)
+	} else {
+		s.setHandler(s.fallback(), true)
+	}
+	if len(rest.data) > 0 {
+		s.input(rest, false)
+	}
+}
+
+// choose runs detection on buffered data.  If force is set, the fallback
+// handler is used when no protocol matches yet.
+func (s *stream) choose(force bool) {
+	var chosen *Protocol
+	undecided := false
+	for _, p := range s.candidates {
+		switch p.detect(&s.bufs, s.transport) {
+		case Match:
+			chosen = p
+		case NeedMore:
+			undecided = true
+		}
+		if chosen != nil {
+			break
+		}
+	}
+	if chosen == nil && undecided && !force {
+		return
+	}
+	var h Handler
+	if chosen != nil {
+		h = chosen.New(s.conn(chosen.Name))
+	} else {
+		h = s.fallback()
+	}
+	s.setHandler(h, true)
+	pending := s.pending
+	s.pending = nil
+	s.bufs = [2][]byte{}
+	for _, seg := range pending {
+		s.input(seg, true)
+	}
+}
+
+func (s *stream) conn(protocol string) *Conn {
+	return &Conn{Net: s.net, Transport: s.transport, Protocol: protocol}
+}
+
+func (s *stream) fallback() Handler {
+	if s.d.Fallback == nil {
+		return nil
+	}
+	return s.d.Fallback(s.conn(""))
+}
+
+// setHandler closes the current handler, and replaces it with h.  If the
+// protocol is decided and h is nil, data is discarded.
+func (s *stream) setHandler(h Handler, decided bool) {
+	if s.handler != nil {
+		s.handler.Close()
+	}
+	s.handler = h
+	s.discard = decided && h == nil
+}
@@ -0,0 +1,202 @@
+// Copyright 2012 Google, Inc. All rights reserved.
+//
+// Use of this source code is governed by a BSD-style license
+// that can be found in the LICENSE file in the root of the source
+// tree.
+
+package dispatch
+
+import (
+	"bytes"
+	"fmt"
+	"net"
+	"reflect"
+	"testing"
+
+	"github.com/davidsonff/gopacket"
+	"github.com/davidsonff/gopacket/layers"
+	"github.com/davidsonff/gopacket/reassembly"
+)
+
+var netFlow gopacket.Flow
+
+func init() {
+	netFlow, _ = gopacket.FlowFromEndpoints(
+		layers.NewIPEndpoint(net.IP{1, 2, 3, 4}),
+		layers.NewIPEndpoint(net.IP{5, 6, 7, 8}))
+}
+
+// testHandler records everything it is given as strings.
+type testHandler struct {
+	name     string
+	log      *[]string
+	switchTo func(dir reassembly.TCPFlowDirection, data []byte) (int, string)
+}
+
+func (h *testHandler) Data(dir reassembly.TCPFlowDirection, data []byte, ci gopacket.CaptureInfo) (int, string) {
+	*h.log = append(*h.log, fmt.Sprintf("%s %s %q", h.name, dir, data))
+	if h.switchTo != nil {
+		return h.switchTo(dir, data)
+	}
+	return 0, ""
+}
+
+func (h *testHandler) Gap(dir reassembly.TCPFlowDirection, lost int) {
+	*h.log = append(*h.log, fmt.Sprintf("%s %s gap %d", h.name, dir, lost))
+}
+
+func (h *testHandler) Close() {
+	*h.log = append(*h.log, h.name+" close")
+}
+
+type packet struct {
+	c2s  bool
+	seq  uint32
+	data string
+}
+
+func run(d *Dispatcher, srcPort, dstPort layers.TCPPort, packets []packet) {
+	a := reassembly.NewAssembler(reassembly.NewStreamPool(d))
+	for _, p := range packets {
+		tcp := layers.TCP{Seq: p.seq, BaseLayer: layers.BaseLayer{Payload: []byte(p.data)}}
+		flow := netFlow
+		tcp.SrcPort, tcp.DstPort = srcPort, dstPort
+		if !p.c2s {
+			flow = netFlow.Reverse()
+			tcp.SrcPort, tcp.DstPort = dstPort, srcPort
+		}
+		if p.data == "" {
+			tcp.SYN = true
+		}
+		tcp.SetInternalPortsForTesting()
+		a.Assemble(flow, &tcp)
+	}
+	a.FlushAll()
+}
+
+func newTestDispatcher(log *[]string, peek int) *Dispatcher {
+	d := NewDispatcher(DispatcherOptions{PeekBytes: peek})
+	for _, p := range []struct {
+		name   string
+		ports  []layers.TCPPort
+		detect func(reassembly.TCPFlowDirection, []byte) Detection
+	}{
+		{"http", []layers.TCPPort{80}, DetectHTTP},
+		{"tls", []layers.TCPPort{443}, DetectTLS},
+		{"smtp", []layers.TCPPort{25}, DetectSMTP},
+	} {
+		name := p.name
+		d.Register(&Protocol{
+			Name:   name,
+			Ports:  p.ports,
+			Detect: p.detect,
+			New: func(c *Conn) Handler {
+				h := &testHandler{name: name, log: log}
+				if name == "smtp" {
+					h.switchTo = func(dir reassembly.TCPFlowDirection, data []byte) (int, string) {
+						if i := bytes.Index(data, []byte("220 go ahead\r\n")); i >= 0 {
+							return i + 14, "tls"
+						}
+						return 0, ""
+					}
+				}
+				return h
+			},
+		})
+	}
+	d.Fallback = func(c *Conn) Handler {
+		return &testHandler{name: "fallback", log: log}
+	}
+	return d
+}
+
+func TestDispatchHTTP(t *testing.T) {
+	var log []string
+	run(newTestDispatcher(&log, 16), 1234, 8080, []packet{
+		{c2s: true, seq: 1000},
+		{c2s: false, seq: 5000},
+		{c2s: true, seq: 1001, data: "GE"},
+		{c2s: true, seq: 1003, data: "T / HTTP/1.1\r\n"},
+		{c2s: false, seq: 5001, data: "HTTP/1.1 200 OK\r\n"},
+	})
+	want := []string{
+		`http client->server "GE"`,
+		`http client->server "T / HTTP/1.1\r\n"`,
+		`http server->client "HTTP/1.1 200 OK\r\n"`,
+		"http close",
+	}
+	if !reflect.DeepEqual(log, want) {
+		t.Errorf("want\n%q\ngot\n%q", want, log)
+	}
+}
+
+func TestDispatchFallback(t *testing.T) {
+	var log []string
+	run(newTestDispatcher(&log, 4), 1234, 80, []packet{
+		{c2s: true, seq: 1000},
+		{c2s: true, seq: 1001, data: "GE"},
+		{c2s: true, seq: 1003, data: "XXXX"},
+		{c2s: true, seq: 1007, data: "YY"},
+	})
+	want := []string{
+		`fallback client->server "GE"`,
+		`fallback client->server "XXXX"`,
+		`fallback client->server "YY"`,
+		"fallback close",
+	}
+	if !reflect.DeepEqual(log, want) {
+		t.Errorf("want\n%q\ngot\n%q", want, log)
+	}
+}
+
+func TestDispatchStartTLS(t *testing.T) {
+	var log []string
+	run(newTestDispatcher(&log, 1024), 1234, 25, []packet{
+		{c2s: true, seq: 1000},
+		{c2s: false, seq: 5000},
+		{c2s: false, seq: 5001, data: "220 mx ESMTP\r\n"},
+		{c2s: true, seq: 1001, data: "STARTTLS\r\n"},
+		{c2s: false, seq: 5015, data: "220 go ahead\r\n\x16\x03\x01"},
+		{c2s: true, seq: 1011, data: "\x16\x03\x01"},
+	})
+	want := []string{
+		`smtp server->client "220 mx ESMTP\r\n"`,
+		`smtp client->server "STARTTLS\r\n"`,
+		`smtp server->client "220 go ahead\r\n\x16\x03\x01"`,
+		"smtp close",
+		`tls server->client "\x16\x03\x01"`,
+		`tls client->server "\x16\x03\x01"`,
+		"tls close",
+	}
+	if !reflect.DeepEqual(log, want) {
+		t.Errorf("want\n%q\ngot\n%q", want, log)
+	}
+}
+
+func TestDetect(t *testing.T) {
+	c2s, s2c := reassembly.TCPDirClientToServer, reassembly.TCPDirServerToClient
+	for i, test := range []struct {
+		detect func(reassembly.TCPFlowDirection, []byte) Detection
+		dir    reassembly.TCPFlowDirection
+		data   string
+		want   Detection
+	}{
+		{DetectHTTP, c2s, "", NeedMore},
+		{DetectHTTP, c2s, "PO", NeedMore},
+		{DetectHTTP, c2s, "POST /", Match},
+		{DetectHTTP, s2c, "HTTP/1.0 404", Match},
+		{DetectHTTP, c2s, "SSH-2.0", NoMatch},
+		{DetectTLS, c2s, "\x16", NeedMore},
+		{DetectTLS, c2s, "\x16\x03\x03\x00", Match},
+		{DetectTLS, c2s, "\x17\x03", NoMatch},
+		{DetectSSH, s2c, "SSH-2.0-OpenSSH", Match},
+		{DetectSMTP, s2c, "220 mx.example.com ESMTP", NeedMore},
+		{DetectSMTP, s2c, "220 mx.example.com ESMTP\r\n", Match},
+		{DetectSMTP, s2c, "220 FTP server ready\r\n", NoMatch},
+		{DetectSMTP, c2s, "EHLO client", Match},
+	} {
+		if got := test.detect(test.dir, []byte(test.data)); got != test.want {
+			t.Errorf("%d: %q: want %v, got %v", i, test.data, test.want, got)
+		}
+	}
+}
@@ -0,0 +1,289 @@
+// Copyright 2012 Google, Inc. All rights reserved.
+//
+// Use of this source code is governed by a BSD-style license
+// that can be found in the LICENSE file in the root of the source
+// tree.
+
+// Package reader provides an implementation for reassembly.Stream which
+// presents the caller with one io.Reader per half-connection.
+//
+// It is the reassembly counterpart of the tcpassembly/tcpreader package: the
+// reassembly package hands reassembled data to a Stream through a
+// ScatterGather, which is convenient for zero-copy processing but not usable
+// by most Go libraries.  A ReaderStream turns each direction of a TCP
+// connection into an io.Reader, so that the data can be fed to net/http,
+// bufio, encoding/binary, etc.:
+//
+//  type httpStreamFactory struct{}
+//  func (f *httpStreamFactory) New(n, t gopacket.Flow, tcp *layers.TCP, ac reassembly.AssemblerContext) reassembly.Stream {
+//  	s := reader.NewReaderStream(reader.ReaderStreamOptions{})
+//  	go printRequests(s.Reader(reassembly.TCPDirClientToServer))
+//  	go reader.DiscardBytesToEOF(s.Reader(reassembly.TCPDirServerToClient))
+//  	return s
+//  }
+//  func printRequests(r *reader.HalfReader) {
+//  	buf := bufio.NewReader(r)
+//  	for {
+//  		req, err := http.ReadRequest(buf)
+//  		if err == io.EOF {
+//  			return
+//  		} else if err != nil {
+//  			log.Println("Error parsing HTTP requests:", err)
+//  			continue
+//  		}
+//  		fmt.Println(r.CaptureInfo().Timestamp, "HTTP REQUEST:", req)
+//  		fmt.Println("Body contains", reader.DiscardBytesToEOF(req.Body), "bytes")
+//  	}
+//  }
+//
+// Data is not copied: ReassembledSG blocks until the bytes it was given have
+// been read, which applies backpressure on the Assembler.  The flip side is
+// that callers MUST read ALL BYTES from BOTH directions (or Close the readers
+// they are not interested in), otherwise reassembly will block.
+package reader
+
+import (
+	"fmt"
+	"io"
+
+	"github.com/davidsonff/gopacket"
+	"github.com/davidsonff/gopacket/layers"
+	"github.com/davidsonff/gopacket/reassembly"
+)
+
+var discardBuffer = make([]byte, 4096)
+
+// DiscardBytesToFirstError will read in all bytes up to the first error
+// reported by the given reader, then return the number of bytes discarded
+// and the error encountered.
+func DiscardBytesToFirstError(r io.Reader) (discarded int, err error) {
+	for {
+		n, e := r.Read(discardBuffer)
+		discarded += n
+		if e != nil {
+			return discarded, e
+		}
+	}
+}
+
+// DiscardBytesToEOF will read in all bytes from a Reader until it
+// encounters an io.EOF, then return the number of bytes.  Be careful
+// of this... if used on a Reader that returns a non-io.EOF error
+// consistently, this will loop forever discarding that error while
+// it waits for an EOF.
+func DiscardBytesToEOF(r io.Reader) (discarded int) {
+	for {
+		n, e := DiscardBytesToFirstError(r)
+		discarded += n
+		if e == io.EOF {
+			return
+		}
+	}
+}
+
+// DataLostError is returned by HalfReader.Read when LossErrors is set and
+// the next bytes of the stream are not contiguous with the previous ones.
+type DataLostError struct {
+	// Direction of the half-connection which lost data.
+	Direction reassembly.TCPFlowDirection
+	// Lost is the number of bytes missing from the stream.
+	Lost int
+	// CaptureInfo of the first packet following the gap.
+	CaptureInfo gopacket.CaptureInfo
+}
+
+func (e *DataLostError) Error() string {
+	return fmt.Sprintf("%s: lost %d bytes", e.Direction, e.Lost)
+}
+
+// GapFunc is called when a gap is found in a half-connection.  It is called
+// from the goroutine calling Read, just before the bytes following the gap are
+// returned.
+type GapFunc func(dir reassembly.TCPFlowDirection, lost int, ci gopacket.CaptureInfo)
+
+// ReaderStreamOptions provides user-settable options for a ReaderStream.
+type ReaderStreamOptions struct {
+	// LossErrors determines whether Read returns a *DataLostError whenever
+	// it determines data has been lost.
+	LossErrors bool
+	// OnGap, if non-nil, is called whenever data has been lost.
+	OnGap GapFunc
+	// CheckState enables a reassembly.TCPSimpleFSM in Accept, rejecting
+	// packets which are invalid with respect to the TCP state machine.
+	CheckState bool
+	// FSMOptions are passed to the TCPSimpleFSM if CheckState is set.
+	FSMOptions reassembly.TCPSimpleFSMOptions
+}
+
+// ReaderStream implements reassembly.Stream, and provides an io.Reader for
+// each direction of the connection through its Reader method.
+type ReaderStream struct {
+	ReaderStreamOptions
+	halves   [2]HalfReader
+	fsm      *reassembly.TCPSimpleFSM
+	complete bool
+}
+
+// NewReaderStream returns a new ReaderStream object.
+func NewReaderStream(options ReaderStreamOptions) *ReaderStream {
+	r := &ReaderStream{ReaderStreamOptions: options}
+	for i, dir := range []reassembly.TCPFlowDirection{reassembly.TCPDirClientToServer, reassembly.TCPDirServerToClient} {
+		r.halves[i] = HalfReader{
+			dir:         dir,
+			options:     &r.ReaderStreamOptions,
+			reassembled: make(chan chunk),
+			done:        make(chan struct{}),
+		}
+	}
+	if options.CheckState {
+		r.fsm = reassembly.NewTCPSimpleFSM(options.FSMOptions)
+	}
+	return r
+}
+
+// Reader returns the io.Reader for the given direction.
+func (r *ReaderStream) Reader(dir reassembly.TCPFlowDirection) *HalfReader {
+	if dir == reassembly.TCPDirClientToServer {
+		return &r.halves[0]
+	}
+	return &r.halves[1]
+}
+
+// Accept implements reassembly.Stream's Accept function.
+func (r *ReaderStream) Accept(tcp *layers.TCP, ci gopacket.CaptureInfo, dir reassembly.TCPFlowDirection, nextSeq reassembly.Sequence, start *bool, ac reassembly.AssemblerContext) bool {
+	if r.fsm != nil {
+		return r.fsm.CheckState(tcp, dir)
+	}
+	return true
+}
+
+// ReassembledSG implements reassembly.Stream's ReassembledSG function.  It
+// blocks until all the given bytes have been read from the corresponding
+// HalfReader.
+func (r *ReaderStream) ReassembledSG(sg reassembly.ScatterGather, ac reassembly.AssemblerContext) {
+	dir, _, _, skip := sg.Info()
+	length, _ := sg.Lengths()
+	if length == 0 && skip <= 0 {
+		return
+	}
+	h := r.Reader(dir)
+	h.reassembled <- chunk{sg: sg, bytes: sg.Fetch(length), skip: skip}
+	<-h.done
+}
+
+// ReassemblyComplete implements reassembly.Stream's ReassemblyComplete
+// function.  Both readers will return io.EOF once their remaining bytes have
+// been read.
+func (r *ReaderStream) ReassemblyComplete(ac reassembly.AssemblerContext) bool {
+	if !r.complete {
+		r.complete = true
+		for i := range r.halves {
+			close(r.halves[i].reassembled)
+		}
+	}
+	return true
+}
+
+// chunk is the data of a single ReassembledSG call.
+type chunk struct {
+	sg     reassembly.ScatterGather
+	bytes  []byte
+	offset int
+	skip   int
+}
+
+// HalfReader is the io.Reader for one direction of a ReaderStream.
+type HalfReader struct {
+	dir         reassembly.TCPFlowDirection
+	options     *ReaderStreamOptions
+	reassembled chan chunk
+	done        chan struct{}
+	current     chunk
+	pending     bool // current has been received and not acknowledged yet
+	closed      bool
+	ci          gopacket.CaptureInfo
+}
+
+// Direction returns the direction of the half-connection read by h.
+func (h *HalfReader) Direction() reassembly.TCPFlowDirection {
+	return h.dir
+}
+
+// CaptureInfo returns the CaptureInfo of the packet which carried the first
+// byte returned by the last call to Read.
+func (h *HalfReader) CaptureInfo() gopacket.CaptureInfo {
+	return h.ci
+}
+
+// next acknowledges the current chunk, if any, and waits for the next one.
+func (h *HalfReader) next() {
+	if h.pending {
+		h.pending = false
+		h.done <- struct{}{}
+	}
+	c, ok := <-h.reassembled
+	if !ok {
+		h.closed = true
+		h.current = chunk{}
+		return
+	}
+	h.current = c
+	h.pending = true
+}
+
+// Read implements io.Reader's Read function.
+// Given a byte slice, it will either copy a non-zero number of bytes into
+// that slice and return the number of bytes and a nil error, return a
+// *DataLostError (if LossErrors is set), or leave slice p as is and return
+// 0, io.EOF.
+func (h *HalfReader) Read(p []byte) (int, error) {
+	if h.reassembled == nil {
+		panic("HalfReader not created via NewReaderStream")
+	}
+	for !h.closed && h.current.offset == len(h.current.bytes) {
+		h.next()
+		if h.closed {
+			break
+		}
+		if h.current.skip > 0 {
+			lost := h.current.skip
+			h.current.skip = 0
+			ci := h.current.sg.CaptureInfo(0)
+			if h.options.OnGap != nil {
+				h.options.OnGap(h.dir, lost, ci)
+			}
+			if h.options.LossErrors {
+				return 0, &DataLostError{Direction: h.dir, Lost: lost, CaptureInfo: ci}
+			}
+		}
+	}
+	if h.closed {
+		return 0, io.EOF
+	}
+	h.ci = h.current.sg.CaptureInfo(h.current.offset)
+	n := copy(p, h.current.bytes[h.current.offset:])
+	h.current.offset += n
+	return n, nil
+}
+
+// Close implements io.Closer's Close function, making HalfReader an
+// io.ReadCloser.  It discards all remaining bytes of this direction in a
+// manner that's safe for the assembler (IE: it doesn't block).
+func (h *HalfReader) Close() error {
+	if h.closed {
+		return nil
+	}
+	h.closed = true
+	pending := h.pending
+	h.pending = false
+	h.current = chunk{}
+	go func() {
+		if pending {
+			h.done <- struct{}{}
+		}
+		for range h.reassembled {
+			h.done <- struct{}{}
+		}
+	}()
+	return nil
+}
@@ -0,0 +1,152 @@
+// Copyright 2012 Google, Inc. All rights reserved.
+//
+// Use of this source code is governed by a BSD-style license
+// that can be found in the LICENSE file in the root of the source
+// tree.
+
+package reader
+
+import (
+	"bytes"
+	"io"
+	"io/ioutil"
+	"net"
+	"testing"
+	"time"
+
+	"github.com/davidsonff/gopacket"
+	"github.com/davidsonff/gopacket/layers"
+	"github.com/davidsonff/gopacket/reassembly"
+)
+
+var netFlow gopacket.Flow
+
+func init() {
+	netFlow, _ = gopacket.FlowFromEndpoints(
+		layers.NewIPEndpoint(net.IP{1, 2, 3, 4}),
+		layers.NewIPEndpoint(net.IP{5, 6, 7, 8}))
+}
+
+type testContext struct {
+	ci gopacket.CaptureInfo
+}
+
+func (c *testContext) GetCaptureInfo() gopacket.CaptureInfo {
+	return c.ci
+}
+
+type testFactory struct {
+	options ReaderStreamOptions
+	streams chan *ReaderStream
+}
+
+func (f *testFactory) New(a, b gopacket.Flow, tcp *layers.TCP, ac reassembly.AssemblerContext) reassembly.Stream {
+	s := NewReaderStream(f.options)
+	f.streams <- s
+	return s
+}
+
+func assemble(options ReaderStreamOptions, in []layers.TCP) *ReaderStream {
+	f := &testFactory{options: options, streams: make(chan *ReaderStream, 1)}
+	a := reassembly.NewAssembler(reassembly.NewStreamPool(f))
+	go func() {
+		for i := range in {
+			in[i].SetInternalPortsForTesting()
+			ctx := &testContext{ci: gopacket.CaptureInfo{Timestamp: time.Unix(int64(i), 0)}}
+			flow := netFlow
+			if in[i].SrcPort == 2 {
+				flow = netFlow.Reverse()
+			}
+			a.AssembleWithContext(flow, &in[i], ctx)
+		}
+		a.FlushAll()
+	}()
+	return <-f.streams
+}
+
+func TestReadBothDirections(t *testing.T) {
+	s := assemble(ReaderStreamOptions{}, []layers.TCP{
+		{SYN: true, SrcPort: 1, DstPort: 2, Seq: 1000},
+		{SYN: true, ACK: true, SrcPort: 2, DstPort: 1, Seq: 5000, Ack: 1001},
+		{SrcPort: 1, DstPort: 2, Seq: 1001, BaseLayer: layers.BaseLayer{Payload: []byte{1, 2, 3}}},
+		{SrcPort: 2, DstPort: 1, Seq: 5001, BaseLayer: layers.BaseLayer{Payload: []byte{4, 5}}},
+		{SrcPort: 1, DstPort: 2, Seq: 1004, BaseLayer: layers.BaseLayer{Payload: []byte{6}}},
+		{FIN: true, SrcPort: 1, DstPort: 2, Seq: 1005},
+		{FIN: true, SrcPort: 2, DstPort: 1, Seq: 5003},
+	})
+	c2s := make(chan []byte)
+	go func() {
+		b, _ := ioutil.ReadAll(s.Reader(reassembly.TCPDirClientToServer))
+		c2s <- b
+	}()
+	s2c, err := ioutil.ReadAll(s.Reader(reassembly.TCPDirServerToClient))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if want := []byte{4, 5}; !bytes.Equal(s2c, want) {
+		t.Errorf("server->client: want %v, got %v", want, s2c)
+	}
+	if got, want := <-c2s, []byte{1, 2, 3, 6}; !bytes.Equal(got, want) {
+		t.Errorf("client->server: want %v, got %v", want, got)
+	}
+}
+
+func TestReadCaptureInfo(t *testing.T) {
+	s := assemble(ReaderStreamOptions{}, []layers.TCP{
+		{SYN: true, SrcPort: 1, DstPort: 2, Seq: 1000},
+		{SrcPort: 1, DstPort: 2, Seq: 1001, BaseLayer: layers.BaseLayer{Payload: []byte{1, 2}}},
+		{SrcPort: 1, DstPort: 2, Seq: 1003, BaseLayer: layers.BaseLayer{Payload: []byte{3, 4}}},
+		{FIN: true, SrcPort: 1, DstPort: 2, Seq: 1005},
+	})
+	r := s.Reader(reassembly.TCPDirClientToServer)
+	defer s.Reader(reassembly.TCPDirServerToClient).Close()
+	buf := make([]byte, 1)
+	for i, want := range []int64{1, 1, 2, 2} {
+		if _, err := r.Read(buf); err != nil {
+			t.Fatalf("read %d: %v", i, err)
+		}
+		if got := r.CaptureInfo().Timestamp.Unix(); got != want {
+			t.Errorf("read %d: want timestamp %d, got %d", i, want, got)
+		}
+	}
+	if _, err := r.Read(buf); err != io.EOF {
+		t.Errorf("want io.EOF, got %v", err)
+	}
+}
+
+func TestReadLoss(t *testing.T) {
+	var gaps []int
+	s := assemble(ReaderStreamOptions{
+		LossErrors: true,
+		OnGap: func(dir reassembly.TCPFlowDirection, lost int, ci gopacket.CaptureInfo) {
+			gaps = append(gaps, lost)
+		},
+	}, []layers.TCP{
+		{SYN: true, SrcPort: 1, DstPort: 2, Seq: 1000},
+		{SrcPort: 1, DstPort: 2, Seq: 1001, BaseLayer: layers.BaseLayer{Payload: []byte{1, 2}}},
+		{SrcPort: 1, DstPort: 2, Seq: 1010, BaseLayer: layers.BaseLayer{Payload: []byte{3, 4}}},
+	})
+	r := s.Reader(reassembly.TCPDirClientToServer)
+	defer s.Reader(reassembly.TCPDirServerToClient).Close()
+	buf := make([]byte, 10)
+	if n, err := r.Read(buf); err != nil || !bytes.Equal(buf[:n], []byte{1, 2}) {
+		t.Fatalf("first read: got %v, %v", buf[:n], err)
+	}
+	_, err := r.Read(buf)
+	lost, ok := err.(*DataLostError)
+	if !ok {
+		t.Fatalf("want *DataLostError, got %v", err)
+	}
+	if lost.Lost != 7 || lost.CaptureInfo.Timestamp.Unix() != 2 {
+		t.Errorf("unexpected error %+v", lost)
+	}
+	if n, err := r.Read(buf); err != nil || !bytes.Equal(buf[:n], []byte{3, 4}) {
+		t.Fatalf("read after gap: got %v, %v", buf[:n], err)
+	}
+	if _, err := r.Read(buf); err != io.EOF {
+		t.Errorf("want io.EOF, got %v", err)
+	}
+	if len(gaps) != 1 || gaps[0] != 7 {
+		t.Errorf("want one gap of 7 bytes, got %v", gaps)
+	}
+}
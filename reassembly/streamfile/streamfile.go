@@ -0,0 +1,324 @@
+// Copyright 2012 Google, Inc. All rights reserved.
+//
+// Use of this source code is governed by a BSD-style license
+// that can be found in the LICENSE file in the root of the source
+// tree.
+
+// Package streamfile provides a reassembly.StreamFactory which writes each
+// direction of every TCP connection to its own file, like tcpflow does.
+//
+// Files are named after the connection start time and the 4-tuple of the
+// direction, for example:
+//
+//  20240102T030405.000000000Z_10.0.0.1.51234-10.0.0.2.80
+//  20240102T030405.000000000Z_10.0.0.2.80-10.0.0.1.51234
+//
+// and can be sharded in sub-directories using Options.Shard.  Each data file
+// gets a sidecar metadata file (same name, with a ".json" suffix) recording
+// the timestamps, the gaps found in the stream and the reason the connection
+// was closed.  The same metadata is also given to Options.OnClose.  Directions
+// which carried no data have no data file, but still get their metadata.
+//
+// Usage:
+//
+//  factory := streamfile.NewFactory(streamfile.Options{
+//  	Dir:      "/var/flows",
+//  	Shard:    streamfile.ShardByTime("2006/01/02/15"),
+//  	MaxBytes: 100 << 20,
+//  })
+//  assembler := reassembly.NewAssembler(reassembly.NewStreamPool(factory))
+//  // feed packets, call FlushCloseOlderThan regularly, and FlushAll at the end.
+package streamfile
+
+import (
+	"bufio"
+	"encoding/json"
+	"fmt"
+	"os"
+	"path/filepath"
+	"time"
+
+	"github.com/davidsonff/gopacket"
+	"github.com/davidsonff/gopacket/layers"
+	"github.com/davidsonff/gopacket/reassembly"
+)
+
+// CloseReason tells why a connection was closed.
+type CloseReason string
+
+// CloseReason values.
+const (
+	// CloseFIN is used when both directions sent a FIN.
+	CloseFIN CloseReason = "fin"
+	// CloseRST is used when a RST was seen.
+	CloseRST CloseReason = "rst"
+	// CloseTimeout is used when the connection was closed by a flush.
+	CloseTimeout CloseReason = "timeout"
+)
+
+// Gap records bytes missing from a stream.
+type Gap struct {
+	// Offset in the stream where the missing bytes would be.  It is the
+	// offset in the data file, unless the file was truncated.
+	Offset int64 `json:"offset"`
+	// Length is the number of missing bytes.
+	Length int `json:"length"`
+}
+
+// Metadata describes the file written for one direction of a connection.
+type Metadata struct {
+	Path    string `json:"path"`
+	Src     string `json:"src"`
+	SrcPort string `json:"src_port"`
+	Dst     string `json:"dst"`
+	DstPort string `json:"dst_port"`
+	// Direction of the file, relative to the first packet of the connection.
+	Direction string `json:"direction"`
+	// ConnStart is the timestamp of the first packet of the connection.
+	ConnStart time.Time `json:"conn_start"`
+	// First and Last are the timestamps of the first and last packets which
+	// carried data in this direction.
+	First time.Time `json:"first"`
+	Last  time.Time `json:"last"`
+	// Bytes is the size of the data file.
+	Bytes int64 `json:"bytes"`
+	// Truncated is the number of bytes not written because of MaxBytes.
+	Truncated   int64       `json:"truncated"`
+	Gaps        []Gap       `json:"gaps"`
+	CloseReason CloseReason `json:"close_reason"`
+	// Error is the first error encountered writing the file, if any.
+	Error string `json:"error,omitempty"`
+}
+
+// Options controls the behavior of a Factory.
+type Options struct {
+	// Dir is the directory files are written in.
+	Dir string
+	// Shard, if non-nil, returns the sub-directory of Dir the files of a
+	// connection are written in.
+	Shard func(start time.Time, netFlow, tcpFlow gopacket.Flow) string
+	// MaxBytes limits the size of each data file.  If <= 0, it is ignored.
+	MaxBytes int64
+	// NoSidecar disables the writing of the metadata files.
+	NoSidecar bool
+	// OnClose, if non-nil, is called with the metadata of each direction
+	// once the connection is complete, even if no data file was written.
+	OnClose func(*Metadata)
+	// OnError, if non-nil, is called on errors creating or writing files.
+	OnError func(error)
+	// Accept, if non-nil, is called by the streams' Accept method.
+	Accept func(tcp *layers.TCP, ci gopacket.CaptureInfo, dir reassembly.TCPFlowDirection, nextSeq reassembly.Sequence, start *bool, ac reassembly.AssemblerContext) bool
+}
+
+// ShardByTime returns a function for Options.Shard which builds the
+// sub-directory from the connection start time formatted with layout, e.g.
+// "2006/01/02/15" for one directory per hour.
+func ShardByTime(layout string) func(time.Time, gopacket.Flow, gopacket.Flow) string {
+	return func(start time.Time, netFlow, tcpFlow gopacket.Flow) string {
+		return filepath.FromSlash(start.UTC().Format(layout))
+	}
+}
+
+// Factory implements reassembly.StreamFactory, writing streams to files.
+type Factory struct {
+	Options
+}
+
+// NewFactory creates a new Factory.
+func NewFactory(options Options) *Factory {
+	return &Factory{Options: options}
+}
+
+// New implements reassembly.StreamFactory.
+func (f *Factory) New(netFlow, tcpFlow gopacket.Flow, tcp *layers.TCP, ac reassembly.AssemblerContext) reassembly.Stream {
+	start := ac.GetCaptureInfo().Timestamp
+	dir := f.Dir
+	if f.Shard != nil {
+		dir = filepath.Join(dir, f.Shard(start, netFlow, tcpFlow))
+	}
+	s := &stream{f: f}
+	for i, flows := range [2][2]gopacket.Flow{{netFlow, tcpFlow}, {netFlow.Reverse(), tcpFlow.Reverse()}} {
+		src, dst := flows[0].Endpoints()
+		sport, dport := flows[1].Endpoints()
+		h := &s.halves[i]
+		h.Metadata = Metadata{
+			Src: src.String(), SrcPort: sport.String(),
+			Dst: dst.String(), DstPort: dport.String(),
+			Direction: reassembly.TCPFlowDirection(i == 1).String(),
+			ConnStart: start,
+			Gaps:      []Gap{},
+		}
+		h.Path = filepath.Join(dir, fmt.Sprintf("%s_%s.%s-%s.%s",
+			start.UTC().Format("20060102T150405.000000000Z"), h.Src, h.SrcPort, h.Dst, h.DstPort))
+	}
+	return s
+}
+
+func (f *Factory) error(err error) {
+	if f.OnError != nil {
+		f.OnError(err)
+	}
+}
+
+// half is the file of one direction.
+type half struct {
+	Metadata
+	file *os.File
+	w    *bufio.Writer
+	fin  bool
+	err  error
+}
+
+func (h *half) setError(f *Factory, err error) {
+	if h.err == nil {
+		h.err = err
+		h.Error = err.Error()
+	}
+	f.error(err)
+}
+
+func (h *half) write(f *Factory, data []byte) {
+	if f.MaxBytes > 0 && h.Bytes+int64(len(data)) > f.MaxBytes {
+		keep := f.MaxBytes - h.Bytes
+		h.Truncated += int64(len(data)) - keep
+		data = data[:keep]
+	}
+	if len(data) == 0 || h.err != nil {
+		return
+	}
+	if h.file == nil {
+		if err := os.MkdirAll(filepath.Dir(h.Path), 0755); err != nil {
+			h.setError(f, err)
+			return
+		}
+		file, err := os.Create(h.Path)
+		if err != nil {
+			h.setError(f, err)
+			return
+		}
+		h.file = file
+		h.w = bufio.NewWriter(file)
+	}
+	n, err := h.w.Write(data)
+	h.Bytes += int64(n)
+	if err != nil {
+		h.setError(f, err)
+	}
+}
+
+// close closes the data file, if any.  The metadata is written and given to
+// OnClose even if no data file was created, so that the gaps, errors and
+// close reason of every direction are recorded.
+func (h *half) close(f *Factory, reason CloseReason) {
+	if h.file != nil {
+		if err := h.w.Flush(); err != nil {
+			h.setError(f, err)
+		}
+		if err := h.file.Close(); err != nil {
+			h.setError(f, err)
+		}
+	}
+	h.CloseReason = reason
+	if !f.NoSidecar {
+		if err := h.writeSidecar(); err != nil {
+			h.setError(f, err)
+		}
+	}
+	if f.OnClose != nil {
+		f.OnClose(&h.Metadata)
+	}
+}
+
+func (h *half) writeSidecar() error {
+	data, err := json.MarshalIndent(&h.Metadata, "", "  ")
+	if err != nil {
+		return err
+	}
+	if h.file == nil {
+		// the directory is created with the data file
+		if err := os.MkdirAll(filepath.Dir(h.Path), 0755); err != nil {
+			return err
+		}
+	}
+	return writeFile(h.Path+".json", append(data, '\n'))
+}
+
+func writeFile(name string, data []byte) error {
+	f, err := os.Create(name)
+	if err != nil {
+		return err
+	}
+	if _, err := f.Write(data); err != nil {
+		f.Close()
+		return err
+	}
+	return f.Close()
+}
+
+// stream implements reassembly.Stream for a Factory.
+type stream struct {
+	f      *Factory
+	halves [2]half
+	rst    bool
+	done   bool
+}
+
+func (s *stream) half(dir reassembly.TCPFlowDirection) *half {
+	if dir == reassembly.TCPDirClientToServer {
+		return &s.halves[0]
+	}
+	return &s.halves[1]
+}
+
+func (s *stream) Accept(tcp *layers.TCP, ci gopacket.CaptureInfo, dir reassembly.TCPFlowDirection, nextSeq reassembly.Sequence, start *bool, ac reassembly.AssemblerContext) bool {
+	if s.f.Accept != nil && !s.f.Accept(tcp, ci, dir, nextSeq, start, ac) {
+		return false
+	}
+	if tcp.RST {
+		s.rst = true
+	}
+	if tcp.FIN {
+		s.half(dir).fin = true
+	}
+	return true
+}
+
+func (s *stream) ReassembledSG(sg reassembly.ScatterGather, ac reassembly.AssemblerContext) {
+	dir, _, _, skip := sg.Info()
+	length, _ := sg.Lengths()
+	h := s.half(dir)
+	if skip > 0 {
+		h.Gaps = append(h.Gaps, Gap{Offset: h.Bytes + h.Truncated, Length: skip})
+	}
+	if length == 0 {
+		return
+	}
+	ts := sg.CaptureInfo(0).Timestamp
+	if h.First.IsZero() {
+		h.First = ts
+	}
+	if last := sg.CaptureInfo(length - 1).Timestamp; last.After(ts) {
+		ts = last
+	}
+	if ts.After(h.Last) {
+		h.Last = ts
+	}
+	h.write(s.f, sg.Fetch(length))
+}
+
+func (s *stream) ReassemblyComplete(ac reassembly.AssemblerContext) bool {
+	if s.done {
+		return true
+	}
+	s.done = true
+	reason := CloseTimeout
+	if s.rst {
+		reason = CloseRST
+	} else if s.halves[0].fin && s.halves[1].fin {
+		reason = CloseFIN
+	}
+	for i := range s.halves {
+		s.halves[i].close(s.f, reason)
+	}
+	return true
+}
@@ -0,0 +1,178 @@
+// Copyright 2012 Google, Inc. All rights reserved.
+//
+// Use of this source code is governed by a BSD-style license
+// that can be found in the LICENSE file in the root of the source
+// tree.
+
+package streamfile
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"net"
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+	"time"
+
+	"github.com/davidsonff/gopacket"
+	"github.com/davidsonff/gopacket/layers"
+	"github.com/davidsonff/gopacket/reassembly"
+)
+
+var netFlow gopacket.Flow
+
+func init() {
+	netFlow, _ = gopacket.FlowFromEndpoints(
+		layers.NewIPEndpoint(net.IP{1, 2, 3, 4}),
+		layers.NewIPEndpoint(net.IP{5, 6, 7, 8}))
+}
+
+type testContext struct {
+	ci gopacket.CaptureInfo
+}
+
+func (c *testContext) GetCaptureInfo() gopacket.CaptureInfo {
+	return c.ci
+}
+
+func TestWriteStreams(t *testing.T) {
+	dir, err := ioutil.TempDir("", "streamfile")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	var closed []*Metadata
+	f := NewFactory(Options{
+		Dir:      dir,
+		Shard:    ShardByTime("2006/01"),
+		MaxBytes: 8,
+		OnClose:  func(m *Metadata) { closed = append(closed, m) },
+		OnError:  func(err error) { t.Error(err) },
+	})
+	a := reassembly.NewAssembler(reassembly.NewStreamPool(f))
+	base := time.Date(2020, 3, 4, 5, 6, 7, 0, time.UTC)
+	for i, tcp := range []layers.TCP{
+		{SYN: true, SrcPort: 1, DstPort: 2, Seq: 1000},
+		{SYN: true, ACK: true, SrcPort: 2, DstPort: 1, Seq: 5000},
+		{SrcPort: 1, DstPort: 2, Seq: 1001, BaseLayer: layers.BaseLayer{Payload: []byte("hello")}},
+		{SrcPort: 2, DstPort: 1, Seq: 5001, BaseLayer: layers.BaseLayer{Payload: []byte("world")}},
+		{SrcPort: 1, DstPort: 2, Seq: 1010, BaseLayer: layers.BaseLayer{Payload: []byte("again")}},
+		{FIN: true, SrcPort: 2, DstPort: 1, Seq: 5006},
+		{RST: true, SrcPort: 1, DstPort: 2, Seq: 1015},
+	} {
+		flow := netFlow
+		if tcp.SrcPort == 2 {
+			flow = netFlow.Reverse()
+		}
+		tcp.SetInternalPortsForTesting()
+		ctx := &testContext{ci: gopacket.CaptureInfo{Timestamp: base.Add(time.Duration(i) * time.Second)}}
+		a.AssembleWithContext(flow, &tcp, ctx)
+	}
+	a.FlushAll()
+
+	if len(closed) != 2 {
+		t.Fatalf("want 2 closed files, got %d", len(closed))
+	}
+	c2s := filepath.Join(dir, "2020", "03", "20200304T050607.000000000Z_1.2.3.4.1-5.6.7.8.2")
+	want := &Metadata{
+		Path: c2s,
+		Src:  "1.2.3.4", SrcPort: "1",
+		Dst: "5.6.7.8", DstPort: "2",
+		Direction:   "client->server",
+		ConnStart:   base,
+		First:       base.Add(2 * time.Second),
+		Last:        base.Add(4 * time.Second),
+		Bytes:       8,
+		Truncated:   2,
+		Gaps:        []Gap{{Offset: 5, Length: 4}},
+		CloseReason: CloseRST,
+	}
+	if !reflect.DeepEqual(closed[0], want) {
+		t.Errorf("metadata:\nwant %+v\n got %+v", want, closed[0])
+	}
+	if data, err := ioutil.ReadFile(c2s); err != nil || string(data) != "helloaga" {
+		t.Errorf("client->server file: got %q, %v", data, err)
+	}
+	s2c := filepath.Join(dir, "2020", "03", "20200304T050607.000000000Z_5.6.7.8.2-1.2.3.4.1")
+	if data, err := ioutil.ReadFile(s2c); err != nil || string(data) != "world" {
+		t.Errorf("server->client file: got %q, %v", data, err)
+	}
+	var sidecar Metadata
+	data, err := ioutil.ReadFile(c2s + ".json")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := json.Unmarshal(data, &sidecar); err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(&sidecar, want) {
+		t.Errorf("sidecar:\nwant %+v\n got %+v", want, sidecar)
+	}
+}
+
+func TestCloseWithoutData(t *testing.T) {
+	dir, err := ioutil.TempDir("", "streamfile")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	var closed []*Metadata
+	f := NewFactory(Options{
+		Dir:     dir,
+		OnClose: func(m *Metadata) { closed = append(closed, m) },
+		OnError: func(err error) { t.Error(err) },
+	})
+	a := reassembly.NewAssembler(reassembly.NewStreamPool(f))
+	base := time.Date(2020, 3, 4, 5, 6, 7, 0, time.UTC)
+	for i, tcp := range []layers.TCP{
+		{SYN: true, SrcPort: 1, DstPort: 2, Seq: 1000},
+		{SYN: true, ACK: true, SrcPort: 2, DstPort: 1, Seq: 5000},
+		{SrcPort: 1, DstPort: 2, Seq: 1001, BaseLayer: layers.BaseLayer{Payload: []byte("hello")}},
+		{FIN: true, SrcPort: 1, DstPort: 2, Seq: 1006},
+		{FIN: true, SrcPort: 2, DstPort: 1, Seq: 5001},
+	} {
+		flow := netFlow
+		if tcp.SrcPort == 2 {
+			flow = netFlow.Reverse()
+		}
+		tcp.SetInternalPortsForTesting()
+		ctx := &testContext{ci: gopacket.CaptureInfo{Timestamp: base.Add(time.Duration(i) * time.Second)}}
+		a.AssembleWithContext(flow, &tcp, ctx)
+	}
+	a.FlushAll()
+
+	if len(closed) != 2 {
+		t.Fatalf("want 2 closed directions, got %d", len(closed))
+	}
+	s2c := filepath.Join(dir, "20200304T050607.000000000Z_5.6.7.8.2-1.2.3.4.1")
+	want := &Metadata{
+		Path: s2c,
+		Src:  "5.6.7.8", SrcPort: "2",
+		Dst: "1.2.3.4", DstPort: "1",
+		Direction:   "server->client",
+		ConnStart:   base,
+		Gaps:        []Gap{},
+		CloseReason: CloseFIN,
+	}
+	if !reflect.DeepEqual(closed[1], want) {
+		t.Errorf("metadata:\nwant %+v\n got %+v", want, closed[1])
+	}
+	if _, err := os.Stat(s2c); !os.IsNotExist(err) {
+		t.Errorf("server->client data file: want no file, got %v", err)
+	}
+	var sidecar Metadata
+	data, err := ioutil.ReadFile(s2c + ".json")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := json.Unmarshal(data, &sidecar); err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(&sidecar, want) {
+		t.Errorf("sidecar:\nwant %+v\n got %+v", want, sidecar)
+	}
+}
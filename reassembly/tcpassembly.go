@@ -17,6 +17,9 @@
 // track of all current Streams being reassembled, so multiple Assemblers may
 // run at once to assemble packets while taking advantage of multiple cores.
 //
+// UDPAssembler provides the same programming model for UDP: it groups
+// datagrams by conversation and passes them to a user-defined UDPStream.
+//
 // TODO: Add simplest example
 package reassembly
 
@@ -511,7 +514,8 @@ type AssemblerOptions struct {
 // get around this by creating multiple assemblers that share a StreamPool.  In
 // that case, each individual stream will still be handled serially (each stream
 // has an individual mutex associated with it), however multiple assemblers can
-// assemble different connections concurrently.
+// assemble different connections concurrently.  ConcurrentAssembler does just
+// that, sharding packets between its own worker goroutines.
 //
 // The Assembler provides (hopefully) fast TCP stream re-assembly for sniffing
 // applications written in Go.  The Assembler uses the following methods to be
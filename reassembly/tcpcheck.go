@@ -244,3 +244,58 @@ func (t *TCPSimpleFSM) CheckState(tcp *layers.TCP, dir TCPFlowDirection) bool {
 	}
 	return false
 }
+
+// MarshalBinary implements encoding.BinaryMarshaler, so that the state
+// machine can be persisted by a CheckpointStream.
+func (t *TCPSimpleFSM) MarshalBinary() ([]byte, error) {
+	var b [3]byte
+	if t.dir == TCPDirServerToClient {
+		b[0] = 1
+	}
+	b[1] = byte(t.state)
+	if t.options.SupportMissingEstablishment {
+		b[2] = 1
+	}
+	return b[:], nil
+}
+
+// UnmarshalBinary implements encoding.BinaryUnmarshaler.
+func (t *TCPSimpleFSM) UnmarshalBinary(data []byte) error {
+	if len(data) != 3 || data[1] > TCPStateReset {
+		return ErrBadCheckpoint
+	}
+	t.dir = TCPFlowDirection(data[0] == 1)
+	t.state = int(data[1])
+	t.options.SupportMissingEstablishment = data[2] == 1
+	return nil
+}
+
+// MarshalBinary implements encoding.BinaryMarshaler, so that the options
+// seen so far can be persisted by a CheckpointStream.
+func (t *TCPOptionCheck) MarshalBinary() ([]byte, error) {
+	b := make([]byte, 0, 24)
+	for _, o := range t.options {
+		b = append(b, make([]byte, 12)...)
+		s := b[len(b)-12:]
+		binary.BigEndian.PutUint32(s[0:], uint32(o.mss))
+		binary.BigEndian.PutUint32(s[4:], uint32(int32(o.scale)))
+		binary.BigEndian.PutUint32(s[8:], uint32(o.receiveWindow))
+	}
+	return b, nil
+}
+
+// UnmarshalBinary implements encoding.BinaryUnmarshaler.
+func (t *TCPOptionCheck) UnmarshalBinary(data []byte) error {
+	if len(data) != 24 {
+		return ErrBadCheckpoint
+	}
+	for i := range t.options {
+		s := data[i*12:]
+		t.options[i] = tcpStreamOptions{
+			mss:           int(binary.BigEndian.Uint32(s[0:])),
+			scale:         int(int32(binary.BigEndian.Uint32(s[4:]))),
+			receiveWindow: uint(binary.BigEndian.Uint32(s[8:])),
+		}
+	}
+	return nil
+}
@@ -0,0 +1,268 @@
+// Copyright 2012 Google, Inc. All rights reserved.
+//
+// Use of this source code is governed by a BSD-style license
+// that can be found in the LICENSE file in the root of the source
+// tree.
+
+package reassembly
+
+import (
+	"log"
+	"sync"
+	"time"
+
+	"github.com/davidsonff/gopacket"
+	"github.com/davidsonff/gopacket/layers"
+)
+
+/*
+ * UDP conversations
+ */
+
+// UDPStream is implemented by the caller to handle the datagrams of a UDP
+// conversation, i.e. all the datagrams exchanged, in both directions,
+// between two UDP endpoints.  Callers create a UDPStreamFactory, then
+// UDPStreamPool uses it to create a new UDPStream for every conversation.
+//
+// UDPAssembler will, in order:
+//    1) Create the stream via UDPStreamFactory.New
+//    2) Call Datagram 1 or more times, once per datagram, in assembly order
+//    3) Call ConversationComplete one time, after which the stream is dereferenced.
+type UDPStream interface {
+	// Datagram is called for each datagram of the conversation.  dir is
+	// TCPDirClientToServer for datagrams sent in the same direction as the
+	// first datagram of the conversation.  The UDP layer is only valid
+	// during the call, copy anything you need out of it.
+	Datagram(udp *layers.UDP, dir TCPFlowDirection, ac AssemblerContext)
+
+	// ConversationComplete is called when the conversation has been idle
+	// long enough to be flushed by FlushOlderThan, or by FlushAll.
+	ConversationComplete()
+}
+
+// UDPStreamFactory is used by UDPAssembler to create a new stream for each
+// new UDP conversation.
+type UDPStreamFactory interface {
+	// New should return a new stream for the given UDP key.
+	New(netFlow, udpFlow gopacket.Flow, udp *layers.UDP, ac AssemblerContext) UDPStream
+}
+
+type udpConversation struct {
+	key               key // client->server
+	stream            UDPStream
+	created, lastSeen time.Time
+	mu                sync.Mutex
+}
+
+// UDPStreamPool stores all UDP streams created by UDPAssemblers, allowing
+// multiple assemblers to work together while enforcing the fact that a single
+// stream receives its datagrams serially.  It is safe for concurrency, usable
+// by multiple UDPAssemblers at once.
+//
+// Like StreamPool, UDPStreamPool reuses its conversation objects to minimize
+// allocation.
+type UDPStreamPool struct {
+	conns     map[key]*udpConversation
+	mu        sync.RWMutex
+	factory   UDPStreamFactory
+	free      []*udpConversation
+	all       [][]udpConversation
+	nextAlloc int
+}
+
+// NewUDPStreamPool creates a new UDP conversation pool.  Streams will be
+// created as necessary using the passed-in UDPStreamFactory.
+func NewUDPStreamPool(factory UDPStreamFactory) *UDPStreamPool {
+	return &UDPStreamPool{
+		conns:     make(map[key]*udpConversation, initialAllocSize),
+		free:      make([]*udpConversation, 0, initialAllocSize),
+		factory:   factory,
+		nextAlloc: initialAllocSize,
+	}
+}
+
+func (p *UDPStreamPool) grow() {
+	conns := make([]udpConversation, p.nextAlloc)
+	p.all = append(p.all, conns)
+	for i := range conns {
+		p.free = append(p.free, &conns[i])
+	}
+	if *memLog {
+		log.Println("UDPStreamPool: created", p.nextAlloc, "new conversations")
+	}
+	p.nextAlloc *= 2
+}
+
+func (p *UDPStreamPool) getHalf(k key) (*udpConversation, TCPFlowDirection) {
+	if conn := p.conns[k]; conn != nil {
+		return conn, TCPDirClientToServer
+	}
+	if conn := p.conns[k.Reverse()]; conn != nil {
+		return conn, TCPDirServerToClient
+	}
+	return nil, TCPDirClientToServer
+}
+
+// getConversation returns the conversation of the given key, creating it if
+// needed, and the direction of the key within it.
+func (p *UDPStreamPool) getConversation(k key, ts time.Time, udp *layers.UDP, ac AssemblerContext) (*udpConversation, TCPFlowDirection) {
+	p.mu.RLock()
+	conn, dir := p.getHalf(k)
+	p.mu.RUnlock()
+	if conn != nil {
+		return conn, dir
+	}
+	s := p.factory.New(k[0], k[1], udp, ac)
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	if conn, dir := p.getHalf(k); conn != nil {
+		// Added by another assembler in the meantime
+		return conn, dir
+	}
+	if len(p.free) == 0 {
+		p.grow()
+	}
+	index := len(p.free) - 1
+	conn, p.free = p.free[index], p.free[:index]
+	conn.key = k
+	conn.stream = s
+	conn.created = ts
+	conn.lastSeen = ts
+	p.conns[k] = conn
+	return conn, TCPDirClientToServer
+}
+
+func (p *UDPStreamPool) remove(conn *udpConversation) {
+	p.mu.Lock()
+	if _, ok := p.conns[conn.key]; ok {
+		delete(p.conns, conn.key)
+		conn.stream = nil
+		p.free = append(p.free, conn)
+	}
+	p.mu.Unlock()
+}
+
+func (p *UDPStreamPool) conversations() []*udpConversation {
+	p.mu.RLock()
+	conns := make([]*udpConversation, 0, len(p.conns))
+	for _, conn := range p.conns {
+		conns = append(conns, conn)
+	}
+	p.mu.RUnlock()
+	return conns
+}
+
+// DefaultUDPAssemblerOptions provides default options for a UDPAssembler.
+var DefaultUDPAssemblerOptions = UDPAssemblerOptions{
+	IdleTimeout: 0, // manual flushing only
+}
+
+// UDPAssemblerOptions controls the behavior of each UDPAssembler.
+type UDPAssemblerOptions struct {
+	// IdleTimeout, if > 0, makes the assembler complete conversations which
+	// have not seen any datagram for that long, based on the timestamps of
+	// the packets it assembles.  It is checked at most once per IdleTimeout
+	// of packet time.  If <= 0, conversations are only completed by
+	// FlushOlderThan and FlushAll.
+	IdleTimeout time.Duration
+}
+
+// UDPAssembler groups UDP datagrams into conversations, and passes them to
+// the conversation's UDPStream.  Like Assembler, it is not safe for
+// concurrency, but multiple UDPAssemblers can share a UDPStreamPool.
+type UDPAssembler struct {
+	UDPAssemblerOptions
+	connPool  *UDPStreamPool
+	lastCheck time.Time
+}
+
+// NewUDPAssembler creates a new UDP assembler.  Pass in the UDPStreamPool
+// to use, may be shared across assemblers.
+//
+// This sets some sane defaults for the assembler options,
+// see DefaultUDPAssemblerOptions for details.
+func NewUDPAssembler(pool *UDPStreamPool) *UDPAssembler {
+	return &UDPAssembler{
+		UDPAssemblerOptions: DefaultUDPAssemblerOptions,
+		connPool:            pool,
+	}
+}
+
+// Assemble calls AssembleWithContext with the current timestamp, useful for
+// packets being read directly off the wire.
+func (a *UDPAssembler) Assemble(netFlow gopacket.Flow, u *layers.UDP) {
+	ctx := assemblerSimpleContext(gopacket.CaptureInfo{Timestamp: time.Now()})
+	a.AssembleWithContext(netFlow, u, &ctx)
+}
+
+// AssembleWithContext passes the given UDP datagram to the stream of its
+// conversation.
+//
+// The timestamp of the AssemblerContext's CaptureInfo must be the timestamp
+// the packet was seen, it is used for idle timeouts.
+//
+// Each AssembleWithContext call results in, in order:
+//
+//    zero or one call to UDPStreamFactory.New, creating a stream
+//    one call to Datagram on a single stream
+//    zero or more calls to ConversationComplete, if IdleTimeout is set
+func (a *UDPAssembler) AssembleWithContext(netFlow gopacket.Flow, u *layers.UDP, ac AssemblerContext) {
+	k := key{netFlow, u.TransportFlow()}
+	ts := ac.GetCaptureInfo().Timestamp
+	var conn *udpConversation
+	var dir TCPFlowDirection
+	for {
+		conn, dir = a.connPool.getConversation(k, ts, u, ac)
+		conn.mu.Lock()
+		if conn.stream != nil && (conn.key == k || conn.key == k.Reverse()) {
+			break
+		}
+		// Completed by another assembler in the meantime
+		conn.mu.Unlock()
+	}
+	if conn.lastSeen.Before(ts) {
+		conn.lastSeen = ts
+	}
+	conn.stream.Datagram(u, dir, ac)
+	conn.mu.Unlock()
+
+	if a.IdleTimeout > 0 {
+		if a.lastCheck.IsZero() {
+			a.lastCheck = ts
+		} else if ts.Sub(a.lastCheck) >= a.IdleTimeout {
+			a.lastCheck = ts
+			a.FlushOlderThan(ts.Add(-a.IdleTimeout))
+		}
+	}
+}
+
+// FlushOlderThan completes the conversations which haven't seen any datagram
+// since t, and removes them from the pool.  It returns the number of
+// conversations completed.
+func (a *UDPAssembler) FlushOlderThan(t time.Time) (closed int) {
+	for _, conn := range a.connPool.conversations() {
+		conn.mu.Lock()
+		if conn.stream != nil && conn.lastSeen.Before(t) {
+			conn.stream.ConversationComplete()
+			a.connPool.remove(conn)
+			closed++
+		}
+		conn.mu.Unlock()
+	}
+	return
+}
+
+// FlushAll completes all the conversations of the pool.  It returns the
+// number of conversations completed.
+func (a *UDPAssembler) FlushAll() (closed int) {
+	for _, conn := range a.connPool.conversations() {
+		conn.mu.Lock()
+		if conn.stream != nil {
+			conn.stream.ConversationComplete()
+			a.connPool.remove(conn)
+			closed++
+		}
+		conn.mu.Unlock()
+	}
+	return
+}
@@ -0,0 +1,83 @@
+// Copyright 2012 Google, Inc. All rights reserved.
+//
+// Use of this source code is governed by a BSD-style license
+// that can be found in the LICENSE file in the root of the source
+// tree.
+
+package reassembly
+
+import (
+	"fmt"
+	"reflect"
+	"testing"
+	"time"
+
+	"github.com/davidsonff/gopacket"
+	"github.com/davidsonff/gopacket/layers"
+)
+
+/* For UDP tests: logs datagrams */
+type testUDPFactory struct {
+	log []string
+}
+
+type testUDPStream struct {
+	f    *testUDPFactory
+	name string
+}
+
+func (f *testUDPFactory) New(a, b gopacket.Flow, udp *layers.UDP, ac AssemblerContext) UDPStream {
+	return &testUDPStream{f: f, name: b.String()}
+}
+
+func (s *testUDPStream) Datagram(udp *layers.UDP, dir TCPFlowDirection, ac AssemblerContext) {
+	s.f.log = append(s.f.log, fmt.Sprintf("%s %s %q %d", s.name, dir, udp.Payload, ac.GetCaptureInfo().Timestamp.Unix()))
+}
+
+func (s *testUDPStream) ConversationComplete() {
+	s.f.log = append(s.f.log, s.name+" complete")
+}
+
+func TestUDPAssembler(t *testing.T) {
+	f := &testUDPFactory{}
+	a := NewUDPAssembler(NewUDPStreamPool(f))
+	a.IdleTimeout = 10 * time.Second
+	for i, in := range []struct {
+		src, dst layers.UDPPort
+		data     string
+		ts       int64
+	}{
+		{1000, 53, "query", 0},
+		{2000, 53, "other", 1},
+		{53, 1000, "answer", 2},
+		{1000, 53, "query2", 5},
+		{53, 1000, "answer2", 13}, // triggers the idle check: 2000->53 is idle
+	} {
+		udp := &layers.UDP{SrcPort: in.src, DstPort: in.dst, BaseLayer: layers.BaseLayer{Payload: []byte(in.data)}}
+		udp.SetInternalPortsForTesting()
+		flow := netFlow
+		if in.src == 53 {
+			flow = netFlow.Reverse()
+		}
+		ctx := assemblerSimpleContext(gopacket.CaptureInfo{Timestamp: time.Unix(in.ts, 0)})
+		a.AssembleWithContext(flow, udp, &ctx)
+		if i == 1 && len(a.connPool.conns) != 2 {
+			t.Fatalf("want 2 conversations, got %d", len(a.connPool.conns))
+		}
+	}
+	if closed := a.FlushAll(); closed != 1 {
+		t.Errorf("want 1 conversation closed, got %d", closed)
+	}
+	want := []string{
+		`1000->53 client->server "query" 0`,
+		`2000->53 client->server "other" 1`,
+		`1000->53 server->client "answer" 2`,
+		`1000->53 client->server "query2" 5`,
+		`1000->53 server->client "answer2" 13`,
+		`2000->53 complete`,
+		`1000->53 complete`,
+	}
+	if !reflect.DeepEqual(f.log, want) {
+		t.Errorf("want\n%q\ngot\n%q", want, f.log)
+	}
+}
@@ -0,0 +1,360 @@
+// Copyright 2012 Google, Inc. All rights reserved.
+//
+// Use of this source code is governed by a BSD-style license
+// that can be found in the LICENSE file in the root of the source
+// tree.
+
+// Package replay writes the packets of a gopacket.PacketDataSource to a
+// packet writer with controlled timing, like tcpreplay does.
+//
+// Packets can be replayed with their original timing, optionally sped up or
+// slowed down, at a fixed packet or bit rate, or as fast as possible.  The
+// source can be replayed several times, and the beginning of it skipped.
+// Waits are done by sleeping until shortly before a packet is due, and
+// spinning for the rest, which avoids the jitter of time.Sleep.
+//
+// Usage:
+//
+//	src, _ := pcap.OpenOffline("capture.pcap")
+//	dst, _ := pcap.OpenLive("eth0", 65536, false, pcap.BlockForever)
+//	stats, err := replay.Replay(context.Background(), src, gopacket.NewRawPacketDataWriter(dst), replay.Options{Speed: 2})
+//	fmt.Printf("sent %d packets in %v (%v late at most)\n", stats.Packets, stats.Elapsed, stats.MaxLag)
+package replay
+
+import (
+	"context"
+	"errors"
+	"io"
+	"sync"
+	"time"
+
+	"github.com/davidsonff/gopacket"
+)
+
+// Clock is the time source used to pace packets.
+type Clock interface {
+	Now() time.Time
+	// Sleep returns after d elapsed.
+	Sleep(d time.Duration)
+}
+
+// DefaultSpinWindow is the SpinWindow of the clock used if Options.Clock is
+// nil.
+const DefaultSpinWindow = time.Millisecond
+
+// SystemClock is a Clock using the system time.  Sleep sleeps until
+// SpinWindow before the deadline with time.Sleep, and busy waits for the
+// rest.  A larger SpinWindow gives more precise timing, at the cost of CPU
+// time.
+type SystemClock struct {
+	SpinWindow time.Duration
+}
+
+// Now returns time.Now().
+func (c SystemClock) Now() time.Time {
+	return time.Now()
+}
+
+// Sleep returns after d elapsed.
+func (c SystemClock) Sleep(d time.Duration) {
+	deadline := time.Now().Add(d)
+	if d > c.SpinWindow {
+		time.Sleep(d - c.SpinWindow)
+	}
+	for time.Now().Before(deadline) {
+	}
+}
+
+// Options configures a Replayer.  The zero value replays the source once with
+// its original timing.
+type Options struct {
+	// Speed is a multiplier for the original timing: 2 replays twice as
+	// fast.  Zero means 1.
+	Speed float64
+	// PPS replays at a fixed rate of packets per second, ignoring the
+	// original timing.
+	PPS float64
+	// Mbps replays at a fixed rate of megabits (10^6 bits) per second,
+	// counting the packet data, and ignoring the original timing.
+	Mbps float64
+	// Fast replays the packets as fast as possible.
+	Fast bool
+	// Loops is the number of times the source is replayed.  Zero means 1, a
+	// negative value replays forever.  To replay the source more than once,
+	// its packets are kept in memory.
+	Loops int
+	// StartOffset skips the packets within StartOffset of the timestamp of
+	// the first packet of the source.
+	StartOffset time.Duration
+	// SendTruncated writes packets which were truncated by the capture.  By
+	// default they are skipped.
+	SendTruncated bool
+	// Clock paces the packets.  If nil, SystemClock{DefaultSpinWindow} is
+	// used.
+	Clock Clock
+}
+
+func (o Options) check() error {
+	rates := 0
+	for _, set := range []bool{o.PPS != 0, o.Mbps != 0, o.Fast} {
+		if set {
+			rates++
+		}
+	}
+	switch {
+	case o.Speed < 0:
+		return errors.New("replay: negative speed")
+	case o.PPS < 0:
+		return errors.New("replay: negative packet rate")
+	case o.Mbps < 0:
+		return errors.New("replay: negative bit rate")
+	case rates > 1:
+		return errors.New("replay: only one of PPS, Mbps and Fast can be set")
+	case rates == 1 && o.Speed != 0:
+		return errors.New("replay: Speed only applies to the original timing")
+	case o.StartOffset < 0:
+		return errors.New("replay: negative start offset")
+	}
+	return nil
+}
+
+// Stats reports the progress of a replay, and how closely the timing was
+// met.  The lag of a packet is the time between when it was due, and when it
+// was passed to the writer.
+type Stats struct {
+	// Packets and Bytes count the packets written.
+	Packets int64
+	Bytes   int64
+	// Skipped counts the packets skipped due to StartOffset, or because they
+	// were truncated.
+	Skipped int64
+	// Loops is the number of times the source was replayed completely.
+	Loops int
+	// Start is when the first packet was written.
+	Start time.Time
+	// Elapsed is the time from Start until the last packet was written, and
+	// Target the time it should have taken.
+	Elapsed time.Duration
+	Target  time.Duration
+	// MaxLag and TotalLag are the maximum and sum of the lags of all packets.
+	// They are zero with Options.Fast.
+	MaxLag   time.Duration
+	TotalLag time.Duration
+}
+
+// MeanLag returns the average lag of the packets.
+func (s Stats) MeanLag() time.Duration {
+	if s.Packets == 0 {
+		return 0
+	}
+	return s.TotalLag / time.Duration(s.Packets)
+}
+
+// PPS returns the achieved rate in packets per second.
+func (s Stats) PPS() float64 {
+	if s.Elapsed <= 0 {
+		return 0
+	}
+	return float64(s.Packets) / s.Elapsed.Seconds()
+}
+
+// Mbps returns the achieved rate in megabits per second.
+func (s Stats) Mbps() float64 {
+	if s.Elapsed <= 0 {
+		return 0
+	}
+	return float64(s.Bytes) * 8 / 1e6 / s.Elapsed.Seconds()
+}
+
+// maxWait bounds a single wait, so that a cancelled context is noticed.
+const maxWait = 100 * time.Millisecond
+
+type packet struct {
+	ci   gopacket.CaptureInfo
+	data []byte
+}
+
+// Replayer replays packet sources to a writer.  A Replayer must not be used
+// for more than one replay at a time, but Stats may be called concurrently.
+type Replayer struct {
+	w     gopacket.CaptureInfoWriter
+	opts  Options
+	clock Clock
+
+	mu    sync.Mutex // guards stats
+	stats Stats
+
+	// schedule state
+	start  time.Time     // when the first packet was due
+	sched  time.Duration // offset from start of the next packet
+	prevTS time.Time     // timestamp of the previous packet of the current loop
+	prevN  int           // length of the previous packet
+	first  bool          // no packet written yet
+}
+
+// New returns a Replayer writing to w, for example a gopacket.PacketDataWriter,
+// a pcapgo.Writer or pcapgo.NgWriter.  Live interfaces, like pcap.Handle and
+// afpacket.TPacket, are wrapped with gopacket.NewRawPacketDataWriter.  The
+// timestamp of the CaptureInfo passed to w is the time the packet is written.
+func New(w gopacket.CaptureInfoWriter, opts Options) (*Replayer, error) {
+	if err := opts.check(); err != nil {
+		return nil, err
+	}
+	if opts.Speed == 0 {
+		opts.Speed = 1
+	}
+	if opts.Loops == 0 {
+		opts.Loops = 1
+	}
+	r := &Replayer{w: w, opts: opts, clock: opts.Clock}
+	if r.clock == nil {
+		r.clock = SystemClock{DefaultSpinWindow}
+	}
+	return r, nil
+}
+
+// Stats returns the statistics of the current or last replay.
+func (r *Replayer) Stats() Stats {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	return r.stats
+}
+
+// Replay replays src to w, and returns the statistics of the replay.
+func Replay(ctx context.Context, src gopacket.PacketDataSource, w gopacket.CaptureInfoWriter, opts Options) (Stats, error) {
+	r, err := New(w, opts)
+	if err != nil {
+		return Stats{}, err
+	}
+	err = r.Run(ctx, src)
+	return r.Stats(), err
+}
+
+// Run replays src until it returns io.EOF, as often as Options.Loops says,
+// and returns nil.  It stops early and returns the error if reading, writing
+// or ctx fails.
+func (r *Replayer) Run(ctx context.Context, src gopacket.PacketDataSource) error {
+	r.mu.Lock()
+	r.stats = Stats{}
+	r.mu.Unlock()
+	r.sched = 0
+	r.first = true
+
+	var cache []packet
+	keep := r.opts.Loops != 1
+	var firstTS time.Time
+	r.prevTS = time.Time{}
+	for n := 0; ; n++ {
+		data, ci, err := src.ReadPacketData()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return err
+		}
+		if n == 0 {
+			firstTS = ci.Timestamp
+		}
+		if ci.Timestamp.Sub(firstTS) < r.opts.StartOffset || (ci.CaptureLength < ci.Length && !r.opts.SendTruncated) {
+			r.mu.Lock()
+			r.stats.Skipped++
+			r.mu.Unlock()
+			continue
+		}
+		if keep {
+			cache = append(cache, packet{ci, append([]byte(nil), data...)})
+		}
+		if err := r.send(ctx, ci, data); err != nil {
+			return err
+		}
+	}
+	r.endLoop()
+	for loop := 1; r.opts.Loops < 0 || loop < r.opts.Loops; loop++ {
+		if len(cache) == 0 {
+			break
+		}
+		for _, p := range cache {
+			if err := r.send(ctx, p.ci, p.data); err != nil {
+				return err
+			}
+		}
+		r.endLoop()
+	}
+	return nil
+}
+
+func (r *Replayer) endLoop() {
+	// The next loop starts right after the last packet of this one.
+	r.prevTS = time.Time{}
+	r.mu.Lock()
+	r.stats.Loops++
+	r.mu.Unlock()
+}
+
+// delay returns the time between the previous packet and this one.
+func (r *Replayer) delay(ci gopacket.CaptureInfo) time.Duration {
+	switch {
+	case r.first || r.opts.Fast:
+		return 0
+	case r.opts.PPS > 0:
+		return time.Duration(float64(time.Second) / r.opts.PPS)
+	case r.opts.Mbps > 0:
+		// the time it takes to send the previous packet
+		return time.Duration(float64(r.prevN*8) / (r.opts.Mbps * 1e6) * float64(time.Second))
+	case r.prevTS.IsZero():
+		return 0
+	}
+	d := ci.Timestamp.Sub(r.prevTS)
+	if d < 0 {
+		return 0
+	}
+	return time.Duration(float64(d) / r.opts.Speed)
+}
+
+// send waits until the packet is due, and writes it.
+func (r *Replayer) send(ctx context.Context, ci gopacket.CaptureInfo, data []byte) error {
+	r.sched += r.delay(ci)
+	r.prevTS = ci.Timestamp
+	r.prevN = len(data)
+	if r.first {
+		r.start = r.clock.Now()
+	}
+	due := r.start.Add(r.sched)
+	for {
+		if err := ctx.Err(); err != nil {
+			return err
+		}
+		d := due.Sub(r.clock.Now())
+		if d <= 0 {
+			break
+		}
+		if d > maxWait {
+			d = maxWait
+		}
+		r.clock.Sleep(d)
+	}
+	now := r.clock.Now()
+	ci.Timestamp = now
+	if err := r.w.WritePacket(ci, data); err != nil {
+		return err
+	}
+	var lag time.Duration
+	if !r.opts.Fast {
+		lag = now.Sub(due)
+	}
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if r.first {
+		r.stats.Start = now
+		r.first = false
+	}
+	r.stats.Packets++
+	r.stats.Bytes += int64(len(data))
+	r.stats.Elapsed = now.Sub(r.stats.Start)
+	r.stats.Target = r.sched
+	r.stats.TotalLag += lag
+	if lag > r.stats.MaxLag {
+		r.stats.MaxLag = lag
+	}
+	return nil
+}
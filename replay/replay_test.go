@@ -0,0 +1,232 @@
+// Copyright 2012 Google, Inc. All rights reserved.
+//
+// Use of this source code is governed by a BSD-style license
+// that can be found in the LICENSE file in the root of the source
+// tree.
+
+package replay
+
+import (
+	"context"
+	"errors"
+	"io"
+	"testing"
+	"time"
+
+	"github.com/davidsonff/gopacket"
+)
+
+var base = time.Date(2020, 1, 2, 3, 4, 5, 0, time.UTC)
+
+// fakeClock advances only when sleeping.  Each write takes writeCost.
+type fakeClock struct {
+	now       time.Time
+	writeCost time.Duration
+	sleeps    int
+}
+
+func (c *fakeClock) Now() time.Time        { return c.now }
+func (c *fakeClock) Sleep(d time.Duration) { c.now = c.now.Add(d); c.sleeps++ }
+
+type written struct {
+	ts   time.Time
+	data []byte
+}
+
+type memWriter struct {
+	clock   *fakeClock
+	packets []written
+	err     error
+}
+
+func (w *memWriter) WritePacket(ci gopacket.CaptureInfo, data []byte) error {
+	if w.err != nil && len(w.packets) == 2 {
+		return w.err
+	}
+	w.packets = append(w.packets, written{ci.Timestamp, append([]byte(nil), data...)})
+	w.clock.now = w.clock.now.Add(w.clock.writeCost)
+	return nil
+}
+
+// offsets returns the write times relative to the first write.
+func (w *memWriter) offsets() []time.Duration {
+	var ret []time.Duration
+	for _, p := range w.packets {
+		ret = append(ret, p.ts.Sub(w.packets[0].ts))
+	}
+	return ret
+}
+
+type sliceSource struct {
+	packets []written
+	lengths []int
+}
+
+func (s *sliceSource) ReadPacketData() ([]byte, gopacket.CaptureInfo, error) {
+	if len(s.packets) == 0 {
+		return nil, gopacket.CaptureInfo{}, io.EOF
+	}
+	p := s.packets[0]
+	s.packets = s.packets[1:]
+	ci := gopacket.CaptureInfo{Timestamp: p.ts, CaptureLength: len(p.data), Length: len(p.data)}
+	if len(s.lengths) > 0 {
+		ci.Length = s.lengths[0]
+		s.lengths = s.lengths[1:]
+	}
+	return p.data, ci, nil
+}
+
+// source returns packets of 125 bytes (1000 bits) at the given offsets.
+func source(offsets ...time.Duration) *sliceSource {
+	s := &sliceSource{}
+	for i, off := range offsets {
+		data := make([]byte, 125)
+		data[0] = byte(i)
+		s.packets = append(s.packets, written{base.Add(off), data})
+	}
+	return s
+}
+
+func ms(n ...int) []time.Duration {
+	var ret []time.Duration
+	for _, i := range n {
+		ret = append(ret, time.Duration(i)*time.Millisecond)
+	}
+	return ret
+}
+
+func equal(a, b []time.Duration) bool {
+	if len(a) != len(b) {
+		return false
+	}
+	for i := range a {
+		if a[i] != b[i] {
+			return false
+		}
+	}
+	return true
+}
+
+func TestReplayTiming(t *testing.T) {
+	for _, test := range []struct {
+		name      string
+		opts      Options
+		src       []time.Duration
+		writeCost time.Duration
+		want      []time.Duration
+		maxLag    time.Duration
+		skipped   int64
+	}{
+		{name: "original", src: ms(0, 10, 30, 30, 100), want: ms(0, 10, 30, 30, 100)},
+		{name: "speed", opts: Options{Speed: 2}, src: ms(0, 10, 30, 100), want: ms(0, 5, 15, 50)},
+		{name: "slow", opts: Options{Speed: 0.5}, src: ms(0, 10, 30), want: ms(0, 20, 60)},
+		{name: "out of order", src: ms(0, 20, 10, 30), want: ms(0, 20, 20, 40)},
+		{name: "pps", opts: Options{PPS: 100}, src: ms(0, 1, 500, 501), want: ms(0, 10, 20, 30)},
+		// 1000 bit packets at 0.1 Mbps take 10ms each
+		{name: "mbps", opts: Options{Mbps: 0.1}, src: ms(0, 1, 2), want: ms(0, 10, 20)},
+		{name: "fast", opts: Options{Fast: true}, src: ms(0, 10, 20), writeCost: time.Millisecond, want: ms(0, 1, 2)},
+		{name: "loops", opts: Options{Loops: 3}, src: ms(0, 10), want: ms(0, 10, 10, 20, 20, 30)},
+		{name: "start offset", opts: Options{StartOffset: 15 * time.Millisecond}, src: ms(0, 10, 20, 40), want: ms(0, 20), skipped: 2},
+		// writes taking 15ms fall behind a 10ms schedule, and catch up after a pause
+		{name: "lag", src: ms(0, 10, 20, 100), writeCost: 15 * time.Millisecond, want: ms(0, 15, 30, 100), maxLag: 10 * time.Millisecond},
+	} {
+		t.Run(test.name, func(t *testing.T) {
+			clock := &fakeClock{now: time.Unix(1000, 0), writeCost: test.writeCost}
+			w := &memWriter{clock: clock}
+			opts := test.opts
+			opts.Clock = clock
+			stats, err := Replay(context.Background(), source(test.src...), w, opts)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if got := w.offsets(); !equal(got, test.want) {
+				t.Errorf("got write times %v, want %v", got, test.want)
+			}
+			if stats.Packets != int64(len(test.want)) || stats.Bytes != int64(125*len(test.want)) || stats.Skipped != test.skipped {
+				t.Errorf("bad stats %+v", stats)
+			}
+			if stats.MaxLag != test.maxLag {
+				t.Errorf("max lag %v, want %v", stats.MaxLag, test.maxLag)
+			}
+			if last := test.want[len(test.want)-1]; stats.Elapsed != last || (!test.opts.Fast && stats.Target != last) {
+				t.Errorf("elapsed %v target %v, want %v", stats.Elapsed, stats.Target, last)
+			}
+		})
+	}
+}
+
+func TestReplayTruncated(t *testing.T) {
+	for _, sendTruncated := range []bool{false, true} {
+		clock := &fakeClock{now: time.Unix(1000, 0)}
+		w := &memWriter{clock: clock}
+		src := source(ms(0, 10, 20)...)
+		src.lengths = []int{125, 1500, 125}
+		stats, err := Replay(context.Background(), src, w, Options{Clock: clock, SendTruncated: sendTruncated})
+		if err != nil {
+			t.Fatal(err)
+		}
+		want := 2
+		if sendTruncated {
+			want = 3
+		}
+		if len(w.packets) != want || stats.Skipped != int64(3-want) {
+			t.Errorf("SendTruncated %v: got %d packets, stats %+v", sendTruncated, len(w.packets), stats)
+		}
+	}
+}
+
+func TestReplayErrors(t *testing.T) {
+	for _, opts := range []Options{
+		{Speed: -1},
+		{PPS: 10, Mbps: 1},
+		{PPS: 10, Speed: 2},
+		{Fast: true, Mbps: 1},
+		{StartOffset: -time.Second},
+	} {
+		if _, err := New(nil, opts); err == nil {
+			t.Errorf("%+v: no error", opts)
+		}
+	}
+
+	clock := &fakeClock{now: time.Unix(1000, 0)}
+	werr := errors.New("write failed")
+	w := &memWriter{clock: clock, err: werr}
+	stats, err := Replay(context.Background(), source(ms(0, 1, 2, 3)...), w, Options{Clock: clock})
+	if err != werr || stats.Packets != 2 {
+		t.Errorf("got %v, %d packets", err, stats.Packets)
+	}
+
+	// Forever, until cancelled.
+	ctx, cancel := context.WithCancel(context.Background())
+	w = &memWriter{clock: clock}
+	r, err := New(w, Options{Clock: clock, Loops: -1})
+	if err != nil {
+		t.Fatal(err)
+	}
+	go func() {
+		for r.Stats().Loops < 10 {
+			time.Sleep(time.Millisecond)
+		}
+		cancel()
+	}()
+	if err := r.Run(ctx, source(ms(0, 1)...)); err != context.Canceled {
+		t.Errorf("got %v", err)
+	}
+}
+
+func TestSystemClock(t *testing.T) {
+	clock := &fakeClock{}
+	w := &memWriter{clock: clock}
+	start := time.Now()
+	stats, err := Replay(context.Background(), source(ms(0, 2, 4, 6, 8, 10)...), w, Options{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if elapsed := time.Since(start); elapsed < 10*time.Millisecond {
+		t.Errorf("replay took %v", elapsed)
+	}
+	if stats.Elapsed < stats.Target-stats.MaxLag || stats.Target != 10*time.Millisecond {
+		t.Errorf("elapsed %v, target %v", stats.Elapsed, stats.Target)
+	}
+	t.Logf("max lag %v, mean lag %v", stats.MaxLag, stats.MeanLag())
+}
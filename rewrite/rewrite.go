@@ -0,0 +1,462 @@
+// Copyright 2012 Google, Inc. All rights reserved.
+//
+// Use of this source code is governed by a BSD-style license
+// that can be found in the LICENSE file in the root of the source
+// tree.
+
+// Package rewrite rewrites the addresses, ports and VLAN tags of packets,
+// like tcprewrite does, for example to replay captures into a lab network.
+//
+// A Rewriter decodes each packet, applies its Rules to the Ethernet, Dot1Q,
+// IPv4, IPv6, TCP and UDP layers, and serializes the packet again with
+// lengths and checksums fixed.  Layers it doesn't know, like application
+// layers, are copied unchanged.  Fragments keep their ports, and the TCP or
+// UDP checksum of a first fragment is updated for the new addresses.
+//
+// Rules apply to both the source and the destination fields by default, so
+// that both directions of a flow are mapped consistently: with a subnet rule
+// mapping 10.1.0.0/16 to 192.168.0.0/16, a request from 10.1.2.3 and the
+// reply to 10.1.2.3 both use 192.168.2.3.
+//
+// Usage:
+//
+//	_, lab, _ := net.ParseCIDR("192.168.0.0/16")
+//	_, prod, _ := net.ParseCIDR("10.1.0.0/16")
+//	rw, _ := rewrite.New(rewrite.Rules{
+//		Subnets: []rewrite.SubnetRule{{From: prod, To: lab}},
+//		StripVLAN: true,
+//	})
+//	// standalone:
+//	out, err := rw.Rewrite(data)
+//	// or in a replay:
+//	replay.Replay(ctx, src, rw.Writer(gopacket.NewRawPacketDataWriter(handle)), replay.Options{})
+package rewrite
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"net"
+
+	"github.com/davidsonff/gopacket"
+	"github.com/davidsonff/gopacket/layers"
+)
+
+// Direction selects the fields of a packet a rule applies to.
+type Direction int
+
+// Direction values.
+const (
+	// Both applies a rule to the source and destination fields.
+	Both Direction = iota
+	// Source applies a rule to the source fields only.
+	Source
+	// Destination applies a rule to the destination fields only.
+	Destination
+)
+
+func (d Direction) src() bool { return d == Both || d == Source }
+func (d Direction) dst() bool { return d == Both || d == Destination }
+
+// MACRule replaces the MAC address From with To.  If From is nil, every
+// address is replaced.
+type MACRule struct {
+	From, To  net.HardwareAddr
+	Direction Direction
+}
+
+// SubnetRule moves the addresses within the prefix From into the prefix To,
+// keeping the host part of the address.  Both prefixes must have the same
+// length and address family.
+type SubnetRule struct {
+	From, To  *net.IPNet
+	Direction Direction
+}
+
+// PortRule replaces the TCP or UDP port From with To.  If Protocol is 0, the
+// rule applies to TCP and UDP, otherwise only to the given protocol.
+type PortRule struct {
+	From, To  uint16
+	Protocol  layers.IPProtocol
+	Direction Direction
+}
+
+// VLANTag is an 802.1Q tag added by Rules.AddVLAN.
+type VLANTag struct {
+	ID       uint16
+	Priority uint8
+}
+
+// Rules is the set of changes a Rewriter applies.  Of several rules matching
+// the same field, the first one is used.  VLAN changes are applied in the
+// order StripVLAN, VLANs, AddVLAN.
+type Rules struct {
+	MACs    []MACRule
+	Subnets []SubnetRule
+	Ports   []PortRule
+	// VLANs maps VLAN IDs.
+	VLANs map[uint16]uint16
+	// StripVLAN removes all 802.1Q tags.
+	StripVLAN bool
+	// AddVLAN adds an 802.1Q tag to packets which have none.
+	AddVLAN *VLANTag
+}
+
+func (r Rules) check() error {
+	for _, m := range r.MACs {
+		if len(m.To) != 6 || m.From != nil && len(m.From) != 6 {
+			return fmt.Errorf("rewrite: invalid MAC rule %v -> %v", m.From, m.To)
+		}
+	}
+	for _, s := range r.Subnets {
+		if s.From == nil || s.To == nil {
+			return errors.New("rewrite: subnet rule without prefix")
+		}
+		fromOnes, fromBits := s.From.Mask.Size()
+		toOnes, toBits := s.To.Mask.Size()
+		if fromOnes != toOnes || fromBits != toBits || fromBits == 0 {
+			return fmt.Errorf("rewrite: subnets %v and %v differ in size", s.From, s.To)
+		}
+	}
+	for id, to := range r.VLANs {
+		if id > 0xfff || to > 0xfff {
+			return fmt.Errorf("rewrite: invalid VLAN mapping %d -> %d", id, to)
+		}
+	}
+	if r.AddVLAN != nil && (r.AddVLAN.ID > 0xfff || r.AddVLAN.Priority > 7) {
+		return fmt.Errorf("rewrite: invalid VLAN tag %+v", *r.AddVLAN)
+	}
+	return nil
+}
+
+// Rewriter applies Rules to packets.  It must not be used concurrently.
+type Rewriter struct {
+	rules   Rules
+	decoder gopacket.Decoder
+	buf     gopacket.SerializeBuffer
+}
+
+// New returns a Rewriter for Ethernet packets.
+func New(rules Rules) (*Rewriter, error) {
+	return NewWithDecoder(rules, layers.LayerTypeEthernet)
+}
+
+// NewWithDecoder returns a Rewriter decoding packets with the given decoder,
+// for example layers.LinkTypeRaw or layers.LinkTypeLoopback.  The VLAN rules
+// need an Ethernet layer.
+func NewWithDecoder(rules Rules, decoder gopacket.Decoder) (*Rewriter, error) {
+	if err := rules.check(); err != nil {
+		return nil, err
+	}
+	return &Rewriter{
+		rules:   rules,
+		decoder: decoder,
+		buf:     gopacket.NewSerializeBuffer(),
+	}, nil
+}
+
+// rewritable returns whether the Rewriter knows how to rewrite and serialize
+// a layer.  Other layers, and all layers after them, are copied as they are.
+func rewritable(l gopacket.Layer) bool {
+	switch l.(type) {
+	case *layers.Ethernet, *layers.Loopback, *layers.Dot1Q, *layers.IPv4, *layers.IPv6, *layers.IPv6HopByHop,
+		*layers.IPv6Destination, *layers.TCP, *layers.UDP, *layers.ICMPv4, *layers.ICMPv6:
+		return true
+	}
+	return false
+}
+
+// isFragment returns whether ip is a fragment, whose ports can't be
+// rewritten.
+func isFragment(ip *layers.IPv4) bool {
+	return ip.Flags&layers.IPv4MoreFragments != 0 || ip.FragOffset != 0
+}
+
+// fixChecksum updates the TCP, UDP or ICMPv6 checksum at the start of data,
+// the first fragment of a datagram, for the addresses of the pseudo-header
+// rewritten from "from" to "to".  The checksum covers the whole datagram, so it
+// is updated incrementally as described in RFC 1624 instead of computed again.
+func fixChecksum(proto layers.IPProtocol, data []byte, from, to [2]net.IP) {
+	var offset int
+	switch proto {
+	case layers.IPProtocolTCP:
+		offset = 16
+	case layers.IPProtocolUDP:
+		offset = 6
+	case layers.IPProtocolICMPv6:
+		offset = 2
+	default:
+		return
+	}
+	if len(data) < offset+2 {
+		return
+	}
+	csum := binary.BigEndian.Uint16(data[offset:])
+	if proto == layers.IPProtocolUDP && csum == 0 {
+		// no checksum
+		return
+	}
+	sum := uint32(^csum)
+	for i := range from {
+		old, ip := from[i], to[i].To16()
+		if len(old) == net.IPv4len {
+			ip = ip.To4()
+		}
+		if len(ip) != len(old) {
+			return
+		}
+		for j := 0; j < len(old); j += 2 {
+			sum += uint32(^binary.BigEndian.Uint16(old[j:])) + uint32(binary.BigEndian.Uint16(ip[j:]))
+		}
+	}
+	for sum > 0xffff {
+		sum = sum&0xffff + sum>>16
+	}
+	csum = ^uint16(sum)
+	if proto == layers.IPProtocolUDP && csum == 0 {
+		csum = 0xffff
+	}
+	binary.BigEndian.PutUint16(data[offset:], csum)
+}
+
+// Rewrite applies the rules to the packet data, and returns the new packet.
+// The returned data is only valid until the next call to Rewrite.
+func (r *Rewriter) Rewrite(data []byte) ([]byte, error) {
+	p := gopacket.NewPacket(data, r.decoder, gopacket.NoCopy)
+	var ls []gopacket.SerializableLayer
+	var network gopacket.NetworkLayer
+	// the addresses before and after rewriting, for the checksums of fragments
+	var from, to [2]net.IP
+layerLoop:
+	for _, l := range p.Layers() {
+		if !rewritable(l) {
+			raw := append(append([]byte(nil), l.LayerContents()...), l.LayerPayload()...)
+			if f, ok := l.(*layers.IPv6Fragment); ok && f.FragmentOffset == 0 {
+				fixChecksum(f.NextHeader, raw[len(f.Contents):], from, to)
+			}
+			ls = append(ls, gopacket.Payload(raw))
+			break
+		}
+		switch l := l.(type) {
+		case *layers.Ethernet:
+			l.SrcMAC, l.DstMAC = r.mac(l.SrcMAC, l.DstMAC)
+		case *layers.Dot1Q:
+			if to, ok := r.rules.VLANs[l.VLANIdentifier]; ok {
+				l.VLANIdentifier = to
+			}
+		case *layers.IPv4:
+			from = [2]net.IP{l.SrcIP, l.DstIP}
+			l.SrcIP, l.DstIP = r.ip(l.SrcIP, l.DstIP)
+			to = [2]net.IP{l.SrcIP, l.DstIP}
+			network = l
+			if isFragment(l) {
+				payload := append([]byte(nil), l.LayerPayload()...)
+				if l.FragOffset == 0 {
+					fixChecksum(l.Protocol, payload, from, to)
+				}
+				ls = append(ls, l, gopacket.Payload(payload))
+				break layerLoop
+			}
+		case *layers.IPv6:
+			from = [2]net.IP{l.SrcIP, l.DstIP}
+			l.SrcIP, l.DstIP = r.ip(l.SrcIP, l.DstIP)
+			to = [2]net.IP{l.SrcIP, l.DstIP}
+			network = l
+		case *layers.TCP:
+			src, dst := r.port(layers.IPProtocolTCP, uint16(l.SrcPort), uint16(l.DstPort))
+			l.SrcPort, l.DstPort = layers.TCPPort(src), layers.TCPPort(dst)
+		case *layers.UDP:
+			src, dst := r.port(layers.IPProtocolUDP, uint16(l.SrcPort), uint16(l.DstPort))
+			l.SrcPort, l.DstPort = layers.UDPPort(src), layers.UDPPort(dst)
+		}
+		if c, ok := l.(interface {
+			SetNetworkLayerForChecksum(gopacket.NetworkLayer) error
+		}); ok && network != nil {
+			if err := c.SetNetworkLayerForChecksum(network); err != nil {
+				return nil, err
+			}
+		}
+		ls = append(ls, l.(gopacket.SerializableLayer))
+	}
+	ls = r.vlan(ls)
+
+	opts := gopacket.SerializeOptions{
+		// The lengths of truncated packets would be set to what was captured.
+		FixLengths:       !p.Metadata().Truncated,
+		ComputeChecksums: true,
+	}
+	if err := gopacket.SerializeLayers(r.buf, opts, ls...); err != nil {
+		return nil, err
+	}
+	return r.buf.Bytes(), nil
+}
+
+// vlan applies the VLAN rules which add or remove layers.
+func (r *Rewriter) vlan(ls []gopacket.SerializableLayer) []gopacket.SerializableLayer {
+	if len(ls) == 0 {
+		return ls
+	}
+	eth, ok := ls[0].(*layers.Ethernet)
+	if !ok {
+		return ls
+	}
+	if r.rules.StripVLAN {
+		for len(ls) > 1 {
+			tag, ok := ls[1].(*layers.Dot1Q)
+			if !ok {
+				break
+			}
+			eth.EthernetType = tag.Type
+			ls = append(ls[:1], ls[2:]...)
+		}
+	}
+	if tag := r.rules.AddVLAN; tag != nil && eth.EthernetType != layers.EthernetTypeDot1Q {
+		dot1q := &layers.Dot1Q{
+			Priority:       tag.Priority,
+			VLANIdentifier: tag.ID,
+			Type:           eth.EthernetType,
+		}
+		eth.EthernetType = layers.EthernetTypeDot1Q
+		ls = append(ls[:1], append([]gopacket.SerializableLayer{dot1q}, ls[1:]...)...)
+	}
+	return ls
+}
+
+func (r *Rewriter) mac(src, dst net.HardwareAddr) (net.HardwareAddr, net.HardwareAddr) {
+	srcDone, dstDone := false, false
+	for _, m := range r.rules.MACs {
+		if !srcDone && m.Direction.src() && (m.From == nil || bytes.Equal(m.From, src)) {
+			src, srcDone = m.To, true
+		}
+		if !dstDone && m.Direction.dst() && (m.From == nil || bytes.Equal(m.From, dst)) {
+			dst, dstDone = m.To, true
+		}
+	}
+	return src, dst
+}
+
+func (r *Rewriter) ip(src, dst net.IP) (net.IP, net.IP) {
+	srcDone, dstDone := false, false
+	for _, s := range r.rules.Subnets {
+		if !srcDone && s.Direction.src() {
+			src, srcDone = mapIP(s, src)
+		}
+		if !dstDone && s.Direction.dst() {
+			dst, dstDone = mapIP(s, dst)
+		}
+	}
+	return src, dst
+}
+
+// mapIP moves ip from s.From to s.To, if it is in s.From.
+func mapIP(s SubnetRule, ip net.IP) (net.IP, bool) {
+	from, to := s.From.IP, s.To.IP
+	if v4 := ip.To4(); v4 != nil && len(s.From.Mask) == net.IPv4len {
+		ip, from, to = v4, from.To4(), to.To4()
+	}
+	if len(ip) != len(s.From.Mask) || len(from) != len(ip) || len(to) != len(ip) || !s.From.Contains(ip) {
+		return ip, false
+	}
+	mapped := make(net.IP, len(ip))
+	for i := range ip {
+		mapped[i] = to[i]&s.To.Mask[i] | ip[i]&^s.From.Mask[i]
+	}
+	return mapped, true
+}
+
+func (r *Rewriter) port(proto layers.IPProtocol, src, dst uint16) (uint16, uint16) {
+	srcDone, dstDone := false, false
+	for _, p := range r.rules.Ports {
+		if p.Protocol != 0 && p.Protocol != proto {
+			continue
+		}
+		if !srcDone && p.Direction.src() && p.From == src {
+			src, srcDone = p.To, true
+		}
+		if !dstDone && p.Direction.dst() && p.From == dst {
+			dst, dstDone = p.To, true
+		}
+	}
+	return src, dst
+}
+
+// rewriteCI rewrites data, and adjusts the lengths of ci to the new packet.
+func (r *Rewriter) rewriteCI(ci gopacket.CaptureInfo, data []byte) ([]byte, gopacket.CaptureInfo, error) {
+	out, err := r.Rewrite(data)
+	if err != nil {
+		return nil, ci, err
+	}
+	ci.Length += len(out) - len(data)
+	ci.CaptureLength = len(out)
+	return out, ci, nil
+}
+
+type writer struct {
+	r *Rewriter
+	w gopacket.PacketDataWriter
+}
+
+func (w writer) WritePacket(ci gopacket.CaptureInfo, data []byte) error {
+	out, ci, err := w.r.rewriteCI(ci, data)
+	if err != nil {
+		return err
+	}
+	return w.w.WritePacket(ci, out)
+}
+
+func (w writer) WritePackets(ci []gopacket.CaptureInfo, data [][]byte) (int, error) {
+	if len(ci) != len(data) {
+		return 0, fmt.Errorf("batch has %d capture infos for %d packets", len(ci), len(data))
+	}
+	outCI := make([]gopacket.CaptureInfo, len(ci))
+	out := make([][]byte, len(data))
+	for i := range data {
+		rewritten, c, err := w.r.rewriteCI(ci[i], data[i])
+		if err != nil {
+			// write the packets rewritten so far
+			n, werr := w.w.WritePackets(outCI[:i], out[:i])
+			if werr != nil {
+				return n, werr
+			}
+			return n, err
+		}
+		// the Rewriter reuses its buffer
+		outCI[i], out[i] = c, append([]byte(nil), rewritten...)
+	}
+	return w.w.WritePackets(outCI, out)
+}
+
+func (w writer) Close() error {
+	return w.w.Close()
+}
+
+// Writer returns a gopacket.PacketDataWriter which rewrites every packet
+// before passing it to w.  w is wrapped with gopacket.NewPacketDataWriter, so
+// Close closes or flushes it.
+func (r *Rewriter) Writer(w gopacket.CaptureInfoWriter) gopacket.PacketDataWriter {
+	return writer{r, gopacket.NewPacketDataWriter(w)}
+}
+
+type source struct {
+	r   *Rewriter
+	src gopacket.PacketDataSource
+}
+
+func (s source) ReadPacketData() ([]byte, gopacket.CaptureInfo, error) {
+	data, ci, err := s.src.ReadPacketData()
+	if err != nil {
+		return nil, ci, err
+	}
+	out, ci, err := s.r.rewriteCI(ci, data)
+	if err != nil {
+		return nil, ci, err
+	}
+	return append([]byte(nil), out...), ci, nil
+}
+
+// Source returns a gopacket.PacketDataSource returning the rewritten packets
+// of src, for example to rewrite a capture file.
+func (r *Rewriter) Source(src gopacket.PacketDataSource) gopacket.PacketDataSource {
+	return source{r, src}
+}
@@ -0,0 +1,367 @@
+// Copyright 2012 Google, Inc. All rights reserved.
+//
+// Use of this source code is governed by a BSD-style license
+// that can be found in the LICENSE file in the root of the source
+// tree.
+
+package rewrite
+
+import (
+	"bytes"
+	"io"
+	"net"
+	"testing"
+	"time"
+
+	"github.com/davidsonff/gopacket"
+	"github.com/davidsonff/gopacket/layers"
+)
+
+var (
+	macA = net.HardwareAddr{0x02, 0, 0, 0, 0, 0xa}
+	macB = net.HardwareAddr{0x02, 0, 0, 0, 0, 0xb}
+	macC = net.HardwareAddr{0x02, 0, 0, 0, 0, 0xc}
+)
+
+func cidr(s string) *net.IPNet {
+	_, n, err := net.ParseCIDR(s)
+	if err != nil {
+		panic(err)
+	}
+	return n
+}
+
+// pkt describes a test packet.
+type pkt struct {
+	srcMAC, dstMAC   net.HardwareAddr
+	vlan             int // -1 for none
+	src, dst         string
+	srcPort, dstPort uint16
+	udp              bool
+	payload          string
+}
+
+func (p pkt) serialize(t *testing.T) []byte {
+	eth := &layers.Ethernet{SrcMAC: p.srcMAC, DstMAC: p.dstMAC}
+	ls := []gopacket.SerializableLayer{eth}
+	ethType := &eth.EthernetType
+	if p.vlan >= 0 {
+		eth.EthernetType = layers.EthernetTypeDot1Q
+		dot1q := &layers.Dot1Q{VLANIdentifier: uint16(p.vlan), Priority: 3}
+		ls = append(ls, dot1q)
+		ethType = &dot1q.Type
+	}
+	var network gopacket.NetworkLayer
+	proto := layers.IPProtocolTCP
+	if p.udp {
+		proto = layers.IPProtocolUDP
+	}
+	if ip := net.ParseIP(p.src); ip.To4() != nil {
+		*ethType = layers.EthernetTypeIPv4
+		ip4 := &layers.IPv4{Version: 4, TTL: 64, Protocol: proto, SrcIP: ip.To4(), DstIP: net.ParseIP(p.dst).To4()}
+		ls = append(ls, ip4)
+		network = ip4
+	} else {
+		*ethType = layers.EthernetTypeIPv6
+		ip6 := &layers.IPv6{Version: 6, HopLimit: 64, NextHeader: proto, SrcIP: ip, DstIP: net.ParseIP(p.dst)}
+		ls = append(ls, ip6)
+		network = ip6
+	}
+	if p.udp {
+		udp := &layers.UDP{SrcPort: layers.UDPPort(p.srcPort), DstPort: layers.UDPPort(p.dstPort)}
+		udp.SetNetworkLayerForChecksum(network)
+		ls = append(ls, udp)
+	} else {
+		tcp := &layers.TCP{SrcPort: layers.TCPPort(p.srcPort), DstPort: layers.TCPPort(p.dstPort), Seq: 1000, ACK: true, Window: 1024,
+			Options: []layers.TCPOption{{OptionType: layers.TCPOptionKindMSS, OptionLength: 4, OptionData: []byte{5, 0xb4}}}}
+		tcp.SetNetworkLayerForChecksum(network)
+		ls = append(ls, tcp)
+	}
+	ls = append(ls, gopacket.Payload(p.payload))
+	buf := gopacket.NewSerializeBuffer()
+	if err := gopacket.SerializeLayers(buf, gopacket.SerializeOptions{FixLengths: true, ComputeChecksums: true}, ls...); err != nil {
+		t.Fatal(err)
+	}
+	return buf.Bytes()
+}
+
+func TestRewrite(t *testing.T) {
+	rules := Rules{
+		MACs: []MACRule{
+			{From: macA, To: macC},
+		},
+		Subnets: []SubnetRule{
+			{From: cidr("10.1.0.0/16"), To: cidr("192.168.0.0/16")},
+			{From: cidr("172.16.0.0/12"), To: cidr("10.16.0.0/12"), Direction: Destination},
+			{From: cidr("2001:db8:1::/48"), To: cidr("fd00:1:2::/48")},
+		},
+		Ports: []PortRule{
+			{From: 8080, To: 80},
+			{From: 53, To: 5353, Protocol: layers.IPProtocolUDP},
+		},
+		VLANs: map[uint16]uint16{10: 20},
+	}
+	for _, test := range []struct {
+		name      string
+		rules     Rules
+		in, want  pkt
+		lengthAdj int
+	}{
+		{
+			name: "request",
+			in:   pkt{macA, macB, 10, "10.1.2.3", "10.1.4.5", 40000, 8080, false, "GET /"},
+			want: pkt{macC, macB, 20, "192.168.2.3", "192.168.4.5", 40000, 80, false, "GET /"},
+		},
+		{
+			name: "reply",
+			in:   pkt{macB, macA, 10, "10.1.4.5", "10.1.2.3", 8080, 40000, false, "200 OK"},
+			want: pkt{macB, macC, 20, "192.168.4.5", "192.168.2.3", 80, 40000, false, "200 OK"},
+		},
+		{
+			name: "destination only",
+			in:   pkt{macB, macB, 30, "172.16.1.1", "172.17.1.1", 1, 2, false, ""},
+			want: pkt{macB, macB, 30, "172.16.1.1", "10.17.1.1", 1, 2, false, ""},
+		},
+		{
+			name: "port protocol",
+			in:   pkt{macB, macB, -1, "10.2.0.1", "10.2.0.2", 53, 53, false, "tcp"},
+			want: pkt{macB, macB, -1, "10.2.0.1", "10.2.0.2", 53, 53, false, "tcp"},
+		},
+		{
+			name: "ipv6 udp",
+			in:   pkt{macA, macA, -1, "2001:db8:1::1", "2001:db8:2::1", 1234, 53, true, "\x12\x34\x01\x00"},
+			want: pkt{macC, macC, -1, "fd00:1:2::1", "2001:db8:2::1", 1234, 5353, true, "\x12\x34\x01\x00"},
+		},
+		{
+			name:      "strip vlan",
+			rules:     Rules{StripVLAN: true},
+			in:        pkt{macA, macB, 10, "10.0.0.1", "10.0.0.2", 1, 2, true, "a payload larger than the ethernet minimum frame size"},
+			want:      pkt{macA, macB, -1, "10.0.0.1", "10.0.0.2", 1, 2, true, "a payload larger than the ethernet minimum frame size"},
+			lengthAdj: -4,
+		},
+		{
+			name:      "add vlan",
+			rules:     Rules{AddVLAN: &VLANTag{ID: 100, Priority: 3}},
+			in:        pkt{macA, macB, -1, "10.0.0.1", "10.0.0.2", 1, 2, true, "a payload larger than the ethernet minimum frame size"},
+			want:      pkt{macA, macB, 100, "10.0.0.1", "10.0.0.2", 1, 2, true, "a payload larger than the ethernet minimum frame size"},
+			lengthAdj: 4,
+		},
+		{
+			name:  "keep vlan",
+			rules: Rules{AddVLAN: &VLANTag{ID: 100, Priority: 3}},
+			in:    pkt{macA, macB, 7, "10.0.0.1", "10.0.0.2", 1, 2, true, ""},
+			want:  pkt{macA, macB, 7, "10.0.0.1", "10.0.0.2", 1, 2, true, ""},
+		},
+	} {
+		t.Run(test.name, func(t *testing.T) {
+			r := rules
+			if test.rules.StripVLAN || test.rules.AddVLAN != nil {
+				r = test.rules
+			}
+			rw, err := New(r)
+			if err != nil {
+				t.Fatal(err)
+			}
+			in := test.in.serialize(t)
+			got, err := rw.Rewrite(in)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if want := test.want.serialize(t); !bytes.Equal(got, want) {
+				t.Errorf("got\n%x\nwant\n%x", got, want)
+			}
+			if len(got) != len(in)+test.lengthAdj {
+				t.Errorf("length %d, want %d", len(got), len(in)+test.lengthAdj)
+			}
+		})
+	}
+}
+
+// fragment returns a fragment of a TCP segment or UDP datagram from src to
+// dst: the first 24 bytes if first is set, or the rest.
+func fragment(t *testing.T, src, dst string, proto layers.IPProtocol, first bool) []byte {
+	eth := &layers.Ethernet{SrcMAC: macA, DstMAC: macB}
+	var network gopacket.NetworkLayer
+	var l4 gopacket.SerializableLayer
+	if ip := net.ParseIP(src); ip.To4() != nil {
+		eth.EthernetType = layers.EthernetTypeIPv4
+		ip4 := &layers.IPv4{Version: 4, TTL: 64, Protocol: proto, Id: 7, SrcIP: ip.To4(), DstIP: net.ParseIP(dst).To4()}
+		if first {
+			ip4.Flags = layers.IPv4MoreFragments
+		} else {
+			ip4.FragOffset = 3
+		}
+		network = ip4
+	} else {
+		eth.EthernetType = layers.EthernetTypeIPv6
+		network = &layers.IPv6{Version: 6, HopLimit: 64, NextHeader: layers.IPProtocolIPv6Fragment, SrcIP: ip, DstIP: net.ParseIP(dst)}
+	}
+	if proto == layers.IPProtocolUDP {
+		udp := &layers.UDP{SrcPort: 1, DstPort: 2}
+		udp.SetNetworkLayerForChecksum(network)
+		l4 = udp
+	} else {
+		tcp := &layers.TCP{SrcPort: 1, DstPort: 2, Seq: 1000, ACK: true, Window: 1024}
+		tcp.SetNetworkLayerForChecksum(network)
+		l4 = tcp
+	}
+	opts := gopacket.SerializeOptions{FixLengths: true, ComputeChecksums: true}
+	buf := gopacket.NewSerializeBuffer()
+	if err := gopacket.SerializeLayers(buf, opts, l4, gopacket.Payload(bytes.Repeat([]byte("fragment"), 4))); err != nil {
+		t.Fatal(err)
+	}
+	data := append([]byte(nil), buf.Bytes()[24:]...)
+	if first {
+		data = append([]byte(nil), buf.Bytes()[:24]...)
+	}
+	if _, ok := network.(*layers.IPv6); ok {
+		header := []byte{byte(proto), 0, 0, 1, 0, 0, 0, 7}
+		if !first {
+			header[3] = 3 << 3
+		}
+		data = append(header, data...)
+	}
+	if err := gopacket.SerializeLayers(buf, opts, eth, network.(gopacket.SerializableLayer), gopacket.Payload(data)); err != nil {
+		t.Fatal(err)
+	}
+	return buf.Bytes()
+}
+
+func TestRewriteFragments(t *testing.T) {
+	rw, err := New(Rules{
+		Subnets: []SubnetRule{{From: cidr("10.0.0.0/8"), To: cidr("11.0.0.0/8")}, {From: cidr("fd00::/16"), To: cidr("fd01::/16")}},
+		Ports:   []PortRule{{From: 1, To: 3}},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	// The ports of fragments are kept, and the transport checksum of the
+	// first fragment is updated for the new addresses.
+	for _, test := range []struct {
+		name     string
+		src, dst string
+		proto    layers.IPProtocol
+		first    bool
+	}{
+		{"ipv4 udp", "10.0.0.1", "10.0.0.2", layers.IPProtocolUDP, true},
+		{"ipv4 tcp", "10.0.0.1", "10.9.8.7", layers.IPProtocolTCP, true},
+		{"ipv4 tcp rest", "10.0.0.1", "10.9.8.7", layers.IPProtocolTCP, false},
+		{"ipv6 udp", "fd00::1", "fd00::2", layers.IPProtocolUDP, true},
+		{"ipv6 tcp", "fd00::1", "fd00:1234::2", layers.IPProtocolTCP, true},
+		{"ipv6 tcp rest", "fd00::1", "fd00:1234::2", layers.IPProtocolTCP, false},
+	} {
+		t.Run(test.name, func(t *testing.T) {
+			in := fragment(t, test.src, test.dst, test.proto, test.first)
+			got, err := rw.Rewrite(in)
+			if err != nil {
+				t.Fatal(err)
+			}
+			src, dst := rw.ip(net.ParseIP(test.src), net.ParseIP(test.dst))
+			if want := fragment(t, src.String(), dst.String(), test.proto, test.first); !bytes.Equal(got, want) {
+				t.Errorf("got\n%x\nwant\n%x", got, want)
+			}
+		})
+	}
+}
+
+func TestRewriteRaw(t *testing.T) {
+	rw, err := New(Rules{Subnets: []SubnetRule{{From: cidr("10.0.0.0/8"), To: cidr("11.0.0.0/8")}}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	// An undecodable network layer is copied as it is.
+	in := []byte{2, 0, 0, 0, 0, 0xb, 2, 0, 0, 0, 0, 0xa, 0x88, 0xb5, 1, 2, 3, 4}
+	out, err := rw.Rewrite(in)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(out[:len(in)], in) {
+		t.Errorf("got %x", out)
+	}
+}
+
+type sliceSource [][]byte
+
+func (s *sliceSource) ReadPacketData() ([]byte, gopacket.CaptureInfo, error) {
+	if len(*s) == 0 {
+		return nil, gopacket.CaptureInfo{}, io.EOF
+	}
+	data := (*s)[0]
+	*s = (*s)[1:]
+	return data, gopacket.CaptureInfo{Timestamp: time.Unix(1, 0), CaptureLength: len(data), Length: len(data) + 10}, nil
+}
+
+type memWriter struct {
+	cis  []gopacket.CaptureInfo
+	data [][]byte
+}
+
+func (w *memWriter) WritePacket(ci gopacket.CaptureInfo, data []byte) error {
+	w.cis = append(w.cis, ci)
+	w.data = append(w.data, append([]byte(nil), data...))
+	return nil
+}
+
+func TestSourceWriter(t *testing.T) {
+	rw, err := New(Rules{AddVLAN: &VLANTag{ID: 5, Priority: 3}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	data := pkt{macA, macB, -1, "10.0.0.1", "10.0.0.2", 1, 2, true, "a payload larger than the ethernet minimum frame size"}.serialize(t)
+	want := pkt{macA, macB, 5, "10.0.0.1", "10.0.0.2", 1, 2, true, "a payload larger than the ethernet minimum frame size"}.serialize(t)
+
+	src := rw.Source(&sliceSource{data, data})
+	first, ci, err := src.ReadPacketData()
+	if err != nil || !bytes.Equal(first, want) || ci.CaptureLength != len(want) || ci.Length != len(want)+10 {
+		t.Fatalf("got %x, %+v, %v", first, ci, err)
+	}
+	// The data of the first packet must stay valid.
+	if _, _, err := src.ReadPacketData(); err != nil || !bytes.Equal(first, want) {
+		t.Fatalf("first packet changed to %x, %v", first, err)
+	}
+
+	w := &memWriter{}
+	if err := rw.Writer(w).WritePacket(gopacket.CaptureInfo{CaptureLength: len(data), Length: len(data)}, data); err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(w.data[0], want) || w.cis[0].CaptureLength != len(want) || w.cis[0].Length != len(want) {
+		t.Errorf("got %x, %+v", w.data[0], w.cis[0])
+	}
+
+	// Batches are rewritten packet by packet, and the packets of a batch
+	// don't share the buffer of the Rewriter.
+	other := pkt{macB, macA, -1, "10.0.0.2", "10.0.0.1", 2, 1, true, "a payload larger than the ethernet minimum frame size"}.serialize(t)
+	wantOther := pkt{macB, macA, 5, "10.0.0.2", "10.0.0.1", 2, 1, true, "a payload larger than the ethernet minimum frame size"}.serialize(t)
+	w = &memWriter{}
+	ci = gopacket.CaptureInfo{CaptureLength: len(data), Length: len(data)}
+	bw := rw.Writer(w)
+	if n, err := bw.WritePackets([]gopacket.CaptureInfo{ci, ci}, [][]byte{data, other}); err != nil || n != 2 {
+		t.Fatalf("WritePackets: %d, %v", n, err)
+	}
+	for i, want := range [][]byte{want, wantOther} {
+		if !bytes.Equal(w.data[i], want) || w.cis[i].CaptureLength != len(want) {
+			t.Errorf("packet %d: got %x, %+v", i, w.data[i], w.cis[i])
+		}
+	}
+	if _, err := bw.WritePackets([]gopacket.CaptureInfo{ci}, [][]byte{data, data}); err == nil {
+		t.Error("WritePackets: no error for mismatched batch")
+	}
+	if err := bw.Close(); err != nil {
+		t.Error(err)
+	}
+}
+
+func TestRulesCheck(t *testing.T) {
+	for _, rules := range []Rules{
+		{MACs: []MACRule{{To: net.HardwareAddr{1, 2, 3}}}},
+		{Subnets: []SubnetRule{{From: cidr("10.0.0.0/8")}}},
+		{Subnets: []SubnetRule{{From: cidr("10.0.0.0/8"), To: cidr("192.168.0.0/16")}}},
+		{Subnets: []SubnetRule{{From: cidr("10.0.0.0/8"), To: cidr("2001:db8::/8")}}},
+		{VLANs: map[uint16]uint16{1: 4096}},
+		{AddVLAN: &VLANTag{ID: 1, Priority: 8}},
+	} {
+		if _, err := New(rules); err == nil {
+			t.Errorf("%+v: no error", rules)
+		}
+	}
+}